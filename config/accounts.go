@@ -0,0 +1,203 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+// accountsDirName is the subdirectory of the data, cache and state directories where the data of additional accounts
+// is stored. The account that was logged in first uses the directories directly.
+const accountsDirName = "accounts"
+
+// Account is the saved session of a Matrix account that isn't currently active.
+type Account struct {
+	UserID      id.UserID   `yaml:"mxid"`
+	DeviceID    id.DeviceID `yaml:"device_id"`
+	AccessToken string      `yaml:"access_token"`
+	HS          string      `yaml:"homeserver"`
+	// Namespace is the name of the subdirectories where the data of the account is stored. Empty means the main
+	// directories.
+	Namespace string `yaml:"namespace"`
+}
+
+var namespaceReplacer = strings.NewReplacer("@", "", ":", "_", "/", "_", "\\", "_")
+
+// AccountNamespace returns the directory name used for the data of the given user.
+func AccountNamespace(userID id.UserID) string {
+	return namespaceReplacer.Replace(string(userID))
+}
+
+func (config *Config) accountDir(dir string) string {
+	if len(config.Namespace) == 0 {
+		return dir
+	}
+	return filepath.Join(dir, accountsDirName, config.Namespace)
+}
+
+func (config *Config) accountFile(path string) string {
+	if len(config.Namespace) == 0 {
+		return path
+	}
+	return filepath.Join(filepath.Dir(path), accountsDirName, config.Namespace, filepath.Base(path))
+}
+
+// AccountConfigDir returns the directory for config files of the active account, like saved cross-signing keys.
+func (config *Config) AccountConfigDir() string {
+	return config.accountDir(config.Dir)
+}
+
+// AccountDataDir returns the directory for non-temporary data of the active account, like the crypto store.
+func (config *Config) AccountDataDir() string {
+	return config.accountDir(config.DataDir)
+}
+
+// AccountCacheDir returns the directory for the cached session data of the active account.
+func (config *Config) AccountCacheDir() string {
+	return config.accountDir(config.CacheDir)
+}
+
+// AccountStateDir returns the directory for the cached room state of the active account.
+func (config *Config) AccountStateDir() string {
+	return config.accountDir(config.StateDir)
+}
+
+// AccountHistoryPath returns the path of the message history database of the active account.
+func (config *Config) AccountHistoryPath() string {
+	return config.accountFile(config.HistoryPath)
+}
+
+// AccountRoomListPath returns the path of the room list cache of the active account.
+func (config *Config) AccountRoomListPath() string {
+	return config.accountFile(config.RoomListPath)
+}
+
+// removeAccountDir removes a directory of the active account. The main directories also contain the directories of
+// the other accounts, so those are kept when the account that uses the main directories is cleared.
+func (config *Config) removeAccountDir(dir string) {
+	if len(config.Namespace) > 0 {
+		_ = os.RemoveAll(dir)
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.Name() != accountsDirName {
+			_ = os.RemoveAll(filepath.Join(dir, entry.Name()))
+		}
+	}
+}
+
+// loadAccountData loads the session data of the active account.
+func (config *Config) loadAccountData() error {
+	config.CreateCacheDirs()
+	config.Rooms = rooms.NewRoomCache(config.AccountRoomListPath(), config.AccountStateDir(), config.RoomCacheSize, config.RoomCacheAge, config.GetUserID)
+	config.AuthCache = AuthCache{}
+	config.PushRules = nil
+	config.Preferences = UserPreferences{}
+	config.LoadAuthCache()
+	config.LoadPushRules()
+	config.LoadPreferences()
+	return config.Rooms.LoadList()
+}
+
+// activeAccount returns the session of the active account.
+func (config *Config) activeAccount() Account {
+	return Account{
+		UserID:      config.UserID,
+		DeviceID:    config.DeviceID,
+		AccessToken: config.AccessToken,
+		HS:          config.HS,
+		Namespace:   config.Namespace,
+	}
+}
+
+// GetAccount returns the saved account with the given user ID, or nil if there isn't one.
+func (config *Config) GetAccount(userID id.UserID) *Account {
+	for i := range config.Accounts {
+		if config.Accounts[i].UserID == userID {
+			return &config.Accounts[i]
+		}
+	}
+	return nil
+}
+
+// AddAccount saves the session of another account, so that it can be switched to later.
+func (config *Config) AddAccount(account Account) error {
+	if account.UserID == config.UserID {
+		return fmt.Errorf("%s is the active account", account.UserID)
+	} else if config.GetAccount(account.UserID) != nil {
+		return fmt.Errorf("%s has already been added", account.UserID)
+	}
+	account.Namespace = AccountNamespace(account.UserID)
+	config.Accounts = append(config.Accounts, account)
+	config.Save()
+	return nil
+}
+
+// RemoveAccount forgets the saved account with the given user ID and deletes its data.
+func (config *Config) RemoveAccount(userID id.UserID) (Account, error) {
+	for i, account := range config.Accounts {
+		if account.UserID != userID {
+			continue
+		}
+		config.Accounts = append(config.Accounts[:i], config.Accounts[i+1:]...)
+		config.Save()
+		if len(account.Namespace) > 0 {
+			for _, dir := range []string{config.Dir, config.DataDir, config.CacheDir, config.StateDir,
+				filepath.Dir(config.HistoryPath), filepath.Dir(config.RoomListPath)} {
+				_ = os.RemoveAll(filepath.Join(dir, accountsDirName, account.Namespace))
+			}
+		}
+		return account, nil
+	}
+	return Account{}, fmt.Errorf("%s is not a saved account", userID)
+}
+
+// SwitchAccount makes the saved account with the given user ID active and loads its data. The previously active
+// account is moved to the end of the saved accounts, so switching to the first saved account cycles through all of
+// them. The caller is responsible for stopping syncing before switching and saving the data of the previous account.
+func (config *Config) SwitchAccount(userID id.UserID) error {
+	index := -1
+	for i, account := range config.Accounts {
+		if account.UserID == userID {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("%s is not a saved account", userID)
+	}
+	newActive := config.Accounts[index]
+	config.Accounts = append(append(config.Accounts[:index:index], config.Accounts[index+1:]...), config.activeAccount())
+	config.UserID = newActive.UserID
+	config.DeviceID = newActive.DeviceID
+	config.AccessToken = newActive.AccessToken
+	config.HS = newActive.HS
+	config.Namespace = newActive.Namespace
+	config.Save()
+	return config.loadAccountData()
+}
@@ -25,6 +25,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 
 	"gopkg.in/yaml.v3"
 
@@ -59,13 +60,30 @@ type UserPreferences struct {
 	DisableDownloads     bool `yaml:"disable_downloads"`
 	DisableNotifications bool `yaml:"disable_notifications"`
 	DisableShowURLs      bool `yaml:"disable_show_urls"`
+	DisableHighlighting  bool `yaml:"disable_highlighting"`
 	AltEnterToSend       bool `yaml:"alt_enter_to_send"`
+	GuidedRecoveryKey    bool `yaml:"guided_recovery_key"`
 
 	InlineURLMode string `yaml:"inline_url_mode"`
+	SASMode       string `yaml:"sas_mode"`
+	// ImageMode is the protocol used to render images: ansi, sixel, kitty or empty to detect it from the terminal.
+	ImageMode string `yaml:"image_mode"`
+	// CodeTheme is the name of the chroma style used for syntax highlighting in code blocks.
+	CodeTheme string `yaml:"code_theme"`
 }
 
+const (
+	ImageModeANSI  = "ansi"
+	ImageModeSixel = "sixel"
+	ImageModeKitty = "kitty"
+)
+
 var InlineURLsProbablySupported bool
 
+// DetectedImageMode is the graphics protocol that the terminal probably supports, or ImageModeANSI if it doesn't
+// seem to support any.
+var DetectedImageMode = ImageModeANSI
+
 func init() {
 	vteVersion, _ := strconv.Atoi(os.Getenv("VTE_VERSION"))
 	term := os.Getenv("TERM")
@@ -74,12 +92,37 @@ func init() {
 		os.Getenv("TERM_PROGRAM") == "iTerm.app" ||
 		term == "foot" ||
 		term == "xterm-kitty"
+
+	termProgram := os.Getenv("TERM_PROGRAM")
+	switch {
+	case term == "xterm-kitty" || os.Getenv("KITTY_WINDOW_ID") != "" || termProgram == "WezTerm":
+		DetectedImageMode = ImageModeKitty
+	case strings.HasPrefix(term, "foot") || strings.HasPrefix(term, "mlterm") || strings.HasPrefix(term, "yaft") ||
+		strings.Contains(term, "sixel") || termProgram == "iTerm.app":
+		DetectedImageMode = ImageModeSixel
+	}
+}
+
+// GetImageMode returns the protocol that should be used to render images.
+func (up *UserPreferences) GetImageMode() string {
+	switch up.ImageMode {
+	case ImageModeANSI, ImageModeSixel, ImageModeKitty:
+		return up.ImageMode
+	default:
+		return DetectedImageMode
+	}
 }
 
 func (up *UserPreferences) EnableInlineURLs() bool {
 	return up.InlineURLMode == "enable" || (InlineURLsProbablySupported && up.InlineURLMode != "disable")
 }
 
+// UseDecimalSAS returns whether interactive verification should compare numbers instead of emojis. By default,
+// numbers are only used if the terminal can't display the emojis.
+func (up *UserPreferences) UseDecimalSAS(canDisplayEmojis bool) bool {
+	return up.SASMode == "decimal" || (!canDisplayEmojis && up.SASMode != "emoji")
+}
+
 type Keybind struct {
 	Mod tcell.ModMask
 	Key tcell.Key
@@ -106,18 +149,64 @@ type Config struct {
 	DeviceID    id.DeviceID `yaml:"device_id"`
 	AccessToken string      `yaml:"access_token"`
 	HS          string      `yaml:"homeserver"`
+	// PreviousCryptoAccount is the user ID and device ID of a session that was logged out with its encryption keys
+	// kept. The Megolm sessions of it are imported into the crypto store when the same user logs in again.
+	PreviousCryptoAccount string `yaml:"previous_crypto_account,omitempty"`
+	// Namespace is the name of the subdirectories where the data of the active account is stored. It's empty for the
+	// account that was logged in first, which uses the main directories.
+	Namespace string `yaml:"account_namespace"`
+	// Accounts are the saved sessions of other accounts that can be switched to.
+	Accounts []Account `yaml:"accounts"`
 
 	RoomCacheSize int   `yaml:"room_cache_size"`
 	RoomCacheAge  int64 `yaml:"room_cache_age"`
 
 	NotifySound        bool `yaml:"notify_sound"`
 	SendToVerifiedOnly bool `yaml:"send_to_verified_only"`
+	// SharedSecretVerification enables the weaker /verify-phrase verification method.
+	SharedSecretVerification bool `yaml:"shared_secret_verification"`
+	// PendingVerificationIndicator shows the number of pending verification requests in the status bar.
+	PendingVerificationIndicator bool `yaml:"pending_verification_indicator"`
+	// ReadReceiptMemberLimit is the largest number of members a room can have for read receipts of other users to
+	// be shown. Zero disables showing read receipts.
+	ReadReceiptMemberLimit int `yaml:"read_receipt_member_limit"`
+	// CollapseMembershipThreshold is the number of consecutive membership and profile change events needed for them
+	// to be collapsed into a single summary line. Zero disables collapsing.
+	CollapseMembershipThreshold int `yaml:"collapse_membership_threshold"`
+	// CollapseMembershipTypes are the kinds of events that can be collapsed: join, leave, invite, kick, ban, unban,
+	// displayname and avatar. If empty, all of them are collapsed.
+	CollapseMembershipTypes []string `yaml:"collapse_membership_types"`
+	// VerificationLog writes verification events and state changes to verification.log in the debug directory.
+	VerificationLog bool `yaml:"verification_log"`
+	// FingerprintURLPattern is a URL where users publish their device fingerprints, used by /verify --from-profile
+	// when the fingerprint isn't in the user's profile. {user}, {localpart}, {server} and {device} are replaced.
+	FingerprintURLPattern string `yaml:"fingerprint_url_pattern"`
+	// LoadCrossSigningKeys asks for the passphrase of the cross-signing keys saved with
+	// /cross-signing fetch --save-to-disk on startup.
+	LoadCrossSigningKeys bool `yaml:"load_cross_signing_keys"`
+	// DisableCrossSigningAutoTrust stops new devices of users trusted through cross-signing from being marked as
+	// verified automatically.
+	DisableCrossSigningAutoTrust bool `yaml:"disable_cross_signing_auto_trust"`
 
 	Backspace1RemovesWord bool `yaml:"backspace1_removes_word"`
 	Backspace2RemovesWord bool `yaml:"backspace2_removes_word"`
 
 	AlwaysClearScreen bool `yaml:"always_clear_screen"`
 
+	// EmojiAutocompleteTrigger is the prefix that starts emoji shortcode completion with tab. It must be at the start
+	// of a word or after punctuation. An empty string disables emoji completion.
+	EmojiAutocompleteTrigger string `yaml:"emoji_autocomplete_trigger"`
+
+	// CommandAliases maps custom command names to the command they run, like `v: verify`. The command can contain
+	// $1, $2 etc for single arguments and $* for all of them, otherwise the arguments are added to the end.
+	// Aliases can't override built-in commands.
+	CommandAliases map[string]string `yaml:"command_aliases"`
+
+	// OutgoingMessageFilter is a command that outgoing messages are passed through before they're sent. It gets the
+	// message content as JSON in stdin and can print changed content to stdout, or exit with an error to cancel
+	// sending. The error output is shown as the reason. Empty disables the filter.
+	OutgoingMessageFilter string `yaml:"outgoing_message_filter"`
+
 	Dir          string `yaml:"-"`
 	DataDir      string `yaml:"data_dir"`
 	CacheDir     string `yaml:"cache_dir"`
@@ -132,8 +221,11 @@ type Config struct {
 	Rooms       *rooms.RoomCache       `yaml:"-"`
 	PushRules   *pushrules.PushRuleset `yaml:"-"`
 	Keybindings ParsedKeybindings      `yaml:"-"`
+	// EmojiUsage counts how many times each emoji has been sent, used to rank emoji completions.
+	EmojiUsage map[string]int `yaml:"-"`
 
-	nosave bool
+	emojiUsageLock sync.Mutex
+	nosave         bool
 }
 
 // NewConfig creates a config that loads data from the given directory.
@@ -155,40 +247,73 @@ func NewConfig(configDir, dataDir, cacheDir, downloadDir string) *Config {
 		SendToVerifiedOnly:    false,
 		Backspace1RemovesWord: true,
 		AlwaysClearScreen:     true,
+
+		EmojiAutocompleteTrigger: ":",
+
+		PendingVerificationIndicator: true,
+		ReadReceiptMemberLimit:       20,
+		CollapseMembershipThreshold:  3,
 	}
 }
 
+// CanCollapseMembership returns whether membership events of the given kind should be collapsed when there are
+// enough of them in a row.
+func (config *Config) CanCollapseMembership(kind string) bool {
+	if config.CollapseMembershipThreshold <= 0 || len(kind) == 0 {
+		return false
+	} else if len(config.CollapseMembershipTypes) == 0 {
+		return true
+	}
+	for _, collapsedKind := range config.CollapseMembershipTypes {
+		if collapsedKind == kind {
+			return true
+		}
+	}
+	return false
+}
+
 // Clear clears the session cache and removes all history.
 func (config *Config) Clear() {
-	_ = os.Remove(config.HistoryPath)
-	_ = os.Remove(config.RoomListPath)
-	_ = os.RemoveAll(config.StateDir)
+	_ = os.Remove(config.AccountHistoryPath())
+	_ = os.Remove(config.AccountRoomListPath())
+	config.removeAccountDir(config.AccountStateDir())
 	_ = os.RemoveAll(config.MediaDir)
-	_ = os.RemoveAll(config.CacheDir)
+	config.removeAccountDir(config.AccountCacheDir())
 	config.nosave = true
 }
 
 // ClearData clears non-temporary session data.
 func (config *Config) ClearData() {
-	_ = os.RemoveAll(config.DataDir)
+	config.removeAccountDir(config.AccountDataDir())
 }
 
 func (config *Config) CreateCacheDirs() {
-	_ = os.MkdirAll(config.CacheDir, 0700)
-	_ = os.MkdirAll(config.DataDir, 0700)
-	_ = os.MkdirAll(config.StateDir, 0700)
+	_ = os.MkdirAll(config.AccountCacheDir(), 0700)
+	_ = os.MkdirAll(config.AccountDataDir(), 0700)
+	_ = os.MkdirAll(config.AccountStateDir(), 0700)
+	_ = os.MkdirAll(filepath.Dir(config.AccountHistoryPath()), 0700)
+	_ = os.MkdirAll(filepath.Dir(config.AccountRoomListPath()), 0700)
 	_ = os.MkdirAll(config.MediaDir, 0700)
 }
 
-func (config *Config) DeleteSession() {
+// DeleteSession forgets the access token and deletes the session data of the active account. If keepKeys is true,
+// non-temporary data like the crypto store is kept.
+func (config *Config) DeleteSession(keepKeys bool) {
+	if keepKeys && len(config.DeviceID) > 0 {
+		config.PreviousCryptoAccount = fmt.Sprintf("%s/%s", config.UserID, config.DeviceID)
+	} else if !keepKeys {
+		config.PreviousCryptoAccount = ""
+	}
 	config.AuthCache.NextBatch = ""
 	config.AuthCache.InitialSyncDone = false
 	config.AccessToken = ""
 	config.DeviceID = ""
-	config.Rooms = rooms.NewRoomCache(config.RoomListPath, config.StateDir, config.RoomCacheSize, config.RoomCacheAge, config.GetUserID)
+	config.Rooms = rooms.NewRoomCache(config.AccountRoomListPath(), config.AccountStateDir(), config.RoomCacheSize, config.RoomCacheAge, config.GetUserID)
 	config.PushRules = nil
 
-	config.ClearData()
+	if !keepKeys {
+		config.ClearData()
+	}
 	config.Clear()
 	config.nosave = false
 	config.CreateCacheDirs()
@@ -196,12 +321,9 @@ func (config *Config) DeleteSession() {
 
 func (config *Config) LoadAll() {
 	config.Load()
-	config.Rooms = rooms.NewRoomCache(config.RoomListPath, config.StateDir, config.RoomCacheSize, config.RoomCacheAge, config.GetUserID)
-	config.LoadAuthCache()
-	config.LoadPushRules()
-	config.LoadPreferences()
 	config.LoadKeybindings()
-	err := config.Rooms.LoadList()
+	config.LoadEmojiUsage()
+	err := config.loadAccountData()
 	if err != nil {
 		panic(err)
 	}
@@ -221,6 +343,7 @@ func (config *Config) SaveAll() {
 	config.SaveAuthCache()
 	config.SavePushRules()
 	config.SavePreferences()
+	config.SaveEmojiUsage()
 	err := config.Rooms.SaveList()
 	if err != nil {
 		panic(err)
@@ -234,11 +357,11 @@ func (config *Config) Save() {
 }
 
 func (config *Config) LoadPreferences() {
-	_ = config.load("user preferences", config.CacheDir, "preferences.yaml", &config.Preferences)
+	_ = config.load("user preferences", config.AccountCacheDir(), "preferences.yaml", &config.Preferences)
 }
 
 func (config *Config) SavePreferences() {
-	config.save("user preferences", config.CacheDir, "preferences.yaml", &config.Preferences)
+	config.save("user preferences", config.AccountCacheDir(), "preferences.yaml", &config.Preferences)
 }
 
 //go:embed keybindings.yaml
@@ -285,18 +408,18 @@ func (config *Config) SaveKeybindings() {
 }
 
 func (config *Config) LoadAuthCache() {
-	err := config.load("auth cache", config.CacheDir, "auth-cache.yaml", &config.AuthCache)
+	err := config.load("auth cache", config.AccountCacheDir(), "auth-cache.yaml", &config.AuthCache)
 	if err != nil {
 		panic(fmt.Errorf("failed to load auth-cache.yaml: %w", err))
 	}
 }
 
 func (config *Config) SaveAuthCache() {
-	config.save("auth cache", config.CacheDir, "auth-cache.yaml", &config.AuthCache)
+	config.save("auth cache", config.AccountCacheDir(), "auth-cache.yaml", &config.AuthCache)
 }
 
 func (config *Config) LoadPushRules() {
-	_ = config.load("push rules", config.CacheDir, "pushrules.json", &config.PushRules)
+	_ = config.load("push rules", config.AccountCacheDir(), "pushrules.json", &config.PushRules)
 
 }
 
@@ -304,7 +427,41 @@ func (config *Config) SavePushRules() {
 	if config.PushRules == nil {
 		return
 	}
-	config.save("push rules", config.CacheDir, "pushrules.json", &config.PushRules)
+	config.save("push rules", config.AccountCacheDir(), "pushrules.json", &config.PushRules)
+}
+
+func (config *Config) LoadEmojiUsage() {
+	config.emojiUsageLock.Lock()
+	defer config.emojiUsageLock.Unlock()
+	_ = config.load("emoji usage", config.DataDir, "emoji-usage.yaml", &config.EmojiUsage)
+	if config.EmojiUsage == nil {
+		config.EmojiUsage = make(map[string]int)
+	}
+}
+
+func (config *Config) SaveEmojiUsage() {
+	config.emojiUsageLock.Lock()
+	defer config.emojiUsageLock.Unlock()
+	config.save("emoji usage", config.DataDir, "emoji-usage.yaml", &config.EmojiUsage)
+}
+
+// AddEmojiUsage increments the usage counters of the given emojis.
+func (config *Config) AddEmojiUsage(emojis ...string) {
+	config.emojiUsageLock.Lock()
+	defer config.emojiUsageLock.Unlock()
+	if config.EmojiUsage == nil {
+		config.EmojiUsage = make(map[string]int)
+	}
+	for _, emoji := range emojis {
+		config.EmojiUsage[emoji]++
+	}
+}
+
+// GetEmojiUsage returns how many times the given emoji has been sent.
+func (config *Config) GetEmojiUsage(emoji string) int {
+	config.emojiUsageLock.Lock()
+	defer config.emojiUsageLock.Unlock()
+	return config.EmojiUsage[emoji]
 }
 
 func (config *Config) load(name, dir, file string, target interface{}) error {
@@ -369,7 +526,7 @@ func (config *Config) GetUserID() id.UserID {
 	return config.UserID
 }
 
-const FilterVersion = 1
+const FilterVersion = 6
 
 func (config *Config) SaveFilterID(_ id.UserID, filterID string) {
 	config.AuthCache.FilterID = filterID
@@ -19,6 +19,7 @@ require (
 	go.mau.fi/cbind v0.0.0-20220415094356-e1d579b7925e
 	go.mau.fi/mauview v0.1.4-0.20220424212347-bfa59b8f6ad0
 	go.mau.fi/tcell v0.0.0-20220417202829-9f14d62226c5
+	golang.org/x/crypto v0.0.0-20220408190544-5352b0902921
 	golang.org/x/image v0.0.0-20220413100746-70e8d0d3baa9
 	golang.org/x/net v0.0.0-20220412020605-290c469a71a5
 	gopkg.in/toast.v1 v1.0.0-20180812000517-0a84660828b2
@@ -39,7 +40,6 @@ require (
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.0 // indirect
 	github.com/tidwall/sjson v1.2.4 // indirect
-	golang.org/x/crypto v0.0.0-20220408190544-5352b0902921 // indirect
 	golang.org/x/sys v0.0.0-20220412211240-33da011f77ad // indirect
 	golang.org/x/term v0.0.0-20220411215600-e5f449aeb171 // indirect
 	golang.org/x/text v0.3.7 // indirect
@@ -17,6 +17,9 @@
 package ifc
 
 import (
+	"errors"
+	"time"
+
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/crypto/attachment"
 	"maunium.net/go/mautrix/event"
@@ -30,8 +33,30 @@ import (
 type Relation struct {
 	Type  event.RelationType
 	Event *muksevt.Event
+	// ThreadRoot is the root event of the thread for muksevt.RelThread relations. Event is the message in the thread
+	// that's used for the reply fallback.
+	ThreadRoot id.EventID
+	// Quote is the part of Event that's included in the reply fallback. If empty, the whole message is quoted.
+	Quote string
 }
 
+// UploadProgressFunc is called with the number of bytes uploaded so far while a file is being uploaded.
+type UploadProgressFunc func(uploaded, total int64)
+
+// OutgoingMessageHook can inspect and change a message before it's sent. Returning an error cancels sending the
+// message, and the error is shown to the user as the reason.
+type OutgoingMessageHook func(roomID id.RoomID, content *event.MessageEventContent) error
+
+// RegistrationTokenFunc asks the user for a registration token when the homeserver requires one to register. It
+// returns false if the user cancelled.
+type RegistrationTokenFunc func() (token string, ok bool)
+
+// ErrMessageCancelled is returned by the Prepare*Message methods if an outgoing message hook cancelled the send.
+var ErrMessageCancelled = errors.New("message cancelled")
+
+// ErrPresenceDisabled is returned by SetPresence if the homeserver has presence turned off.
+var ErrPresenceDisabled = errors.New("presence is disabled on the homeserver")
+
 type UploadedMediaInfo struct {
 	*mautrix.RespMediaUpload
 	EncryptionInfo *attachment.EncryptedFile
@@ -40,6 +65,97 @@ type UploadedMediaInfo struct {
 	Info           *event.FileInfo
 }
 
+type KeyRequestStatus string
+
+const (
+	KeyRequestShared    KeyRequestStatus = "shared"
+	KeyRequestFulfilled KeyRequestStatus = "fulfilled manually"
+	KeyRequestPending   KeyRequestStatus = "pending"
+	KeyRequestRejected  KeyRequestStatus = "rejected"
+	KeyRequestIgnored   KeyRequestStatus = "ignored"
+)
+
+// KeyRequest is an incoming m.room_key_request and the decision that was made about it.
+type KeyRequest struct {
+	ID        int
+	UserID    id.UserID
+	DeviceID  id.DeviceID
+	RoomID    id.RoomID
+	SenderKey id.SenderKey
+	SessionID id.SessionID
+	Received  time.Time
+	Status    KeyRequestStatus
+	Reason    string
+}
+
+// OutgoingKeyRequest is a room key request that was sent manually for an event that couldn't be decrypted.
+type OutgoingKeyRequest struct {
+	RoomID    id.RoomID
+	SessionID id.SessionID
+	Targets   map[id.UserID][]id.DeviceID
+	Sent      time.Time
+}
+
+// ErrSearchUnsupported is returned by Search if the homeserver doesn't implement the search API or has it disabled.
+var ErrSearchUnsupported = errors.New("search is disabled on the homeserver")
+
+// ErrReportUnsupported is returned by ReportEvent if the homeserver doesn't implement reporting events.
+var ErrReportUnsupported = errors.New("reporting is not supported by the homeserver")
+
+// SearchResult is a single event found by the server-side search API, along with the events right before and after it.
+type SearchResult struct {
+	Event         *event.Event
+	Rank          float64
+	ContextBefore []*event.Event
+	ContextAfter  []*event.Event
+}
+
+// SearchResults is a page of results from the server-side search API, ordered by rank.
+type SearchResults struct {
+	Count     int
+	Results   []*SearchResult
+	NextBatch string
+}
+
+// PublicRoom is a room in the public room directory.
+type PublicRoom struct {
+	RoomID        id.RoomID
+	Alias         id.RoomAlias
+	Name          string
+	Topic         string
+	Members       int
+	WorldReadable bool
+	GuestCanJoin  bool
+}
+
+// PublicRooms is a page of the public room directory. Total is an estimate from the server and may be zero.
+type PublicRooms struct {
+	Rooms     []*PublicRoom
+	NextBatch string
+	Total     int
+}
+
+// CustomEmote is an image emoticon from an emote pack (MSC2545) that can be used with its :shortcode:.
+type CustomEmote struct {
+	Shortcode string
+	URL       id.ContentURI
+	Pack      string
+}
+
+// RoomNotificationLevel is the notification level of a room, set with room-specific push rules.
+type RoomNotificationLevel string
+
+const (
+	// NotifyDefault means that there are no room-specific push rules and the global rules apply.
+	NotifyDefault RoomNotificationLevel = "default"
+	// NotifyAll notifies about every message in the room.
+	NotifyAll RoomNotificationLevel = "all"
+	// NotifyHighlight only notifies about mentions and keywords.
+	NotifyHighlight RoomNotificationLevel = "highlight"
+	// NotifyNone doesn't notify about anything in the room.
+	NotifyNone RoomNotificationLevel = "none"
+)
+
 type MatrixContainer interface {
 	Client() *mautrix.Client
 	Preferences() *config.UserPreferences
@@ -50,27 +166,72 @@ type MatrixContainer interface {
 	Stop()
 
 	Login(user, password string) error
-	Logout()
+	Logout(keepKeys bool) error
+	Register(username, password string, askToken RegistrationTokenFunc) error
+	RegisterAccount(userID id.UserID, password string, askToken RegistrationTokenFunc) error
+	AddAccount(userID id.UserID, password string) error
+	RemoveAccount(userID id.UserID) error
+	SwitchAccount(userID id.UserID) error
+
+	PresenceEnabled() bool
+	GetPresence(userID id.UserID) *event.PresenceEventContent
+	SetPresence(presence event.Presence, statusMessage string) error
+
+	IsIgnored(userID id.UserID) bool
+	IgnoredUsers() []id.UserID
+	IgnoreUser(userID id.UserID) error
+	UnignoreUser(userID id.UserID) error
+	RotateDevice(password string) (oldDeviceID id.DeviceID, err error)
 	UIAFallback(authType mautrix.AuthType, sessionID string) error
+	VerifyWithPhrase(userID id.UserID, deviceID id.DeviceID, phrase string, timeout time.Duration) (bool, error)
+	RetryDecryption()
+	RedecryptEvent(roomID id.RoomID, eventID id.EventID) error
+	LogVerification(format string, args ...interface{})
+	ReplayVerificationRequest(userID id.UserID, transactionID string) error
+	KeyRequests() []KeyRequest
+	FulfillKeyRequest(requestID int) error
+	RequestSession(roomID id.RoomID, eventID id.EventID, resend bool) (req OutgoingKeyRequest, sent bool, err error)
 
 	SendPreferencesToMatrix()
-	PrepareMarkdownMessage(roomID id.RoomID, msgtype event.MessageType, text, html string, relation *Relation) *muksevt.Event
-	PrepareMediaMessage(room *rooms.Room, path string, relation *Relation) (*muksevt.Event, error)
+	GetRoomNotificationLevel(roomID id.RoomID) RoomNotificationLevel
+	SetRoomNotificationLevel(roomID id.RoomID, level RoomNotificationLevel) error
+	Keywords() []string
+	AddKeyword(keyword string) error
+	RemoveKeyword(keyword string) error
+	CustomEmotes(roomID id.RoomID) map[string]CustomEmote
+	AddOutgoingMessageHook(name string, hook OutgoingMessageHook)
+	RemoveOutgoingMessageHook(name string)
+	PrepareMarkdownMessage(roomID id.RoomID, msgtype event.MessageType, text, html string, relation *Relation) (*muksevt.Event, error)
+	PrepareMediaMessage(room *rooms.Room, path string, relation *Relation, progress UploadProgressFunc) (*muksevt.Event, error)
+	PrepareLocationMessage(roomID id.RoomID, geoURI, description string, relation *Relation) (*muksevt.Event, error)
+	PreparePlainMessage(roomID id.RoomID, msgtype event.MessageType, text string, relation *Relation) (*muksevt.Event, error)
 	SendEvent(evt *muksevt.Event) (id.EventID, error)
+	QueueOutgoing(evt *muksevt.Event)
+	DequeueOutgoing(evt *muksevt.Event)
 	Redact(roomID id.RoomID, eventID id.EventID, reason string) error
+	PinnedEvents(roomID id.RoomID) ([]id.EventID, error)
+	SetPinned(roomID id.RoomID, eventID id.EventID, pinned bool) (changed bool, err error)
+	IsMention(room *rooms.Room, evt *event.Event) bool
 	SendTyping(roomID id.RoomID, typing bool)
 	MarkRead(roomID id.RoomID, eventID id.EventID)
-	JoinRoom(roomID id.RoomID, server string) (*rooms.Room, error)
+	SetFullyRead(roomID id.RoomID, eventID id.EventID) error
+	JoinRoom(roomID id.RoomID, via ...string) (*rooms.Room, error)
+	RoomVersions() (defaultVersion string, available map[string]string, err error)
+	UpgradeRoom(roomID id.RoomID, version string) (id.RoomID, error)
 	LeaveRoom(roomID id.RoomID) error
 	CreateRoom(req *mautrix.ReqCreateRoom) (*rooms.Room, error)
 
 	FetchMembers(room *rooms.Room) error
 	GetHistory(room *rooms.Room, limit int, dbPointer uint64) ([]*muksevt.Event, uint64, error)
 	GetEvent(room *rooms.Room, eventID id.EventID) (*muksevt.Event, error)
+	Search(query string, roomID id.RoomID, nextBatch string) (*SearchResults, error)
+	ReportEvent(roomID id.RoomID, eventID id.EventID, reason string) error
+	PublicRooms(server, searchTerm, since string, limit int) (*PublicRooms, error)
 	GetRoom(roomID id.RoomID) *rooms.Room
 	GetOrCreateRoom(roomID id.RoomID) *rooms.Room
+	GetProfile(roomID id.RoomID, userID id.UserID) (displayname string, avatarURL id.ContentURIString)
 
-	UploadMedia(path string, encrypt bool) (*UploadedMediaInfo, error)
+	UploadMedia(path string, encrypt bool, progress UploadProgressFunc) (*UploadedMediaInfo, error)
 	Download(uri id.ContentURI, file *attachment.EncryptedFile) ([]byte, error)
 	DownloadToDisk(uri id.ContentURI, file *attachment.EncryptedFile, target string) (string, error)
 	GetDownloadURL(uri id.ContentURI) string
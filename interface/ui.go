@@ -56,6 +56,7 @@ type MainView interface {
 	Bump(room *rooms.Room)
 
 	UpdateTags(room *rooms.Room)
+	UpdateIgnoredUsers()
 
 	SetTyping(roomID id.RoomID, users []id.UserID)
 	OpenSyncingModal() SyncingModal
@@ -68,14 +69,18 @@ type RoomView interface {
 
 	SetCompletions(completions []string)
 	SetTyping(users []id.UserID)
+	Update()
 	UpdateUserList()
 
 	AddEvent(evt *muksevt.Event) Message
 	AddRedaction(evt *muksevt.Event)
 	AddEdit(evt *muksevt.Event)
-	AddReaction(evt *muksevt.Event, key string)
+	UpdateReactions(evt *muksevt.Event)
+	UpdateReadReceipts()
+	UpdateFullyRead()
 	GetEvent(eventID id.EventID) Message
 	AddServiceMessage(message string)
+	ResumeSending(evts []*muksevt.Event)
 }
 
 type Message interface {
@@ -222,6 +222,13 @@ func NewScaledFromReader(reader io.Reader, y, x int, bg color.Color) (*ANSImage,
 		return nil, err
 	}
 
+	return NewScaledFromImage(img, y, x, bg)
+}
+
+// NewScaledFromImage creates a new scaled ANSImage from an already decoded image.
+// Background color is used to fill when image has transparency or dithering mode is enabled
+// Dithering mode is used to specify the way that ANSImage render ANSI-pixels (char/block elements).
+func NewScaledFromImage(img image.Image, y, x int, bg color.Color) (*ANSImage, error) {
 	img = imaging.Resize(img, x, y, imaging.Lanczos)
 
 	return createANSImage(img, bg)
@@ -0,0 +1,183 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ansimage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/png"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// The size of a terminal cell in pixels. There's no reliable way to ask the terminal without interfering with tcell's
+// input handling, so these are the typical values for common font sizes.
+const (
+	CellWidth  = 10
+	CellHeight = 20
+)
+
+// kittyChunkSize is the maximum size of a single base64 chunk in the kitty graphics protocol.
+const kittyChunkSize = 4096
+
+// CellSize calculates how many terminal cells an image of the given size should take when it's at most maxCols
+// cells wide.
+func CellSize(width, height, maxCols int) (cols, rows int) {
+	if width <= 0 || height <= 0 || maxCols <= 0 {
+		return 0, 0
+	}
+	cols = (width + CellWidth - 1) / CellWidth
+	if cols > maxCols {
+		cols = maxCols
+	}
+	rows = (cols*CellWidth*height/width + CellHeight - 1) / CellHeight
+	if rows < 1 {
+		rows = 1
+	}
+	return
+}
+
+// EncodeSixel scales the image to fill the given number of cells and encodes it as a sixel escape sequence.
+func EncodeSixel(img image.Image, cols, rows int, bg color.Color) string {
+	scaled := imaging.Resize(img, cols*CellWidth, rows*CellHeight, imaging.Lanczos)
+	bounds := scaled.Bounds()
+	composited := image.NewRGBA(bounds)
+	draw.Draw(composited, bounds, image.NewUniform(bg), image.Point{}, draw.Src)
+	draw.Draw(composited, bounds, scaled, bounds.Min, draw.Over)
+	paletted := image.NewPaletted(bounds, palette.Plan9)
+	draw.FloydSteinberg.Draw(paletted, bounds, composited, bounds.Min)
+
+	width, height := bounds.Dx(), bounds.Dy()
+	var buf strings.Builder
+	// P2=1 leaves pixels that aren't set unchanged instead of painting them with the background color.
+	buf.WriteString("\x1bP0;1;0q")
+	_, _ = fmt.Fprintf(&buf, "\"1;1;%d;%d", width, height)
+
+	used := make([]bool, len(paletted.Palette))
+	for _, index := range paletted.Pix {
+		used[index] = true
+	}
+	for index, isUsed := range used {
+		if !isUsed {
+			continue
+		}
+		r, g, b, _ := paletted.Palette[index].RGBA()
+		_, _ = fmt.Fprintf(&buf, "#%d;2;%d;%d;%d", index, r*100/0xffff, g*100/0xffff, b*100/0xffff)
+	}
+
+	row := make([]byte, width)
+	for bandY := 0; bandY < height; bandY += 6 {
+		bandColors := make([]bool, len(paletted.Palette))
+		for y := bandY; y < bandY+6 && y < height; y++ {
+			for x := 0; x < width; x++ {
+				bandColors[paletted.ColorIndexAt(bounds.Min.X+x, bounds.Min.Y+y)] = true
+			}
+		}
+		for index, inBand := range bandColors {
+			if !inBand {
+				continue
+			}
+			for x := 0; x < width; x++ {
+				var bits byte
+				for dy := 0; dy < 6 && bandY+dy < height; dy++ {
+					if int(paletted.ColorIndexAt(bounds.Min.X+x, bounds.Min.Y+bandY+dy)) == index {
+						bits |= 1 << dy
+					}
+				}
+				row[x] = '?' + bits
+			}
+			_, _ = fmt.Fprintf(&buf, "#%d", index)
+			writeSixelRow(&buf, row)
+			// Graphics carriage return to draw the next color on the same band
+			buf.WriteByte('$')
+		}
+		// Graphics new line to move to the next band
+		buf.WriteByte('-')
+	}
+	buf.WriteString("\x1b\\")
+	return buf.String()
+}
+
+// writeSixelRow writes a row of sixel characters using the run-length encoding introducer for repeated characters.
+func writeSixelRow(buf *strings.Builder, row []byte) {
+	for i := 0; i < len(row); {
+		char := row[i]
+		count := 1
+		for i+count < len(row) && row[i+count] == char {
+			count++
+		}
+		if count > 3 {
+			_, _ = fmt.Fprintf(buf, "!%d%c", count, char)
+		} else {
+			for j := 0; j < count; j++ {
+				buf.WriteByte(char)
+			}
+		}
+		i += count
+	}
+}
+
+// EncodeKitty encodes the image as a kitty graphics protocol escape sequence that displays it in the given number of
+// cells. Any previous placement of the same image ID is deleted first. The terminal is asked to not send responses or
+// move the cursor, so the sequence doesn't interfere with the rest of the UI.
+func EncodeKitty(img image.Image, id uint32, cols, rows int) (string, error) {
+	// The terminal does the final scaling, so there's no point in sending more pixels than would fit in the cells.
+	if img.Bounds().Dx() > cols*CellWidth*2 {
+		img = imaging.Resize(img, cols*CellWidth*2, 0, imaging.Lanczos)
+	}
+	var pngData bytes.Buffer
+	err := png.Encode(&pngData, img)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode image as png: %w", err)
+	}
+	data := base64.StdEncoding.EncodeToString(pngData.Bytes())
+
+	var buf strings.Builder
+	buf.WriteString(DeleteKitty(id))
+	for i := 0; i < len(data); i += kittyChunkSize {
+		end := i + kittyChunkSize
+		more := 1
+		if end >= len(data) {
+			end = len(data)
+			more = 0
+		}
+		if i == 0 {
+			_, _ = fmt.Fprintf(&buf, "\x1b_Ga=T,f=100,i=%d,c=%d,r=%d,C=1,q=2,m=%d;%s\x1b\\", id, cols, rows, more, data[i:end])
+		} else {
+			_, _ = fmt.Fprintf(&buf, "\x1b_Gm=%d;%s\x1b\\", more, data[i:end])
+		}
+	}
+	return buf.String(), nil
+}
+
+// DeleteKitty returns a kitty graphics protocol escape sequence that deletes all placements of the given image ID.
+func DeleteKitty(id uint32) string {
+	return fmt.Sprintf("\x1b_Ga=d,d=i,i=%d,q=2\x1b\\", id)
+}
+
+// PlaceGraphics wraps a sixel or kitty escape sequence so that the image is drawn with its top left corner in the
+// given cell (zero-indexed). The cursor position is saved before and restored after the image, so the sequence can be
+// written to the terminal between frames without moving the cursor tcell thinks it's at.
+func PlaceGraphics(sequence string, x, y int) string {
+	return fmt.Sprintf("\x1b7\x1b[%d;%dH%s\x1b8", y+1, x+1, sequence)
+}
@@ -0,0 +1,137 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crosssigningfile
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix/crypto/utils"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	// Version is the newest version of the file format. Version 1 stores the private keys as a map from key usage to
+	// seed, so new key types can be added without changing the version. Version 2 adds the user ID.
+	Version = 2
+	// Iterations is the number of PBKDF2 rounds used for new files.
+	Iterations = 500000
+	// MaxIterations is the highest number of PBKDF2 rounds accepted when reading files.
+	MaxIterations = 10000000
+	saltLength    = 32
+)
+
+var (
+	ErrWrongPassphrase = errors.New("wrong passphrase or corrupted file")
+	ErrWrongUser       = errors.New("the file contains the cross-signing keys of a different user")
+)
+
+// file is the on-disk format of saved cross-signing private keys. The keys are encrypted with AES-256-CTR and
+// authenticated with HMAC-SHA256, both keys derived from the passphrase with PBKDF2-SHA512.
+type file struct {
+	Version    int    `json:"version"`
+	Iterations int    `json:"iterations"`
+	Salt       string `json:"salt"`
+	IV         string `json:"iv"`
+	Ciphertext string `json:"ciphertext"`
+	MAC        string `json:"mac"`
+}
+
+type payload struct {
+	UserID id.UserID                       `json:"user_id,omitempty"`
+	Keys   map[id.CrossSigningUsage][]byte `json:"keys"`
+}
+
+func deriveKeys(passphrase string, salt []byte, iterations int) (aesKey [utils.AESCTRKeyLength]byte, hmacKey [utils.HMACKeyLength]byte) {
+	key := utils.PBKDF2SHA512([]byte(passphrase), salt, iterations, (utils.AESCTRKeyLength+utils.HMACKeyLength)*8)
+	copy(aesKey[:], key[:utils.AESCTRKeyLength])
+	copy(hmacKey[:], key[utils.AESCTRKeyLength:])
+	return
+}
+
+func calculateMAC(iv, ciphertext []byte, hmacKey [utils.HMACKeyLength]byte) string {
+	return utils.HMACSHA256B64(append(iv, ciphertext...), hmacKey)
+}
+
+// Encrypt encrypts the cross-signing private key seeds of the given user with the passphrase.
+func Encrypt(userID id.UserID, keys map[id.CrossSigningUsage][]byte, passphrase string) ([]byte, error) {
+	data, err := json.Marshal(&payload{UserID: userID, Keys: keys})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal keys: %w", err)
+	}
+	salt := make([]byte, saltLength)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	aesKey, hmacKey := deriveKeys(passphrase, salt, Iterations)
+	iv := utils.GenA256CTRIV()
+	ciphertext := utils.XorA256CTR(data, aesKey, iv)
+	return json.MarshalIndent(&file{
+		Version:    Version,
+		Iterations: Iterations,
+		Salt:       base64.StdEncoding.EncodeToString(salt),
+		IV:         base64.StdEncoding.EncodeToString(iv[:]),
+		Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+		MAC:        calculateMAC(iv[:], ciphertext, hmacKey),
+	}, "", "  ")
+}
+
+// Decrypt decrypts a file created with Encrypt. If the file belongs to a different user than the given one,
+// ErrWrongUser is returned. Version 1 files don't contain the user ID, so they're accepted for any user.
+func Decrypt(data []byte, userID id.UserID, passphrase string) (map[id.CrossSigningUsage][]byte, error) {
+	var encrypted file
+	err := json.Unmarshal(data, &encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse file: %w", err)
+	} else if encrypted.Version < 1 || encrypted.Version > Version {
+		return nil, fmt.Errorf("unsupported file version %d", encrypted.Version)
+	} else if encrypted.Iterations < 1 || encrypted.Iterations > MaxIterations {
+		// A huge iteration count would make deriving the key take forever.
+		return nil, fmt.Errorf("invalid iteration count %d", encrypted.Iterations)
+	}
+	salt, err := base64.StdEncoding.DecodeString(encrypted.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode salt: %w", err)
+	}
+	ivBytes, err := base64.StdEncoding.DecodeString(encrypted.IV)
+	if err != nil || len(ivBytes) != utils.AESCTRIVLength {
+		return nil, fmt.Errorf("invalid IV")
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(encrypted.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ciphertext: %w", err)
+	}
+	aesKey, hmacKey := deriveKeys(passphrase, salt, encrypted.Iterations)
+	if !hmac.Equal([]byte(calculateMAC(ivBytes, ciphertext, hmacKey)), []byte(encrypted.MAC)) {
+		return nil, ErrWrongPassphrase
+	}
+	var iv [utils.AESCTRIVLength]byte
+	copy(iv[:], ivBytes)
+	var decrypted payload
+	err = json.Unmarshal(utils.XorA256CTR(ciphertext, aesKey, iv), &decrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse decrypted keys: %w", err)
+	} else if (encrypted.Version >= 2 || len(decrypted.UserID) > 0) && decrypted.UserID != userID {
+		return nil, ErrWrongUser
+	}
+	return decrypted.Keys, nil
+}
@@ -0,0 +1,68 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crosssigningfile
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestKeysDontBleedBetweenProfiles(t *testing.T) {
+	alice := id.UserID("@alice:example.com")
+	bob := id.UserID("@bob:example.com")
+	aliceKeys := map[id.CrossSigningUsage][]byte{
+		id.XSUsageMaster:      bytes.Repeat([]byte{1}, 32),
+		id.XSUsageSelfSigning: bytes.Repeat([]byte{2}, 32),
+		id.XSUsageUserSigning: bytes.Repeat([]byte{3}, 32),
+	}
+	data, err := Encrypt(alice, aliceKeys, "passphrase")
+	if err != nil {
+		t.Fatalf("Failed to encrypt keys: %v", err)
+	}
+
+	decrypted, err := Decrypt(data, alice, "passphrase")
+	if err != nil {
+		t.Fatalf("Failed to decrypt keys as the same profile: %v", err)
+	}
+	for usage, seed := range aliceKeys {
+		if !bytes.Equal(decrypted[usage], seed) {
+			t.Errorf("Decrypted %s key doesn't match", usage)
+		}
+	}
+
+	decrypted, err = Decrypt(data, bob, "passphrase")
+	if !errors.Is(err, ErrWrongUser) {
+		t.Errorf("Decrypting as another profile returned %v, expected ErrWrongUser", err)
+	} else if decrypted != nil {
+		t.Errorf("Decrypting as another profile returned keys")
+	}
+}
+
+func TestWrongPassphrase(t *testing.T) {
+	user := id.UserID("@alice:example.com")
+	data, err := Encrypt(user, map[id.CrossSigningUsage][]byte{id.XSUsageMaster: {1}}, "passphrase")
+	if err != nil {
+		t.Fatalf("Failed to encrypt keys: %v", err)
+	}
+	_, err = Decrypt(data, user, "wrong")
+	if !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("Decrypting with the wrong passphrase returned %v, expected ErrWrongPassphrase", err)
+	}
+}
@@ -0,0 +1,141 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package keybackup
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Algorithm is the only key backup algorithm supported by this package.
+const Algorithm = "m.megolm_backup.v1.curve25519-aes-sha2"
+
+const (
+	macLength = 8
+	// Byte count for AES key + HMAC key + AES IV
+	derivedKeyLength = 32 + 32 + aes.BlockSize
+)
+
+var (
+	ErrInvalidPrivateKey = errors.New("invalid backup private key")
+	ErrMismatchingMAC    = errors.New("mismatching MAC")
+	ErrInvalidPadding    = errors.New("invalid padding")
+)
+
+// AuthData is the auth_data of a key backup version using the curve25519-aes-sha2 algorithm.
+type AuthData struct {
+	PublicKey string `json:"public_key"`
+}
+
+// SessionData is the encrypted session_data of a single session in the key backup.
+type SessionData struct {
+	Ephemeral  string `json:"ephemeral"`
+	Ciphertext string `json:"ciphertext"`
+	MAC        string `json:"mac"`
+}
+
+// decodeBase64 decodes base64 with or without padding, as the spec uses unpadded base64, but not all
+// implementations follow that.
+func decodeBase64(data string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(data, "="))
+}
+
+// PublicKey returns the unpadded base64 public key of the given backup private key, which can be compared
+// against AuthData.PublicKey to make sure the key is for the right backup.
+func PublicKey(privateKey []byte) (string, error) {
+	if len(privateKey) != curve25519.ScalarSize {
+		return "", ErrInvalidPrivateKey
+	}
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(publicKey), nil
+}
+
+// Decrypt decrypts the session_data of a backed up session into the JSON-encoded session.
+func Decrypt(privateKey []byte, data SessionData) ([]byte, error) {
+	if len(privateKey) != curve25519.ScalarSize {
+		return nil, ErrInvalidPrivateKey
+	}
+	ephemeral, err := decodeBase64(data.Ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ephemeral key: %w", err)
+	}
+	ciphertext, err := decodeBase64(data.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ciphertext: %w", err)
+	}
+	mac, err := decodeBase64(data.MAC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode MAC: %w", err)
+	}
+	sharedSecret, err := curve25519.X25519(privateKey, ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute shared secret: %w", err)
+	}
+	derived := make([]byte, derivedKeyLength)
+	_, err = io.ReadFull(hkdf.New(sha256.New, sharedSecret, nil, nil), derived)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive keys: %w", err)
+	}
+	aesKey, hmacKey, iv := derived[:32], derived[32:64], derived[64:]
+
+	// libolm computes the MAC over an empty string instead of the ciphertext, so accept both
+	if !hmac.Equal(mac, computeMAC(hmacKey, nil)) && !hmac.Equal(mac, computeMAC(hmacKey, ciphertext)) {
+		return nil, ErrMismatchingMAC
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("invalid ciphertext length %d", len(ciphertext))
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	return unpad(plaintext)
+}
+
+func computeMAC(hmacKey, data []byte) []byte {
+	h := hmac.New(sha256.New, hmacKey)
+	h.Write(data)
+	return h.Sum(nil)[:macLength]
+}
+
+func unpad(data []byte) ([]byte, error) {
+	padding := int(data[len(data)-1])
+	if padding == 0 || padding > aes.BlockSize || padding > len(data) {
+		return nil, ErrInvalidPadding
+	}
+	for _, b := range data[len(data)-padding:] {
+		if int(b) != padding {
+			return nil, ErrInvalidPadding
+		}
+	}
+	return data[:len(data)-padding], nil
+}
@@ -0,0 +1,166 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package keyexport
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// DefaultRounds is the number of PBKDF2 rounds used by mautrix and most other clients.
+	DefaultRounds = 100000
+	// MinRounds and MaxRounds are the limits for custom round counts.
+	MinRounds = 10000
+	MaxRounds = 10000000
+)
+
+const (
+	prefix          = "-----BEGIN MEGOLM SESSION DATA-----\n"
+	suffix          = "-----END MEGOLM SESSION DATA-----\n"
+	version1        = 0x01
+	lineLengthLimit = 76
+	// Byte count for version + salt + iv + number of rounds
+	headerLength = 1 + 16 + 16 + 4
+	hashLength   = 32
+)
+
+var (
+	ErrMissingPrefix      = errors.New("invalid Matrix key export: missing prefix")
+	ErrMissingSuffix      = errors.New("invalid Matrix key export: missing suffix")
+	ErrTooShort           = errors.New("invalid Matrix key export: file is too short")
+	ErrUnsupportedVersion = errors.New("unsupported Matrix key export format version")
+	ErrMismatchingHash    = errors.New("mismatching hash; incorrect passphrase?")
+	ErrInvalidRounds      = fmt.Errorf("invalid Matrix key export: round count must be between 1 and %d", MaxRounds)
+)
+
+func computeKey(passphrase string, salt []byte, rounds int) (encryptionKey, hashKey []byte) {
+	key := pbkdf2.Key([]byte(passphrase), salt, rounds, 64, sha512.New)
+	return key[:32], key[32:]
+}
+
+// Encrypt encrypts the given JSON-encoded session list into the Matrix key export format
+// using the given number of PBKDF2 rounds.
+func Encrypt(passphrase string, rounds int, data []byte) ([]byte, error) {
+	if rounds < MinRounds || rounds > MaxRounds {
+		return nil, fmt.Errorf("round count must be between %d and %d", MinRounds, MaxRounds)
+	}
+	salt := make([]byte, 16)
+	iv := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	} else if _, err = rand.Read(iv); err != nil {
+		return nil, err
+	}
+	// Set bit 63 to zero
+	iv[7] &= 0b11111110
+	encryptionKey, hashKey := computeKey(passphrase, salt, rounds)
+
+	exportData := make([]byte, headerLength+len(data)+hashLength)
+	dataWithoutHashLength := len(exportData) - hashLength
+	exportData[0] = version1
+	copy(exportData[1:17], salt)
+	copy(exportData[17:33], iv)
+	binary.BigEndian.PutUint32(exportData[33:37], uint32(rounds))
+
+	block, _ := aes.NewCipher(encryptionKey)
+	cipher.NewCTR(block, iv).XORKeyStream(exportData[headerLength:dataWithoutHashLength], data)
+
+	mac := hmac.New(sha256.New, hashKey)
+	mac.Write(exportData[:dataWithoutHashLength])
+	mac.Sum(exportData[:dataWithoutHashLength])
+
+	base64Data := base64.StdEncoding.EncodeToString(exportData)
+	var buf bytes.Buffer
+	buf.WriteString(prefix)
+	for ptr := 0; ptr < len(base64Data); ptr += lineLengthLimit {
+		end := ptr + lineLengthLimit
+		if end > len(base64Data) {
+			end = len(base64Data)
+		}
+		buf.WriteString(base64Data[ptr:end])
+		buf.WriteByte('\n')
+	}
+	buf.WriteString(suffix)
+	return buf.Bytes(), nil
+}
+
+func decode(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(prefix)) {
+		return nil, ErrMissingPrefix
+	} else if !bytes.HasSuffix(data, []byte(suffix)) {
+		return nil, ErrMissingSuffix
+	}
+	data = bytes.ReplaceAll(data[len(prefix):len(data)-len(suffix)], []byte{'\n'}, nil)
+	exportData := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(exportData, data)
+	if err != nil {
+		return nil, err
+	} else if n < headerLength+hashLength {
+		return nil, ErrTooShort
+	} else if exportData[0] != version1 {
+		return nil, ErrUnsupportedVersion
+	} else if rounds := binary.BigEndian.Uint32(exportData[33:37]); rounds < 1 || rounds > MaxRounds {
+		// The round count is checked before deriving the key, as a huge count would make decrypting take forever.
+		return nil, ErrInvalidRounds
+	}
+	return exportData[:n], nil
+}
+
+// Rounds reads the number of PBKDF2 rounds from the header of the given key export file.
+func Rounds(data []byte) (int, error) {
+	exportData, err := decode(data)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint32(exportData[33:37])), nil
+}
+
+// Decrypt decrypts the given key export file and returns the JSON-encoded session list inside it.
+func Decrypt(passphrase string, data []byte) ([]byte, error) {
+	exportData, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+	salt := exportData[1:17]
+	iv := exportData[17:33]
+	rounds := binary.BigEndian.Uint32(exportData[33:37])
+	dataWithoutHashLength := len(exportData) - hashLength
+
+	encryptionKey, hashKey := computeKey(passphrase, salt, int(rounds))
+	mac := hmac.New(sha256.New, hashKey)
+	mac.Write(exportData[:dataWithoutHashLength])
+	if !hmac.Equal(exportData[dataWithoutHashLength:], mac.Sum(nil)) {
+		return nil, ErrMismatchingHash
+	}
+
+	block, _ := aes.NewCipher(encryptionKey)
+	decrypted := make([]byte, dataWithoutHashLength-headerLength)
+	cipher.NewCTR(block, iv).XORKeyStream(decrypted, exportData[headerLength:dataWithoutHashLength])
+	return decrypted, nil
+}
@@ -0,0 +1,94 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package keyexport
+
+import "fmt"
+
+// MergeResult tells what should be done with an imported Megolm session.
+type MergeResult int
+
+const (
+	// MergeSkip means that the local copy of the session is already as good or better.
+	MergeSkip MergeResult = iota
+	// MergeAdd means that the session isn't stored locally yet.
+	MergeAdd
+	// MergeReplace means that the imported session can decrypt earlier messages than the local copy.
+	MergeReplace
+	// MergeConflict means that the imported session has the same ID as the local copy, but a different ratchet,
+	// so one of them is not the real session.
+	MergeConflict
+)
+
+// SessionComparison contains what's needed to decide whether an imported Megolm session should replace a local copy.
+type SessionComparison struct {
+	// Exists tells whether there's a local copy of the session. The other fields are ignored if there isn't.
+	Exists bool
+	// ExistingFirstIndex and ImportedFirstIndex are the first known message indexes of the sessions.
+	ExistingFirstIndex uint32
+	ImportedFirstIndex uint32
+	// ExistingRatchet and ImportedRatchet are the sessions exported at the later of the two first known indexes.
+	// Both copies of the same session must produce the same export at the same index.
+	ExistingRatchet string
+	ImportedRatchet string
+}
+
+// Result compares the sessions. A session can only decrypt messages from its first known index onwards, so a
+// session that starts later must never replace one that starts earlier.
+func (cmp SessionComparison) Result() MergeResult {
+	switch {
+	case !cmp.Exists:
+		return MergeAdd
+	case cmp.ExistingRatchet != cmp.ImportedRatchet:
+		return MergeConflict
+	case cmp.ImportedFirstIndex < cmp.ExistingFirstIndex:
+		return MergeReplace
+	default:
+		return MergeSkip
+	}
+}
+
+// CommonIndex returns the message index at which both sessions must be exported to fill the ratchet fields.
+func (cmp SessionComparison) CommonIndex() uint32 {
+	if cmp.ExistingFirstIndex > cmp.ImportedFirstIndex {
+		return cmp.ExistingFirstIndex
+	}
+	return cmp.ImportedFirstIndex
+}
+
+// Session is a Megolm inbound group session that can be exported starting from a given message index.
+type Session interface {
+	FirstKnownIndex() uint32
+	Export(messageIndex uint32) (string, error)
+}
+
+// Compare decides what should be done with an imported session. existing is the local copy of the session, or nil if
+// the session isn't stored locally.
+func Compare(existing, imported Session) (MergeResult, error) {
+	cmp := SessionComparison{ImportedFirstIndex: imported.FirstKnownIndex()}
+	if existing == nil {
+		return cmp.Result(), nil
+	}
+	cmp.Exists = true
+	cmp.ExistingFirstIndex = existing.FirstKnownIndex()
+	var err error
+	if cmp.ExistingRatchet, err = existing.Export(cmp.CommonIndex()); err != nil {
+		return MergeSkip, fmt.Errorf("failed to export existing session: %w", err)
+	} else if cmp.ImportedRatchet, err = imported.Export(cmp.CommonIndex()); err != nil {
+		return MergeSkip, fmt.Errorf("failed to export imported session: %w", err)
+	}
+	return cmp.Result(), nil
+}
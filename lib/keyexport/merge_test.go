@@ -0,0 +1,92 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package keyexport
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSessionComparison(t *testing.T) {
+	tests := []struct {
+		name   string
+		cmp    SessionComparison
+		result MergeResult
+		common uint32
+	}{
+		{"new session", SessionComparison{ImportedFirstIndex: 5, ImportedRatchet: "b"}, MergeAdd, 5},
+		{"imported is older", SessionComparison{true, 10, 2, "a", "a"}, MergeReplace, 10},
+		{"imported is newer", SessionComparison{true, 2, 10, "a", "a"}, MergeSkip, 10},
+		{"same index", SessionComparison{true, 4, 4, "a", "a"}, MergeSkip, 4},
+		{"conflicting older", SessionComparison{true, 10, 2, "a", "b"}, MergeConflict, 10},
+		{"conflicting newer", SessionComparison{true, 2, 10, "a", "b"}, MergeConflict, 10},
+		{"conflicting same index", SessionComparison{true, 4, 4, "a", "b"}, MergeConflict, 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if result := test.cmp.Result(); result != test.result {
+				t.Errorf("Result() = %d, expected %d", result, test.result)
+			}
+			if common := test.cmp.CommonIndex(); common != test.common {
+				t.Errorf("CommonIndex() = %d, expected %d", common, test.common)
+			}
+		})
+	}
+}
+
+// fakeSession is a ratchet that produces the same exports as any other fakeSession with the same seed.
+type fakeSession struct {
+	seed       string
+	firstIndex uint32
+}
+
+func (fs *fakeSession) FirstKnownIndex() uint32 {
+	return fs.firstIndex
+}
+
+func (fs *fakeSession) Export(messageIndex uint32) (string, error) {
+	if messageIndex < fs.firstIndex {
+		return "", fmt.Errorf("can't export index %d of a session starting at %d", messageIndex, fs.firstIndex)
+	}
+	return fmt.Sprintf("%s/%d", fs.seed, messageIndex), nil
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing Session
+		imported Session
+		result   MergeResult
+	}{
+		{"new session", nil, &fakeSession{"a", 5}, MergeAdd},
+		{"imported is older", &fakeSession{"a", 10}, &fakeSession{"a", 2}, MergeReplace},
+		{"imported is newer", &fakeSession{"a", 2}, &fakeSession{"a", 10}, MergeSkip},
+		{"same index", &fakeSession{"a", 4}, &fakeSession{"a", 4}, MergeSkip},
+		{"conflicting older", &fakeSession{"a", 10}, &fakeSession{"b", 2}, MergeConflict},
+		{"conflicting newer", &fakeSession{"a", 2}, &fakeSession{"b", 10}, MergeConflict},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := Compare(test.existing, test.imported)
+			if err != nil {
+				t.Fatalf("Compare() returned error: %v", err)
+			} else if result != test.result {
+				t.Errorf("Compare() = %d, expected %d", result, test.result)
+			}
+		})
+	}
+}
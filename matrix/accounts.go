@@ -0,0 +1,137 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"fmt"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/config"
+	"maunium.net/go/gomuks/debug"
+)
+
+// resolveHomeserver finds the client API URL of the given server using .well-known.
+func resolveHomeserver(server string) (string, error) {
+	wellKnown, err := mautrix.DiscoverClientAPI(server)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve homeserver: %w", err)
+	} else if wellKnown != nil {
+		return wellKnown.Homeserver.BaseURL, nil
+	}
+	return "https://" + server, nil
+}
+
+// newClient creates a client for an account other than the active one.
+func (c *Container) newClient(homeserver string) (*mautrix.Client, error) {
+	client, err := mautrix.NewClient(homeserver, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mautrix client: %w", err)
+	}
+	client.UserAgent = fmt.Sprintf("gomuks/%s %s", c.gmx.Version(), mautrix.DefaultUserAgent)
+	client.Logger = mxLogger{}
+	return client, nil
+}
+
+// AddAccount logs in to another account with a password and saves the session, so that it can be switched to later.
+// The active account isn't changed.
+func (c *Container) AddAccount(userID id.UserID, password string) error {
+	_, server, err := userID.Parse()
+	if err != nil {
+		return fmt.Errorf("invalid user ID: %w", err)
+	}
+	homeserver, err := resolveHomeserver(server)
+	if err != nil {
+		return err
+	}
+	client, err := c.newClient(homeserver)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Login(&mautrix.ReqLogin{
+		Type: "m.login.password",
+		Identifier: mautrix.UserIdentifier{
+			Type: "m.id.user",
+			User: userID.String(),
+		},
+		Password:                 password,
+		InitialDeviceDisplayName: "gomuks",
+	})
+	if err != nil {
+		return err
+	}
+	if resp.WellKnown != nil && len(resp.WellKnown.Homeserver.BaseURL) > 0 {
+		homeserver = resp.WellKnown.Homeserver.BaseURL
+	}
+	return c.config.AddAccount(config.Account{
+		UserID:      resp.UserID,
+		DeviceID:    resp.DeviceID,
+		AccessToken: resp.AccessToken,
+		HS:          homeserver,
+	})
+}
+
+// RemoveAccount logs out of a saved account that isn't active and deletes its data.
+func (c *Container) RemoveAccount(userID id.UserID) error {
+	account, err := c.config.RemoveAccount(userID)
+	if err != nil {
+		return err
+	}
+	client, err := mautrix.NewClient(account.HS, account.UserID, account.AccessToken)
+	if err == nil {
+		_, err = client.Logout()
+	}
+	if err != nil {
+		debug.Printf("Failed to log out of removed account %s: %v", userID, err)
+	}
+	return nil
+}
+
+// SwitchAccount stops syncing the active account and starts syncing the given saved account instead. The sync token
+// and caches of each account are saved separately, so switching back continues syncing from where it was left off
+// instead of doing an initial sync.
+func (c *Container) SwitchAccount(userID id.UserID) error {
+	if c.config.GetAccount(userID) == nil {
+		return fmt.Errorf("%s is not a saved account", userID)
+	}
+	// Wait for the sync loop to exit, so that an in-flight sync response isn't processed as the new account.
+	c.stopAndWait()
+	if c.history != nil {
+		_ = c.history.Close()
+		c.history = nil
+	}
+	c.config.SaveAll()
+	c.client = nil
+	c.closeCrypto()
+	c.keyRequests.reset()
+	c.undecryptable.reset()
+	c.verificationRequests.reset()
+	c.emotes.lock.Lock()
+	c.emotes.userEmotes = nil
+	c.emotes.emoteRooms = nil
+	c.emotes.lock.Unlock()
+	c.clearPresence()
+	c.ignored.lock.Lock()
+	c.ignored.users = nil
+	c.ignored.lock.Unlock()
+
+	if err := c.config.SwitchAccount(userID); err != nil {
+		return err
+	}
+	return c.InitClient()
+}
@@ -0,0 +1,245 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build cgo
+
+package matrix
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/debug"
+)
+
+const autoTrustedDevicesFileName = "auto-trusted-devices.json"
+
+// autoTrustedUser contains the devices of a user that were verified automatically, along with the master key that
+// was trusted when they were verified.
+type autoTrustedUser struct {
+	MasterKey id.Ed25519    `json:"master_key"`
+	Devices   []id.DeviceID `json:"devices"`
+}
+
+// autoTrustedDevices remembers which devices were verified automatically because they were cross-signed, so that
+// their trust can be dropped if the cross-signing keys they were trusted through change. It's stored on disk, as the
+// crypto store can't tell automatic and manual verification apart.
+type autoTrustedDevices struct {
+	lock  sync.Mutex
+	users map[id.UserID]*autoTrustedUser
+}
+
+func (c *Container) autoTrustedDevicesPath() string {
+	return filepath.Join(c.config.AccountDataDir(), autoTrustedDevicesFileName)
+}
+
+func (c *Container) loadAutoTrustedDevices() {
+	if c.autoTrust.users != nil {
+		return
+	}
+	c.autoTrust.users = make(map[id.UserID]*autoTrustedUser)
+	data, err := os.ReadFile(c.autoTrustedDevicesPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	} else if err != nil {
+		debug.Printf("Failed to read auto-trusted devices: %v", err)
+		return
+	}
+	err = json.Unmarshal(data, &c.autoTrust.users)
+	if err != nil {
+		debug.Printf("Failed to parse auto-trusted devices: %v", err)
+	}
+}
+
+func (c *Container) saveAutoTrustedDevices() {
+	data, err := json.Marshal(c.autoTrust.users)
+	if err != nil {
+		debug.Printf("Failed to marshal auto-trusted devices: %v", err)
+		return
+	}
+	err = os.WriteFile(c.autoTrustedDevicesPath(), data, 0600)
+	if err != nil {
+		debug.Printf("Failed to save auto-trusted devices: %v", err)
+	}
+}
+
+// getKnownDeviceIDs returns the IDs of the currently stored devices of the given users.
+func getKnownDeviceIDs(mach *crypto.OlmMachine, users []id.UserID) map[id.UserID]map[id.DeviceID]struct{} {
+	known := make(map[id.UserID]map[id.DeviceID]struct{}, len(users))
+	for _, userID := range users {
+		devices, err := mach.CryptoStore.GetDevices(userID)
+		if err != nil {
+			debug.Printf("Failed to get devices of %s to check for new devices: %v", userID, err)
+			continue
+		}
+		known[userID] = make(map[id.DeviceID]struct{}, len(devices))
+		for deviceID := range devices {
+			known[userID][deviceID] = struct{}{}
+		}
+	}
+	return known
+}
+
+// getTrustedCrossSigningKeys returns the master and self-signing keys of the given user if the master key is trusted
+// through our user-signing key (or is our own) and the self-signing key is signed by it.
+func getTrustedCrossSigningKeys(mach *crypto.OlmMachine, userID id.UserID) (masterKey, selfSigningKey id.Ed25519) {
+	if !mach.IsUserTrusted(userID) {
+		return
+	}
+	keys, err := mach.CryptoStore.GetCrossSigningKeys(userID)
+	if err != nil {
+		debug.Printf("Failed to get cross-signing keys of %s: %v", userID, err)
+		return
+	}
+	msk, ok := keys[id.XSUsageMaster]
+	if !ok {
+		return
+	}
+	ssk, ok := keys[id.XSUsageSelfSigning]
+	if !ok {
+		return
+	}
+	signed, err := mach.CryptoStore.IsKeySignedBy(userID, ssk, userID, msk)
+	if err != nil || !signed {
+		return
+	}
+	return msk, ssk
+}
+
+func isSignedBySelfSigningKey(mach *crypto.OlmMachine, device *crypto.DeviceIdentity, selfSigningKey id.Ed25519) bool {
+	signed, err := mach.CryptoStore.IsKeySignedBy(device.UserID, device.SigningKey, device.UserID, selfSigningKey)
+	return err == nil && signed
+}
+
+// updateAutoTrust verifies new cross-signed devices of the given users and drops the trust of previously
+// auto-trusted devices whose cross-signing trust is gone. The known map contains the devices of each user from
+// before the device list was updated, only devices that aren't in it are verified automatically.
+func (c *Container) updateAutoTrust(mach *crypto.OlmMachine, users []id.UserID, known map[id.UserID]map[id.DeviceID]struct{}) {
+	c.autoTrust.lock.Lock()
+	defer c.autoTrust.lock.Unlock()
+	c.loadAutoTrustedDevices()
+
+	revokeUsers := users
+	for _, userID := range users {
+		if userID == mach.Client.UserID {
+			// Our own cross-signing keys changed, which affects the trust of all users
+			revokeUsers = make([]id.UserID, 0, len(c.autoTrust.users))
+			for autoTrustedUserID := range c.autoTrust.users {
+				revokeUsers = append(revokeUsers, autoTrustedUserID)
+			}
+			break
+		}
+	}
+	changed := false
+	for _, userID := range revokeUsers {
+		changed = c.revokeStaleAutoTrust(mach, userID) || changed
+	}
+	if !c.config.DisableCrossSigningAutoTrust {
+		for _, userID := range users {
+			if knownDevices, ok := known[userID]; ok {
+				changed = c.autoTrustNewDevices(mach, userID, knownDevices) || changed
+			}
+		}
+	}
+	if changed {
+		c.saveAutoTrustedDevices()
+	}
+}
+
+func (c *Container) autoTrustNewDevices(mach *crypto.OlmMachine, userID id.UserID, known map[id.DeviceID]struct{}) bool {
+	masterKey, selfSigningKey := getTrustedCrossSigningKeys(mach, userID)
+	if len(selfSigningKey) == 0 {
+		return false
+	}
+	devices, err := mach.CryptoStore.GetDevices(userID)
+	if err != nil {
+		debug.Printf("Failed to get devices of %s to check for new cross-signed devices: %v", userID, err)
+		return false
+	}
+	changed := false
+	for deviceID, device := range devices {
+		if _, ok := known[deviceID]; ok || device.Trust != crypto.TrustStateUnset ||
+			!isSignedBySelfSigningKey(mach, device, selfSigningKey) {
+			continue
+		}
+		device.Trust = crypto.TrustStateVerified
+		err = mach.CryptoStore.PutDevice(userID, device)
+		if err != nil {
+			debug.Printf("Failed to mark cross-signed device %s of %s as verified: %v", deviceID, userID, err)
+			continue
+		}
+		record, ok := c.autoTrust.users[userID]
+		if !ok || record.MasterKey != masterKey {
+			record = &autoTrustedUser{MasterKey: masterKey}
+			c.autoTrust.users[userID] = record
+		}
+		record.Devices = append(record.Devices, deviceID)
+		changed = true
+		c.alertDeviceChange(mach, userID, "New device verified", fmt.Sprintf("The new device %s of %s was "+
+			"verified automatically, as it's cross-signed by a trusted user.", deviceID, userID), false)
+	}
+	return changed
+}
+
+// revokeStaleAutoTrust drops the trust of the auto-trusted devices of the given user that are no longer signed by a
+// self-signing key of the same trusted master key.
+func (c *Container) revokeStaleAutoTrust(mach *crypto.OlmMachine, userID id.UserID) bool {
+	record, ok := c.autoTrust.users[userID]
+	if !ok {
+		return false
+	}
+	masterKey, selfSigningKey := getTrustedCrossSigningKeys(mach, userID)
+	remaining := record.Devices[:0]
+	for _, deviceID := range record.Devices {
+		device, err := mach.CryptoStore.GetDevice(userID, deviceID)
+		if err != nil {
+			debug.Printf("Failed to get auto-trusted device %s of %s: %v", deviceID, userID, err)
+			remaining = append(remaining, deviceID)
+			continue
+		} else if device == nil || device.Trust != crypto.TrustStateVerified {
+			// The device was deleted or its trust was changed manually, so there's nothing to revoke
+			continue
+		} else if masterKey == record.MasterKey && isSignedBySelfSigningKey(mach, device, selfSigningKey) {
+			remaining = append(remaining, deviceID)
+			continue
+		}
+		device.Trust = crypto.TrustStateUnset
+		err = mach.CryptoStore.PutDevice(userID, device)
+		if err != nil {
+			debug.Printf("Failed to drop trust of auto-trusted device %s of %s: %v", deviceID, userID, err)
+			remaining = append(remaining, deviceID)
+			continue
+		}
+		mach.OnDevicesChanged(userID)
+		c.alertDeviceChange(mach, userID, "Device no longer verified", fmt.Sprintf("The device %s of %s is no "+
+			"longer verified, as it was verified automatically with cross-signing keys that are no longer trusted.",
+			deviceID, userID), true)
+	}
+	changed := len(remaining) != len(record.Devices)
+	if len(remaining) == 0 {
+		delete(c.autoTrust.users, userID)
+	} else {
+		record.Devices = remaining
+	}
+	return changed
+}
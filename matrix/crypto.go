@@ -20,13 +20,16 @@ package matrix
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 
 	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/id"
 
 	"maunium.net/go/gomuks/debug"
 )
@@ -55,10 +58,14 @@ func isBadEncryptError(err error) bool {
 	return err != crypto.SessionExpired && err != crypto.SessionNotShared && err != crypto.NoGroupSession
 }
 
+func isMissingSessionError(err error) bool {
+	return errors.Is(err, crypto.NoSessionFound)
+}
+
 func (c *Container) initCrypto() error {
 	var cryptoStore crypto.Store
 	var err error
-	legacyStorePath := filepath.Join(c.config.DataDir, "crypto.gob")
+	legacyStorePath := filepath.Join(c.config.AccountDataDir(), "crypto.gob")
 	if _, err = os.Stat(legacyStorePath); err == nil {
 		debug.Printf("Using legacy crypto store as %s exists", legacyStorePath)
 		cryptoStore, err = crypto.NewGobStore(legacyStorePath)
@@ -67,7 +74,7 @@ func (c *Container) initCrypto() error {
 		}
 	} else {
 		debug.Printf("Using SQLite crypto store")
-		newStorePath := filepath.Join(c.config.DataDir, "crypto.db")
+		newStorePath := filepath.Join(c.config.AccountDataDir(), "crypto.db")
 		db, err := sql.Open("sqlite3", newStorePath)
 		if err != nil {
 			return fmt.Errorf("sql open: %w", err)
@@ -82,6 +89,7 @@ func (c *Container) initCrypto() error {
 	}
 	crypt := crypto.NewOlmMachine(c.client, cryptoLogger{"Crypto"}, cryptoStore, c.config.Rooms)
 	crypt.AllowUnverifiedDevices = !c.config.SendToVerifiedOnly
+	c.wrapAllowKeyShare(crypt)
 	c.crypto = crypt
 	err = c.crypto.Load()
 	if err != nil {
@@ -90,6 +98,29 @@ func (c *Container) initCrypto() error {
 	return nil
 }
 
+// closeCrypto flushes and closes the store of the current crypto machine and drops the machine. Cached private
+// cross-signing keys are cleared first, so that anything still holding a reference to the old machine (e.g. after
+// switching to a different account or device) can't sign with them.
+func (c *Container) closeCrypto() {
+	if mach, ok := c.crypto.(*crypto.OlmMachine); ok && mach != nil {
+		mach.CrossSigningKeys = nil
+		mach.AcceptVerificationFrom = nil
+		if err := mach.FlushStore(); err != nil {
+			debug.Print("Error flushing crypto store:", err)
+		}
+		if sqlStore, ok := mach.CryptoStore.(*crypto.SQLCryptoStore); ok {
+			if err := sqlStore.DB.Close(); err != nil {
+				debug.Print("Error closing crypto store:", err)
+			}
+		}
+	}
+	c.crypto = nil
+	// The auto-trusted devices are stored next to the crypto store, so they're reloaded with the next machine.
+	c.autoTrust.lock.Lock()
+	c.autoTrust.users = nil
+	c.autoTrust.lock.Unlock()
+}
+
 func (c *Container) cryptoOnLogin() {
 	sqlStore, ok := c.crypto.(*crypto.OlmMachine).CryptoStore.(*crypto.SQLCryptoStore)
 	if !ok {
@@ -97,4 +128,38 @@ func (c *Container) cryptoOnLogin() {
 	}
 	sqlStore.DeviceID = c.config.DeviceID
 	sqlStore.AccountID = fmt.Sprintf("%s/%s", c.config.UserID.String(), c.config.DeviceID)
+	if len(c.config.PreviousCryptoAccount) > 0 {
+		c.importPreviousSessions(sqlStore)
+	}
+}
+
+// importPreviousSessions copies the Megolm sessions of a session that was logged out with --keep-keys into the crypto
+// store of the current device. The olm account of the old device can't be reused, as the server deleted the device
+// when logging out.
+func (c *Container) importPreviousSessions(sqlStore *crypto.SQLCryptoStore) {
+	previous := c.config.PreviousCryptoAccount
+	if previous == sqlStore.AccountID || !strings.HasPrefix(previous, c.config.UserID.String()+"/") {
+		return
+	}
+	oldDeviceID := id.DeviceID(strings.TrimPrefix(previous, c.config.UserID.String()+"/"))
+	oldStore := crypto.NewSQLCryptoStore(sqlStore.DB, "sqlite3", previous, oldDeviceID, sqlStore.PickleKey, cryptoLogger{"Crypto/DB"})
+	sessions, err := oldStore.GetAllGroupSessions()
+	if err != nil {
+		debug.Printf("Failed to get sessions of previous device %s: %v", oldDeviceID, err)
+		return
+	}
+	imported := 0
+	for _, session := range sessions {
+		existing, err := sqlStore.GetGroupSession(session.RoomID, session.SenderKey, session.ID())
+		if err != nil || existing != nil {
+			continue
+		} else if err = sqlStore.PutGroupSession(session.RoomID, session.SenderKey, session.ID(), session); err != nil {
+			debug.Printf("Failed to import session %s from previous device %s: %v", session.ID(), oldDeviceID, err)
+			continue
+		}
+		imported++
+	}
+	debug.Printf("Imported %d/%d sessions from previous device %s", imported, len(sessions), oldDeviceID)
+	c.config.PreviousCryptoAccount = ""
+	c.config.Save()
 }
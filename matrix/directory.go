@@ -0,0 +1,92 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+
+	ifc "maunium.net/go/gomuks/interface"
+)
+
+type reqPublicRoomsFilter struct {
+	GenericSearchTerm string `json:"generic_search_term,omitempty"`
+}
+
+type reqPublicRooms struct {
+	Limit  int                   `json:"limit,omitempty"`
+	Since  string                `json:"since,omitempty"`
+	Filter *reqPublicRoomsFilter `json:"filter,omitempty"`
+}
+
+type respPublicRoom struct {
+	RoomID           id.RoomID           `json:"room_id"`
+	CanonicalAlias   id.RoomAlias        `json:"canonical_alias"`
+	Name             string              `json:"name"`
+	Topic            string              `json:"topic"`
+	AvatarURL        id.ContentURIString `json:"avatar_url"`
+	NumJoinedMembers int                 `json:"num_joined_members"`
+	WorldReadable    bool                `json:"world_readable"`
+	GuestCanJoin     bool                `json:"guest_can_join"`
+}
+
+type respPublicRooms struct {
+	Chunk                  []*respPublicRoom `json:"chunk"`
+	NextBatch              string            `json:"next_batch"`
+	TotalRoomCountEstimate int               `json:"total_room_count_estimate"`
+}
+
+// PublicRooms fetches a page of the public room directory. If server is empty, the directory of the user's own
+// homeserver is used. The since token is the NextBatch of the previous page.
+func (c *Container) PublicRooms(server, searchTerm, since string, limit int) (*ifc.PublicRooms, error) {
+	req := reqPublicRooms{
+		Limit: limit,
+		Since: since,
+	}
+	if len(searchTerm) > 0 {
+		req.Filter = &reqPublicRoomsFilter{GenericSearchTerm: searchTerm}
+	}
+	queryParams := map[string]string{}
+	if len(server) > 0 {
+		queryParams["server"] = server
+	}
+	var resp respPublicRooms
+	_, err := c.client.MakeRequest("POST", c.client.BuildURLWithQuery(mautrix.ClientURLPath{"v3", "publicRooms"}, queryParams), &req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	rooms := &ifc.PublicRooms{
+		Rooms:     make([]*ifc.PublicRoom, 0, len(resp.Chunk)),
+		NextBatch: resp.NextBatch,
+		Total:     resp.TotalRoomCountEstimate,
+	}
+	for _, room := range resp.Chunk {
+		if room == nil || len(room.RoomID) == 0 {
+			continue
+		}
+		rooms.Rooms = append(rooms.Rooms, &ifc.PublicRoom{
+			RoomID:        room.RoomID,
+			Alias:         room.CanonicalAlias,
+			Name:          room.Name,
+			Topic:         room.Topic,
+			Members:       room.NumJoinedMembers,
+			WorldReadable: room.WorldReadable,
+			GuestCanJoin:  room.GuestCanJoin,
+		})
+	}
+	return rooms, nil
+}
@@ -0,0 +1,293 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/debug"
+	ifc "maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+// Event types for image packs (MSC2545).
+var (
+	AccountDataUserEmotes = event.Type{Type: "im.ponies.user_emotes", Class: event.AccountDataEventType}
+	AccountDataEmoteRooms = event.Type{Type: "im.ponies.emote_rooms", Class: event.AccountDataEventType}
+	StateRoomEmotes       = event.Type{Type: "im.ponies.room_emotes", Class: event.StateEventType}
+)
+
+const emoteUsageEmoticon = "emoticon"
+
+// EmotePackImage is a single image in an image pack.
+type EmotePackImage struct {
+	URL   id.ContentURIString `json:"url"`
+	Body  string              `json:"body,omitempty"`
+	Info  *event.FileInfo     `json:"info,omitempty"`
+	Usage []string            `json:"usage,omitempty"`
+}
+
+// EmotePackInfo contains the metadata of an image pack.
+type EmotePackInfo struct {
+	DisplayName string              `json:"display_name,omitempty"`
+	AvatarURL   id.ContentURIString `json:"avatar_url,omitempty"`
+	Usage       []string            `json:"usage,omitempty"`
+}
+
+// EmotePackEventContent is the content of the user and room image pack events.
+type EmotePackEventContent struct {
+	Images map[string]*EmotePackImage `json:"images,omitempty"`
+	Pack   EmotePackInfo              `json:"pack"`
+
+	// LegacyEmoticons is the legacy format where the shortcodes are wrapped in colons.
+	LegacyEmoticons map[string]*EmotePackImage `json:"emoticons,omitempty"`
+}
+
+// EmoteRoomsEventContent is the content of the account data event that lists room image packs the user wants to use
+// everywhere. The keys of the inner map are the state keys of the pack events.
+type EmoteRoomsEventContent struct {
+	Rooms map[id.RoomID]map[string]json.RawMessage `json:"rooms"`
+}
+
+func init() {
+	event.TypeMap[AccountDataUserEmotes] = reflect.TypeOf(EmotePackEventContent{})
+	event.TypeMap[AccountDataEmoteRooms] = reflect.TypeOf(EmoteRoomsEventContent{})
+	event.TypeMap[StateRoomEmotes] = reflect.TypeOf(EmotePackEventContent{})
+	gob.Register(&EmotePackEventContent{})
+	gob.Register(&EmoteRoomsEventContent{})
+}
+
+func hasEmoteUsage(usage []string, wanted string) bool {
+	for _, item := range usage {
+		if item == wanted {
+			return true
+		}
+	}
+	return false
+}
+
+// Emoticons returns the images in the pack that can be used as emoticons, keyed by shortcode without colons.
+// Images without an explicit usage inherit the usage of the pack, and an empty usage means both stickers and emoticons.
+func (pack *EmotePackEventContent) Emoticons() map[string]*EmotePackImage {
+	emoticons := make(map[string]*EmotePackImage)
+	if len(pack.Images) == 0 {
+		for shortcode, image := range pack.LegacyEmoticons {
+			emoticons[strings.Trim(shortcode, ":")] = image
+		}
+		return emoticons
+	}
+	for shortcode, image := range pack.Images {
+		usage := image.Usage
+		if len(usage) == 0 {
+			usage = pack.Pack.Usage
+		}
+		if len(usage) == 0 || hasEmoteUsage(usage, emoteUsageEmoticon) {
+			emoticons[shortcode] = image
+		}
+	}
+	return emoticons
+}
+
+type emoteCache struct {
+	lock       sync.Mutex
+	userEmotes *EmotePackEventContent
+	emoteRooms *EmoteRoomsEventContent
+}
+
+func emotePackFromEvent(evt *event.Event) *EmotePackEventContent {
+	if content, ok := evt.Content.Parsed.(*EmotePackEventContent); ok {
+		return content
+	}
+	var content EmotePackEventContent
+	err := json.Unmarshal(evt.Content.VeryRaw, &content)
+	if err != nil {
+		debug.Printf("Failed to parse image pack %s in %s: %v", evt.GetStateKey(), evt.RoomID, err)
+		return nil
+	}
+	return &content
+}
+
+// HandleUserEmotes is the event handler for the user's personal image pack in account data.
+func (c *Container) HandleUserEmotes(source mautrix.EventSource, evt *event.Event) {
+	if source&mautrix.EventSourceAccountData == 0 {
+		return
+	}
+	if content, ok := evt.Content.Parsed.(*EmotePackEventContent); ok {
+		c.emotes.lock.Lock()
+		c.emotes.userEmotes = content
+		c.emotes.lock.Unlock()
+	}
+}
+
+// HandleEmoteRooms is the event handler for the list of room image packs that the user has enabled globally.
+func (c *Container) HandleEmoteRooms(source mautrix.EventSource, evt *event.Event) {
+	if source&mautrix.EventSourceAccountData == 0 {
+		return
+	}
+	if content, ok := evt.Content.Parsed.(*EmoteRoomsEventContent); ok {
+		c.emotes.lock.Lock()
+		c.emotes.emoteRooms = content
+		c.emotes.lock.Unlock()
+	}
+}
+
+// loadEmoteAccountData fetches the image pack account data events that haven't been received through sync yet.
+// Account data is only included in syncs when it changes, so it has to be fetched separately after a restart.
+func (c *Container) loadEmoteAccountData() (*EmotePackEventContent, *EmoteRoomsEventContent) {
+	c.emotes.lock.Lock()
+	defer c.emotes.lock.Unlock()
+	if c.emotes.userEmotes == nil {
+		var content EmotePackEventContent
+		err := c.client.GetAccountData(AccountDataUserEmotes.Type, &content)
+		if err != nil && !errors.Is(err, mautrix.MNotFound) {
+			debug.Print("Failed to fetch personal image pack:", err)
+		} else {
+			c.emotes.userEmotes = &content
+		}
+	}
+	if c.emotes.emoteRooms == nil {
+		var content EmoteRoomsEventContent
+		err := c.client.GetAccountData(AccountDataEmoteRooms.Type, &content)
+		if err != nil && !errors.Is(err, mautrix.MNotFound) {
+			debug.Print("Failed to fetch enabled image packs:", err)
+		} else {
+			c.emotes.emoteRooms = &content
+		}
+	}
+	return c.emotes.userEmotes, c.emotes.emoteRooms
+}
+
+func sortedStateKeys(events map[string]*event.Event) []string {
+	keys := make([]string, 0, len(events))
+	for key := range events {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CustomEmotes returns the custom emoticons that can be used in the given room, keyed by shortcode. If the same
+// shortcode is in multiple packs, the personal pack takes priority, then the packs of the room itself and finally the
+// packs that the user has enabled in all rooms.
+func (c *Container) CustomEmotes(roomID id.RoomID) map[string]ifc.CustomEmote {
+	emotes := make(map[string]ifc.CustomEmote)
+	addPack := func(pack *EmotePackEventContent, fallbackName string) {
+		if pack == nil {
+			return
+		}
+		name := pack.Pack.DisplayName
+		if len(name) == 0 {
+			name = fallbackName
+		}
+		for shortcode, image := range pack.Emoticons() {
+			if _, exists := emotes[shortcode]; exists || len(shortcode) == 0 {
+				continue
+			}
+			uri, err := image.URL.Parse()
+			if err != nil {
+				continue
+			}
+			emotes[shortcode] = ifc.CustomEmote{Shortcode: shortcode, URL: uri, Pack: name}
+		}
+	}
+	addRoomPacks := func(room *rooms.Room, stateKeys map[string]json.RawMessage) {
+		packs := room.GetStateEvents(StateRoomEmotes)
+		for _, stateKey := range sortedStateKeys(packs) {
+			if _, enabled := stateKeys[stateKey]; stateKeys != nil && !enabled {
+				continue
+			}
+			addPack(emotePackFromEvent(packs[stateKey]), room.GetTitle())
+		}
+	}
+
+	userEmotes, emoteRooms := c.loadEmoteAccountData()
+	addPack(userEmotes, "Personal")
+	if room := c.GetRoom(roomID); room != nil {
+		addRoomPacks(room, nil)
+	}
+	if emoteRooms != nil {
+		for packRoomID, stateKeys := range emoteRooms.Rooms {
+			if packRoomID == roomID {
+				continue
+			}
+			if room := c.GetRoom(packRoomID); room != nil {
+				addRoomPacks(room, stateKeys)
+			}
+		}
+	}
+	return emotes
+}
+
+// customEmoteRegex matches :shortcodes: and HTML tags. Tags are matched so that shortcodes inside attributes are
+// skipped and code blocks can be tracked.
+var customEmoteRegex = regexp.MustCompile(`<[^>]*>|:([a-zA-Z0-9_.+\-]+):`)
+
+const customEmoteHTML = `<img data-mx-emoticon src="%[1]s" alt=":%[2]s:" title=":%[2]s:" height="32"/>`
+
+// replaceCustomEmotes replaces the :shortcodes: of known custom emoticons in the formatted body with inline images.
+// The plaintext body keeps the shortcodes.
+func (c *Container) replaceCustomEmotes(roomID id.RoomID, content *event.MessageEventContent) {
+	if !strings.Contains(content.Body, ":") {
+		return
+	}
+	emotes := c.CustomEmotes(roomID)
+	if len(emotes) == 0 {
+		return
+	}
+	formatted := content.FormattedBody
+	if content.Format != event.FormatHTML {
+		formatted = strings.ReplaceAll(html.EscapeString(content.Body), "\n", "<br/>")
+	}
+	replaced := false
+	codeDepth := 0
+	formatted = customEmoteRegex.ReplaceAllStringFunc(formatted, func(match string) string {
+		if strings.HasPrefix(match, "<") {
+			switch {
+			case strings.HasPrefix(match, "<code"), strings.HasPrefix(match, "<pre"):
+				codeDepth++
+			case strings.HasPrefix(match, "</code"), strings.HasPrefix(match, "</pre"):
+				codeDepth--
+			}
+			return match
+		} else if codeDepth > 0 {
+			return match
+		}
+		emote, ok := emotes[strings.Trim(match, ":")]
+		if !ok {
+			return match
+		}
+		replaced = true
+		return fmt.Sprintf(customEmoteHTML, html.EscapeString(emote.URL.String()), html.EscapeString(emote.Shortcode))
+	})
+	if replaced {
+		content.Format = event.FormatHTML
+		content.FormattedBody = formatted
+	}
+}
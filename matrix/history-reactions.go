@@ -0,0 +1,212 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"encoding/json"
+	"errors"
+
+	bolt "go.etcd.io/bbolt"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/matrix/muksevt"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+// countReactions returns the number of stored reactions with the given key.
+func countReactions(evt *muksevt.Event, key string) (count int) {
+	for _, reaction := range evt.Gomuks.Reactions {
+		if reaction.Key == key {
+			count++
+		}
+	}
+	return
+}
+
+// applyReaction adds a reaction to the event it reacts to. If increment is false, the count is only raised to the
+// number of stored reactions with the same key, as events fetched from the server already include the reactions in
+// their bundled aggregations. Returns false if the reaction was already added.
+func applyReaction(evt *muksevt.Event, reactionID id.EventID, reaction muksevt.Reaction, increment bool) bool {
+	if _, ok := evt.Gomuks.Reactions[reactionID]; ok {
+		return false
+	} else if evt.Gomuks.Reactions == nil {
+		evt.Gomuks.Reactions = make(map[id.EventID]muksevt.Reaction)
+	}
+	evt.Gomuks.Reactions[reactionID] = reaction
+	annotations := &evt.Unsigned.Relations.Annotations
+	if annotations.Map == nil {
+		annotations.Map = make(map[string]int)
+	}
+	if increment {
+		annotations.Map[reaction.Key]++
+	} else if stored := countReactions(evt, reaction.Key); annotations.Map[reaction.Key] < stored {
+		annotations.Map[reaction.Key] = stored
+	}
+	return true
+}
+
+func getPendingReactions(pending *bolt.Bucket, targetID id.EventID) (map[id.EventID]muksevt.Reaction, error) {
+	reactions := make(map[id.EventID]muksevt.Reaction)
+	if data := pending.Get([]byte(targetID)); data != nil {
+		if err := json.Unmarshal(data, &reactions); err != nil {
+			return nil, err
+		}
+	}
+	return reactions, nil
+}
+
+func putPendingReactions(pending *bolt.Bucket, targetID id.EventID, reactions map[id.EventID]muksevt.Reaction) error {
+	if len(reactions) == 0 {
+		return pending.Delete([]byte(targetID))
+	}
+	data, err := json.Marshal(reactions)
+	if err != nil {
+		return err
+	}
+	return pending.Put([]byte(targetID), data)
+}
+
+// addReaction stores a reaction to the given target event. If the target isn't in the history yet, the reaction is
+// kept in the pending bucket and applied when the target is stored. Returns the updated target event, or nil if it
+// isn't stored yet or already had the reaction.
+func (hm *HistoryManager) addReaction(tx *bolt.Tx, roomID []byte, reactionID, targetID id.EventID, reaction muksevt.Reaction, increment bool) (*muksevt.Event, error) {
+	targets, err := tx.Bucket(bucketReactionTargets).CreateBucketIfNotExists(roomID)
+	if err != nil {
+		return nil, err
+	} else if err = targets.Put([]byte(reactionID), []byte(targetID)); err != nil {
+		return nil, err
+	}
+	stream, index, err := hm.getStreamIndex(tx, roomID, []byte(targetID))
+	if errors.Is(err, EventNotFoundError) || errors.Is(err, RoomNotFoundError) {
+		pending, err := tx.Bucket(bucketPendingReactions).CreateBucketIfNotExists(roomID)
+		if err != nil {
+			return nil, err
+		}
+		reactions, err := getPendingReactions(pending, targetID)
+		if err != nil {
+			return nil, err
+		}
+		reactions[reactionID] = reaction
+		return nil, putPendingReactions(pending, targetID, reactions)
+	} else if err != nil {
+		return nil, err
+	}
+	evt, err := hm.getEvent(tx, stream, index)
+	if err != nil {
+		return nil, err
+	} else if !applyReaction(evt, reactionID, reaction, increment) {
+		return nil, nil
+	}
+	data, err := marshalEvent(evt)
+	if err != nil {
+		return nil, err
+	}
+	return evt, stream.Put(index, data)
+}
+
+// storeReactions is called for every event that's stored in the history. Pending reactions to the event are applied
+// to it, and if the event itself is a reaction (fetched with history), it's added to the event it reacts to.
+func (hm *HistoryManager) storeReactions(tx *bolt.Tx, roomID []byte, evt *muksevt.Event) error {
+	if content, ok := evt.Content.Parsed.(*event.ReactionEventContent); ok && evt.Type == event.EventReaction {
+		rel := content.RelatesTo
+		if rel.Type == event.RelAnnotation && len(rel.EventID) > 0 {
+			reaction := muksevt.Reaction{Key: rel.Key, Sender: evt.Sender}
+			_, err := hm.addReaction(tx, roomID, evt.ID, rel.EventID, reaction, false)
+			return err
+		}
+		return nil
+	}
+	pending := tx.Bucket(bucketPendingReactions).Bucket(roomID)
+	if pending == nil {
+		return nil
+	}
+	reactions, err := getPendingReactions(pending, evt.ID)
+	if err != nil || len(reactions) == 0 {
+		return err
+	}
+	for reactionID, reaction := range reactions {
+		applyReaction(evt, reactionID, reaction, false)
+	}
+	return pending.Delete([]byte(evt.ID))
+}
+
+// AddReaction stores a reaction received from sync. Returns the updated event the reaction is to, or nil if the
+// event isn't stored yet or already had the reaction.
+func (hm *HistoryManager) AddReaction(room *rooms.Room, reactionID, targetID id.EventID, reaction muksevt.Reaction) (evt *muksevt.Event, err error) {
+	err = hm.db.Update(func(tx *bolt.Tx) error {
+		evt, err = hm.addReaction(tx, []byte(room.ID), reactionID, targetID, reaction, true)
+		return err
+	})
+	return
+}
+
+// RemoveReaction removes a redacted reaction from the event it reacted to. Returns the updated event, which is nil if
+// the event isn't stored yet, or EventNotFoundError if the redacted event isn't a known reaction.
+func (hm *HistoryManager) RemoveReaction(room *rooms.Room, reactionID id.EventID) (evt *muksevt.Event, err error) {
+	roomID := []byte(room.ID)
+	err = hm.db.Update(func(tx *bolt.Tx) error {
+		targets := tx.Bucket(bucketReactionTargets).Bucket(roomID)
+		if targets == nil {
+			return EventNotFoundError
+		}
+		targetID := id.EventID(targets.Get([]byte(reactionID)))
+		if len(targetID) == 0 {
+			return EventNotFoundError
+		} else if err := targets.Delete([]byte(reactionID)); err != nil {
+			return err
+		}
+		stream, index, err := hm.getStreamIndex(tx, roomID, []byte(targetID))
+		if errors.Is(err, EventNotFoundError) || errors.Is(err, RoomNotFoundError) {
+			pending := tx.Bucket(bucketPendingReactions).Bucket(roomID)
+			if pending == nil {
+				return nil
+			}
+			reactions, err := getPendingReactions(pending, targetID)
+			if err != nil {
+				return err
+			}
+			delete(reactions, reactionID)
+			return putPendingReactions(pending, targetID, reactions)
+		} else if err != nil {
+			return err
+		}
+		evt, err = hm.getEvent(tx, stream, index)
+		if err != nil {
+			return err
+		}
+		reaction, ok := evt.Gomuks.Reactions[reactionID]
+		if !ok {
+			evt = nil
+			return nil
+		}
+		delete(evt.Gomuks.Reactions, reactionID)
+		annotations := evt.Unsigned.Relations.Annotations.Map
+		if annotations[reaction.Key] > 1 {
+			annotations[reaction.Key]--
+		} else {
+			delete(annotations, reaction.Key)
+		}
+		data, err := marshalEvent(evt)
+		if err != nil {
+			return err
+		}
+		return stream.Put(index, data)
+	})
+	return
+}
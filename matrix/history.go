@@ -44,6 +44,9 @@ type HistoryManager struct {
 var bucketRoomStreams = []byte("room_streams")
 var bucketRoomEventIDs = []byte("room_event_ids")
 var bucketStreamPointers = []byte("room_stream_pointers")
+var bucketReactionTargets = []byte("reaction_targets")
+var bucketPendingReactions = []byte("pending_reactions")
+var bucketOutgoingQueue = []byte("outgoing_queue")
 
 const halfUint64 = ^uint64(0) >> 1
 
@@ -72,6 +75,18 @@ func NewHistoryManager(dbPath string) (*HistoryManager, error) {
 		if err != nil {
 			return err
 		}
+		_, err = tx.CreateBucketIfNotExists(bucketReactionTargets)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(bucketPendingReactions)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(bucketOutgoingQueue)
+		if err != nil {
+			return err
+		}
 		return nil
 	})
 	if err != nil {
@@ -179,7 +194,9 @@ func (hm *HistoryManager) store(room *rooms.Room, events []*event.Event, append
 			}
 			for i, evt := range events {
 				newEvents[i] = muksevt.Wrap(evt)
-				if err := put(stream, eventIDs, newEvents[i], ptrStart+uint64(i)); err != nil {
+				if err := hm.storeReactions(tx, rid, newEvents[i]); err != nil {
+					return err
+				} else if err := put(stream, eventIDs, newEvents[i], ptrStart+uint64(i)); err != nil {
 					return err
 				}
 			}
@@ -200,7 +217,9 @@ func (hm *HistoryManager) store(room *rooms.Room, events []*event.Event, append
 			eventCount := uint64(len(events))
 			for i, evt := range events {
 				newEvents[i] = muksevt.Wrap(evt)
-				if err := put(stream, eventIDs, newEvents[i], -ptrStart-uint64(i)); err != nil {
+				if err := hm.storeReactions(tx, rid, newEvents[i]); err != nil {
+					return err
+				} else if err := put(stream, eventIDs, newEvents[i], -ptrStart-uint64(i)); err != nil {
 					return err
 				}
 			}
@@ -0,0 +1,132 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	ifc "maunium.net/go/gomuks/interface"
+)
+
+// outgoingFilterTimeout is how long the outgoing message filter command can take before the send is cancelled.
+const outgoingFilterTimeout = 10 * time.Second
+
+type namedOutgoingHook struct {
+	name string
+	hook ifc.OutgoingMessageHook
+}
+
+type outgoingHooks struct {
+	lock  sync.RWMutex
+	hooks []namedOutgoingHook
+}
+
+// AddOutgoingMessageHook registers a hook that outgoing messages go through before they're sent. Hooks are run in the
+// order they were added. If a hook with the same name already exists, it's replaced.
+func (c *Container) AddOutgoingMessageHook(name string, hook ifc.OutgoingMessageHook) {
+	c.outgoingHooks.lock.Lock()
+	defer c.outgoingHooks.lock.Unlock()
+	for i, existing := range c.outgoingHooks.hooks {
+		if existing.name == name {
+			c.outgoingHooks.hooks[i].hook = hook
+			return
+		}
+	}
+	c.outgoingHooks.hooks = append(c.outgoingHooks.hooks, namedOutgoingHook{name, hook})
+}
+
+// RemoveOutgoingMessageHook removes the hook with the given name.
+func (c *Container) RemoveOutgoingMessageHook(name string) {
+	c.outgoingHooks.lock.Lock()
+	defer c.outgoingHooks.lock.Unlock()
+	for i, existing := range c.outgoingHooks.hooks {
+		if existing.name == name {
+			c.outgoingHooks.hooks = append(c.outgoingHooks.hooks[:i], c.outgoingHooks.hooks[i+1:]...)
+			return
+		}
+	}
+}
+
+// runOutgoingHooks passes the message through the registered hooks and the filter command in the config. The content
+// is changed in place. If a hook cancels the send, an error with the reason is returned.
+func (c *Container) runOutgoingHooks(roomID id.RoomID, content *event.MessageEventContent) error {
+	c.outgoingHooks.lock.RLock()
+	hooks := make([]namedOutgoingHook, len(c.outgoingHooks.hooks))
+	copy(hooks, c.outgoingHooks.hooks)
+	c.outgoingHooks.lock.RUnlock()
+
+	for _, hook := range hooks {
+		if err := hook.hook(roomID, content); err != nil {
+			return fmt.Errorf("%w by %s: %v", ifc.ErrMessageCancelled, hook.name, err)
+		}
+	}
+	if len(strings.TrimSpace(c.config.OutgoingMessageFilter)) > 0 {
+		if err := c.runOutgoingFilterCommand(roomID, content); err != nil {
+			return fmt.Errorf("%w by filter command: %v", ifc.ErrMessageCancelled, err)
+		}
+	}
+	return nil
+}
+
+// runOutgoingFilterCommand runs the outgoing message filter command from the config. The command gets the message
+// content as JSON in stdin and the room ID in the GOMUKS_ROOM_ID environment variable. It can print changed content
+// to stdout, or exit with a non-zero status to cancel sending, in which case stderr is used as the reason.
+func (c *Container) runOutgoingFilterCommand(roomID id.RoomID, content *event.MessageEventContent) error {
+	args := strings.Fields(c.config.OutgoingMessageFilter)
+	input, err := json.Marshal(content)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), outgoingFilterTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("GOMUKS_ROOM_ID=%s", roomID))
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && stderr.Len() > 0 {
+		return errors.New(strings.TrimSpace(stderr.String()))
+	} else if err != nil {
+		return err
+	} else if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return nil
+	}
+
+	var filtered event.MessageEventContent
+	if err = json.Unmarshal(stdout.Bytes(), &filtered); err != nil {
+		return fmt.Errorf("failed to parse output: %w", err)
+	}
+	*content = filtered
+	return nil
+}
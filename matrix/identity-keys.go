@@ -0,0 +1,125 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build cgo
+
+package matrix
+
+import (
+	"fmt"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/lib/notification"
+)
+
+// getTrustedDevices returns the currently stored devices of the given users that are trusted either directly or
+// through cross-signing.
+func getTrustedDevices(mach *crypto.OlmMachine, users []id.UserID) map[id.UserID][]*crypto.DeviceIdentity {
+	trusted := make(map[id.UserID][]*crypto.DeviceIdentity)
+	for _, userID := range users {
+		devices, err := mach.CryptoStore.GetDevices(userID)
+		if err != nil {
+			debug.Printf("Failed to get devices of %s to check for identity key changes: %v", userID, err)
+			continue
+		}
+		for _, device := range devices {
+			if mach.IsDeviceTrusted(device) {
+				trusted[userID] = append(trusted[userID], device)
+			}
+		}
+	}
+	return trusted
+}
+
+// processCryptoSync passes the sync response to the crypto machine and retries decrypting undecryptable events if
+// the response contained encrypted to-device events, as those may have contained new room keys.
+func (c *Container) processCryptoSync(resp *mautrix.RespSync, since string) bool {
+	resp.ToDevice.Events = dropPlaintextPhraseVerifications(resp.ToDevice.Events)
+	c.logReceivedVerificationEvents(resp.ToDevice.Events)
+	result := c.processCryptoDeviceLists(resp, since)
+	if mach, ok := c.crypto.(*crypto.OlmMachine); ok {
+		c.rememberVerificationRequests(mach, resp.ToDevice.Events)
+	}
+	c.retryDecryptionAfterToDevice(resp.ToDevice.Events)
+	return result
+}
+
+// processCryptoDeviceLists passes the sync response to the crypto machine and checks whether any of the trusted
+// devices whose device lists changed got a new identity key. The signing key can't change (mautrix rejects such
+// updates), but a changed curve25519 key is not detected by mautrix, so without this check the new key would be
+// accepted silently.
+func (c *Container) processCryptoDeviceLists(resp *mautrix.RespSync, since string) bool {
+	mach, ok := c.crypto.(*crypto.OlmMachine)
+	if !ok || len(resp.DeviceLists.Changed) == 0 {
+		return c.crypto.ProcessSyncResponse(resp, since)
+	}
+	trusted := getTrustedDevices(mach, resp.DeviceLists.Changed)
+	known := getKnownDeviceIDs(mach, resp.DeviceLists.Changed)
+	result := c.crypto.ProcessSyncResponse(resp, since)
+	for userID, devices := range trusted {
+		for _, old := range devices {
+			device, err := mach.CryptoStore.GetDevice(userID, old.DeviceID)
+			if err != nil {
+				debug.Printf("Failed to get device %s of %s to check for identity key changes: %v", old.DeviceID, userID, err)
+			} else if device != nil && device.IdentityKey != old.IdentityKey {
+				c.handleChangedIdentityKey(mach, old, device)
+			}
+		}
+	}
+	c.updateAutoTrust(mach, resp.DeviceLists.Changed, known)
+	return result
+}
+
+// handleChangedIdentityKey drops the trust of a previously trusted device whose identity key changed and alerts the
+// user about it. The device must be verified again before it's trusted.
+func (c *Container) handleChangedIdentityKey(mach *crypto.OlmMachine, old, device *crypto.DeviceIdentity) {
+	debug.Printf("Identity key of trusted device %s of %s changed from %s to %s", device.DeviceID, device.UserID,
+		old.IdentityKey, device.IdentityKey)
+	device.Trust = crypto.TrustStateUnset
+	if mach.IsDeviceTrusted(device) {
+		// Cross-signing signatures are stored by the signing key, which didn't change,
+		// so the only way to stop trusting the new identity key is to blacklist the device.
+		device.Trust = crypto.TrustStateBlacklisted
+	}
+	err := mach.CryptoStore.PutDevice(device.UserID, device)
+	if err != nil {
+		debug.Printf("Failed to drop trust of device %s of %s: %v", device.DeviceID, device.UserID, err)
+	}
+	mach.OnDevicesChanged(device.UserID)
+
+	message := fmt.Sprintf("The identity key of the verified device %s of %s changed. This should never happen "+
+		"legitimately, the device is no longer trusted (trust state: %s). Verify it again with /verify-device "+
+		"only if you're sure it's the same device.", device.DeviceID, device.UserID, device.Trust)
+	c.alertDeviceChange(mach, device.UserID, "Device keys changed", message, true)
+}
+
+// alertDeviceChange logs a change to the devices of a user and shows it as a notification and in all rooms shared
+// with the user.
+func (c *Container) alertDeviceChange(mach *crypto.OlmMachine, userID id.UserID, title, message string, critical bool) {
+	c.LogVerification("%s", message)
+	_ = notification.Send(title, message, critical, critical)
+	mainView := c.ui.MainView()
+	for _, roomID := range mach.StateStore.FindSharedRooms(userID) {
+		if roomView := mainView.GetRoom(roomID); roomView != nil {
+			roomView.AddServiceMessage(message)
+		}
+	}
+	c.ui.Render()
+}
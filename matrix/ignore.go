@@ -0,0 +1,132 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/debug"
+)
+
+type ignoredUsers struct {
+	lock  sync.RWMutex
+	users map[id.UserID]event.IgnoredUser
+}
+
+// setIgnoredUsers replaces the cached ignore list and tells the UI to hide or show the affected messages.
+func (c *Container) setIgnoredUsers(users map[id.UserID]event.IgnoredUser) {
+	c.ignored.lock.Lock()
+	c.ignored.users = users
+	c.ignored.lock.Unlock()
+	if c.config.AuthCache.InitialSyncDone {
+		c.ui.MainView().UpdateIgnoredUsers()
+	}
+}
+
+// HandleIgnoredUsers is the event handler for the m.ignored_user_list account data event.
+func (c *Container) HandleIgnoredUsers(source mautrix.EventSource, evt *event.Event) {
+	if source&mautrix.EventSourceAccountData == 0 {
+		return
+	}
+	c.setIgnoredUsers(evt.Content.AsIgnoredUserList().IgnoredUsers)
+}
+
+// loadIgnoredUsers fetches the ignore list. Account data is only included in syncs when it changes, so it has to be
+// fetched separately after a restart.
+func (c *Container) loadIgnoredUsers() {
+	defer debug.Recover()
+	client := c.client
+	if client == nil {
+		return
+	}
+	var content event.IgnoredUserListEventContent
+	err := client.GetAccountData(event.AccountDataIgnoredUserList.Type, &content)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		debug.Print("Failed to fetch ignored users:", err)
+		return
+	}
+	c.setIgnoredUsers(content.IgnoredUsers)
+}
+
+// IsIgnored checks if the given user is on the ignore list.
+func (c *Container) IsIgnored(userID id.UserID) bool {
+	c.ignored.lock.RLock()
+	defer c.ignored.lock.RUnlock()
+	_, ignored := c.ignored.users[userID]
+	return ignored
+}
+
+// IgnoredUsers returns the users on the ignore list, sorted by user ID.
+func (c *Container) IgnoredUsers() []id.UserID {
+	c.ignored.lock.RLock()
+	defer c.ignored.lock.RUnlock()
+	users := make([]id.UserID, 0, len(c.ignored.users))
+	for userID := range c.ignored.users {
+		users = append(users, userID)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i] < users[j]
+	})
+	return users
+}
+
+// updateIgnoredUsers fetches the ignore list from the server, changes it and saves it back. The list is fetched
+// first so that changes made by other clients since the last sync aren't overwritten.
+func (c *Container) updateIgnoredUsers(userID id.UserID, ignore bool) error {
+	var content event.IgnoredUserListEventContent
+	err := c.client.GetAccountData(event.AccountDataIgnoredUserList.Type, &content)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return fmt.Errorf("failed to fetch ignored users: %w", err)
+	}
+	if content.IgnoredUsers == nil {
+		content.IgnoredUsers = make(map[id.UserID]event.IgnoredUser)
+	}
+	if _, ignored := content.IgnoredUsers[userID]; ignored == ignore {
+		c.setIgnoredUsers(content.IgnoredUsers)
+		return nil
+	} else if ignore {
+		content.IgnoredUsers[userID] = event.IgnoredUser{}
+	} else {
+		delete(content.IgnoredUsers, userID)
+	}
+	err = c.client.SetAccountData(event.AccountDataIgnoredUserList.Type, &content)
+	if err != nil {
+		return fmt.Errorf("failed to save ignored users: %w", err)
+	}
+	c.setIgnoredUsers(content.IgnoredUsers)
+	return nil
+}
+
+// IgnoreUser adds the given user to the ignore list.
+func (c *Container) IgnoreUser(userID id.UserID) error {
+	if userID == c.config.UserID {
+		return fmt.Errorf("you can't ignore yourself")
+	}
+	return c.updateIgnoredUsers(userID, true)
+}
+
+// UnignoreUser removes the given user from the ignore list.
+func (c *Container) UnignoreUser(userID id.UserID) error {
+	return c.updateIgnoredUsers(userID, false)
+}
@@ -0,0 +1,261 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build cgo
+
+package matrix
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	ifc "maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/matrix/muksevt"
+)
+
+// keyRequestBufferSize is the number of incoming key requests that are remembered.
+const keyRequestBufferSize = 50
+
+type keyRequestBuffer struct {
+	lock     sync.Mutex
+	requests []*ifc.KeyRequest
+	nextID   int
+	outgoing map[id.SessionID]ifc.OutgoingKeyRequest
+}
+
+// reset forgets all incoming and outgoing key requests, as they belong to the previous account.
+func (krb *keyRequestBuffer) reset() {
+	krb.lock.Lock()
+	krb.requests = nil
+	krb.outgoing = nil
+	krb.lock.Unlock()
+}
+
+func (krb *keyRequestBuffer) add(req *ifc.KeyRequest) {
+	krb.lock.Lock()
+	defer krb.lock.Unlock()
+	krb.nextID++
+	req.ID = krb.nextID
+	krb.requests = append(krb.requests, req)
+	if len(krb.requests) > keyRequestBufferSize {
+		krb.requests = krb.requests[len(krb.requests)-keyRequestBufferSize:]
+	}
+}
+
+// wrapAllowKeyShare wraps the key sharing policy of the crypto machine so that every incoming key request and the
+// decision made about it is recorded.
+func (c *Container) wrapAllowKeyShare(mach *crypto.OlmMachine) {
+	allowKeyShare := mach.AllowKeyShare
+	mach.AllowKeyShare = func(device *crypto.DeviceIdentity, info event.RequestedKeyInfo) *crypto.KeyShareRejection {
+		rejection := allowKeyShare(device, info)
+		req := &ifc.KeyRequest{
+			UserID:    device.UserID,
+			DeviceID:  device.DeviceID,
+			RoomID:    info.RoomID,
+			SenderKey: info.SenderKey,
+			SessionID: info.SessionID,
+			Received:  time.Now(),
+		}
+		switch {
+		case rejection == nil:
+			req.Status = ifc.KeyRequestShared
+		case rejection.Code == "":
+			req.Status = ifc.KeyRequestIgnored
+		case rejection.Code == event.RoomKeyWithheldUnverified:
+			req.Status = ifc.KeyRequestPending
+			req.Reason = rejection.Reason
+		default:
+			req.Status = ifc.KeyRequestRejected
+			req.Reason = rejection.Reason
+		}
+		c.keyRequests.add(req)
+		return rejection
+	}
+}
+
+// KeyRequests returns the recently received key requests, oldest first.
+func (c *Container) KeyRequests() []ifc.KeyRequest {
+	c.keyRequests.lock.Lock()
+	defer c.keyRequests.lock.Unlock()
+	requests := make([]ifc.KeyRequest, len(c.keyRequests.requests))
+	for i, req := range c.keyRequests.requests {
+		requests[i] = *req
+	}
+	return requests
+}
+
+// FulfillKeyRequest forwards the session requested by a pending key request. The requesting device must have been
+// verified since the request was received.
+func (c *Container) FulfillKeyRequest(requestID int) error {
+	c.keyRequests.lock.Lock()
+	var req *ifc.KeyRequest
+	for _, candidate := range c.keyRequests.requests {
+		if candidate.ID == requestID {
+			req = candidate
+			break
+		}
+	}
+	c.keyRequests.lock.Unlock()
+	if req == nil {
+		return fmt.Errorf("key request #%d not found", requestID)
+	} else if req.Status == ifc.KeyRequestShared || req.Status == ifc.KeyRequestFulfilled {
+		return fmt.Errorf("key request #%d was already answered", requestID)
+	}
+
+	mach := c.crypto.(*crypto.OlmMachine)
+	device, err := mach.GetOrFetchDevice(req.UserID, req.DeviceID)
+	if err != nil {
+		return fmt.Errorf("failed to get device: %w", err)
+	} else if !mach.IsDeviceTrusted(device) {
+		return fmt.Errorf("%s/%s is not verified", req.UserID, req.DeviceID)
+	}
+	igs, err := mach.CryptoStore.GetGroupSession(req.RoomID, req.SenderKey, req.SessionID)
+	if err != nil {
+		return fmt.Errorf("failed to get session: %w", err)
+	} else if igs == nil {
+		return fmt.Errorf("session %s is not in the local store", req.SessionID)
+	}
+	exportedKey, err := igs.Internal.Export(igs.Internal.FirstKnownIndex())
+	if err != nil {
+		return fmt.Errorf("failed to export session: %w", err)
+	}
+	err = mach.SendEncryptedToDevice(device, event.ToDeviceForwardedRoomKey, event.Content{
+		Parsed: &event.ForwardedRoomKeyEventContent{
+			RoomKeyEventContent: event.RoomKeyEventContent{
+				Algorithm:  id.AlgorithmMegolmV1,
+				RoomID:     igs.RoomID,
+				SessionID:  igs.ID(),
+				SessionKey: exportedKey,
+			},
+			SenderKey:          req.SenderKey,
+			ForwardingKeyChain: igs.ForwardingChains,
+			SenderClaimedKey:   igs.SigningKey,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send forwarded key: %w", err)
+	}
+	c.keyRequests.lock.Lock()
+	req.Status = ifc.KeyRequestFulfilled
+	c.keyRequests.lock.Unlock()
+	return nil
+}
+
+// getUndecryptableContent finds the encrypted content of an event that couldn't be decrypted. The event is looked up
+// from the local history first, as that's where undecryptable events are stored. The second return value tells
+// whether the event was found locally.
+func (c *Container) getUndecryptableContent(roomID id.RoomID, eventID id.EventID) (*event.Event, *event.EncryptedEventContent, bool, error) {
+	room := c.GetRoom(roomID)
+	if room == nil {
+		return nil, nil, false, fmt.Errorf("room %s not found", roomID)
+	}
+	evt, err := c.history.Get(room, eventID)
+	local := err == nil && evt != nil
+	if !local {
+		evt, err = c.GetEvent(room, eventID)
+		if err != nil {
+			return nil, nil, false, fmt.Errorf("failed to get event: %w", err)
+		}
+	}
+	switch content := evt.Content.Parsed.(type) {
+	case *muksevt.BadEncryptedContent:
+		if content.Original != nil {
+			return evt.Event, content.Original, local, nil
+		}
+	case *event.EncryptedEventContent:
+		return evt.Event, content, local, nil
+	}
+	return nil, nil, false, fmt.Errorf("%s is not an undecryptable encrypted event", eventID)
+}
+
+// RequestSession sends a room key request for the Megolm session of an event that couldn't be decrypted. The
+// request is sent to our other devices and the device that sent the event. If the session was already requested,
+// the previous request is returned and nothing is sent unless resend is true. Events in the local history are
+// re-decrypted once the session arrives.
+func (c *Container) RequestSession(roomID id.RoomID, eventID id.EventID, resend bool) (req ifc.OutgoingKeyRequest, sent bool, err error) {
+	mach := c.crypto.(*crypto.OlmMachine)
+	evt, content, local, err := c.getUndecryptableContent(roomID, eventID)
+	if err != nil {
+		return
+	} else if content.Algorithm != id.AlgorithmMegolmV1 || len(content.SessionID) == 0 {
+		err = fmt.Errorf("%s is not encrypted with Megolm", eventID)
+		return
+	}
+	if local {
+		c.addUndecryptable(content.SessionID, roomID, eventID)
+	}
+	igs, err := mach.CryptoStore.GetGroupSession(roomID, content.SenderKey, content.SessionID)
+	if err != nil {
+		err = fmt.Errorf("failed to check session store: %w", err)
+		return
+	} else if igs != nil {
+		c.RetryDecryption()
+		err = fmt.Errorf("session %s is already in the store, retrying decryption", content.SessionID)
+		return
+	}
+
+	c.keyRequests.lock.Lock()
+	existing, ok := c.keyRequests.outgoing[content.SessionID]
+	c.keyRequests.lock.Unlock()
+	if ok && !resend {
+		return existing, false, nil
+	}
+
+	req = ifc.OutgoingKeyRequest{
+		RoomID:    roomID,
+		SessionID: content.SessionID,
+		Targets:   make(map[id.UserID][]id.DeviceID),
+	}
+	ownDevices, err := mach.CryptoStore.GetDevices(c.config.UserID)
+	if err != nil {
+		err = fmt.Errorf("failed to get own devices: %w", err)
+		return
+	}
+	for deviceID := range ownDevices {
+		if deviceID != c.config.DeviceID {
+			req.Targets[c.config.UserID] = append(req.Targets[c.config.UserID], deviceID)
+		}
+	}
+	if evt.Sender != c.config.UserID {
+		if len(content.DeviceID) > 0 {
+			req.Targets[evt.Sender] = []id.DeviceID{content.DeviceID}
+		} else {
+			req.Targets[evt.Sender] = []id.DeviceID{"*"}
+		}
+	}
+	if len(req.Targets) == 0 {
+		err = fmt.Errorf("no devices to request the session from")
+		return
+	}
+	err = mach.SendRoomKeyRequest(roomID, content.SenderKey, content.SessionID, "", req.Targets)
+	if err != nil {
+		err = fmt.Errorf("failed to send key request: %w", err)
+		return
+	}
+	req.Sent = time.Now()
+	c.keyRequests.lock.Lock()
+	if c.keyRequests.outgoing == nil {
+		c.keyRequests.outgoing = make(map[id.SessionID]ifc.OutgoingKeyRequest)
+	}
+	c.keyRequests.outgoing[content.SessionID] = req
+	c.keyRequests.lock.Unlock()
+	return req, true, nil
+}
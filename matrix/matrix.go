@@ -23,15 +23,19 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"reflect"
 	"runtime"
 	dbg "runtime/debug"
+	"strings"
+	"sync"
 	"time"
 
 	"maunium.net/go/mautrix"
@@ -60,10 +64,23 @@ type Container struct {
 	ui      ifc.GomuksUI
 	config  *config.Config
 	history *HistoryManager
-	running bool
-	stop    chan bool
 
-	typing int64
+	// syncLock protects syncCancel and syncDone, which are set by Start for each sync loop.
+	syncLock   sync.Mutex
+	syncCancel context.CancelFunc
+	syncDone   chan struct{}
+
+	typing     int64
+	typingRoom id.RoomID
+
+	undecryptable        undecryptableEvents
+	keyRequests          keyRequestBuffer
+	verificationRequests verificationRequestBuffer
+	autoTrust            autoTrustedDevices
+	emotes               emoteCache
+	outgoingHooks        outgoingHooks
+	presence             presenceCache
+	ignored              ignoredUsers
 }
 
 // NewContainer creates a new Container for the given Gomuks instance.
@@ -99,9 +116,9 @@ func (c *Container) InitClient() error {
 	}
 
 	if c.client != nil {
-		c.Stop()
+		c.stopAndWait()
 		c.client = nil
-		c.crypto = nil
+		c.closeCrypto()
 	}
 
 	var mxid id.UserID
@@ -126,7 +143,7 @@ func (c *Container) InitClient() error {
 	}
 
 	if c.history == nil {
-		c.history, err = NewHistoryManager(c.config.HistoryPath)
+		c.history, err = NewHistoryManager(c.config.AccountHistoryPath())
 		if err != nil {
 			return fmt.Errorf("failed to initialize history: %w", err)
 		}
@@ -138,8 +155,7 @@ func (c *Container) InitClient() error {
 			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
 		}
 	}
-
-	c.stop = make(chan bool, 1)
+	c.initVerificationLog()
 
 	if len(accessToken) > 0 {
 		go c.Start()
@@ -201,17 +217,14 @@ func respondHTML(w http.ResponseWriter, status int, message string) {
 </html>`, message)))
 }
 
+// ssoLoginTimeout is how long the user has to finish single sign-on in the browser.
+const ssoLoginTimeout = 5 * time.Minute
+
+// SingleSignOn opens the single sign-on page of the homeserver in the browser and waits for the homeserver to redirect
+// back to a temporary local server with a login token, which is then used to log in.
 func (c *Container) SingleSignOn() error {
-	loginURL := c.client.BuildURLWithQuery(mautrix.ClientURLPath{"v3", "login", "sso", "redirect"}, map[string]string{
-		"redirectUrl": "http://localhost:29325",
-	})
-	err := open.Open(loginURL)
-	if err != nil {
-		return err
-	}
 	errChan := make(chan error, 1)
-	server := &http.Server{Addr: ":29325"}
-	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	server, callbackURL, err := startLocalCallbackServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		loginToken := r.URL.Query().Get("loginToken")
 		if len(loginToken) == 0 {
 			respondHTML(w, http.StatusBadRequest, "Missing loginToken parameter")
@@ -226,77 +239,162 @@ func (c *Container) SingleSignOn() error {
 			StoreHomeserverURL: true,
 		})
 		if err != nil {
-			respondHTML(w, http.StatusForbidden, err.Error())
-			errChan <- err
-			return
+			respondHTML(w, http.StatusForbidden, html.EscapeString(err.Error()))
+		} else {
+			respondHTML(w, http.StatusOK, fmt.Sprintf("Successfully logged in as %s", html.EscapeString(resp.UserID.String())))
+			c.finishLogin(resp)
 		}
-		respondHTML(w, http.StatusOK, fmt.Sprintf("Successfully logged in as %s", resp.UserID))
-		c.finishLogin(resp)
-		go func() {
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-			defer cancel()
-			err = server.Shutdown(ctx)
-			if err != nil {
-				debug.Printf("Failed to shut down SSO server: %v\n", err)
-			}
-			errChan <- err
-		}()
+		select {
+		case errChan <- err:
+		default:
+		}
+	}))
+	if err != nil {
+		return fmt.Errorf("failed to start local server for single sign-on: %w", err)
+	}
+	defer closeLocalCallbackServer(server)
+
+	loginURL := c.client.BuildURLWithQuery(mautrix.ClientURLPath{"v3", "login", "sso", "redirect"}, map[string]string{
+		"redirectUrl": callbackURL,
 	})
-	err = server.ListenAndServe()
+	err = open.Open(loginURL)
 	if err != nil {
+		return fmt.Errorf("failed to open browser: %w", err)
+	}
+	select {
+	case err = <-errChan:
 		return err
+	case <-time.After(ssoLoginTimeout):
+		return fmt.Errorf("single sign-on wasn't completed in the browser within %s", ssoLoginTimeout)
 	}
-	err = <-errChan
-	return err
 }
 
-// Login sends a password login request with the given username and password.
+// Login logs in with the given username and password. If the password is empty or the homeserver doesn't support
+// password login, single sign-on in the browser is used instead.
 func (c *Container) Login(user, password string) error {
 	resp, err := c.client.GetLoginFlows()
 	if err != nil {
 		return err
 	}
+	var supportsPassword, supportsSSO bool
 	for _, flow := range resp.Flows {
-		if flow.Type == "m.login.password" {
-			return c.PasswordLogin(user, password)
-		} else if flow.Type == "m.login.sso" && len(password) == 0 {
-			return c.SingleSignOn()
+		switch flow.Type {
+		case "m.login.password":
+			supportsPassword = true
+		case "m.login.sso":
+			supportsSSO = true
 		}
 	}
-	return fmt.Errorf("no supported login flows")
+	switch {
+	case supportsSSO && (len(password) == 0 || !supportsPassword):
+		return c.SingleSignOn()
+	case supportsPassword && len(password) == 0:
+		return fmt.Errorf("the homeserver doesn't support single sign-on, please enter a password")
+	case supportsPassword:
+		return c.PasswordLogin(user, password)
+	default:
+		return fmt.Errorf("no supported login flows")
+	}
+}
+
+// Logout revokes the access token, stops the syncer, deletes the local session data and calls the OnLogout() method
+// of the UI. If keepKeys is true, the crypto store is kept, so the keys in it aren't lost. Nothing is deleted if
+// revoking the access token fails.
+func (c *Container) Logout(keepKeys bool) error {
+	_, err := c.client.Logout()
+	if err != nil && !errors.Is(err, mautrix.MUnknownToken) {
+		return err
+	}
+	c.stopAndWait()
+	c.clearSession(keepKeys)
+	return nil
 }
 
-// Logout revokes the access token, stops the syncer and calls the OnLogout() method of the UI.
-func (c *Container) Logout() {
-	c.client.Logout()
-	c.Stop()
-	c.config.DeleteSession()
+// clearSession deletes the local data of a session that has already been invalidated on the server. The syncer must
+// be stopped before calling this.
+func (c *Container) clearSession(keepKeys bool) {
+	if c.history != nil {
+		_ = c.history.Close()
+		c.history = nil
+	}
 	c.client = nil
-	c.crypto = nil
+	// The crypto store is flushed and closed before the session data is deleted, so the olm account can't be written
+	// back halfway through deleting it.
+	c.closeCrypto()
+	c.config.DeleteSession(keepKeys)
+	c.keyRequests.reset()
+	c.undecryptable.reset()
+	c.verificationRequests.reset()
+	c.clearPresence()
+	c.ignored.lock.Lock()
+	c.ignored.users = nil
+	c.ignored.lock.Unlock()
 	c.ui.OnLogout()
 }
 
+// RotateDevice logs in as a new device of the current user with the given password and switches the client to it.
+// The old device is not logged out. The crypto machine is recreated, so any references to the old one must be dropped.
+func (c *Container) RotateDevice(password string) (oldDeviceID id.DeviceID, err error) {
+	resp, err := c.client.Login(&mautrix.ReqLogin{
+		Type: "m.login.password",
+		Identifier: mautrix.UserIdentifier{
+			Type: "m.id.user",
+			User: c.config.UserID.String(),
+		},
+		Password:                 password,
+		InitialDeviceDisplayName: "gomuks",
+	})
+	if err != nil {
+		return "", err
+	}
+	oldDeviceID = c.config.DeviceID
+	c.config.DeviceID = resp.DeviceID
+	c.config.AccessToken = resp.AccessToken
+	c.config.Save()
+	return oldDeviceID, c.InitClient()
+}
+
+// stopAndWait stops the syncer and waits for the sync loop to exit, so that an in-flight sync response isn't processed
+// after the session has been changed.
+func (c *Container) stopAndWait() {
+	c.stop(true)
+}
+
 // Stop stops the Matrix syncer.
 func (c *Container) Stop() {
-	if c.running {
-		debug.Print("Stopping Matrix container...")
-		select {
-		case c.stop <- true:
-		default:
-		}
+	c.stop(false)
+}
+
+func (c *Container) stop(wait bool) {
+	c.syncLock.Lock()
+	cancel, done := c.syncCancel, c.syncDone
+	c.syncCancel, c.syncDone = nil, nil
+	c.syncLock.Unlock()
+	if cancel == nil {
+		return
+	}
+	debug.Print("Stopping Matrix container...")
+	cancel()
+	if c.client != nil {
 		c.client.StopSync()
+	}
+	if wait {
+		// Cancelling the context aborts the sync request, but a response that's already being processed is finished.
+		<-done
+	}
+	if c.history != nil {
 		debug.Print("Closing history manager...")
 		err := c.history.Close()
 		if err != nil {
 			debug.Print("Error closing history manager:", err)
 		}
 		c.history = nil
-		if c.crypto != nil {
-			debug.Print("Flushing crypto store")
-			err = c.crypto.FlushStore()
-			if err != nil {
-				debug.Print("Error flushing crypto store:", err)
-			}
+	}
+	if c.crypto != nil {
+		debug.Print("Flushing crypto store")
+		err := c.crypto.FlushStore()
+		if err != nil {
+			debug.Print("Error flushing crypto store:", err)
 		}
 	}
 }
@@ -346,11 +444,13 @@ func (c *Container) OnLogin() {
 	c.ui.OnLogin()
 
 	c.client.Store = c.config
+	go c.checkPresenceSupport()
+	go c.loadIgnoredUsers()
 
 	debug.Print("Initializing syncer")
 	c.syncer = NewGomuksSyncer(c.config.Rooms)
 	if c.crypto != nil {
-		c.syncer.OnSync(c.crypto.ProcessSyncResponse)
+		c.syncer.OnSync(c.processCryptoSync)
 		c.syncer.OnEventType(event.StateMember, func(source mautrix.EventSource, evt *event.Event) {
 			// Don't spam the crypto module with member events of an initial sync
 			// TODO invalidate all group sessions when clearing cache?
@@ -359,6 +459,7 @@ func (c *Container) OnLogin() {
 			}
 		})
 		c.syncer.OnEventType(event.EventEncrypted, c.HandleEncrypted)
+		c.enablePhraseVerification(c.config.SharedSecretVerification)
 	} else {
 		c.syncer.OnEventType(event.EventEncrypted, c.HandleEncryptedUnsupported)
 	}
@@ -370,13 +471,20 @@ func (c *Container) OnLogin() {
 	c.syncer.OnEventType(event.StateCanonicalAlias, c.HandleMessage)
 	c.syncer.OnEventType(event.StateTopic, c.HandleMessage)
 	c.syncer.OnEventType(event.StateRoomName, c.HandleMessage)
+	c.syncer.OnEventType(event.StatePinnedEvents, c.HandleMessage)
+	c.syncer.OnEventType(event.StateTombstone, c.HandleTombstone)
 	c.syncer.OnEventType(event.StateMember, c.HandleMembership)
 	c.syncer.OnEventType(event.EphemeralEventReceipt, c.HandleReadReceipt)
 	c.syncer.OnEventType(event.EphemeralEventTyping, c.HandleTyping)
+	c.syncer.OnEventType(event.EphemeralEventPresence, c.HandlePresence)
 	c.syncer.OnEventType(event.AccountDataDirectChats, c.HandleDirectChatInfo)
+	c.syncer.OnEventType(event.AccountDataIgnoredUserList, c.HandleIgnoredUsers)
 	c.syncer.OnEventType(event.AccountDataPushRules, c.HandlePushRules)
 	c.syncer.OnEventType(event.AccountDataRoomTags, c.HandleTag)
+	c.syncer.OnEventType(event.AccountDataFullyRead, c.HandleFullyRead)
 	c.syncer.OnEventType(AccountDataGomuksPreferences, c.HandlePreferences)
+	c.syncer.OnEventType(AccountDataUserEmotes, c.HandleUserEmotes)
+	c.syncer.OnEventType(AccountDataEmoteRooms, c.HandleEmoteRooms)
 	if len(c.config.AuthCache.NextBatch) == 0 {
 		c.syncer.Progress = c.ui.MainView().OpenSyncingModal()
 		c.syncer.Progress.SetMessage("Waiting for /sync response from server")
@@ -411,6 +519,7 @@ func (c *Container) OnLogin() {
 
 	debug.Print("Setting existing rooms")
 	c.ui.MainView().SetRooms(c.config.Rooms)
+	go c.resumeOutgoing()
 
 	debug.Print("OnLogin() done.")
 }
@@ -419,6 +528,16 @@ func (c *Container) OnLogin() {
 func (c *Container) Start() {
 	defer debug.Recover()
 
+	// Each sync loop has its own context and done channel, so that a loop that's still exiting can't be confused
+	// with the loop of the next session.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	defer close(done)
+	c.syncLock.Lock()
+	c.syncCancel = cancel
+	c.syncDone = done
+	c.syncLock.Unlock()
+
 	c.OnLogin()
 
 	if c.client == nil {
@@ -426,26 +545,22 @@ func (c *Container) Start() {
 	}
 
 	debug.Print("Starting sync...")
-	c.running = true
 	c.client.StreamSyncMinAge = 30 * time.Minute
 	for {
-		select {
-		case <-c.stop:
+		err := c.client.SyncWithContext(ctx)
+		if ctx.Err() != nil {
 			debug.Print("Stopping sync...")
-			c.running = false
 			return
-		default:
-			if err := c.client.Sync(); err != nil {
-				if errors.Is(err, mautrix.MUnknownToken) {
-					debug.Print("Sync() errored with ", err, " -> logging out")
-					// TODO support soft logout
-					c.Logout()
-				} else {
-					debug.Print("Sync() errored", err)
-				}
-			} else {
-				debug.Print("Sync() returned without error")
-			}
+		} else if errors.Is(err, mautrix.MUnknownToken) {
+			debug.Print("Sync() errored with ", err, " -> logging out")
+			// TODO support soft logout
+			c.Stop()
+			c.clearSession(false)
+			return
+		} else if err != nil {
+			debug.Print("Sync() errored", err)
+		} else {
+			debug.Print("Sync() returned without error")
 		}
 	}
 }
@@ -479,8 +594,34 @@ func (c *Container) SendPreferencesToMatrix() {
 	}
 }
 
+// HandleTombstone is the event handler for the m.room.tombstone event, which is sent when a room is upgraded.
+func (c *Container) HandleTombstone(source mautrix.EventSource, evt *event.Event) {
+	c.HandleMessage(source, evt)
+	if source&mautrix.EventSourceLeave != 0 || !c.config.AuthCache.InitialSyncDone {
+		return
+	}
+	if roomView := c.ui.MainView().GetRoom(evt.RoomID); roomView != nil {
+		// Show the upgrade banner
+		roomView.Update()
+		c.ui.Render()
+	}
+}
+
 func (c *Container) HandleRedaction(source mautrix.EventSource, evt *event.Event) {
 	room := c.GetOrCreateRoom(evt.RoomID)
+	if reactedEvt, err := c.history.RemoveReaction(room, evt.Redacts); !errors.Is(err, EventNotFoundError) {
+		if err != nil {
+			debug.Print("Failed to remove redacted reaction", evt.Redacts, "from history db:", err)
+		} else if reactedEvt != nil && c.config.AuthCache.InitialSyncDone && room.Loaded() {
+			if roomView := c.ui.MainView().GetRoom(evt.RoomID); roomView != nil {
+				roomView.UpdateReactions(reactedEvt)
+				if c.syncer.FirstSyncDone {
+					c.ui.Render()
+				}
+			}
+		}
+		return
+	}
 	var redactedEvt *muksevt.Event
 	err := c.history.Update(room, evt.Redacts, func(redacted *muksevt.Event) error {
 		redacted.Unsigned.RedactedBecause = evt
@@ -542,19 +683,16 @@ func (c *Container) HandleEdit(room *rooms.Room, editsID id.EventID, editEvent *
 
 func (c *Container) HandleReaction(room *rooms.Room, reactsTo id.EventID, reactEvent *muksevt.Event) {
 	rel := reactEvent.Content.AsReaction().RelatesTo
-	var origEvt *muksevt.Event
-	err := c.history.Update(room, reactsTo, func(evt *muksevt.Event) error {
-		if evt.Unsigned.Relations.Annotations.Map == nil {
-			evt.Unsigned.Relations.Annotations.Map = make(map[string]int)
-		}
-		val, _ := evt.Unsigned.Relations.Annotations.Map[rel.Key]
-		evt.Unsigned.Relations.Annotations.Map[rel.Key] = val + 1
-		origEvt = evt
-		return nil
+	origEvt, err := c.history.AddReaction(room, reactEvent.ID, reactsTo, muksevt.Reaction{
+		Key:    rel.Key,
+		Sender: reactEvent.Sender,
 	})
 	if err != nil {
 		debug.Print("Failed to store reaction in history db:", err)
 		return
+	} else if origEvt == nil {
+		// The reacted event isn't loaded yet (the reaction is applied when it is), or the reaction is a duplicate
+		return
 	} else if !c.config.AuthCache.InitialSyncDone || !room.Loaded() {
 		return
 	}
@@ -565,7 +703,7 @@ func (c *Container) HandleReaction(room *rooms.Room, reactsTo id.EventID, reactE
 		return
 	}
 
-	roomView.AddReaction(origEvt, rel.Key)
+	roomView.UpdateReactions(origEvt)
 	if c.syncer.FirstSyncDone {
 		c.ui.Render()
 	}
@@ -584,6 +722,7 @@ func (c *Container) HandleEncrypted(source mautrix.EventSource, mxEvent *event.E
 		debug.Printf("Failed to decrypt event %s: %v", mxEvent.ID, err)
 		mxEvent.Type = muksevt.EventBadEncrypted
 		origContent, _ := mxEvent.Content.Parsed.(*event.EncryptedEventContent)
+		c.markUndecryptable(mxEvent, origContent, err)
 		mxEvent.Content.Parsed = &muksevt.BadEncryptedContent{
 			Original: origContent,
 			Reason:   err.Error(),
@@ -592,6 +731,7 @@ func (c *Container) HandleEncrypted(source mautrix.EventSource, mxEvent *event.E
 		return
 	}
 	if evt.Type.IsInRoomVerification() {
+		c.logVerificationEvent("Received in-room", evt)
 		err := c.crypto.ProcessInRoomVerification(evt)
 		if err != nil {
 			debug.Printf("[Crypto/Error] Failed to process in-room verification event %s of type %s: %v", evt.ID, evt.Type.String(), err)
@@ -645,7 +785,7 @@ func (c *Container) HandleMessage(source mautrix.EventSource, mxEvent *event.Eve
 	}
 
 	if !room.Loaded() {
-		pushRules := c.PushRules().GetActions(room, evt.Event).Should()
+		pushRules := c.getPushActions(room, evt.Event).Should()
 		shouldNotify := pushRules.Notify || !pushRules.NotifySpecified
 		if !shouldNotify {
 			room.LastReceivedMessage = time.Unix(evt.Timestamp/1000, evt.Timestamp%1000*1000)
@@ -659,7 +799,7 @@ func (c *Container) HandleMessage(source mautrix.EventSource, mxEvent *event.Eve
 	if message != nil {
 		roomView.MxRoom().LastReceivedMessage = message.Time()
 		if c.syncer.FirstSyncDone && evt.Sender != c.config.UserID {
-			pushRules := c.PushRules().GetActions(roomView.MxRoom(), evt.Event).Should()
+			pushRules := c.getPushActions(roomView.MxRoom(), evt.Event).Should()
 			mainView.NotifyMessage(roomView.MxRoom(), message, pushRules)
 			c.ui.Render()
 		}
@@ -740,25 +880,83 @@ func (c *Container) parseReadReceipt(evt *event.Event) (largestTimestampEvent id
 	return
 }
 
+// parseOtherReadReceipts returns the newest event each other user has read according to the given receipt event.
+func (c *Container) parseOtherReadReceipts(evt *event.Event) map[id.UserID]id.EventID {
+	timestamps := make(map[id.UserID]int64)
+	lastRead := make(map[id.UserID]id.EventID)
+	for eventID, receipts := range *evt.Content.AsReceipt() {
+		for userID, info := range receipts.Read {
+			if userID == c.config.UserID {
+				continue
+			} else if ts, ok := timestamps[userID]; !ok || info.Timestamp > ts {
+				timestamps[userID] = info.Timestamp
+				lastRead[userID] = eventID
+			}
+		}
+	}
+	return lastRead
+}
+
 func (c *Container) HandleReadReceipt(source mautrix.EventSource, evt *event.Event) {
 	if source&mautrix.EventSourceLeave != 0 {
 		return
 	}
 
-	lastReadEvent := c.parseReadReceipt(evt)
-	if len(lastReadEvent) == 0 {
+	room := c.GetRoom(evt.RoomID)
+	if room == nil {
+		return
+	}
+	changed := false
+	if lastReadEvent := c.parseReadReceipt(evt); len(lastReadEvent) > 0 {
+		room.MarkRead(lastReadEvent)
+		changed = true
+	}
+	receiptsChanged := false
+	for userID, eventID := range c.parseOtherReadReceipts(evt) {
+		if room.SetReadReceipt(userID, eventID) {
+			receiptsChanged = true
+		}
+	}
+	if !c.config.AuthCache.InitialSyncDone {
 		return
 	}
+	if receiptsChanged && room.Loaded() {
+		if roomView := c.ui.MainView().GetRoom(evt.RoomID); roomView != nil {
+			roomView.UpdateReadReceipts()
+			changed = true
+		}
+	}
+	if changed {
+		c.ui.Render()
+	}
+}
 
+// HandleFullyRead is the event handler for the m.fully_read room account data event.
+func (c *Container) HandleFullyRead(_ mautrix.EventSource, evt *event.Event) {
 	room := c.GetRoom(evt.RoomID)
-	if room != nil {
-		room.MarkRead(lastReadEvent)
-		if c.config.AuthCache.InitialSyncDone {
+	if room == nil || !room.SetFullyRead(evt.Content.AsFullyRead().EventID) {
+		return
+	}
+	if c.config.AuthCache.InitialSyncDone && room.Loaded() {
+		if roomView := c.ui.MainView().GetRoom(evt.RoomID); roomView != nil {
+			roomView.UpdateFullyRead()
 			c.ui.Render()
 		}
 	}
 }
 
+// SetFullyRead moves the fully read marker of the room to the given event. The read receipt isn't changed.
+func (c *Container) SetFullyRead(roomID id.RoomID, eventID id.EventID) error {
+	err := c.client.SetReadMarkers(roomID, map[string]interface{}{"m.fully_read": eventID})
+	if err != nil {
+		return err
+	}
+	if room := c.GetRoom(roomID); room != nil {
+		room.SetFullyRead(eventID)
+	}
+	return nil
+}
+
 func (c *Container) parseDirectChatInfo(evt *event.Event) map[*rooms.Room]id.UserID {
 	directChats := make(map[*rooms.Room]id.UserID)
 	for userID, roomIDList := range *evt.Content.AsDirectChats() {
@@ -844,8 +1042,8 @@ func (c *Container) MarkRead(roomID id.RoomID, eventID id.EventID) {
 	}()
 }
 
-func (c *Container) PrepareMediaMessage(room *rooms.Room, path string, rel *ifc.Relation) (*muksevt.Event, error) {
-	resp, err := c.UploadMedia(path, room.Encrypted)
+func (c *Container) PrepareMediaMessage(room *rooms.Room, path string, rel *ifc.Relation, progress ifc.UploadProgressFunc) (*muksevt.Event, error) {
+	resp, err := c.UploadMedia(path, room.Encrypted, progress)
 	if err != nil {
 		return nil, err
 	}
@@ -863,10 +1061,10 @@ func (c *Container) PrepareMediaMessage(room *rooms.Room, path string, rel *ifc.
 		content.URL = resp.ContentURI.CUString()
 	}
 
-	return c.prepareEvent(room.ID, &content, rel), nil
+	return c.prepareEvent(room.ID, &content, rel)
 }
 
-func (c *Container) PrepareMarkdownMessage(roomID id.RoomID, msgtype event.MessageType, text, html string, rel *ifc.Relation) *muksevt.Event {
+func (c *Container) PrepareMarkdownMessage(roomID id.RoomID, msgtype event.MessageType, text, html string, rel *ifc.Relation) (*muksevt.Event, error) {
 	var content event.MessageEventContent
 	if html != "" {
 		content = event.MessageEventContent{
@@ -878,12 +1076,72 @@ func (c *Container) PrepareMarkdownMessage(roomID id.RoomID, msgtype event.Messa
 	} else {
 		content = format.RenderMarkdown(text, !c.config.Preferences.DisableMarkdown, !c.config.Preferences.DisableHTML)
 		content.MsgType = msgtype
+		if !c.config.Preferences.DisableMarkdown {
+			c.replaceCustomEmotes(roomID, &content)
+		}
 	}
 
 	return c.prepareEvent(roomID, &content, rel)
 }
 
-func (c *Container) prepareEvent(roomID id.RoomID, content *event.MessageEventContent, rel *ifc.Relation) *muksevt.Event {
+// PrepareLocationMessage makes a static m.location message. The body is the description, or the geo URI itself for
+// clients that don't render locations if there's no description.
+func (c *Container) PrepareLocationMessage(roomID id.RoomID, geoURI, description string, rel *ifc.Relation) (*muksevt.Event, error) {
+	content := event.MessageEventContent{
+		MsgType: event.MsgLocation,
+		Body:    description,
+		GeoURI:  geoURI,
+	}
+	if len(content.Body) == 0 {
+		content.Body = geoURI
+	}
+	return c.prepareEvent(roomID, &content, rel)
+}
+
+// setReply makes the content a reply to the event of the relation. If the relation has a quote, the reply fallback
+// only contains the quoted part of the message instead of the whole message.
+func setReply(content *event.MessageEventContent, rel *ifc.Relation) {
+	if len(strings.TrimSpace(rel.Quote)) == 0 {
+		content.SetReply(rel.Event.Event)
+		return
+	}
+	content.RelatesTo = &event.RelatesTo{
+		EventID: rel.Event.ID,
+		Type:    event.RelReply,
+	}
+	if content.MsgType != event.MsgText && content.MsgType != event.MsgNotice {
+		return
+	}
+	quote := strings.TrimSpace(rel.Quote)
+	lines := strings.Split(quote, "\n")
+	var fallbackText strings.Builder
+	_, _ = fmt.Fprintf(&fallbackText, "> <%s> %s", rel.Event.Sender, lines[0])
+	for _, line := range lines[1:] {
+		_, _ = fmt.Fprintf(&fallbackText, "\n> %s", line)
+	}
+	fallbackText.WriteString("\n\n")
+	fallbackHTML := fmt.Sprintf(event.ReplyFormat, rel.Event.RoomID, rel.Event.ID, rel.Event.Sender, rel.Event.Sender,
+		strings.ReplaceAll(html.EscapeString(quote), "\n", "<br/>"))
+
+	content.EnsureHasHTML()
+	content.FormattedBody = fallbackHTML + content.FormattedBody
+	content.Body = fallbackText.String() + content.Body
+}
+
+// PreparePlainMessage makes a message with only a plaintext body. The text is sent as-is without markdown processing.
+func (c *Container) PreparePlainMessage(roomID id.RoomID, msgtype event.MessageType, text string, rel *ifc.Relation) (*muksevt.Event, error) {
+	content := event.MessageEventContent{
+		MsgType: msgtype,
+		Body:    text,
+	}
+	return c.prepareEvent(roomID, &content, rel)
+}
+
+// prepareEvent runs the outgoing message hooks on the content, adds the relation and wraps it in a local echo event.
+func (c *Container) prepareEvent(roomID id.RoomID, content *event.MessageEventContent, rel *ifc.Relation) (*muksevt.Event, error) {
+	if err := c.runOutgoingHooks(roomID, content); err != nil {
+		return nil, err
+	}
 	if rel != nil && rel.Type == event.RelReplace {
 		contentCopy := *content
 		content.NewContent = &contentCopy
@@ -896,7 +1154,25 @@ func (c *Container) prepareEvent(roomID id.RoomID, content *event.MessageEventCo
 			EventID: rel.Event.ID,
 		}
 	} else if rel != nil && rel.Type == event.RelReply {
-		content.SetReply(rel.Event.Event)
+		setReply(content, rel)
+	}
+	var rawContent map[string]interface{}
+	if rel != nil && rel.Type == muksevt.RelThread {
+		// Clients that don't support threads see the message as a normal reply
+		setReply(content, rel)
+		content.RelatesTo = &event.RelatesTo{
+			Type:    muksevt.RelThread,
+			EventID: rel.ThreadRoot,
+		}
+		// The reply fallback fields aren't supported by event.RelatesTo, so they're merged in from the raw content
+		rawContent = map[string]interface{}{
+			"m.relates_to": map[string]interface{}{
+				"is_falling_back": true,
+				"m.in_reply_to": map[string]interface{}{
+					"event_id": rel.Event.ID,
+				},
+			},
+		}
 	}
 
 	txnID := c.client.TxnID()
@@ -906,7 +1182,7 @@ func (c *Container) prepareEvent(roomID id.RoomID, content *event.MessageEventCo
 		Type:      event.EventMessage,
 		Timestamp: time.Now().UnixNano() / 1e6,
 		RoomID:    roomID,
-		Content:   event.Content{Parsed: content},
+		Content:   event.Content{Parsed: content, Raw: rawContent},
 		Unsigned:  event.Unsigned{TransactionID: txnID},
 	})
 	localEcho.Gomuks.OutgoingState = muksevt.StateLocalEcho
@@ -914,7 +1190,7 @@ func (c *Container) prepareEvent(roomID id.RoomID, content *event.MessageEventCo
 		localEcho.ID = rel.Event.ID
 		localEcho.Gomuks.Edits = []*muksevt.Event{localEcho}
 	}
-	return localEcho
+	return localEcho, nil
 }
 
 func (c *Container) Redact(roomID id.RoomID, eventID id.EventID, reason string) error {
@@ -923,12 +1199,54 @@ func (c *Container) Redact(roomID id.RoomID, eventID id.EventID, reason string)
 	return err
 }
 
-// SendMessage sends the given event.
+// PinnedEvents fetches the IDs of the pinned messages in the given room from the server.
+func (c *Container) PinnedEvents(roomID id.RoomID) ([]id.EventID, error) {
+	var content event.PinnedEventsEventContent
+	err := c.client.StateEvent(roomID, event.StatePinnedEvents, "", &content)
+	if errors.Is(err, mautrix.MNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return content.Pinned, nil
+}
+
+// SetPinned pins or unpins the given message. The current pinned messages are fetched from the server first so that
+// pins made by others since the last sync aren't lost. If the message is already in the requested state, nothing is
+// sent and changed is false.
+func (c *Container) SetPinned(roomID id.RoomID, eventID id.EventID, pinned bool) (changed bool, err error) {
+	defer debug.Recover()
+	current, err := c.PinnedEvents(roomID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get current pinned messages: %w", err)
+	}
+	index := -1
+	for i, pinnedID := range current {
+		if pinnedID == eventID {
+			index = i
+			break
+		}
+	}
+	if pinned == (index >= 0) {
+		return false, nil
+	}
+	updated := make([]id.EventID, 0, len(current)+1)
+	if pinned {
+		updated = append(append(updated, current...), eventID)
+	} else {
+		updated = append(append(updated, current[:index]...), current[index+1:]...)
+	}
+	_, err = c.client.SendStateEvent(roomID, event.StatePinnedEvents, "", &event.PinnedEventsEventContent{Pinned: updated})
+	return err == nil, err
+}
+
+// SendEvent sends the given event, encrypting it first if the room is encrypted.
 func (c *Container) SendEvent(evt *muksevt.Event) (id.EventID, error) {
 	defer debug.Recover()
 
-	_, _ = c.client.UserTyping(evt.RoomID, false, 0)
-	c.typing = 0
+	c.SendTyping(evt.RoomID, false)
+	// The event itself isn't modified, so that it can be sent again if sending fails.
+	evtType, content := evt.Type, &evt.Content
 	room := c.GetRoom(evt.RoomID)
 	if room != nil && room.Encrypted && c.crypto != nil && evt.Type != event.EventReaction {
 		encrypted, err := c.crypto.EncryptMegolmEvent(evt.RoomID, evt.Type, &evt.Content)
@@ -946,17 +1264,32 @@ func (c *Container) SendEvent(evt *muksevt.Event) (id.EventID, error) {
 				return "", err
 			}
 		}
-		evt.Type = event.EventEncrypted
-		evt.Content = event.Content{Parsed: encrypted}
+		evtType = event.EventEncrypted
+		content = &event.Content{Parsed: encrypted}
 	}
-	resp, err := c.client.SendMessageEvent(evt.RoomID, evt.Type, &evt.Content, mautrix.ReqSendEvent{TransactionID: evt.Unsigned.TransactionID})
+	resp, err := c.client.SendMessageEvent(evt.RoomID, evtType, content, mautrix.ReqSendEvent{TransactionID: evt.Unsigned.TransactionID})
 	if err != nil {
 		return "", err
 	}
 	return resp.EventID, nil
 }
 
-func (c *Container) UploadMedia(path string, encrypt bool) (*ifc.UploadedMediaInfo, error) {
+// progressReader calls the given function after every read with the total number of bytes read so far.
+type progressReader struct {
+	reader   io.Reader
+	read     int64
+	total    int64
+	progress ifc.UploadProgressFunc
+}
+
+func (pr *progressReader) Read(p []byte) (n int, err error) {
+	n, err = pr.reader.Read(p)
+	pr.read += int64(n)
+	pr.progress(pr.read, pr.total)
+	return
+}
+
+func (c *Container) UploadMedia(path string, encrypt bool, progress ifc.UploadProgressFunc) (*ifc.UploadedMediaInfo, error) {
 	var err error
 	path, err = filepath.Abs(path)
 	if err != nil {
@@ -972,24 +1305,27 @@ func (c *Container) UploadMedia(path string, encrypt bool) (*ifc.UploadedMediaIn
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file: %w", err)
 	}
+	defer file.Close()
 
 	stat, err := file.Stat()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get file info: %w", err)
 	}
+	info.Size = int(stat.Size())
 
 	uploadFileName := stat.Name()
 	uploadMimeType := info.MimeType
 
-	var content io.Reader
+	var content io.Reader = file
+	if progress != nil {
+		content = &progressReader{reader: file, total: stat.Size(), progress: progress}
+	}
 	var encryptionInfo *attachment.EncryptedFile
 	if encrypt {
 		uploadMimeType = "application/octet-stream"
 		uploadFileName = ""
 		encryptionInfo = attachment.NewEncryptedFile()
-		content = encryptionInfo.EncryptStream(file)
-	} else {
-		content = file
+		content = encryptionInfo.EncryptStream(content)
 	}
 
 	resp, err := c.client.UploadMedia(mautrix.ReqUploadMedia{
@@ -1017,16 +1353,29 @@ func (c *Container) sendTypingAsync(roomID id.RoomID, typing bool, timeout int64
 	_, _ = c.client.UserTyping(roomID, typing, timeout)
 }
 
+// Typing notifications are sent with a timeout of typingTimeout milliseconds and resent every typingResendInterval
+// seconds while the user keeps typing, so the server doesn't get a request for every keypress.
+const (
+	typingTimeout        = 20000
+	typingResendInterval = 15
+)
+
 // SendTyping sets whether or not the user is typing in the given room.
 func (c *Container) SendTyping(roomID id.RoomID, typing bool) {
 	ts := time.Now().Unix()
+	if c.typing != 0 && c.typingRoom != roomID {
+		// The user switched rooms while typing, so stop typing in the previous room.
+		go c.sendTypingAsync(c.typingRoom, false, 0)
+		c.typing = 0
+	}
 	if (c.typing > ts && typing) || (c.typing == 0 && !typing) {
 		return
 	}
 
 	if typing {
-		go c.sendTypingAsync(roomID, true, 20000)
-		c.typing = ts + 15
+		go c.sendTypingAsync(roomID, true, typingTimeout)
+		c.typing = ts + typingResendInterval
+		c.typingRoom = roomID
 	} else {
 		go c.sendTypingAsync(roomID, false, 0)
 		c.typing = 0
@@ -1044,8 +1393,20 @@ func (c *Container) CreateRoom(req *mautrix.ReqCreateRoom) (*rooms.Room, error)
 }
 
 // JoinRoom makes the current user try to join the given room.
-func (c *Container) JoinRoom(roomID id.RoomID, server string) (*rooms.Room, error) {
-	resp, err := c.client.JoinRoom(string(roomID), server, nil)
+func (c *Container) JoinRoom(roomID id.RoomID, via ...string) (*rooms.Room, error) {
+	// mautrix only supports one server name, so the URL is built here to allow passing several.
+	query := url.Values{}
+	for _, server := range via {
+		if len(server) > 0 {
+			query.Add("server_name", server)
+		}
+	}
+	urlPath := c.client.BuildClientURL("v3", "join", roomID)
+	if len(query) > 0 {
+		urlPath += "?" + query.Encode()
+	}
+	var resp mautrix.RespJoinRoom
+	_, err := c.client.MakeRequest("POST", urlPath, struct{}{}, &resp)
 	if err != nil {
 		return nil, err
 	}
@@ -1119,6 +1480,7 @@ func (c *Container) GetHistory(room *rooms.Room, limit int, dbPointer uint64) ([
 					debug.Printf("Failed to decrypt event %s: %v", evt.ID, err)
 					evt.Type = muksevt.EventBadEncrypted
 					origContent, _ := evt.Content.Parsed.(*event.EncryptedEventContent)
+					c.markUndecryptable(evt, origContent, err)
 					evt.Content.Parsed = &muksevt.BadEncryptedContent{
 						Original: origContent,
 						Reason:   err.Error(),
@@ -1175,6 +1537,28 @@ func (c *Container) GetRoom(roomID id.RoomID) *rooms.Room {
 	return c.config.Rooms.Get(roomID)
 }
 
+// GetProfile resolves the display name and avatar URL of a user. The member event in the given room is preferred
+// if the room is known, otherwise the global profile is fetched from the server.
+func (c *Container) GetProfile(roomID id.RoomID, userID id.UserID) (displayname string, avatarURL id.ContentURIString) {
+	if len(roomID) > 0 {
+		if room := c.GetRoom(roomID); room != nil {
+			if member := room.GetMember(userID); member != nil && len(member.Displayname) > 0 {
+				return member.Displayname, member.AvatarURL
+			}
+		}
+	}
+	var profile struct {
+		Displayname string              `json:"displayname"`
+		AvatarURL   id.ContentURIString `json:"avatar_url"`
+	}
+	_, err := c.client.MakeRequest("GET", c.client.BuildClientURL("v3", "profile", userID), nil, &profile)
+	if err != nil {
+		debug.Printf("Failed to fetch profile of %s: %v", userID, err)
+		return "", ""
+	}
+	return profile.Displayname, profile.AvatarURL
+}
+
 func cp(src, dst string) error {
 	in, err := os.Open(src)
 	if err != nil {
@@ -1195,6 +1579,25 @@ func cp(src, dst string) error {
 	return out.Close()
 }
 
+// uniqueFilePath returns the given path, or if a file already exists there, the path with the lowest counter
+// appended to the file name that doesn't exist yet.
+func uniqueFilePath(fullPath string) string {
+	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+		return fullPath
+	}
+	ext := path.Ext(fullPath)
+	base := strings.TrimSuffix(fullPath, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s-%d%s", base, i, ext)
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// DownloadToDisk downloads the given file into the media cache and copies it to the target path. Relative targets
+// are resolved relative to the download directory. If a file already exists at the target path, a counter is
+// appended to the file name.
 func (c *Container) DownloadToDisk(uri id.ContentURI, file *attachment.EncryptedFile, target string) (fullPath string, err error) {
 	cachePath := c.GetCachePath(uri)
 	if target == "" {
@@ -1237,6 +1640,7 @@ func (c *Container) DownloadToDisk(uri id.ContentURI, file *attachment.Encrypted
 		if err != nil {
 			return
 		}
+		fullPath = uniqueFilePath(fullPath)
 		err = cp(cachePath, fullPath)
 	}
 
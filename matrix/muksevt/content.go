@@ -26,6 +26,9 @@ import (
 var EventBadEncrypted = event.Type{Type: "net.maunium.gomuks.bad_encrypted", Class: event.MessageEventType}
 var EventEncryptionUnsupported = event.Type{Type: "net.maunium.gomuks.encryption_unsupported", Class: event.MessageEventType}
 
+// RelThread is the relation type of messages in a thread (MSC3440).
+const RelThread event.RelationType = "m.thread"
+
 type BadEncryptedContent struct {
 	Original *event.EncryptedEventContent `json:"-"`
 
@@ -18,6 +18,7 @@ package muksevt
 
 import (
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
 type Event struct {
@@ -45,9 +46,22 @@ const (
 	StateDefault OutgoingState = iota
 	StateLocalEcho
 	StateSendFail
+	// StateSendRetry means sending failed with a temporary error and will be retried automatically.
+	StateSendRetry
+	// StateQueued means the event is waiting for earlier events in the same room to be sent first.
+	StateQueued
 )
 
+// Reaction is a reaction to an event. Reactions are stored with the event they react to, so that they can be
+// removed when redacted and so that own reactions can be found.
+type Reaction struct {
+	Key    string
+	Sender id.UserID
+}
+
 type GomuksContent struct {
 	OutgoingState OutgoingState
 	Edits         []*Event
+	// Reactions contains the reactions received to the event, by reaction event ID.
+	Reactions map[id.EventID]Reaction
 }
@@ -4,12 +4,72 @@
 
 package matrix
 
+import (
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	ifc "maunium.net/go/gomuks/interface"
+)
+
+var ToDevicePhraseVerification = event.Type{
+	Type:  "net.maunium.gomuks.verification.phrase",
+	Class: event.ToDeviceEventType,
+}
+
 func isBadEncryptError(err error) bool {
 	return false
 }
 
+func isMissingSessionError(err error) bool {
+	return false
+}
+
 func (c *Container) initCrypto() error {
 	return nil
 }
 
+func (c *Container) closeCrypto() {
+	c.crypto = nil
+}
+
 func (c *Container) cryptoOnLogin() {}
+
+func (c *Container) processCryptoSync(_ *mautrix.RespSync, _ string) bool {
+	return true
+}
+
+func (c *Container) enablePhraseVerification(_ bool) {}
+
+type keyRequestBuffer struct{}
+
+func (krb *keyRequestBuffer) reset() {}
+
+type verificationRequestBuffer struct{}
+
+func (vrb *verificationRequestBuffer) reset() {}
+
+type autoTrustedDevices struct{}
+
+func (c *Container) KeyRequests() []ifc.KeyRequest {
+	return nil
+}
+
+func (c *Container) FulfillKeyRequest(_ int) error {
+	return fmt.Errorf("gomuks was built without encryption support")
+}
+
+func (c *Container) RequestSession(_ id.RoomID, _ id.EventID, _ bool) (ifc.OutgoingKeyRequest, bool, error) {
+	return ifc.OutgoingKeyRequest{}, false, fmt.Errorf("gomuks was built without encryption support")
+}
+
+func (c *Container) ReplayVerificationRequest(_ id.UserID, _ string) error {
+	return fmt.Errorf("gomuks was built without encryption support")
+}
+
+func (c *Container) VerifyWithPhrase(_ id.UserID, _ id.DeviceID, _ string, _ time.Duration) (bool, error) {
+	return false, fmt.Errorf("gomuks was built without encryption support")
+}
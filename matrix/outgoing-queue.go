@@ -0,0 +1,160 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"encoding/json"
+
+	bolt "go.etcd.io/bbolt"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/matrix/muksevt"
+)
+
+// The outgoing queue is stored as JSON instead of gob like the rest of the history, so that the raw content (e.g.
+// thread reply fallbacks) is kept as-is when the event is sent after a restart.
+
+// QueueOutgoing stores an event that's about to be sent at the end of the outgoing queue of its room.
+func (hm *HistoryManager) QueueOutgoing(evt *muksevt.Event) error {
+	data, err := json.Marshal(evt.Event)
+	if err != nil {
+		return err
+	}
+	return hm.db.Update(func(tx *bolt.Tx) error {
+		queue, err := tx.Bucket(bucketOutgoingQueue).CreateBucketIfNotExists([]byte(evt.RoomID))
+		if err != nil {
+			return err
+		}
+		seq, err := queue.NextSequence()
+		if err != nil {
+			return err
+		}
+		return queue.Put(itob(seq), data)
+	})
+}
+
+// DequeueOutgoing removes the event with the given transaction ID from the outgoing queue of the room.
+func (hm *HistoryManager) DequeueOutgoing(roomID id.RoomID, txnID string) error {
+	return hm.db.Update(func(tx *bolt.Tx) error {
+		queue := tx.Bucket(bucketOutgoingQueue).Bucket([]byte(roomID))
+		if queue == nil {
+			return nil
+		}
+		var remove [][]byte
+		err := queue.ForEach(func(key, data []byte) error {
+			var queued struct {
+				Unsigned struct {
+					TransactionID string `json:"transaction_id"`
+				} `json:"unsigned"`
+			}
+			if err := json.Unmarshal(data, &queued); err != nil || queued.Unsigned.TransactionID == txnID {
+				remove = append(remove, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range remove {
+			if err = queue.Delete(key); err != nil {
+				return err
+			}
+		}
+		if key, _ := queue.Cursor().First(); key == nil {
+			return tx.Bucket(bucketOutgoingQueue).DeleteBucket([]byte(roomID))
+		}
+		return nil
+	})
+}
+
+// OutgoingQueues returns the queued outgoing events of all rooms, oldest first.
+func (hm *HistoryManager) OutgoingQueues() (map[id.RoomID][]*muksevt.Event, error) {
+	queues := make(map[id.RoomID][]*muksevt.Event)
+	err := hm.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketOutgoingQueue).ForEach(func(roomID, _ []byte) error {
+			queue := tx.Bucket(bucketOutgoingQueue).Bucket(roomID)
+			if queue == nil {
+				return nil
+			}
+			return queue.ForEach(func(_, data []byte) error {
+				var evt event.Event
+				if err := json.Unmarshal(data, &evt); err != nil {
+					debug.Print("Failed to parse queued event in", string(roomID), err)
+					return nil
+				} else if err = evt.Content.ParseRaw(evt.Type); err != nil {
+					debug.Print("Failed to parse content of queued event", evt.ID, err)
+					return nil
+				}
+				queues[id.RoomID(roomID)] = append(queues[id.RoomID(roomID)], muksevt.Wrap(&evt))
+				return nil
+			})
+		})
+	})
+	return queues, err
+}
+
+// QueueOutgoing saves an event that's about to be sent, so that sending it can be continued after a restart. The
+// event is removed from the queue with DequeueOutgoing after it has been sent or sending has failed permanently.
+func (c *Container) QueueOutgoing(evt *muksevt.Event) {
+	if c.history == nil {
+		return
+	} else if err := c.history.QueueOutgoing(evt); err != nil {
+		debug.Print("Failed to save", evt.Unsigned.TransactionID, "to the outgoing queue:", err)
+	}
+}
+
+// DequeueOutgoing removes an event from the saved outgoing queue.
+func (c *Container) DequeueOutgoing(evt *muksevt.Event) {
+	if c.history == nil {
+		return
+	} else if err := c.history.DequeueOutgoing(evt.RoomID, evt.Unsigned.TransactionID); err != nil {
+		debug.Print("Failed to remove", evt.Unsigned.TransactionID, "from the outgoing queue:", err)
+	}
+}
+
+// resumeOutgoing gives the events that were left in the outgoing queues when gomuks was last closed to the room
+// views, which send them again with the same transaction IDs, so that events that had already reached the server
+// aren't duplicated.
+func (c *Container) resumeOutgoing() {
+	defer debug.Recover()
+	if c.history == nil {
+		return
+	}
+	queues, err := c.history.OutgoingQueues()
+	if err != nil {
+		debug.Print("Failed to load outgoing queues:", err)
+		return
+	}
+	for roomID, evts := range queues {
+		room := c.GetRoom(roomID)
+		if room == nil || room.HasLeft {
+			debug.Printf("Dropping %d queued events in %s, as the room has been left", len(evts), roomID)
+			for _, evt := range evts {
+				c.DequeueOutgoing(evt)
+			}
+			continue
+		}
+		debug.Printf("Resuming sending %d queued events in %s", len(evts), roomID)
+		for _, evt := range evts {
+			evt.Gomuks.OutgoingState = muksevt.StateQueued
+		}
+		c.ui.MainView().GetRoom(roomID).ResumeSending(evts)
+	}
+}
@@ -0,0 +1,190 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build cgo
+
+package matrix
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/debug"
+)
+
+// ToDevicePhraseVerification is a gomuks-specific to-device event containing a commitment to a shared secret phrase.
+// It's always sent Olm-encrypted, so only the target device can see the commitment.
+//
+// This is NOT a standard verification method. A weak phrase can be brute forced from the commitment by the device
+// that receives it, so it's much weaker than SAS or cross-signing.
+var ToDevicePhraseVerification = event.Type{
+	Type:  "net.maunium.gomuks.verification.phrase",
+	Class: event.ToDeviceEventType,
+}
+
+// PhraseVerificationEventContent is the content of a ToDevicePhraseVerification event.
+type PhraseVerificationEventContent struct {
+	UserID     id.UserID   `json:"user_id"`
+	DeviceID   id.DeviceID `json:"device_id"`
+	Commitment string      `json:"commitment"`
+}
+
+// UnmarshalJSON parses the content and passes it to the waiting VerifyWithPhrase call.
+//
+// The crypto machine drops decrypted to-device events of unknown types after parsing them, so parsing is the only
+// point where gomuks can see the content of encrypted phrase verification events. Unencrypted phrase verification
+// events are removed from the sync response by processCryptoSync before the crypto machine parses them, so everything
+// that gets here came through Olm.
+func (content *PhraseVerificationEventContent) UnmarshalJSON(data []byte) error {
+	type rawContent PhraseVerificationEventContent
+	err := json.Unmarshal(data, (*rawContent)(content))
+	if err != nil {
+		return err
+	}
+	phraseVerifications.receive(content)
+	return nil
+}
+
+func init() {
+	event.TypeMap[ToDevicePhraseVerification] = reflect.TypeOf(PhraseVerificationEventContent{})
+}
+
+// dropPlaintextPhraseVerifications removes unencrypted phrase verification events from the to-device events of a sync
+// response. The commitments must be encrypted, so unencrypted ones are either from an older gomuks version or forged.
+func dropPlaintextPhraseVerifications(evts []*event.Event) []*event.Event {
+	filtered := evts[:0]
+	for _, evt := range evts {
+		if evt.Type.Type == ToDevicePhraseVerification.Type {
+			debug.Printf("Dropping unencrypted phrase verification event from %s", evt.Sender)
+			continue
+		}
+		filtered = append(filtered, evt)
+	}
+	return filtered
+}
+
+type phraseVerificationState struct {
+	lock     sync.Mutex
+	enabled  bool
+	received map[string][]byte
+	waiters  map[string]chan []byte
+}
+
+var phraseVerifications = phraseVerificationState{
+	received: make(map[string][]byte),
+	waiters:  make(map[string]chan []byte),
+}
+
+func phraseVerificationKey(userID id.UserID, deviceID id.DeviceID) string {
+	return fmt.Sprintf("%s|%s", userID, deviceID)
+}
+
+// phraseCommitment calculates the commitment that the sender sends to the recipient. Both device keys are included,
+// so the commitments only match if both sides know the phrase and see the same keys.
+func phraseCommitment(phrase string, sender, recipient *crypto.DeviceIdentity) []byte {
+	mac := hmac.New(sha256.New, []byte(phrase))
+	_, _ = fmt.Fprintf(mac, "%s|%s|%s|%s|%s|%s",
+		sender.UserID, sender.DeviceID, sender.SigningKey,
+		recipient.UserID, recipient.DeviceID, recipient.SigningKey)
+	return mac.Sum(nil)
+}
+
+// enablePhraseVerification sets whether phrase verification commitments from other devices are stored before a
+// verification is started locally.
+func (c *Container) enablePhraseVerification(enabled bool) {
+	phraseVerifications.setEnabled(enabled)
+}
+
+func (state *phraseVerificationState) setEnabled(enabled bool) {
+	state.lock.Lock()
+	state.enabled = enabled
+	if !enabled {
+		state.received = make(map[string][]byte)
+	}
+	state.lock.Unlock()
+}
+
+func (state *phraseVerificationState) receive(content *PhraseVerificationEventContent) {
+	commitment, err := base64.RawStdEncoding.DecodeString(content.Commitment)
+	if err != nil || len(content.UserID) == 0 || len(content.DeviceID) == 0 {
+		debug.Printf("Invalid phrase verification event from %s/%s: %v", content.UserID, content.DeviceID, err)
+		return
+	}
+	key := phraseVerificationKey(content.UserID, content.DeviceID)
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if waiter, ok := state.waiters[key]; ok {
+		delete(state.waiters, key)
+		waiter <- commitment
+	} else if state.enabled {
+		state.received[key] = commitment
+	}
+}
+
+// VerifyWithPhrase sends a commitment to the shared secret phrase to the given device and waits for the device to
+// send its own commitment. It returns true if the commitment of the other device matches the phrase and device keys.
+func (c *Container) VerifyWithPhrase(userID id.UserID, deviceID id.DeviceID, phrase string, timeout time.Duration) (bool, error) {
+	mach := c.crypto.(*crypto.OlmMachine)
+	device, err := mach.GetOrFetchDevice(userID, deviceID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get device: %w", err)
+	}
+	own := mach.OwnIdentity()
+	content := event.Content{Parsed: &PhraseVerificationEventContent{
+		UserID:     own.UserID,
+		DeviceID:   own.DeviceID,
+		Commitment: base64.RawStdEncoding.EncodeToString(phraseCommitment(phrase, own, device)),
+	}}
+
+	key := phraseVerificationKey(userID, deviceID)
+	waiter := make(chan []byte, 1)
+	phraseVerifications.lock.Lock()
+	if commitment, ok := phraseVerifications.received[key]; ok {
+		delete(phraseVerifications.received, key)
+		waiter <- commitment
+	} else {
+		phraseVerifications.waiters[key] = waiter
+	}
+	phraseVerifications.lock.Unlock()
+
+	err = mach.SendEncryptedToDevice(device, ToDevicePhraseVerification, content)
+	if err != nil {
+		phraseVerifications.lock.Lock()
+		delete(phraseVerifications.waiters, key)
+		phraseVerifications.lock.Unlock()
+		return false, fmt.Errorf("failed to send commitment: %w", err)
+	}
+
+	select {
+	case commitment := <-waiter:
+		return hmac.Equal(commitment, phraseCommitment(phrase, device, own)), nil
+	case <-time.After(timeout):
+		phraseVerifications.lock.Lock()
+		delete(phraseVerifications.waiters, key)
+		phraseVerifications.lock.Unlock()
+		return false, fmt.Errorf("timed out waiting for %s/%s to enter the phrase", userID, deviceID)
+	}
+}
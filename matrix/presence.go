@@ -0,0 +1,128 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/debug"
+	ifc "maunium.net/go/gomuks/interface"
+)
+
+var mUnrecognized = mautrix.RespError{ErrCode: "M_UNRECOGNIZED"}
+
+type presenceCache struct {
+	lock  sync.RWMutex
+	users map[id.UserID]*event.PresenceEventContent
+	// disabled is set if the homeserver has turned presence off, in which case it's never sent.
+	disabled bool
+}
+
+// isPresenceDisabledError checks if a presence request failed because presence is turned off on the homeserver.
+func isPresenceDisabledError(err error) bool {
+	var httpErr mautrix.HTTPError
+	return errors.Is(err, mautrix.MForbidden) || errors.Is(err, mUnrecognized) ||
+		(errors.As(err, &httpErr) && httpErr.IsStatus(http.StatusNotFound))
+}
+
+// checkPresenceSupport fetches the presence of the current user to find out if the homeserver has presence enabled.
+func (c *Container) checkPresenceSupport() {
+	defer debug.Recover()
+	client := c.client
+	if client == nil {
+		return
+	}
+	_, err := client.GetOwnPresence()
+	disabled := isPresenceDisabledError(err)
+	c.presence.lock.Lock()
+	c.presence.disabled = disabled
+	c.presence.lock.Unlock()
+	if disabled {
+		debug.Print("Presence is disabled on the homeserver:", err)
+		// Don't tell the server we're online in every sync request either.
+		client.SyncPresence = event.PresenceOffline
+	} else if err != nil {
+		debug.Print("Failed to check presence support:", err)
+	}
+}
+
+// clearPresence forgets the presence of all users, e.g. when switching accounts.
+func (c *Container) clearPresence() {
+	c.presence.lock.Lock()
+	c.presence.users = nil
+	c.presence.disabled = false
+	c.presence.lock.Unlock()
+}
+
+// HandlePresence is the event handler for the m.presence event.
+func (c *Container) HandlePresence(_ mautrix.EventSource, evt *event.Event) {
+	content := evt.Content.AsPresence()
+	c.presence.lock.Lock()
+	if c.presence.users == nil {
+		c.presence.users = make(map[id.UserID]*event.PresenceEventContent)
+	}
+	c.presence.users[evt.Sender] = content
+	c.presence.lock.Unlock()
+	if c.syncer.FirstSyncDone {
+		c.ui.Render()
+	}
+}
+
+// PresenceEnabled returns false if the homeserver has presence turned off.
+func (c *Container) PresenceEnabled() bool {
+	c.presence.lock.RLock()
+	defer c.presence.lock.RUnlock()
+	return !c.presence.disabled
+}
+
+// GetPresence returns the last known presence of the given user, or nil if it isn't known.
+func (c *Container) GetPresence(userID id.UserID) *event.PresenceEventContent {
+	c.presence.lock.RLock()
+	defer c.presence.lock.RUnlock()
+	return c.presence.users[userID]
+}
+
+// SetPresence sets the presence and status message of the current user. The presence is also sent with every sync
+// request, so that syncing doesn't reset it back to online.
+func (c *Container) SetPresence(presence event.Presence, statusMessage string) error {
+	if !c.PresenceEnabled() {
+		return ifc.ErrPresenceDisabled
+	}
+	req := map[string]interface{}{"presence": presence}
+	if len(statusMessage) > 0 {
+		req["status_msg"] = statusMessage
+	}
+	url := c.client.BuildClientURL("v3", "presence", c.client.UserID, "status")
+	_, err := c.client.MakeRequest(http.MethodPut, url, req, nil)
+	if isPresenceDisabledError(err) {
+		c.presence.lock.Lock()
+		c.presence.disabled = true
+		c.presence.lock.Unlock()
+		c.client.SyncPresence = event.PresenceOffline
+		return ifc.ErrPresenceDisabled
+	} else if err != nil {
+		return err
+	}
+	c.client.SyncPresence = presence
+	return nil
+}
@@ -0,0 +1,297 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+
+	ifc "maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+const pushRuleScope = "global"
+
+// isDontNotifyRule checks if the given rule is enabled and only has the dont_notify action.
+func isDontNotifyRule(rule *pushrules.PushRule) bool {
+	if rule == nil || !rule.Enabled {
+		return false
+	}
+	should := rule.Actions.Should()
+	return should.NotifySpecified && !should.Notify
+}
+
+// GetRoomNotificationLevel returns the notification level of the given room based on the room-specific push rules.
+// Muting a room is done with an override rule (so that mentions are muted too), while the other levels use room rules.
+func (c *Container) GetRoomNotificationLevel(roomID id.RoomID) ifc.RoomNotificationLevel {
+	rules := c.PushRules()
+	for _, rule := range rules.Override {
+		if rule.RuleID == string(roomID) && isDontNotifyRule(rule) {
+			return ifc.NotifyNone
+		}
+	}
+	rule, ok := rules.Room.Map[string(roomID)]
+	if !ok || !rule.Enabled {
+		return ifc.NotifyDefault
+	} else if isDontNotifyRule(rule) {
+		return ifc.NotifyHighlight
+	}
+	return ifc.NotifyAll
+}
+
+func (c *Container) deleteRoomPushRule(kind pushrules.PushRuleType, roomID id.RoomID) error {
+	err := c.client.DeletePushRule(pushRuleScope, kind, string(roomID))
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return fmt.Errorf("failed to delete %s rule: %w", kind, err)
+	}
+	return nil
+}
+
+// SetRoomNotificationLevel replaces the room-specific push rules of the given room to match the given level. The
+// cached push rules and the unread counts of the room are updated right away instead of waiting for the server to
+// send the new rules, so the room list reflects the change immediately.
+func (c *Container) SetRoomNotificationLevel(roomID id.RoomID, level ifc.RoomNotificationLevel) error {
+	var overrideRule, roomRule *pushrules.PushRule
+	switch level {
+	case ifc.NotifyDefault:
+	case ifc.NotifyAll, ifc.NotifyHighlight:
+		action := pushrules.ActionNotify
+		if level == ifc.NotifyHighlight {
+			action = pushrules.ActionDontNotify
+		}
+		err := c.client.PutPushRule(pushRuleScope, pushrules.RoomRule, string(roomID), &mautrix.ReqPutPushRule{
+			Actions: []pushrules.PushActionType{action},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set room rule: %w", err)
+		}
+		roomRule = &pushrules.PushRule{
+			Type:    pushrules.RoomRule,
+			RuleID:  string(roomID),
+			Actions: pushrules.PushActionArray{{Action: action}},
+			Enabled: true,
+		}
+	case ifc.NotifyNone:
+		conditions := []pushrules.PushCondition{{
+			Kind:    pushrules.KindEventMatch,
+			Key:     "room_id",
+			Pattern: string(roomID),
+		}}
+		err := c.client.PutPushRule(pushRuleScope, pushrules.OverrideRule, string(roomID), &mautrix.ReqPutPushRule{
+			Actions:    []pushrules.PushActionType{pushrules.ActionDontNotify},
+			Conditions: conditions,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set override rule: %w", err)
+		}
+		overrideRule = &pushrules.PushRule{
+			Type:       pushrules.OverrideRule,
+			RuleID:     string(roomID),
+			Actions:    pushrules.PushActionArray{{Action: pushrules.ActionDontNotify}},
+			Enabled:    true,
+			Conditions: []*pushrules.PushCondition{&conditions[0]},
+		}
+	default:
+		return fmt.Errorf("unknown notification level %s", level)
+	}
+	if overrideRule == nil {
+		if err := c.deleteRoomPushRule(pushrules.OverrideRule, roomID); err != nil {
+			return err
+		}
+	}
+	if roomRule == nil {
+		if err := c.deleteRoomPushRule(pushrules.RoomRule, roomID); err != nil {
+			return err
+		}
+	}
+
+	c.updateCachedRoomPushRules(roomID, overrideRule, roomRule)
+	if room := c.GetRoom(roomID); room != nil {
+		room.UpdateUnread(func(msg *rooms.UnreadMessage) {
+			switch level {
+			case ifc.NotifyAll:
+				msg.Counted = true
+			case ifc.NotifyHighlight:
+				msg.Counted = msg.Highlight
+			case ifc.NotifyNone:
+				msg.Counted = false
+				msg.Highlight = false
+			}
+		})
+	}
+	c.ui.Render()
+	return nil
+}
+
+func (c *Container) updateCachedRoomPushRules(roomID id.RoomID, overrideRule, roomRule *pushrules.PushRule) {
+	rules := c.PushRules()
+	override := make(pushrules.PushRuleArray, 0, len(rules.Override)+1)
+	for _, rule := range rules.Override {
+		if rule.RuleID != string(roomID) {
+			override = append(override, rule)
+		}
+	}
+	if overrideRule != nil {
+		// User-defined override rules take priority over all default rules except the master rule.
+		index := 0
+		if len(override) > 0 && override[0].RuleID == ".m.rule.master" {
+			index = 1
+		}
+		override = append(override[:index], append(pushrules.PushRuleArray{overrideRule}, override[index:]...)...)
+	}
+	rules.Override = override
+	if rules.Room.Map == nil {
+		rules.Room = pushrules.PushRuleMap{Map: make(map[string]*pushrules.PushRule), Type: pushrules.RoomRule}
+	}
+	if roomRule != nil {
+		rules.Room.Map[string(roomID)] = roomRule
+	} else {
+		delete(rules.Room.Map, string(roomID))
+	}
+	c.config.SavePushRules()
+}
+
+var (
+	keywordRegexCache     = make(map[string]*regexp.Regexp)
+	keywordRegexCacheLock sync.Mutex
+)
+
+// compileKeywordPattern converts the glob pattern of a content push rule into a case-insensitive regex that only
+// matches whole words, so that e.g. the keyword "go" doesn't match "good".
+func compileKeywordPattern(pattern string) *regexp.Regexp {
+	keywordRegexCacheLock.Lock()
+	defer keywordRegexCacheLock.Unlock()
+	regex, ok := keywordRegexCache[pattern]
+	if !ok {
+		quoted := regexp.QuoteMeta(pattern)
+		quoted = strings.ReplaceAll(quoted, `\*`, `.*?`)
+		quoted = strings.ReplaceAll(quoted, `\?`, `.`)
+		regex = regexp.MustCompile(`(?i)(?:^|[^\p{L}\p{N}_])` + quoted + `(?:$|[^\p{L}\p{N}_])`)
+		keywordRegexCache[pattern] = regex
+	}
+	return regex
+}
+
+// matchContentRules finds the first enabled content rule whose pattern appears in the body of the event.
+func matchContentRules(rules pushrules.PushRuleArray, evt *event.Event) pushrules.PushActionArray {
+	body, ok := evt.Content.Raw["body"].(string)
+	if !ok || len(body) == 0 {
+		return nil
+	}
+	for _, rule := range rules {
+		if rule.Enabled && len(rule.Pattern) > 0 && compileKeywordPattern(rule.Pattern).MatchString(body) {
+			return rule.Actions
+		}
+	}
+	return nil
+}
+
+// getPushActions evaluates the push rules for the given event. It's the same as PushRuleset.GetActions, except that
+// content rules (keywords and the username rule) match whole words case-insensitively like the spec requires, rather
+// than matching the glob against the entire message body.
+func (c *Container) getPushActions(room pushrules.Room, evt *event.Event) pushrules.PushActionArray {
+	rules := c.PushRules()
+	if actions := rules.Override.GetActions(room, evt); actions != nil {
+		return actions
+	} else if actions = matchContentRules(rules.Content, evt); actions != nil {
+		return actions
+	}
+	remaining := pushrules.PushRuleset{
+		Room:      rules.Room,
+		Sender:    rules.Sender,
+		Underride: rules.Underride,
+	}
+	return remaining.GetActions(room, evt)
+}
+
+// IsMention checks if the push rules highlight the given event, i.e. if it mentions the current user. The user's own
+// messages never count as mentions.
+func (c *Container) IsMention(room *rooms.Room, evt *event.Event) bool {
+	return evt.Sender != c.config.UserID && c.getPushActions(room, evt).Should().Highlight
+}
+
+type reqPutContentRule struct {
+	Actions pushrules.PushActionArray `json:"actions"`
+	Pattern string                    `json:"pattern"`
+}
+
+// Keywords returns the patterns of the user-defined content push rules.
+func (c *Container) Keywords() []string {
+	var keywords []string
+	for _, rule := range c.PushRules().Content {
+		if !rule.Default {
+			keywords = append(keywords, rule.Pattern)
+		}
+	}
+	return keywords
+}
+
+// AddKeyword adds a content push rule that notifies about and highlights messages containing the given keyword.
+func (c *Container) AddKeyword(keyword string) error {
+	actions := pushrules.PushActionArray{
+		{Action: pushrules.ActionNotify},
+		{Action: pushrules.ActionSetTweak, Tweak: pushrules.TweakSound, Value: "default"},
+		{Action: pushrules.ActionSetTweak, Tweak: pushrules.TweakHighlight, Value: true},
+	}
+	url := c.client.BuildClientURL("v3", "pushrules", pushRuleScope, pushrules.ContentRule, keyword)
+	_, err := c.client.MakeRequest("PUT", url, &reqPutContentRule{Actions: actions, Pattern: keyword}, nil)
+	if err != nil {
+		return err
+	}
+	rules := c.PushRules()
+	content := pushrules.PushRuleArray{{
+		Type:    pushrules.ContentRule,
+		RuleID:  keyword,
+		Actions: actions,
+		Enabled: true,
+		Pattern: keyword,
+	}}
+	for _, rule := range rules.Content {
+		if rule.RuleID != keyword {
+			content = append(content, rule)
+		}
+	}
+	rules.Content = content
+	c.config.SavePushRules()
+	return nil
+}
+
+// RemoveKeyword removes the content push rule of the given keyword.
+func (c *Container) RemoveKeyword(keyword string) error {
+	err := c.client.DeletePushRule(pushRuleScope, pushrules.ContentRule, keyword)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return err
+	}
+	rules := c.PushRules()
+	content := make(pushrules.PushRuleArray, 0, len(rules.Content))
+	for _, rule := range rules.Content {
+		if rule.RuleID != keyword || rule.Default {
+			content = append(content, rule)
+		}
+	}
+	rules.Content = content
+	c.config.SavePushRules()
+	return nil
+}
@@ -0,0 +1,211 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/matrix/muksevt"
+)
+
+// redecryptDebounce is how long to wait for more keys to arrive before retrying decryption.
+// Key imports and backup restores can insert thousands of sessions, so retrying after each one would be wasteful.
+const redecryptDebounce = 2 * time.Second
+
+var errNotUndecryptable = errors.New("event is not an undecryptable event")
+
+type undecryptableEvent struct {
+	roomID  id.RoomID
+	eventID id.EventID
+}
+
+// undecryptableEvents keeps track of events that couldn't be decrypted because the Megolm session was missing,
+// so that they can be decrypted and re-rendered when the session arrives.
+type undecryptableEvents struct {
+	lock    sync.Mutex
+	pending map[id.SessionID][]undecryptableEvent
+	timer   *time.Timer
+}
+
+// reset forgets all pending events and cancels the scheduled decryption attempt, as the events belong to a session
+// that is being closed.
+func (ue *undecryptableEvents) reset() {
+	ue.lock.Lock()
+	ue.pending = nil
+	if ue.timer != nil {
+		ue.timer.Stop()
+		ue.timer = nil
+	}
+	ue.lock.Unlock()
+}
+
+func (c *Container) markUndecryptable(evt *event.Event, content *event.EncryptedEventContent, err error) {
+	if content == nil || len(evt.ID) == 0 || !isMissingSessionError(err) {
+		return
+	}
+	c.addUndecryptable(content.SessionID, evt.RoomID, evt.ID)
+}
+
+func (c *Container) addUndecryptable(sessionID id.SessionID, roomID id.RoomID, eventID id.EventID) {
+	c.undecryptable.lock.Lock()
+	defer c.undecryptable.lock.Unlock()
+	if c.undecryptable.pending == nil {
+		c.undecryptable.pending = make(map[id.SessionID][]undecryptableEvent)
+	}
+	for _, evt := range c.undecryptable.pending[sessionID] {
+		if evt.eventID == eventID {
+			return
+		}
+	}
+	c.undecryptable.pending[sessionID] = append(c.undecryptable.pending[sessionID], undecryptableEvent{
+		roomID:  roomID,
+		eventID: eventID,
+	})
+}
+
+// RetryDecryption schedules a new decryption attempt for events that previously failed to decrypt due to a
+// missing session. Calls are debounced, so it's safe to call this after every received key.
+func (c *Container) RetryDecryption() {
+	c.undecryptable.lock.Lock()
+	defer c.undecryptable.lock.Unlock()
+	if len(c.undecryptable.pending) == 0 {
+		return
+	} else if c.undecryptable.timer == nil {
+		c.undecryptable.timer = time.AfterFunc(redecryptDebounce, c.redecryptPending)
+	} else {
+		c.undecryptable.timer.Reset(redecryptDebounce)
+	}
+}
+
+// retryDecryptionAfterToDevice retries decryption of undecryptable events if there are encrypted to-device events,
+// as those may have contained new room keys. The crypto machine must have already processed the events.
+func (c *Container) retryDecryptionAfterToDevice(evts []*event.Event) {
+	for _, evt := range evts {
+		if evt.Type.Type == event.ToDeviceEncrypted.Type {
+			c.RetryDecryption()
+			return
+		}
+	}
+}
+
+// RedecryptEvent retries decrypting a single event that previously failed to decrypt, and replaces the message in
+// the room view if it succeeds. If the session is still missing, the event is decrypted automatically when it arrives.
+func (c *Container) RedecryptEvent(roomID id.RoomID, eventID id.EventID) error {
+	room := c.GetRoom(roomID)
+	if c.crypto == nil {
+		return errors.New("encryption is not enabled")
+	} else if room == nil {
+		return fmt.Errorf("room %s not found", roomID)
+	}
+	evt, err := c.history.Get(room, eventID)
+	if err != nil {
+		return fmt.Errorf("failed to get event: %w", err)
+	}
+	content, ok := evt.Content.Parsed.(*muksevt.BadEncryptedContent)
+	if !ok || content.Original == nil {
+		return fmt.Errorf("%s is not an undecryptable message", eventID)
+	}
+	err = c.redecryptEvent(undecryptableEvent{roomID: roomID, eventID: eventID})
+	if isMissingSessionError(err) {
+		c.addUndecryptable(content.Original.SessionID, roomID, eventID)
+		return fmt.Errorf("session %s is still missing", content.Original.SessionID)
+	} else if err != nil {
+		return err
+	}
+	c.ui.Render()
+	return nil
+}
+
+func (c *Container) redecryptPending() {
+	c.undecryptable.lock.Lock()
+	pending := c.undecryptable.pending
+	c.undecryptable.pending = nil
+	c.undecryptable.lock.Unlock()
+	if c.crypto == nil || len(pending) == 0 {
+		return
+	}
+
+	var decrypted int
+	for sessionID, events := range pending {
+		for i, evt := range events {
+			err := c.redecryptEvent(evt)
+			if isMissingSessionError(err) {
+				// The session still hasn't arrived, put the rest of the events back to wait for it
+				c.undecryptable.lock.Lock()
+				if c.undecryptable.pending == nil {
+					c.undecryptable.pending = make(map[id.SessionID][]undecryptableEvent)
+				}
+				c.undecryptable.pending[sessionID] = append(c.undecryptable.pending[sessionID], events[i:]...)
+				c.undecryptable.lock.Unlock()
+				break
+			} else if errors.Is(err, errNotUndecryptable) {
+				// Already decrypted some other way, e.g. with /decrypt
+			} else if err != nil {
+				debug.Printf("Failed to re-decrypt event %s in %s: %v", evt.eventID, evt.roomID, err)
+			} else {
+				decrypted++
+			}
+		}
+	}
+	if decrypted > 0 {
+		debug.Printf("Decrypted %d previously undecryptable events", decrypted)
+		c.ui.Render()
+	}
+}
+
+func (c *Container) redecryptEvent(target undecryptableEvent) error {
+	room := c.GetRoom(target.roomID)
+	if room == nil {
+		return nil
+	}
+	var updatedEvt *muksevt.Event
+	err := c.history.Update(room, target.eventID, func(evt *muksevt.Event) error {
+		content, ok := evt.Content.Parsed.(*muksevt.BadEncryptedContent)
+		if !ok || evt.Type != muksevt.EventBadEncrypted || content.Original == nil {
+			return errNotUndecryptable
+		}
+		encrypted := *evt.Event
+		encrypted.Type = event.EventEncrypted
+		encrypted.Content.Parsed = content.Original
+		decrypted, err := c.crypto.DecryptMegolmEvent(&encrypted)
+		if err != nil {
+			return err
+		}
+		evt.Event = decrypted
+		updatedEvt = evt
+		return nil
+	})
+	if err != nil {
+		return err
+	} else if !room.Loaded() {
+		return nil
+	}
+
+	roomView := c.ui.MainView().GetRoom(target.roomID)
+	if roomView != nil {
+		// AddEdit replaces the existing message with the same ID in-place
+		roomView.AddEdit(updatedEvt)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/config"
+	"maunium.net/go/gomuks/debug"
+	ifc "maunium.net/go/gomuks/interface"
+)
+
+const (
+	authTypeRegistrationToken         mautrix.AuthType = "m.login.registration_token"
+	authTypeRegistrationTokenUnstable mautrix.AuthType = "org.matrix.msc3231.login.registration_token"
+)
+
+// maxRegistrationSteps is the number of user-interactive auth stages after which registration is given up, in case
+// the server keeps asking for the same stage.
+const maxRegistrationSteps = 10
+
+var errRegistrationCancelled = errors.New("registration cancelled")
+
+// isInlineRegistrationStage checks if the stage can be completed without opening the browser.
+func isInlineRegistrationStage(stage mautrix.AuthType) bool {
+	switch stage {
+	case mautrix.AuthTypeDummy, authTypeRegistrationToken, authTypeRegistrationTokenUnstable:
+		return true
+	default:
+		return false
+	}
+}
+
+// nextRegistrationStage finds the next stage to complete. Out of the flows that match the already completed stages,
+// the one with the fewest stages that need the browser is chosen.
+func nextRegistrationStage(uia *mautrix.RespUserInteractive) (stage mautrix.AuthType, ok bool) {
+	bestBrowserStages := -1
+	for _, flow := range uia.Flows {
+		if len(flow.Stages) <= len(uia.Completed) {
+			continue
+		}
+		matches := true
+		for i, completed := range uia.Completed {
+			if string(flow.Stages[i]) != completed {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+		browserStages := 0
+		for _, flowStage := range flow.Stages[len(uia.Completed):] {
+			if !isInlineRegistrationStage(flowStage) {
+				browserStages++
+			}
+		}
+		if bestBrowserStages < 0 || browserStages < bestBrowserStages {
+			bestBrowserStages = browserStages
+			stage = flow.Stages[len(uia.Completed)]
+			ok = true
+		}
+	}
+	return
+}
+
+// register creates an account with the given client, going through the user-interactive auth stages the server asks
+// for. Registration tokens are asked with askToken, dummy stages are completed automatically and everything else is
+// done with the fallback page in the browser.
+func (c *Container) register(client *mautrix.Client, username, password string, askToken ifc.RegistrationTokenFunc) (*mautrix.RespRegister, error) {
+	req := &mautrix.ReqRegister{
+		Username:                 username,
+		Password:                 password,
+		InitialDeviceDisplayName: "gomuks",
+	}
+	for i := 0; i < maxRegistrationSteps; i++ {
+		resp, uia, err := client.Register(req)
+		if err == nil && resp != nil {
+			return resp, nil
+		} else if uia == nil {
+			return nil, err
+		} else if len(uia.Error) > 0 {
+			debug.Printf("Registration stage failed: %s: %s", uia.ErrCode, uia.Error)
+			if i > 0 {
+				return nil, fmt.Errorf("%s", uia.Error)
+			}
+		}
+		stage, ok := nextRegistrationStage(uia)
+		if !ok {
+			return nil, fmt.Errorf("the homeserver doesn't allow registration or has no supported registration flows")
+		}
+		debug.Printf("Completing registration stage %s", stage)
+		switch stage {
+		case mautrix.AuthTypeDummy:
+			req.Auth = mautrix.BaseAuthData{Type: stage, Session: uia.Session}
+		case authTypeRegistrationToken, authTypeRegistrationTokenUnstable:
+			token, ok := askToken()
+			if !ok {
+				return nil, errRegistrationCancelled
+			}
+			req.Auth = map[string]interface{}{
+				"type":    stage,
+				"token":   token,
+				"session": uia.Session,
+			}
+		default:
+			err = c.uiaFallback(client, stage, uia.Session)
+			if err != nil {
+				return nil, err
+			}
+			req.Auth = map[string]interface{}{"session": uia.Session}
+		}
+	}
+	return nil, fmt.Errorf("registration didn't finish after %d steps", maxRegistrationSteps)
+}
+
+// Register creates an account on the homeserver of the client created with InitClient and logs in to it.
+func (c *Container) Register(username, password string, askToken ifc.RegistrationTokenFunc) error {
+	resp, err := c.register(c.client, username, password, askToken)
+	if err != nil {
+		return err
+	}
+	c.client.SetCredentials(resp.UserID, resp.AccessToken)
+	c.client.DeviceID = resp.DeviceID
+	c.finishLogin(&mautrix.RespLogin{
+		AccessToken: resp.AccessToken,
+		DeviceID:    resp.DeviceID,
+		UserID:      resp.UserID,
+	})
+	return nil
+}
+
+// RegisterAccount creates an account for the given user ID and saves its session, so that it can be switched to
+// later. The active account isn't changed.
+func (c *Container) RegisterAccount(userID id.UserID, password string, askToken ifc.RegistrationTokenFunc) error {
+	localpart, server, err := userID.Parse()
+	if err != nil {
+		return fmt.Errorf("invalid user ID: %w", err)
+	}
+	homeserver, err := resolveHomeserver(server)
+	if err != nil {
+		return err
+	}
+	client, err := c.newClient(homeserver)
+	if err != nil {
+		return err
+	}
+	resp, err := c.register(client, localpart, password, askToken)
+	if err != nil {
+		return err
+	}
+	return c.config.AddAccount(config.Account{
+		UserID:      resp.UserID,
+		DeviceID:    resp.DeviceID,
+		AccessToken: resp.AccessToken,
+		HS:          homeserver,
+	})
+}
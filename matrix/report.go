@@ -0,0 +1,61 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+
+	ifc "maunium.net/go/gomuks/interface"
+)
+
+// reportScore is the score sent with reports. The spec range is from -100 (most offensive) to 0 (inoffensive).
+const reportScore = -100
+
+type reqReport struct {
+	Score  int    `json:"score"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// isReportUnsupportedError checks if a report request failed because the homeserver doesn't implement reporting.
+// A 404 with M_NOT_FOUND means that the event wasn't found, so it's not treated as unsupported.
+func isReportUnsupportedError(err error) bool {
+	var httpErr mautrix.HTTPError
+	if !errors.As(err, &httpErr) {
+		return false
+	} else if httpErr.RespError != nil && httpErr.RespError.ErrCode == "M_UNRECOGNIZED" {
+		return true
+	} else if httpErr.IsStatus(http.StatusNotFound) {
+		return httpErr.RespError == nil || httpErr.RespError.ErrCode != mautrix.MNotFound.ErrCode
+	}
+	return httpErr.IsStatus(http.StatusMethodNotAllowed) || httpErr.IsStatus(http.StatusNotImplemented)
+}
+
+// ReportEvent reports the given event to the homeserver admins.
+func (c *Container) ReportEvent(roomID id.RoomID, eventID id.EventID, reason string) error {
+	req := reqReport{Score: reportScore, Reason: reason}
+	url := c.client.BuildClientURL("v3", "rooms", roomID, "report", eventID)
+	_, err := c.client.MakeRequest(http.MethodPost, url, &req, nil)
+	if isReportUnsupportedError(err) {
+		return fmt.Errorf("%w (%v)", ifc.ErrReportUnsupported, err)
+	}
+	return err
+}
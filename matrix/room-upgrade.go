@@ -0,0 +1,65 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"errors"
+
+	"maunium.net/go/mautrix/id"
+)
+
+type respCapabilities struct {
+	Capabilities struct {
+		RoomVersions *struct {
+			Default   string            `json:"default"`
+			Available map[string]string `json:"available"`
+		} `json:"m.room_versions"`
+	} `json:"capabilities"`
+}
+
+type reqUpgradeRoom struct {
+	NewVersion string `json:"new_version"`
+}
+
+type respUpgradeRoom struct {
+	ReplacementRoom id.RoomID `json:"replacement_room"`
+}
+
+// RoomVersions returns the default room version of the homeserver and the stability of all the versions it supports.
+func (c *Container) RoomVersions() (defaultVersion string, available map[string]string, err error) {
+	var resp respCapabilities
+	_, err = c.client.MakeRequest("GET", c.client.BuildClientURL("v3", "capabilities"), nil, &resp)
+	if err != nil {
+		return
+	} else if resp.Capabilities.RoomVersions == nil {
+		err = errors.New("server didn't list supported room versions")
+		return
+	}
+	return resp.Capabilities.RoomVersions.Default, resp.Capabilities.RoomVersions.Available, nil
+}
+
+// UpgradeRoom upgrades the given room to the given room version. The server creates the replacement room, joins the
+// user to it and sends a tombstone to the old room.
+func (c *Container) UpgradeRoom(roomID id.RoomID, version string) (id.RoomID, error) {
+	var resp respUpgradeRoom
+	url := c.client.BuildClientURL("v3", "rooms", roomID, "upgrade")
+	_, err := c.client.MakeRequest("POST", url, &reqUpgradeRoom{NewVersion: version}, &resp)
+	if err != nil {
+		return "", err
+	}
+	return resp.ReplacementRoom, nil
+}
@@ -92,6 +92,11 @@ type Room struct {
 	unreadCountCache *int
 	highlightCache   *bool
 	lastMarkedRead   id.EventID
+	// The event each other user has last read, from m.receipt events.
+	ReadReceipts map[id.UserID]id.EventID
+	// The event the user has fully read up to, from the m.fully_read account data event. Unlike the read receipt,
+	// it's only moved explicitly, so it marks where the user stopped reading.
+	FullyRead id.EventID
 	// Whether or not this room is marked as a direct chat.
 	IsDirect  bool
 	OtherUser id.UserID
@@ -343,6 +348,62 @@ func (room *Room) AddUnread(eventID id.EventID, counted, highlight bool) {
 	}
 }
 
+// UpdateUnread changes the counted and highlight flags of the unread messages, e.g. after the notification level of
+// the room was changed.
+func (room *Room) UpdateUnread(update func(msg *UnreadMessage)) {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	for i := range room.UnreadMessages {
+		update(&room.UnreadMessages[i])
+	}
+	room.highlightCache = nil
+	room.unreadCountCache = nil
+}
+
+// SetReadReceipt stores the last event the given user has read. Returns false if the receipt didn't change.
+func (room *Room) SetReadReceipt(userID id.UserID, eventID id.EventID) bool {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	if room.ReadReceipts == nil {
+		room.ReadReceipts = make(map[id.UserID]id.EventID)
+	} else if room.ReadReceipts[userID] == eventID {
+		return false
+	}
+	room.ReadReceipts[userID] = eventID
+	return true
+}
+
+// SetFullyRead stores the event the user has fully read up to. Returns false if it didn't change.
+func (room *Room) SetFullyRead(eventID id.EventID) bool {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	if room.FullyRead == eventID {
+		return false
+	}
+	room.FullyRead = eventID
+	return true
+}
+
+// GetFullyRead returns the event the user has fully read up to.
+func (room *Room) GetFullyRead() id.EventID {
+	room.lock.RLock()
+	defer room.lock.RUnlock()
+	return room.FullyRead
+}
+
+// GetReadReceipts returns the users whose last read event is the given event.
+func (room *Room) GetReadReceipts(eventID id.EventID) []id.UserID {
+	room.lock.RLock()
+	defer room.lock.RUnlock()
+	var users []id.UserID
+	for userID, readEventID := range room.ReadReceipts {
+		if readEventID == eventID {
+			users = append(users, userID)
+		}
+	}
+	return users
+}
+
 var (
 	tagDirect  = RoomTag{"net.maunium.gomuks.fake.direct", "0.5"}
 	tagInvite  = RoomTag{"net.maunium.gomuks.fake.invite", "0.5"}
@@ -416,6 +477,10 @@ func (room *Room) UpdateState(evt *event.Event) {
 		if content.Algorithm == id.AlgorithmMegolmV1 {
 			room.Encrypted = true
 		}
+	case *event.TombstoneEventContent:
+		replacement := content.ReplacementRoom
+		room.replacedCache = true
+		room.replacedByCache = &replacement
 	}
 
 	if evt.Type != event.StateMember {
@@ -463,6 +528,19 @@ func (room *Room) GetStateEvent(eventType event.Type, stateKey string) *event.Ev
 	return evt
 }
 
+// GetStateEvents returns a copy of the state events for the given type, keyed by state key.
+func (room *Room) GetStateEvents(eventType event.Type) map[string]*event.Event {
+	room.Load()
+	room.lock.RLock()
+	defer room.lock.RUnlock()
+	stateEventMap := room.getStateEvents(eventType)
+	copied := make(map[string]*event.Event, len(stateEventMap))
+	for stateKey, evt := range stateEventMap {
+		copied[stateKey] = evt
+	}
+	return copied
+}
+
 // getStateEvents returns the state events for the given type.
 func (room *Room) getStateEvents(eventType event.Type) map[string]*event.Event {
 	stateEventMap, _ := room.state[eventType]
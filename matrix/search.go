@@ -0,0 +1,130 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	ifc "maunium.net/go/gomuks/interface"
+)
+
+// searchContextLimit is the number of events before and after each result that are requested for context.
+const searchContextLimit = 1
+
+type reqSearch struct {
+	SearchCategories struct {
+		RoomEvents reqSearchRoomEvents `json:"room_events"`
+	} `json:"search_categories"`
+}
+
+type reqSearchEventContext struct {
+	BeforeLimit int `json:"before_limit"`
+	AfterLimit  int `json:"after_limit"`
+}
+
+type reqSearchRoomEvents struct {
+	SearchTerm   string                `json:"search_term"`
+	Keys         []string              `json:"keys"`
+	OrderBy      string                `json:"order_by"`
+	Filter       *mautrix.FilterPart   `json:"filter,omitempty"`
+	EventContext reqSearchEventContext `json:"event_context"`
+}
+
+type respSearchResult struct {
+	Rank    float64      `json:"rank"`
+	Result  *event.Event `json:"result"`
+	Context struct {
+		EventsBefore []*event.Event `json:"events_before"`
+		EventsAfter  []*event.Event `json:"events_after"`
+	} `json:"context"`
+}
+
+type respSearch struct {
+	SearchCategories struct {
+		RoomEvents struct {
+			Count     int                 `json:"count"`
+			Results   []*respSearchResult `json:"results"`
+			NextBatch string              `json:"next_batch"`
+		} `json:"room_events"`
+	} `json:"search_categories"`
+}
+
+// isSearchUnsupportedError checks if a search request failed because the homeserver doesn't have the search API.
+// Servers respond to unknown endpoints with either 404 or 405 and M_UNRECOGNIZED, depending on the implementation.
+func isSearchUnsupportedError(err error) bool {
+	var httpErr mautrix.HTTPError
+	if !errors.As(err, &httpErr) {
+		return false
+	} else if httpErr.RespError != nil && httpErr.RespError.ErrCode == "M_UNRECOGNIZED" {
+		return true
+	}
+	return httpErr.IsStatus(http.StatusNotFound) || httpErr.IsStatus(http.StatusMethodNotAllowed) ||
+		httpErr.IsStatus(http.StatusNotImplemented)
+}
+
+// Search searches message bodies with the server-side search API, ordered by rank. If roomID is empty, all joined
+// rooms are searched. The server can't see the contents of encrypted messages, so they're never found.
+func (c *Container) Search(query string, roomID id.RoomID, nextBatch string) (*ifc.SearchResults, error) {
+	var req reqSearch
+	req.SearchCategories.RoomEvents = reqSearchRoomEvents{
+		SearchTerm: query,
+		Keys:       []string{"content.body"},
+		OrderBy:    "rank",
+		EventContext: reqSearchEventContext{
+			BeforeLimit: searchContextLimit,
+			AfterLimit:  searchContextLimit,
+		},
+	}
+	if len(roomID) > 0 {
+		req.SearchCategories.RoomEvents.Filter = &mautrix.FilterPart{Rooms: []id.RoomID{roomID}}
+	}
+	queryParams := map[string]string{}
+	if len(nextBatch) > 0 {
+		queryParams["next_batch"] = nextBatch
+	}
+	var resp respSearch
+	_, err := c.client.MakeRequest("POST", c.client.BuildURLWithQuery(mautrix.ClientURLPath{"v3", "search"}, queryParams), &req, &resp)
+	if isSearchUnsupportedError(err) {
+		return nil, fmt.Errorf("%w (%v)", ifc.ErrSearchUnsupported, err)
+	} else if err != nil {
+		return nil, err
+	}
+	roomEvents := resp.SearchCategories.RoomEvents
+	results := &ifc.SearchResults{
+		Count:     roomEvents.Count,
+		Results:   make([]*ifc.SearchResult, 0, len(roomEvents.Results)),
+		NextBatch: roomEvents.NextBatch,
+	}
+	for _, result := range roomEvents.Results {
+		if result == nil || result.Result == nil {
+			continue
+		}
+		results.Results = append(results.Results, &ifc.SearchResult{
+			Event:         result.Result,
+			Rank:          result.Rank,
+			ContextBefore: result.Context.EventsBefore,
+			ContextAfter:  result.Context.EventsAfter,
+		})
+	}
+	return results, nil
+}
@@ -19,6 +19,7 @@
 package matrix
 
 import (
+	"errors"
 	"sync"
 	"time"
 
@@ -60,7 +61,7 @@ func (s *GomuksSyncer) ProcessResponse(res *mautrix.RespSync, since string) (err
 	debug.Print("Received sync response")
 	s.Progress.SetMessage("Processing sync response")
 	steps := len(res.Rooms.Join) + len(res.Rooms.Invite) + len(res.Rooms.Leave)
-	s.Progress.SetSteps(steps + 2 + len(s.globalListeners))
+	s.Progress.SetSteps(steps + 3 + len(s.globalListeners))
 
 	wait := &sync.WaitGroup{}
 	callback := func() {
@@ -75,6 +76,8 @@ func (s *GomuksSyncer) ProcessResponse(res *mautrix.RespSync, since string) (err
 	s.Progress.Step()
 	s.processSyncEvents(nil, res.AccountData.Events, mautrix.EventSourceAccountData)
 	s.Progress.Step()
+	s.processSyncEvents(nil, res.ToDevice.Events, mautrix.EventSourceToDevice)
+	s.Progress.Step()
 
 	wait.Add(steps)
 
@@ -177,8 +180,9 @@ func (s *GomuksSyncer) processSyncEvent(room *rooms.Room, evt *event.Event, sour
 		evt.Type.Class = event.MessageEventType
 	}
 
+	// The crypto machine parses to-device events before the syncer sees them.
 	err := evt.Content.ParseRaw(evt.Type)
-	if err != nil {
+	if err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
 		debug.Printf("Failed to unmarshal content of event %s (type %s) by %s in %s: %v\n%s", evt.ID, evt.Type.Repr(), evt.Sender, evt.RoomID, err, string(evt.Content.VeryRaw))
 		// TODO might be good to let these pass to allow handling invalid events too
 		return
@@ -230,6 +234,8 @@ func (s *GomuksSyncer) GetFilterJSON(_ id.UserID) *mautrix.Filter {
 		event.StatePowerLevels,
 		event.StateTombstone,
 		event.StateEncryption,
+		event.StatePinnedEvents,
+		StateRoomEmotes,
 	}
 	messageEvents := []event.Type{
 		event.EventMessage,
@@ -254,14 +260,15 @@ func (s *GomuksSyncer) GetFilterJSON(_ id.UserID) *mautrix.Filter {
 				Types: []event.Type{event.EphemeralEventTyping, event.EphemeralEventReceipt},
 			},
 			AccountData: mautrix.FilterPart{
-				Types: []event.Type{event.AccountDataRoomTags},
+				Types: []event.Type{event.AccountDataRoomTags, event.AccountDataFullyRead},
 			},
 		},
 		AccountData: mautrix.FilterPart{
-			Types: []event.Type{event.AccountDataPushRules, event.AccountDataDirectChats, AccountDataGomuksPreferences},
+			Types: []event.Type{event.AccountDataPushRules, event.AccountDataDirectChats, AccountDataGomuksPreferences,
+				AccountDataUserEmotes, AccountDataEmoteRooms, event.AccountDataIgnoredUserList},
 		},
 		Presence: mautrix.FilterPart{
-			NotTypes: []event.Type{event.NewEventType("*")},
+			Types: []event.Type{event.EphemeralEventPresence},
 		},
 	}
 }
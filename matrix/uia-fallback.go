@@ -19,6 +19,8 @@ package matrix
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"time"
@@ -66,10 +68,42 @@ const uiaFallbackPage = `<!DOCTYPE html>
 </html>
 `
 
+// startLocalCallbackServer starts a temporary HTTP server on a random local port, which the browser is sent back to
+// after finishing a login or authentication flow. The returned URL points to the root of the server.
+func startLocalCallbackServer(handler http.Handler) (*http.Server, string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, "", err
+	}
+	server := &http.Server{Handler: handler}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			debug.Printf("Local callback server errored: %v", err)
+		}
+	}()
+	return server, fmt.Sprintf("http://%s", listener.Addr().String()), nil
+}
+
+// closeLocalCallbackServer shuts down a server created with startLocalCallbackServer, letting requests that are in
+// progress finish first.
+func closeLocalCallbackServer(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		debug.Printf("Failed to shut down local callback server: %v", err)
+	}
+}
+
 func (c *Container) UIAFallback(loginType mautrix.AuthType, sessionID string) error {
+	return c.uiaFallback(c.client, loginType, sessionID)
+}
+
+// uiaFallback opens the fallback page of the given auth stage in the browser and waits for the user to complete it.
+func (c *Container) uiaFallback(client *mautrix.Client, loginType mautrix.AuthType, sessionID string) error {
 	errChan := make(chan error, 1)
-	server := &http.Server{Addr: ":29325"}
-	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	server, callbackURL, err := startLocalCallbackServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "GET" {
 			w.Header().Add("Content-Type", "text/html")
 			w.WriteHeader(http.StatusOK)
@@ -78,38 +112,39 @@ func (c *Container) UIAFallback(loginType mautrix.AuthType, sessionID string) er
 			w.Header().Add("Content-Type", "text/html")
 			w.WriteHeader(http.StatusOK)
 
-			go func() {
-				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-				defer cancel()
-				err := server.Shutdown(ctx)
-				if err != nil {
-					debug.Printf("Failed to shut down SSO server: %v\n", err)
-				}
-				if r.Method == "DELETE" {
-					errChan <- errors.New("login cancelled")
-				} else {
-					errChan <- nil
-				}
-			}()
+			var result error
+			if r.Method == "DELETE" {
+				result = errors.New("login cancelled")
+			}
+			select {
+			case errChan <- result:
+			default:
+			}
 		} else {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 		}
-	})
-	go server.ListenAndServe()
-	defer server.Close()
-	authURL := c.client.BuildURLWithQuery(mautrix.ClientURLPath{"v3", "auth", loginType, "fallback", "web"}, map[string]string{
+	}))
+	if err != nil {
+		return fmt.Errorf("failed to start local server for authentication: %w", err)
+	}
+	defer closeLocalCallbackServer(server)
+	authURL := client.BuildURLWithQuery(mautrix.ClientURLPath{"v3", "auth", loginType, "fallback", "web"}, map[string]string{
 		"session": sessionID,
 	})
-	link := url.URL{
-		Scheme:   "http",
-		Host:     "localhost:29325",
-		Path:     "/",
-		Fragment: authURL,
+	link, err := url.Parse(callbackURL)
+	if err != nil {
+		return err
 	}
-	err := open.Open(link.String())
+	link.Path = "/"
+	link.Fragment = authURL
+	err = open.Open(link.String())
 	if err != nil {
 		return err
 	}
-	err = <-errChan
-	return err
+	select {
+	case err = <-errChan:
+		return err
+	case <-time.After(ssoLoginTimeout):
+		return fmt.Errorf("authentication wasn't completed in the browser within %s", ssoLoginTimeout)
+	}
 }
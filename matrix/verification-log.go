@@ -0,0 +1,149 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+
+	"maunium.net/go/gomuks/debug"
+)
+
+// verificationLogRedactedFields are the fields of verification events that contain key material or MACs.
+// Everything else (methods, hash and MAC algorithms, transaction IDs) is logged, as that's what usually
+// differs between clients.
+var verificationLogRedactedFields = map[string]bool{
+	"key":        true,
+	"keys":       true,
+	"mac":        true,
+	"commitment": true,
+}
+
+type verificationLogger struct {
+	lock   sync.Mutex
+	writer io.WriteCloser
+}
+
+var verificationLog verificationLogger
+
+func (vl *verificationLogger) printf(format string, args ...interface{}) {
+	vl.lock.Lock()
+	defer vl.lock.Unlock()
+	if vl.writer == nil {
+		var err error
+		vl.writer, err = os.OpenFile(filepath.Join(debug.LogDirectory, "verification.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			debug.Print("Failed to open verification log:", err)
+			return
+		}
+	}
+	_, _ = fmt.Fprintf(vl.writer, time.Now().Format("[2006-01-02 15:04:05] ")+format+"\n", args...)
+}
+
+func redactVerificationData(data interface{}) interface{} {
+	switch typedData := data.(type) {
+	case map[string]interface{}:
+		for key, value := range typedData {
+			if verificationLogRedactedFields[key] {
+				typedData[key] = "<redacted>"
+			} else {
+				typedData[key] = redactVerificationData(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range typedData {
+			typedData[i] = redactVerificationData(value)
+		}
+	}
+	return data
+}
+
+func redactVerificationJSON(data []byte) string {
+	var parsed interface{}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return fmt.Sprintf("<unparseable: %v>", err)
+	}
+	redacted, _ := json.Marshal(redactVerificationData(parsed))
+	return string(redacted)
+}
+
+// LogVerification writes a line to the verification log if it's enabled in the config.
+func (c *Container) LogVerification(format string, args ...interface{}) {
+	if c.config.VerificationLog {
+		verificationLog.printf(format, args...)
+	}
+}
+
+func (c *Container) logVerificationEvent(direction string, evt *event.Event) {
+	c.LogVerification("%s %s from %s (%s) in %s: %s", direction, evt.Type.Type, evt.Sender, evt.ID, evt.RoomID,
+		redactVerificationJSON(evt.Content.VeryRaw))
+}
+
+// logReceivedVerificationEvents logs the incoming to-device verification events of a sync response. It's called
+// before the events are passed to the crypto machine, so events that the machine fails to parse are logged too.
+func (c *Container) logReceivedVerificationEvents(evts []*event.Event) {
+	if !c.config.VerificationLog {
+		return
+	}
+	for _, evt := range evts {
+		if strings.HasPrefix(evt.Type.Type, "m.key.verification.") {
+			c.logVerificationEvent("Received", evt)
+		}
+	}
+}
+
+// verificationLogTransport is a http.RoundTripper that logs outgoing verification events.
+type verificationLogTransport struct {
+	container *Container
+	base      http.RoundTripper
+}
+
+func (vlt *verificationLogTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodPut && req.Body != nil && strings.Contains(req.URL.Path, "/m.key.verification.") {
+		body, err := ioutil.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		vlt.container.LogVerification("Sending %s: %s", req.URL.Path, redactVerificationJSON(body))
+	}
+	return vlt.base.RoundTrip(req)
+}
+
+func (c *Container) initVerificationLog() {
+	if !c.config.VerificationLog {
+		return
+	}
+	base := c.client.Client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	c.client.Client.Transport = &verificationLogTransport{container: c, base: base}
+	c.LogVerification("Verification logging enabled for %s/%s", c.config.UserID, c.config.DeviceID)
+}
@@ -0,0 +1,105 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build cgo
+
+package matrix
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var errUnknownVerificationRequest = errors.New("verification request not found or expired")
+
+type receivedVerificationRequest struct {
+	evt      *event.Event
+	received time.Time
+}
+
+// verificationRequestBuffer keeps the to-device verification requests and starts that were received, so that a
+// request the user didn't answer immediately can be passed to the crypto machine again once the user accepts it.
+type verificationRequestBuffer struct {
+	lock     sync.Mutex
+	requests map[string]receivedVerificationRequest
+}
+
+func verificationRequestKey(userID id.UserID, transactionID string) string {
+	return userID.String() + "|" + transactionID
+}
+
+// reset forgets all received verification requests, as they belong to the previous account.
+func (vrb *verificationRequestBuffer) reset() {
+	vrb.lock.Lock()
+	vrb.requests = nil
+	vrb.lock.Unlock()
+}
+
+// rememberVerificationRequests stores the verification requests and starts of the given to-device events. It must
+// be called after the crypto machine has parsed the events.
+func (c *Container) rememberVerificationRequests(mach *crypto.OlmMachine, evts []*event.Event) {
+	c.verificationRequests.lock.Lock()
+	defer c.verificationRequests.lock.Unlock()
+	for key, req := range c.verificationRequests.requests {
+		if time.Since(req.received) > mach.DefaultSASTimeout {
+			delete(c.verificationRequests.requests, key)
+		}
+	}
+	for _, evt := range evts {
+		var transactionID string
+		switch content := evt.Content.Parsed.(type) {
+		case *event.VerificationRequestEventContent:
+			transactionID = content.TransactionID
+		case *event.VerificationStartEventContent:
+			transactionID = content.TransactionID
+		default:
+			continue
+		}
+		if c.verificationRequests.requests == nil {
+			c.verificationRequests.requests = make(map[string]receivedVerificationRequest)
+		}
+		c.verificationRequests.requests[verificationRequestKey(evt.Sender, transactionID)] = receivedVerificationRequest{
+			evt:      evt,
+			received: time.Now(),
+		}
+	}
+}
+
+// ReplayVerificationRequest passes a previously received verification request or start to the crypto machine again.
+// It's used to answer requests that were ignored when they were received: the machine will ask the
+// AcceptVerificationFrom hook about the transaction again and continue the existing transaction if it's accepted.
+func (c *Container) ReplayVerificationRequest(userID id.UserID, transactionID string) error {
+	mach, ok := c.crypto.(*crypto.OlmMachine)
+	if !ok {
+		return errors.New("encryption is not enabled")
+	}
+	key := verificationRequestKey(userID, transactionID)
+	c.verificationRequests.lock.Lock()
+	req, ok := c.verificationRequests.requests[key]
+	delete(c.verificationRequests.requests, key)
+	c.verificationRequests.lock.Unlock()
+	if !ok || time.Since(req.received) > mach.DefaultSASTimeout {
+		return errUnknownVerificationRequest
+	}
+	c.LogVerification("Replaying %s %s from %s", req.evt.Type.Type, transactionID, userID)
+	mach.HandleToDeviceEvent(req.evt)
+	return nil
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -57,6 +58,89 @@ func autocompleteFile(cmd *CommandAutocomplete) (completions []string, newText s
 	return
 }
 
+// autocompleteMember completes the user ID of a member of the current room as the first argument.
+func autocompleteMember(cmd *CommandAutocomplete) (completions []string, newText string) {
+	if len(cmd.Args) != 1 || strings.HasSuffix(cmd.RawArgs, " ") {
+		return
+	}
+	userCompletions := cmd.Room.AutocompleteUser(cmd.Args[0])
+	if len(userCompletions) == 1 {
+		newText = fmt.Sprintf("/%s %s ", cmd.OrigCommand, userCompletions[0].id)
+		return
+	}
+	for _, completion := range userCompletions {
+		completions = append(completions, completion.id)
+	}
+	return
+}
+
+func autocompletePowerLevel(cmd *CommandAutocomplete) (completions []string, newText string) {
+	if len(cmd.Args) != 2 || strings.HasSuffix(cmd.RawArgs, " ") {
+		return autocompleteMember(cmd)
+	}
+	for name := range namedPowerLevels {
+		if strings.HasPrefix(name, strings.ToLower(cmd.Args[1])) {
+			completions = append(completions, name)
+		}
+	}
+	sort.Strings(completions)
+	if len(completions) == 1 {
+		newText = fmt.Sprintf("/%s %s %s", cmd.OrigCommand, cmd.Args[0], completions[0])
+	}
+	return
+}
+
+func autocompleteNotify(cmd *CommandAutocomplete) (completions []string, newText string) {
+	if len(cmd.Args) > 1 || strings.HasSuffix(cmd.RawArgs, " ") {
+		return
+	}
+	for level := range notificationLevels {
+		if strings.HasPrefix(string(level), cmd.RawArgs) {
+			completions = append(completions, string(level))
+		}
+	}
+	if len(completions) == 1 {
+		newText = fmt.Sprintf("/%s %s", cmd.OrigCommand, completions[0])
+	}
+	return
+}
+
+func autocompleteKeyword(cmd *CommandAutocomplete) (completions []string, newText string) {
+	if len(cmd.Args) < 2 || !strings.HasPrefix(strings.ToLower(cmd.Args[0]), "rem") {
+		return
+	}
+	prefix := strings.Join(cmd.Args[1:], " ")
+	for _, keyword := range cmd.Matrix.Keywords() {
+		if strings.HasPrefix(keyword, prefix) {
+			completions = append(completions, keyword)
+		}
+	}
+	if len(completions) == 1 {
+		newText = fmt.Sprintf("/%s %s %s", cmd.OrigCommand, cmd.Args[0], completions[0])
+	}
+	return
+}
+
+func autocompleteCommandName(cmd *CommandAutocomplete) (completions []string, newText string) {
+	prefix := strings.TrimPrefix(cmd.RawArgs, "/")
+	for name := range cmd.Handler.help {
+		if strings.HasPrefix(name, prefix) {
+			completions = append(completions, name)
+		}
+	}
+	userAliases, _ := cmd.Handler.userAliases()
+	for name := range userAliases {
+		if strings.HasPrefix(name, prefix) {
+			completions = append(completions, name)
+		}
+	}
+	sort.Strings(completions)
+	if len(completions) == 1 {
+		newText = fmt.Sprintf("/%s %s", cmd.OrigCommand, completions[0])
+	}
+	return
+}
+
 func autocompleteToggle(cmd *CommandAutocomplete) (completions []string, newText string) {
 	completions = make([]string, 0, len(toggleMsg))
 	for k := range toggleMsg {
@@ -0,0 +1,147 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxUserAliasDepth is the number of custom aliases that can expand into each other before giving up.
+const maxUserAliasDepth = 10
+
+// isBuiltinCommand checks if the given name is a built-in command or alias.
+func (ch *CommandProcessor) isBuiltinCommand(name string) bool {
+	_, isCommand := ch.commands[name]
+	_, isAlias := ch.aliases[name]
+	return isCommand || isAlias
+}
+
+// userAliases returns the custom aliases in the config with lowercase names. Aliases whose name is a built-in command
+// are returned in conflicts instead, as the built-in command always wins.
+func (ch *CommandProcessor) userAliases() (aliases map[string]string, conflicts []string) {
+	aliases = make(map[string]string, len(ch.Config.CommandAliases))
+	for name, template := range ch.Config.CommandAliases {
+		name = strings.ToLower(strings.TrimPrefix(name, "/"))
+		template = strings.TrimPrefix(strings.TrimSpace(template), "/")
+		if len(name) == 0 || len(template) == 0 {
+			continue
+		} else if ch.isBuiltinCommand(name) {
+			conflicts = append(conflicts, name)
+			continue
+		}
+		aliases[name] = template
+	}
+	sort.Strings(conflicts)
+	return
+}
+
+// expandUserAlias fills the arguments into the command of a custom alias. $1 to $9 are replaced with single arguments,
+// $* with all of them and $$ with a dollar sign. If there are no placeholders, the arguments are added to the end.
+func expandUserAlias(template string, args []string, rawArgs string) string {
+	var buf strings.Builder
+	hasPlaceholders := false
+	for i := 0; i < len(template); i++ {
+		char := template[i]
+		if char != '$' || i+1 >= len(template) {
+			buf.WriteByte(char)
+			continue
+		}
+		switch next := template[i+1]; {
+		case next == '*':
+			buf.WriteString(strings.TrimSpace(rawArgs))
+			hasPlaceholders = true
+		case next >= '1' && next <= '9':
+			if index := int(next - '1'); index < len(args) {
+				buf.WriteString(args[index])
+			}
+			hasPlaceholders = true
+		case next == '$':
+			buf.WriteByte('$')
+		default:
+			buf.WriteByte(char)
+			continue
+		}
+		i++
+	}
+	if !hasPlaceholders && len(strings.TrimSpace(rawArgs)) > 0 {
+		buf.WriteByte(' ')
+		buf.WriteString(rawArgs)
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+// ResolveUserAliases expands custom aliases until the command is no longer one. An error is returned if the aliases
+// refer to each other in a loop.
+func (ch *CommandProcessor) ResolveUserAliases(cmd *Command) (*Command, error) {
+	aliases, _ := ch.userAliases()
+	chain := []string{cmd.Command}
+	for {
+		template, ok := aliases[cmd.Command]
+		if !ok {
+			return cmd, nil
+		} else if len(chain) > maxUserAliasDepth {
+			return nil, fmt.Errorf("too many nested aliases: /%s", strings.Join(chain, " → /"))
+		}
+		expanded := ch.ParseCommand(cmd.Room, "/"+expandUserAlias(template, cmd.Args, cmd.RawArgs))
+		if expanded == nil {
+			return nil, fmt.Errorf("alias /%s doesn't expand to a command", cmd.Command)
+		}
+		for _, name := range chain {
+			if name == expanded.Command {
+				return nil, fmt.Errorf("aliases refer to each other in a loop: /%s → /%s",
+					strings.Join(chain, " → /"), expanded.Command)
+			}
+		}
+		chain = append(chain, expanded.Command)
+		cmd = expanded
+	}
+}
+
+// userAliasHelp creates the help entry of a custom alias.
+func userAliasHelp(name, template string) *CommandHelp {
+	return &CommandHelp{
+		Name:        name,
+		Description: fmt.Sprintf("Custom alias for /%s", template),
+		Details:     "Defined in command_aliases in config.yaml.",
+	}
+}
+
+// HelpCategories returns the help of the built-in commands and a category for the custom aliases in the config.
+func (ch *CommandProcessor) HelpCategories() []CommandCategory {
+	aliases, conflicts := ch.userAliases()
+	if len(aliases) == 0 && len(conflicts) == 0 {
+		return commandHelp
+	}
+	custom := CommandCategory{Name: "Custom aliases"}
+	for name, template := range aliases {
+		custom.Commands = append(custom.Commands, userAliasHelp(name, template))
+	}
+	sort.Slice(custom.Commands, func(i, j int) bool {
+		return custom.Commands[i].Name < custom.Commands[j].Name
+	})
+	for _, name := range conflicts {
+		custom.Commands = append(custom.Commands, &CommandHelp{
+			Name:        name,
+			Description: "Ignored, a built-in command has the same name.",
+		})
+	}
+	categories := make([]CommandCategory, len(commandHelp), len(commandHelp)+1)
+	copy(categories, commandHelp)
+	return append(categories, custom)
+}
@@ -0,0 +1,354 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mattn/go-runewidth"
+)
+
+// CommandHelp describes a command for /help.
+type CommandHelp struct {
+	Name string
+	// Usage is the arguments of the command, like "<user id> [reason]".
+	Usage string
+	// Description is a one-line summary shown in the command list.
+	Description string
+	// Details is a longer explanation shown by /help <command>.
+	Details string
+}
+
+// CommandCategory is a group of related commands in the /help listing.
+type CommandCategory struct {
+	Name     string
+	Commands []*CommandHelp
+}
+
+// commandHelp contains the help of all commands, in the order they're listed in /help. Commands that aren't listed
+// here work normally, but are hidden from the help.
+var commandHelp = []CommandCategory{{
+	Name: "General",
+	Commands: []*CommandHelp{
+		{Name: "help", Usage: "[command]", Description: "Show this help dialog, or the details of a command.",
+			Details: "Press / in the help dialog to search it."},
+		{Name: "quit", Description: "Quit gomuks."},
+		{Name: "clearcache", Description: "Clear cache and quit gomuks."},
+		{Name: "logout", Usage: "[--keep-keys]", Description: "Log out of Matrix and delete the local session data.",
+			Details: "The session is invalidated on the server first, and nothing is deleted if that fails. With " +
+				"--keep-keys, the encryption keys are kept and imported into the new session when logging back in " +
+				"as the same user."},
+		{Name: "account", Usage: "<list|add|switch|remove> [user ID]", Description: "Manage multiple accounts.",
+			Details: "Only the active account is synced. Each account has its own session, encryption keys and room " +
+				"cache, so switching back to an account continues where it was left off. Alt+s switches to the next " +
+				"saved account."},
+		{Name: "status", Usage: "<online|away|offline> [message]", Description: "Set your presence and status message.",
+			Details: "The presence of other users is shown next to direct chats in the room list and in the member " +
+				"list. Presence can't be set or shown if it's disabled on the homeserver."},
+		{Name: "ignore", Usage: "[user id]", Description: "Ignore a user, or list ignored users.",
+			Details: "Messages from ignored users are replaced with a line that can be clicked to show the message. " +
+				"Their membership events are hidden completely."},
+		{Name: "unignore", Usage: "<user id>", Description: "Stop ignoring a user."},
+		{Name: "register", Usage: "<user ID>", Description: "Register a new account and add it to the saved accounts.",
+			Details: "Registration tokens are asked for in gomuks. Other registration steps, like captchas and terms " +
+				"of service, are completed in the browser."},
+		{Name: "toggle", Usage: "<things...>", Description: "Toggle various UI features.",
+			Details: "Run /toggle without arguments to see the list of toggles."},
+		{Name: "id", Description: "Show the internal ID of the current room."},
+	},
+}, {
+	Name: "Media",
+	Commands: []*CommandHelp{
+		{Name: "download", Usage: "[path]", Description: "Download the file in the selected message.",
+			Details: "Files are saved to the download directory with their original name unless a path is given. " +
+				"Existing files are never overwritten."},
+		{Name: "open", Usage: "[path]", Description: "Download the file in the selected message and open it.",
+			Details: "The file is opened with xdg-open or the equivalent on your OS."},
+		{Name: "upload", Usage: "<path>", Description: "Upload the file at the given path to the current room."},
+		{Name: "copy", Usage: "[register]", Description: "Copy the text of the selected message.",
+			Details: `The register is either "clipboard" or "primary". Defaults to "clipboard".`},
+		{Name: "paste", Description: "Send the contents of the clipboard.",
+			Details: "Text is sent as a message, images and other files are uploaded."},
+	},
+}, {
+	Name: "Sending special messages",
+	Commands: []*CommandHelp{
+		{Name: "me", Usage: "<message>", Description: "Send an emote message."},
+		{Name: "notice", Usage: "<message>", Description: "Send a notice (generally used for bot messages)."},
+		{Name: "location", Usage: "<lat> <lon> [description]", Description: "Send a location."},
+		{Name: "spoiler", Usage: "[[reason]] <message>", Description: "Send a message hidden as a spoiler.",
+			Details: "The optional reason is given in square brackets before the message. " +
+				"Press s on a selected message to reveal its spoilers."},
+		{Name: "plain", Usage: "<message>", Description: "Send a message as-is.",
+			Details: "Markdown, HTML and emoji shortcodes aren't processed."},
+		{Name: "html", Usage: "<html>", Description: "Send a message with the given HTML as the formatted body.",
+			Details: "The plaintext fallback is generated from the HTML."},
+		{Name: "rainbow", Usage: "<message>", Description: "Send rainbow text."},
+		{Name: "rainbowme", Usage: "<message>", Description: "Send rainbow text in an emote."},
+		{Name: "rainbownotice", Usage: "<message>", Description: "Send rainbow text in a notice."},
+		{Name: "external", Description: "Write a message in an external editor.",
+			Details: "The editor is taken from $VISUAL or $EDITOR."},
+	},
+}, {
+	Name: "Message actions",
+	Commands: []*CommandHelp{
+		{Name: "reply", Usage: "[text]", Description: "Reply to the selected message."},
+		{Name: "quote", Usage: "[text]", Description: "Reply to the selected message, quoting some of its lines.",
+			Details: "Press q on a selected message to do the same."},
+		{Name: "thread", Usage: "[event ID]", Description: "Reply in the thread of the selected message."},
+		{Name: "react", Usage: "<reaction>", Description: "React to the selected message.",
+			Details: "If you already reacted with the same thing, the reaction is removed."},
+		{Name: "redact", Usage: "[reason]", Description: "Redact the selected message.",
+			Details: "Press Space to mark several messages and Enter to redact them all."},
+		{Name: "edit", Description: "Edit the selected message.",
+			Details: "Only your own text messages can be edited."},
+		{Name: "pin", Description: "Pin the selected message.",
+			Details: "Press p on a selected message to pin or unpin it."},
+		{Name: "unpin", Description: "Unpin the selected message."},
+		{Name: "report", Usage: "[reason]", Description: "Report the selected message to the homeserver admins.",
+			Details: "Asks for confirmation before sending the report."},
+		{Name: "pins", Description: "List the pinned messages in the current room (Alt+i).",
+			Details: "Press enter on a message to jump to it."},
+		{Name: "unread", Description: "Jump to the first unread message (Alt+g).",
+			Details: "Unread messages start after the read marker, which can be moved by pressing r on a selected " +
+				"message. More history is loaded if the read marker isn't loaded yet."},
+		{Name: "mention", Usage: "[prev|next]", Description: "Jump to an older or newer message that mentions you.",
+			Details: "Alt+h and Alt+j do the same. Going back past the oldest loaded mention loads more history."},
+		{Name: "retry", Usage: "[cancel]", Description: "Send the last message that failed to send again (Alt+t).",
+			Details: "Messages that are still sending are marked with ○, sent messages with ✓ and failed messages " +
+				"with ✗. Network errors, rate limits and server errors are retried automatically with increasing " +
+				"delays, those messages are marked with ↻. Messages are sent in order, so later messages wait " +
+				"behind a retrying one and are marked with …. Unsent messages are saved and sent again after a " +
+				"restart. The error of the last failed message is shown in the status bar. /retry cancel stops the " +
+				"pending automatic retry."},
+		{Name: "search", Usage: "[--server|--all] <query>", Description: "Search for messages.",
+			Details: "Highlight the loaded messages containing the query. Use Alt+n and Alt+p to jump between " +
+				"matches. If none of the loaded messages match, the server is searched instead, except in encrypted " +
+				"rooms. --server always searches the server, --all searches all rooms on the server. " +
+				"Press enter on a server result to jump to it in its room."},
+	},
+}, {
+	Name: "Encryption",
+	Commands: []*CommandHelp{
+		{Name: "fingerprint", Usage: "[--grouped|fingerprint]", Description: "View the keys of your device.",
+			Details: "With an argument, the fingerprint is shown in groups of four and compared with the given " +
+				"fingerprint."},
+		{Name: "whoami", Description: "Show your user and device IDs and the state of encryption features.",
+			Details: "Shows the device keys and whether cross-signing, SSSS and key backup are set up."},
+		{Name: "devices", Usage: "<user id> [--last-active]", Description: "View the device list of a user.",
+			Details: "With --last-active, show the room where each device last sent a message that was decrypted " +
+				"locally."},
+		{Name: "delete-device", Usage: "[device id]", Description: "Log out one of your other devices.",
+			Details: "Without a device ID, lists the devices of your account with when they were last seen."},
+		{Name: "device", Usage: "<user id> <device id>", Description: "Show info about a specific device."},
+		{Name: "olm-sessions", Usage: "<user id> <device id>",
+			Description: "List the Olm sessions with a device and their ages."},
+		{Name: "unverify", Usage: "<user id> <device id>", Description: "Un-verify a device.",
+			Details: "Accepts --all (or *) as the device ID to un-verify all devices of the user."},
+		{Name: "blacklist", Usage: "<user id> <device id>", Description: "Blacklist a device.",
+			Details: "Accepts --all (or *) as the device ID to blacklist all devices of the user."},
+		{Name: "verify", Usage: "<user id> [device id]", Description: "Verify a user or device interactively.",
+			Details: "With only a user ID, in-room verification is used, which is probably broken.\n" +
+				"--observe <user id> <device id> compares the emojis with a device without establishing any " +
+				"trust, which is useful for debugging mismatch reports.\n" +
+				"<user id> <device id> --from-profile verifies a device using the fingerprint the user published " +
+				"in their profile or at the configured fingerprint_url_pattern.\n" +
+				"--show-keys <user id> <device id> shows the full keys and fingerprint of a device and the exact " +
+				"/verify-device command for manual verification."},
+		{Name: "verify-device", Usage: "<user id> <device id> [fingerprint]", Description: "Verify a device.",
+			Details: "If the fingerprint is not provided, interactive emoji verification will be started. " +
+				"Accepts --all (or *) as the device ID to verify all devices of the user."},
+		{Name: "verify-phrase", Usage: "<user id> <device id>",
+			Description: "Verify a device with a secret phrase agreed on out of band.",
+			Details:     "Weaker than emoji verification, must be enabled in the config."},
+		{Name: "reset-session", Usage: "[--force]", Description: "Reset the outbound Megolm session of the room.",
+			Details: "Asks for confirmation if the session was created in the last 10 minutes, unless --force is " +
+				"given."},
+		{Name: "key-requests", Usage: "[fulfill <number>]", Description: "List recent incoming room key requests.",
+			Details: "Pending requests from devices that have since been verified can be fulfilled manually."},
+		{Name: "keyrequest", Usage: "[event ID] [--resend]",
+			Description: "Request the missing session of an undecryptable message.",
+			Details: "The session is requested from your other devices and the sender. Without an event ID, the " +
+				"message is selected in the room. Only messages in the local history are decrypted when the key arrives."},
+		{Name: "undecryptable", Description: "Count the loaded messages that couldn't be decrypted.",
+			Details: "The messages are grouped by session to show which keys are missing."},
+		{Name: "decrypt", Usage: "[event ID]", Description: "Retry decrypting a message that failed to decrypt.",
+			Details: "Useful if the key arrived late. Without an event ID, the message is selected in the room."},
+		{Name: "import", Usage: "[--use-ssss] [--this-room] <file>", Description: "Import encryption keys.",
+			Details: "With --this-room, only the sessions of the current room are imported."},
+		{Name: "verify-export", Usage: "<file>", Description: "Check that a key export file is valid.",
+			Details: "The file is decrypted and the sessions are checked without importing anything."},
+		{Name: "export", Usage: "[--iterations N] [--use-ssss] <file>", Description: "Export encryption keys.",
+			Details: "With --use-ssss, the file is encrypted with your SSSS key instead of a separate passphrase."},
+		{Name: "export-room", Usage: "[--iterations N] [--use-ssss] <file>",
+			Description: "Export encryption keys for the current room."},
+		{Name: "export-trust", Usage: "<file>", Description: "Export manual device trust decisions as a signed file."},
+		{Name: "import-trust", Usage: "<file>", Description: "Merge manual device trust decisions from a file.",
+			Details: "The file must have been exported by this device or one of your verified devices."},
+		{Name: "cross-signing", Usage: "<subcommand> [...]", Description: "Cross-signing commands.",
+			Details: "Somewhat experimental. Run without arguments for help."},
+		{Name: "ssss", Usage: "<subcommand> [...]", Description: "Secure Secret Storage (and Sharing) commands.",
+			Details: "Very experimental. Run without arguments for help."},
+		{Name: "crypto", Usage: "<subcommand> [...]", Description: "Miscellaneous encryption maintenance commands.",
+			Details: "Run without arguments for help."},
+		{Name: "keybackup", Usage: "<subcommand> [...]", Description: "Server-side key backup commands.",
+			Details: "Run without arguments for help."},
+		{Name: "importbackup", Usage: "[--room <room ID>] [--recovery-key]",
+			Description: "Import the sessions in the server-side key backup.",
+			Details:     "The backup key is fetched from SSSS."},
+	},
+}, {
+	Name: "Rooms",
+	Commands: []*CommandHelp{
+		{Name: "pm", Usage: "<user id> <...>", Description: "Create a private chat with the given user(s)."},
+		{Name: "create", Usage: "[room name]", Description: "Create a room."},
+		{Name: "join", Usage: "<room> [servers...]", Description: "Join a room.",
+			Details: "The room can be a room ID, alias, matrix.to link or matrix: URI. Servers in the link and " +
+				"after it are used to join through."},
+		{Name: "directory", Usage: "[--server <server>] [search term]", Description: "Browse the public room directory.",
+			Details: "Shows the directory of your homeserver or another server. Press enter on a room to join it."},
+		{Name: "accept", Description: "Accept the invite."},
+		{Name: "reject", Description: "Reject the invite."},
+		{Name: "invite", Usage: "<user id>", Description: "Invite the given user to the room."},
+		{Name: "roomnick", Usage: "<name>", Description: "Change your per-room displayname."},
+		{Name: "tag", Usage: "<tag> [order]", Description: "Add the room to a tag."},
+		{Name: "untag", Usage: "<tag>", Description: "Remove the room from a tag."},
+		{Name: "tags", Description: "List the tags the room is in."},
+		{Name: "alias", Usage: "<add|remove> <localpart>", Description: "Add or remove local addresses."},
+		{Name: "notify", Usage: "[room] [all|highlight|none|default]",
+			Description: "Show or change the notification level of a room.",
+			Details: "highlight only notifies about mentions and keywords, none mutes the room and default removes " +
+				"the room-specific rules."},
+		{Name: "keyword", Usage: "<add|remove|list> [keyword]", Description: "Manage notification keywords.",
+			Details: "Keywords notify you and highlight the message like a mention. Keywords match whole words and " +
+				"ignore case."},
+		{Name: "leave", Description: "Leave the current room."},
+		{Name: "kick", Usage: "<user id> [reason]", Description: "Kick a user."},
+		{Name: "ban", Usage: "<user id> [reason]", Description: "Ban a user."},
+		{Name: "unban", Usage: "<user id>", Description: "Unban a user."},
+		{Name: "upgrade", Usage: "[version]", Description: "Upgrade the room to a new room version."},
+		{Name: "follow-upgrade", Description: "Join and switch to the room that replaced this room (Alt+u)."},
+		{Name: "powerlevel", Usage: "[<user id> <level>]", Description: "Show or set power levels.",
+			Details: "Without arguments, the power levels of the room are shown. The level can be a number or " +
+				"admin, moderator or default."},
+	},
+}, {
+	Name: "Advanced",
+	Commands: []*CommandHelp{
+		{Name: "sendevent", Usage: "<room id> <event type> <content>", Description: "Send a custom event.",
+			Details: "The content is JSON."},
+		{Name: "msendevent", Usage: "<event type> <content>", Description: "Send a custom event in the current room."},
+		{Name: "setstate", Usage: "<room id> <event type> <state key/`-`> <content>",
+			Description: "Send a custom state event."},
+		{Name: "msetstate", Usage: "<event type> <state key> <content>",
+			Description: "Send a custom state event in the current room."},
+		{Name: "hprof", Usage: "[nogc]", Description: "Write a heap profile to gomuks.heap.prof."},
+		{Name: "cprof", Usage: "<seconds>", Description: "Write a CPU profile to gomuks.cpu.prof."},
+		{Name: "trace", Usage: "<seconds>", Description: "Write a call trace to gomuks.trace."},
+	},
+}}
+
+// makeCommandHelpIndex maps command names to their help.
+func makeCommandHelpIndex(categories []CommandCategory) map[string]*CommandHelp {
+	index := make(map[string]*CommandHelp)
+	for _, category := range categories {
+		for _, help := range category.Commands {
+			index[help.Name] = help
+		}
+	}
+	return index
+}
+
+// Signature returns the command with its arguments, like "/ban <user id> [reason]".
+func (help *CommandHelp) Signature() string {
+	if len(help.Usage) == 0 {
+		return "/" + help.Name
+	}
+	return fmt.Sprintf("/%s %s", help.Name, help.Usage)
+}
+
+// Matches checks if the command name or any of its descriptions contain the given lowercase query.
+func (help *CommandHelp) Matches(query string) bool {
+	return strings.Contains(help.Name, query) ||
+		strings.Contains(strings.ToLower(help.Description), query) ||
+		strings.Contains(strings.ToLower(help.Details), query)
+}
+
+// maxHelpSignatureWidth is the widest command signature that fits on the same line as the description in the list.
+const maxHelpSignatureWidth = 24
+
+// FormatCommandList formats the list of commands for the help dialog. If query is not empty, only the commands
+// matching it are included.
+func FormatCommandList(categories []CommandCategory, query string) string {
+	query = strings.ToLower(strings.TrimSpace(query))
+	var buf strings.Builder
+	for _, category := range categories {
+		var matches []*CommandHelp
+		for _, help := range category.Commands {
+			if len(query) == 0 || help.Matches(query) {
+				matches = append(matches, help)
+			}
+		}
+		if len(matches) == 0 {
+			continue
+		}
+		width := 0
+		for _, help := range matches {
+			if signatureWidth := runewidth.StringWidth(help.Signature()); signatureWidth <= maxHelpSignatureWidth &&
+				signatureWidth > width {
+				width = signatureWidth
+			}
+		}
+		if buf.Len() > 0 {
+			buf.WriteRune('\n')
+		}
+		_, _ = fmt.Fprintf(&buf, "# %s\n", category.Name)
+		for _, help := range matches {
+			signature := help.Signature()
+			if signatureWidth := runewidth.StringWidth(signature); signatureWidth > width {
+				_, _ = fmt.Fprintf(&buf, "%s\n%s  - %s\n", signature, strings.Repeat(" ", width), help.Description)
+			} else {
+				_, _ = fmt.Fprintf(&buf, "%s%s  - %s\n", signature, strings.Repeat(" ", width-signatureWidth),
+					help.Description)
+			}
+		}
+	}
+	if buf.Len() == 0 {
+		return fmt.Sprintf("No commands match %q", query)
+	}
+	return strings.TrimRight(buf.String(), "\n")
+}
+
+// FormatDetails formats the full help of a single command, including the aliases that point to it.
+func (help *CommandHelp) FormatDetails(aliases []string) string {
+	var buf strings.Builder
+	buf.WriteString(help.Signature())
+	buf.WriteRune('\n')
+	buf.WriteString(help.Description)
+	if len(help.Details) > 0 {
+		buf.WriteRune('\n')
+		buf.WriteString(help.Details)
+	}
+	if len(aliases) > 0 {
+		sort.Strings(aliases)
+		buf.WriteString("\nAliases: /")
+		buf.WriteString(strings.Join(aliases, ", /"))
+	}
+	return buf.String()
+}
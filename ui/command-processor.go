@@ -71,6 +71,7 @@ type CommandProcessor struct {
 
 	aliases  map[string]*Alias
 	commands map[string]CommandHandler
+	help     map[string]*CommandHelp
 
 	autocompleters map[string]CommandAutocompleter
 }
@@ -110,20 +111,36 @@ func NewCommandProcessor(parent *MainView) *CommandProcessor {
 			"s4":         {"ssss"},
 			"cs":         {"cross-signing"},
 		},
+		help: makeCommandHelpIndex(commandHelp),
 		autocompleters: map[string]CommandAutocompleter{
+			"help":          autocompleteCommandName,
 			"devices":       autocompleteUser,
 			"device":        autocompleteDevice,
 			"verify":        autocompleteUser,
 			"verify-device": autocompleteDevice,
+			"olm-sessions":  autocompleteDevice,
+			"verify-phrase": autocompleteDevice,
 			"unverify":      autocompleteDevice,
 			"blacklist":     autocompleteDevice,
 			"upload":        autocompleteFile,
 			"download":      autocompleteFile,
 			"open":          autocompleteFile,
 			"import":        autocompleteFile,
+			"verify-export": autocompleteFile,
 			"export":        autocompleteFile,
 			"export-room":   autocompleteFile,
+			"import-trust":  autocompleteFile,
+			"export-trust":  autocompleteFile,
 			"toggle":        autocompleteToggle,
+			"notify":        autocompleteNotify,
+			"kick":          autocompleteMember,
+			"ban":           autocompleteMember,
+			"ignore":        autocompleteMember,
+			"unignore":      autocompleteMember,
+			"powerlevel":    autocompletePowerLevel,
+			"keyword":       autocompleteKeyword,
+			"delete-device": autocompleteOwnDevice,
+			"ssss":          autocompleteSSSS,
 		},
 		commands: map[string]CommandHandler{
 			"unknown-command": cmdUnknownCommand,
@@ -137,15 +154,24 @@ func NewCommandProcessor(parent *MainView) *CommandProcessor {
 			"create":     cmdCreateRoom,
 			"pm":         cmdPrivateMessage,
 			"join":       cmdJoin,
+			"directory":  cmdDirectory,
 			"kick":       cmdKick,
 			"ban":        cmdBan,
+			"ignore":     cmdIgnore,
+			"unignore":   cmdUnignore,
 			"unban":      cmdUnban,
 			"toggle":     cmdToggle,
 			"logout":     cmdLogout,
+			"account":    cmdAccount,
+			"register":   cmdRegister,
+			"status":     cmdStatus,
 			"accept":     cmdAccept,
 			"reject":     cmdReject,
 			"reply":      cmdReply,
+			"quote":      cmdQuote,
+			"thread":     cmdThread,
 			"redact":     cmdRedact,
+			"search":     cmdSearch,
 			"react":      cmdReact,
 			"edit":       cmdEdit,
 			"external":   cmdExternalEditor,
@@ -162,11 +188,25 @@ func NewCommandProcessor(parent *MainView) *CommandProcessor {
 			"rainbow":    cmdRainbow,
 			"rainbowme":  cmdRainbowMe,
 			"notice":     cmdNotice,
+			"plain":      cmdPlain,
+			"html":       cmdHTML,
+			"location":   cmdLocation,
+			"spoiler":    cmdSpoiler,
+			"pin":        cmdPin,
+			"report":     cmdReport,
+			"unread":     cmdUnread,
+			"mention":    cmdMention,
+			"retry":      cmdRetry,
+			"unpin":      cmdUnpin,
+			"pins":       cmdPins,
 			"alias":      cmdAlias,
 			"tags":       cmdTags,
+			"notify":     cmdNotify,
+			"keyword":    cmdKeyword,
 			"tag":        cmdTag,
 			"untag":      cmdUntag,
 			"invite":     cmdInvite,
+			"powerlevel": cmdPowerLevel,
 			"hprof":      cmdHeapProfile,
 			"cprof":      cmdCPUProfile,
 			"trace":      cmdTrace,
@@ -176,19 +216,36 @@ func NewCommandProcessor(parent *MainView) *CommandProcessor {
 
 			"rainbownotice": cmdRainbowNotice,
 
+			"upgrade":        cmdUpgrade,
+			"follow-upgrade": cmdFollowUpgrade,
+
 			"fingerprint":   cmdFingerprint,
+			"whoami":        cmdWhoami,
 			"devices":       cmdDevices,
+			"delete-device": cmdDeleteDevice,
 			"verify-device": cmdVerifyDevice,
 			"verify":        cmdVerify,
+			"olm-sessions":  cmdOlmSessions,
+			"verify-phrase": cmdVerifyPhrase,
 			"device":        cmdDevice,
 			"unverify":      cmdUnverify,
 			"blacklist":     cmdBlacklist,
 			"reset-session": cmdResetSession,
 			"import":        cmdImportKeys,
+			"verify-export": cmdVerifyExport,
 			"export":        cmdExportKeys,
 			"export-room":   cmdExportRoomKeys,
+			"import-trust":  cmdImportTrust,
+			"export-trust":  cmdExportTrust,
 			"ssss":          cmdSSSS,
 			"cross-signing": cmdCrossSigning,
+			"crypto":        cmdCrypto,
+			"keybackup":     cmdKeyBackup,
+			"importbackup":  cmdImportBackup,
+			"key-requests":  cmdKeyRequests,
+			"keyrequest":    cmdKeyRequest,
+			"decrypt":       cmdDecrypt,
+			"undecryptable": cmdUndecryptable,
 		},
 	}
 }
@@ -227,7 +284,13 @@ func (ch *CommandProcessor) Autocomplete(roomView *RoomView, text string, cursor
 	var cmd *Command
 	if cmd = ch.ParseCommand(roomView, text); cmd == nil {
 		return completions, text, false
-	} else if alias, ok := ch.aliases[cmd.Command]; ok {
+	}
+	// Custom aliases that only rename a command get the completions of that command.
+	aliases, _ := ch.userAliases()
+	if template, ok := aliases[cmd.Command]; ok && !strings.ContainsAny(template, " $") {
+		cmd.Command = strings.ToLower(template)
+	}
+	if alias, ok := ch.aliases[cmd.Command]; ok {
 		cmd = alias.Process(cmd)
 	}
 
@@ -247,6 +310,15 @@ func (ch *CommandProcessor) AutocompleteCommand(word string) (completions []stri
 		return
 	}
 	word = word[1:]
+	userAliases, _ := ch.userAliases()
+	for alias := range userAliases {
+		if alias == word {
+			return []string{"/" + alias}
+		}
+		if strings.HasPrefix(alias, word) {
+			completions = append(completions, "/"+alias)
+		}
+	}
 	for alias := range ch.aliases {
 		if alias == word {
 			return []string{"/" + alias}
@@ -266,11 +338,39 @@ func (ch *CommandProcessor) AutocompleteCommand(word string) (completions []stri
 	return
 }
 
+// GetHelp returns the help of the given command or alias, and the aliases that point to the command.
+func (ch *CommandProcessor) GetHelp(command string) (help *CommandHelp, aliases []string) {
+	command = strings.ToLower(strings.TrimPrefix(command, "/"))
+	userAliases, _ := ch.userAliases()
+	if template, ok := userAliases[command]; ok {
+		return userAliasHelp(command, template), nil
+	}
+	if alias, ok := ch.aliases[command]; ok {
+		command = alias.NewCommand
+	}
+	help, ok := ch.help[command]
+	if !ok {
+		return nil, nil
+	}
+	for name, alias := range ch.aliases {
+		if alias.NewCommand == command {
+			aliases = append(aliases, name)
+		}
+	}
+	return help, aliases
+}
+
 func (ch *CommandProcessor) HandleCommand(cmd *Command) {
 	defer debug.Recover()
 	if cmd == nil {
 		return
 	}
+	resolved, err := ch.ResolveUserAliases(cmd)
+	if err != nil {
+		cmd.Reply("Failed to run command: %v", err)
+		return
+	}
+	cmd = resolved
 	if alias, ok := ch.aliases[cmd.Command]; ok {
 		cmd = alias.Process(cmd)
 	}
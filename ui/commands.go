@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"io"
 	"math"
 	"os"
@@ -31,6 +32,7 @@ import (
 	dbg "runtime/debug"
 	"runtime/pprof"
 	"runtime/trace"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -40,14 +42,21 @@ import (
 	"github.com/lucasb-eyer/go-colorful"
 	"github.com/yuin/goldmark"
 	"github.com/zyedidia/clipboard"
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/format"
 	"maunium.net/go/mautrix/id"
 
+	"maunium.net/go/gomuks/config"
 	"maunium.net/go/gomuks/debug"
+	ifc "maunium.net/go/gomuks/interface"
 	"maunium.net/go/gomuks/lib/filepicker"
+	"maunium.net/go/gomuks/matrix/muksevt"
+	"maunium.net/go/gomuks/matrix/rooms"
+	"maunium.net/go/gomuks/ui/messages"
 )
 
 func cmdMe(cmd *Command) {
@@ -123,10 +132,106 @@ func cmdRainbowNotice(cmd *Command) {
 	makeRainbow(cmd, event.MsgNotice)
 }
 
+func cmdPlain(cmd *Command) {
+	if len(strings.TrimSpace(cmd.RawArgs)) == 0 {
+		cmd.Reply("Usage: /plain <text>")
+		return
+	}
+	go cmd.Room.SendPlainMessage(event.MsgText, cmd.RawArgs)
+}
+
+// normalizeHTML parses the given HTML and renders it again, so that unclosed tags and other mistakes are fixed
+// before the HTML is sent.
+func normalizeHTML(input string) (string, error) {
+	context := &xhtml.Node{Type: xhtml.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := xhtml.ParseFragment(strings.NewReader(input), context)
+	if err != nil {
+		return "", err
+	}
+	var buf strings.Builder
+	for _, node := range nodes {
+		if err = xhtml.Render(&buf, node); err != nil {
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
+
+func cmdHTML(cmd *Command) {
+	input := strings.TrimSpace(cmd.RawArgs)
+	if len(input) == 0 {
+		cmd.Reply("Usage: /html <html>")
+		return
+	}
+	htmlBody, err := normalizeHTML(input)
+	if err != nil {
+		cmd.Reply("Failed to parse HTML: %v", err)
+		return
+	}
+	text := format.HTMLToText(htmlBody)
+	if len(strings.TrimSpace(text)) == 0 {
+		cmd.Reply("The HTML doesn't contain any text")
+		return
+	}
+	go cmd.Room.SendMessageHTML(event.MsgText, text, htmlBody)
+}
+
+func cmdSpoiler(cmd *Command) {
+	text := strings.TrimSpace(cmd.RawArgs)
+	var reason string
+	if strings.HasPrefix(text, "[") {
+		if end := strings.IndexRune(text, ']'); end > 0 {
+			reason = strings.TrimSpace(text[1:end])
+			text = strings.TrimSpace(text[end+1:])
+		}
+	}
+	if len(text) == 0 {
+		cmd.Reply("Usage: /spoiler [[reason]] <text>")
+		return
+	}
+
+	content := format.RenderMarkdown(text, !cmd.Config.Preferences.DisableMarkdown, !cmd.Config.Preferences.DisableHTML)
+	inner := content.FormattedBody
+	if content.Format != event.FormatHTML {
+		inner = strings.ReplaceAll(html.EscapeString(content.Body), "\n", "<br>")
+	}
+	var htmlBody, body string
+	if len(reason) > 0 {
+		htmlBody = fmt.Sprintf(`<span data-mx-spoiler="%s">%s</span>`, html.EscapeString(reason), inner)
+		body = fmt.Sprintf("[Spoiler: %s] %s", reason, content.Body)
+	} else {
+		htmlBody = fmt.Sprintf("<span data-mx-spoiler>%s</span>", inner)
+		body = fmt.Sprintf("[Spoiler] %s", content.Body)
+	}
+	go cmd.Room.SendMessageHTML(event.MsgText, body, htmlBody)
+}
+
 func cmdNotice(cmd *Command) {
 	go cmd.Room.SendMessage(event.MsgNotice, strings.Join(cmd.Args, " "))
 }
 
+func cmdLocation(cmd *Command) {
+	if len(cmd.Args) < 2 {
+		cmd.Reply("Usage: /location <latitude> <longitude> [description]")
+		return
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSuffix(cmd.Args[0], ","), 64)
+	if err != nil {
+		cmd.Reply("Invalid latitude %q", cmd.Args[0])
+		return
+	}
+	lon, err := strconv.ParseFloat(cmd.Args[1], 64)
+	if err != nil {
+		cmd.Reply("Invalid longitude %q", cmd.Args[1])
+		return
+	}
+	if !messages.ValidCoordinates(lat, lon) {
+		cmd.Reply("Latitude must be between -90 and 90 and longitude between -180 and 180")
+		return
+	}
+	go cmd.Room.SendLocation(messages.FormatGeoURI(lat, lon), strings.Join(cmd.Args[2:], " "))
+}
+
 func cmdAccept(cmd *Command) {
 	room := cmd.Room.MxRoom()
 	if room.SessionMember.Membership != "invite" {
@@ -165,20 +270,62 @@ func cmdID(cmd *Command) {
 
 type SelectReason string
 
+// defaultReaction is the reaction toggled by the react keybinding.
+const defaultReaction = "👍"
+
 const (
-	SelectReply    SelectReason = "reply to"
-	SelectReact                 = "react to"
-	SelectRedact                = "redact"
-	SelectEdit                  = "edit"
-	SelectDownload              = "download"
-	SelectOpen                  = "open"
-	SelectCopy                  = "copy"
+	SelectReply      SelectReason = "reply to"
+	SelectReact                   = "react to"
+	SelectRedact                  = "redact"
+	SelectEdit                    = "edit"
+	SelectDownload                = "download"
+	SelectOpen                    = "open"
+	SelectCopy                    = "copy"
+	SelectKeyRequest              = "request keys for"
+	SelectDecrypt                 = "decrypt"
+	SelectThread                  = "reply in thread to"
+	SelectPin                     = "pin"
+	SelectUnpin                   = "unpin"
+	SelectQuote                   = "quote"
+	SelectReport                  = "report"
 )
 
 func cmdReply(cmd *Command) {
 	cmd.Room.StartSelecting(SelectReply, strings.Join(cmd.Args, " "))
 }
 
+func cmdQuote(cmd *Command) {
+	cmd.Room.StartSelecting(SelectQuote, strings.Join(cmd.Args, " "))
+}
+
+func cmdThread(cmd *Command) {
+	if len(cmd.Args) == 0 {
+		cmd.Room.StartSelecting(SelectThread, "")
+		return
+	} else if len(cmd.Args) > 1 {
+		cmd.Reply("Usage: /thread [event ID]")
+		return
+	}
+	eventID := id.EventID(cmd.Args[0])
+	var evt *muksevt.Event
+	if msg := cmd.Room.MessageView().getMessageByID(eventID); msg != nil {
+		evt = msg.Event
+	} else {
+		var err error
+		evt, err = cmd.Matrix.GetEvent(cmd.Room.Room, eventID)
+		if err != nil {
+			cmd.Reply("Failed to get event %s: %v", eventID, err)
+			return
+		}
+	}
+	if evt == nil {
+		cmd.Reply("Event %s not found", eventID)
+		return
+	}
+	cmd.Room.StartThread(evt)
+	cmd.UI.Render()
+}
+
 func cmdEdit(cmd *Command) {
 	cmd.Room.StartSelecting(SelectEdit, "")
 }
@@ -256,6 +403,58 @@ func cmdRedact(cmd *Command) {
 	cmd.Room.StartSelecting(SelectRedact, strings.Join(cmd.Args, " "))
 }
 
+// cmdSearch highlights the loaded messages matching the query. If nothing matches, or if --server or --all is given,
+// the server-side search API is used instead, which can't search encrypted rooms.
+func cmdSearch(cmd *Command) {
+	serverSearch := false
+	roomID := cmd.Room.Room.ID
+	args := cmd.Args
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		switch args[0] {
+		case "--server":
+			serverSearch = true
+		case "--all":
+			serverSearch = true
+			roomID = ""
+		default:
+			cmd.Reply("Unknown flag %s. Usage: /search [--server|--all] <query>", args[0])
+			return
+		}
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		cmd.Room.ClearSearch()
+		cmd.Reply("Usage: /search [--server|--all] <query>")
+		return
+	}
+	query := strings.Join(args, " ")
+	if !serverSearch {
+		if matches := cmd.Room.Search(query); matches > 0 {
+			cmd.Reply("Found %d loaded messages matching \"%s\", use Alt+n and Alt+p to jump between them", matches, query)
+			return
+		} else if cmd.Room.Room.Encrypted {
+			cmd.Reply("No loaded messages match \"%s\". The server can't search encrypted rooms, "+
+				"so only loaded messages were searched.", query)
+			return
+		}
+	}
+	results, err := cmd.Matrix.Search(query, roomID, "")
+	if errors.Is(err, ifc.ErrSearchUnsupported) {
+		cmd.Reply("Your homeserver doesn't support searching messages, only loaded messages can be searched")
+		return
+	} else if err != nil {
+		cmd.Reply("Failed to search messages on the server: %v", err)
+		return
+	} else if len(results.Results) == 0 {
+		cmd.Reply("No results for \"%s\" on the server", query)
+		return
+	}
+	modal := NewSearchResultsModal(cmd.MainView, roomID, query, 100, 25)
+	modal.AddResults(results)
+	cmd.MainView.ShowModal(modal)
+	cmd.UI.Render()
+}
+
 func cmdDownload(cmd *Command) {
 	cmd.Room.StartSelecting(SelectDownload, strings.Join(cmd.Args, " "))
 }
@@ -344,6 +543,46 @@ func cmdCopy(cmd *Command) {
 	}
 }
 
+func cmdPin(cmd *Command) {
+	cmd.Room.StartSelecting(SelectPin, "")
+}
+
+func cmdUnread(cmd *Command) {
+	go cmd.Room.JumpToUnread()
+}
+
+func cmdMention(cmd *Command) {
+	if len(cmd.Args) == 0 || cmd.Args[0] == "prev" {
+		go cmd.Room.JumpToMention(false)
+	} else if cmd.Args[0] == "next" {
+		go cmd.Room.JumpToMention(true)
+	} else {
+		cmd.Reply("Usage: /mention [prev|next]")
+	}
+}
+
+func cmdRetry(cmd *Command) {
+	if len(cmd.Args) == 0 {
+		go cmd.Room.RetrySend()
+	} else if cmd.Args[0] == "cancel" {
+		go cmd.Room.CancelRetry()
+	} else {
+		cmd.Reply("Usage: /retry [cancel]")
+	}
+}
+
+func cmdReport(cmd *Command) {
+	cmd.Room.StartSelecting(SelectReport, strings.Join(cmd.Args, " "))
+}
+
+func cmdUnpin(cmd *Command) {
+	cmd.Room.StartSelecting(SelectUnpin, "")
+}
+
+func cmdPins(cmd *Command) {
+	cmd.Room.ShowPinnedMessages()
+}
+
 func cmdReact(cmd *Command) {
 	if len(cmd.Args) == 0 {
 		cmd.Reply("Usage: /react <reaction>")
@@ -432,6 +671,238 @@ func cmdResolveAlias(cmd *Command, alias id.RoomAlias) {
 	}
 }
 
+var notificationLevels = map[ifc.RoomNotificationLevel]string{
+	ifc.NotifyDefault:   "the global notification settings apply",
+	ifc.NotifyAll:       "notify about all messages",
+	ifc.NotifyHighlight: "only notify about mentions and keywords",
+	ifc.NotifyNone:      "muted",
+}
+
+func cmdNotify(cmd *Command) {
+	const usage = "Usage: /notify [room] [all|highlight|none|default]"
+	if len(cmd.Args) > 2 {
+		cmd.Reply(usage)
+		return
+	}
+	room := cmd.Room.Room
+	args := cmd.Args
+	if len(args) > 0 {
+		if _, isLevel := notificationLevels[ifc.RoomNotificationLevel(strings.ToLower(args[0]))]; !isLevel {
+			roomID := id.RoomID(args[0])
+			if args[0][0] == '#' {
+				resp, err := cmd.Matrix.Client().ResolveAlias(id.RoomAlias(args[0]))
+				if err != nil {
+					cmd.Reply("Failed to resolve alias: %v", niceError(err))
+					return
+				}
+				roomID = resp.RoomID
+			}
+			room = cmd.Matrix.GetRoom(roomID)
+			if room == nil {
+				cmd.Reply("Room %s not found", args[0])
+				return
+			}
+			args = args[1:]
+		}
+	}
+	if len(args) == 0 {
+		level := cmd.Matrix.GetRoomNotificationLevel(room.ID)
+		cmd.Reply("Notification level of %s is %s (%s)", room.GetTitle(), level, notificationLevels[level])
+		return
+	}
+	level := ifc.RoomNotificationLevel(strings.ToLower(args[0]))
+	if _, ok := notificationLevels[level]; !ok {
+		cmd.Reply(usage)
+		return
+	}
+	err := cmd.Matrix.SetRoomNotificationLevel(room.ID, level)
+	if err != nil {
+		cmd.Reply("Failed to change notification level: %v", err)
+		return
+	}
+	cmd.Reply("Notification level of %s set to %s (%s)", room.GetTitle(), level, notificationLevels[level])
+}
+
+func cmdKeyword(cmd *Command) {
+	const usage = "Usage: /keyword <add|remove|list> [keyword]"
+	if len(cmd.Args) == 0 {
+		cmd.Reply(usage)
+		return
+	}
+	keyword := strings.Join(cmd.Args[1:], " ")
+	switch strings.ToLower(cmd.Args[0]) {
+	case "list":
+		keywords := cmd.Matrix.Keywords()
+		if len(keywords) == 0 {
+			cmd.Reply("No keywords set")
+		} else {
+			cmd.Reply("Keywords: %s", strings.Join(keywords, ", "))
+		}
+	case "add":
+		if len(keyword) == 0 {
+			cmd.Reply(usage)
+			return
+		}
+		err := cmd.Matrix.AddKeyword(keyword)
+		if err != nil {
+			cmd.Reply("Failed to add keyword: %v", niceError(err))
+		} else {
+			cmd.Reply("Added keyword %s", keyword)
+		}
+	case "remove", "rm", "delete", "del":
+		if len(keyword) == 0 {
+			cmd.Reply(usage)
+			return
+		}
+		err := cmd.Matrix.RemoveKeyword(keyword)
+		if err != nil {
+			cmd.Reply("Failed to remove keyword: %v", niceError(err))
+		} else {
+			cmd.Reply("Removed keyword %s", keyword)
+		}
+	default:
+		cmd.Reply(usage)
+	}
+}
+
+// findAccount finds a saved account by user ID or by its number in /account list.
+func findAccount(cmd *Command, query string) *config.Account {
+	if index, err := strconv.Atoi(query); err == nil {
+		if index < 1 || index > len(cmd.Config.Accounts) {
+			return nil
+		}
+		return &cmd.Config.Accounts[index-1]
+	}
+	return cmd.Config.GetAccount(id.UserID(query))
+}
+
+func cmdAccount(cmd *Command) {
+	const usage = "Usage: /account <list|add|switch|remove> [user ID or number]"
+	if len(cmd.Args) == 0 {
+		cmd.Reply(usage)
+		return
+	}
+	switch strings.ToLower(cmd.Args[0]) {
+	case "list", "ls":
+		var buf strings.Builder
+		_, _ = fmt.Fprintf(&buf, "Active account: %s", cmd.Config.UserID)
+		if len(cmd.Config.Accounts) == 0 {
+			buf.WriteString("\nNo other accounts saved, use /account add <user ID> to add one")
+		}
+		for i, account := range cmd.Config.Accounts {
+			_, _ = fmt.Fprintf(&buf, "\n%d. %s (%s)", i+1, account.UserID, account.HS)
+		}
+		cmd.Reply("%s", buf.String())
+	case "add":
+		if len(cmd.Args) < 2 {
+			cmd.Reply("Usage: /account add <user ID>")
+			return
+		}
+		userID := id.UserID(cmd.Args[1])
+		password, ok := cmd.MainView.AskPassword(fmt.Sprintf("Password of %s", userID), "", "", false)
+		if !ok {
+			cmd.Reply("Password entry cancelled, account was not added")
+			return
+		}
+		cmd.Reply("Logging in as %s...", userID)
+		err := cmd.Matrix.AddAccount(userID, password)
+		if err != nil {
+			cmd.Reply("Failed to add account: %v", niceError(err))
+		} else {
+			cmd.Reply("Added %s, use /account switch %s to switch to it", userID, userID)
+		}
+	case "switch", "sw":
+		if len(cmd.Args) < 2 {
+			cmd.Reply("Usage: /account switch <user ID or number>")
+			return
+		}
+		account := findAccount(cmd, cmd.Args[1])
+		if account == nil {
+			cmd.Reply("%s is not a saved account, see /account list", cmd.Args[1])
+			return
+		}
+		cmd.Reply("Switching to %s...", account.UserID)
+		cmd.MainView.SwitchAccount(account.UserID)
+	case "remove", "rm", "delete", "del":
+		if len(cmd.Args) < 2 {
+			cmd.Reply("Usage: /account remove <user ID or number>")
+			return
+		}
+		account := findAccount(cmd, cmd.Args[1])
+		if account == nil {
+			cmd.Reply("%s is not a saved account, see /account list", cmd.Args[1])
+			return
+		}
+		userID := account.UserID
+		err := cmd.Matrix.RemoveAccount(userID)
+		if err != nil {
+			cmd.Reply("Failed to remove account: %v", err)
+		} else {
+			cmd.Reply("Logged out of and removed %s", userID)
+		}
+	default:
+		cmd.Reply(usage)
+	}
+}
+
+func cmdRegister(cmd *Command) {
+	if len(cmd.Args) != 1 {
+		cmd.Reply("Usage: /register <user ID>")
+		return
+	}
+	userID := id.UserID(cmd.Args[0])
+	if _, _, err := userID.Parse(); err != nil {
+		cmd.Reply("%s is not a valid user ID", userID)
+		return
+	}
+	password, ok := cmd.MainView.AskPassword(fmt.Sprintf("Password for %s", userID), "", "", true)
+	if !ok {
+		cmd.Reply("Password entry cancelled, account was not registered")
+		return
+	}
+	askToken := func() (string, bool) {
+		return cmd.MainView.AskPassword("Registration token", "", "", false)
+	}
+	cmd.Reply("Registering %s...", userID)
+	err := cmd.Matrix.RegisterAccount(userID, password, askToken)
+	if err != nil {
+		cmd.Reply("Failed to register account: %v", niceError(err))
+	} else {
+		cmd.Reply("Registered %s, use /account switch %s to switch to it", userID, userID)
+	}
+}
+
+func cmdStatus(cmd *Command) {
+	const usage = "Usage: /status <online|away|offline> [message]"
+	if len(cmd.Args) == 0 {
+		cmd.Reply(usage)
+		return
+	}
+	var presence event.Presence
+	switch strings.ToLower(cmd.Args[0]) {
+	case "online":
+		presence = event.PresenceOnline
+	case "away", "unavailable":
+		presence = event.PresenceUnavailable
+	case "offline":
+		presence = event.PresenceOffline
+	default:
+		cmd.Reply(usage)
+		return
+	}
+	message := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(cmd.RawArgs), cmd.Args[0]))
+	err := cmd.Matrix.SetPresence(presence, message)
+	if errors.Is(err, ifc.ErrPresenceDisabled) {
+		cmd.Reply("Presence is disabled on your homeserver")
+	} else if err != nil {
+		cmd.Reply("Failed to set status: %v", err)
+	} else if len(message) > 0 {
+		cmd.Reply("Set presence to %s with status message \"%s\"", presence, message)
+	} else {
+		cmd.Reply("Set presence to %s", presence)
+	}
+}
+
 func cmdTags(cmd *Command) {
 	tags := cmd.Room.MxRoom().RawTags
 	if len(cmd.Args) > 0 && cmd.Args[0] == "--internal" {
@@ -509,15 +980,6 @@ func cmdRoomNick(cmd *Command) {
 	}
 }
 
-func cmdFingerprint(cmd *Command) {
-	c := cmd.Matrix.Crypto()
-	if c == nil {
-		cmd.Reply("Encryption support is not enabled")
-	} else {
-		cmd.Reply("Device ID: %s\nFingerprint: %s", cmd.Matrix.Client().DeviceID, c.Fingerprint())
-	}
-}
-
 func cmdHeapProfile(cmd *Command) {
 	if len(cmd.Args) == 0 || cmd.Args[0] != "nogc" {
 		runtime.GC()
@@ -586,8 +1048,17 @@ func cmdUnknownCommand(cmd *Command) {
 }
 
 func cmdHelp(cmd *Command) {
-	view := cmd.MainView
-	view.ShowModal(NewHelpModal(view))
+	if len(cmd.Args) == 0 {
+		view := cmd.MainView
+		view.ShowModal(NewHelpModal(view))
+		return
+	}
+	help, aliases := cmd.Handler.GetHelp(cmd.Args[0])
+	if help == nil {
+		cmd.Reply(`Unknown command "/%s". Try "/help" for a list of commands.`, strings.TrimPrefix(cmd.Args[0], "/"))
+		return
+	}
+	cmd.Reply("%s", help.FormatDetails(aliases))
 }
 
 func cmdLeave(cmd *Command) {
@@ -598,12 +1069,56 @@ func cmdLeave(cmd *Command) {
 	}
 }
 
+// checkMembershipPermission checks that the user's power level is high enough to change the membership of the
+// target user, so that the user gets a clear error instead of a server-side rejection. If the room doesn't have a
+// power level event cached, the server is left to decide.
+func checkMembershipPermission(cmd *Command, action string, target id.UserID) bool {
+	plEvent := cmd.Room.MxRoom().GetStateEvent(event.StatePowerLevels, "")
+	if plEvent == nil {
+		return true
+	}
+	pls := plEvent.Content.AsPowerLevels()
+	ownLevel := pls.GetUserLevel(cmd.Matrix.Client().UserID)
+	var required int
+	switch action {
+	case "invite":
+		// The spec default for inviting is 0, unlike kicking and banning
+		if pls.InvitePtr != nil {
+			required = *pls.InvitePtr
+		}
+	case "kick":
+		required = pls.Kick()
+	case "ban":
+		required = pls.Ban()
+	case "unban":
+		// Unbanning requires the power to both ban and kick
+		required = pls.Ban()
+		if pls.Kick() > required {
+			required = pls.Kick()
+		}
+	}
+	if ownLevel < required {
+		cmd.Reply("You need power level %d to %s users in this room, but yours is %d", required, action, ownLevel)
+		return false
+	} else if action != "invite" {
+		if targetLevel := pls.GetUserLevel(target); targetLevel >= ownLevel {
+			cmd.Reply("You can't %s %s: their power level (%d) isn't lower than yours (%d)", action, target, targetLevel, ownLevel)
+			return false
+		}
+	}
+	return true
+}
+
 func cmdInvite(cmd *Command) {
 	if len(cmd.Args) != 1 {
 		cmd.Reply("Usage: /invite <user id>")
 		return
 	}
-	_, err := cmd.Matrix.Client().InviteUser(cmd.Room.MxRoom().ID, &mautrix.ReqInviteUser{UserID: id.UserID(cmd.Args[0])})
+	userID := id.UserID(cmd.Args[0])
+	if !checkMembershipPermission(cmd, "invite", userID) {
+		return
+	}
+	_, err := cmd.Matrix.Client().InviteUser(cmd.Room.MxRoom().ID, &mautrix.ReqInviteUser{UserID: userID})
 	if err != nil {
 		debug.Print("Error in invite call:", err)
 		cmd.Reply("Failed to invite user: %v", err)
@@ -619,7 +1134,11 @@ func cmdBan(cmd *Command) {
 	if len(cmd.Args) >= 2 {
 		reason = strings.Join(cmd.Args[1:], " ")
 	}
-	_, err := cmd.Matrix.Client().BanUser(cmd.Room.MxRoom().ID, &mautrix.ReqBanUser{Reason: reason, UserID: id.UserID(cmd.Args[0])})
+	userID := id.UserID(cmd.Args[0])
+	if !checkMembershipPermission(cmd, "ban", userID) {
+		return
+	}
+	_, err := cmd.Matrix.Client().BanUser(cmd.Room.MxRoom().ID, &mautrix.ReqBanUser{Reason: reason, UserID: userID})
 	if err != nil {
 		debug.Print("Error in ban call:", err)
 		cmd.Reply("Failed to ban user: %v", err)
@@ -632,7 +1151,15 @@ func cmdUnban(cmd *Command) {
 		cmd.Reply("Usage: /unban <user>")
 		return
 	}
-	_, err := cmd.Matrix.Client().UnbanUser(cmd.Room.MxRoom().ID, &mautrix.ReqUnbanUser{UserID: id.UserID(cmd.Args[0])})
+	userID := id.UserID(cmd.Args[0])
+	// Members are lazy-loaded, so only a loaded member event with another membership means the user isn't banned.
+	if member := cmd.Room.MxRoom().GetMember(userID); member != nil && member.Membership != event.MembershipBan {
+		cmd.Reply("%s isn't banned from this room", userID)
+		return
+	} else if !checkMembershipPermission(cmd, "unban", userID) {
+		return
+	}
+	_, err := cmd.Matrix.Client().UnbanUser(cmd.Room.MxRoom().ID, &mautrix.ReqUnbanUser{UserID: userID})
 	if err != nil {
 		debug.Print("Error in unban call:", err)
 		cmd.Reply("Failed to unban user: %v", err)
@@ -648,10 +1175,234 @@ func cmdKick(cmd *Command) {
 	if len(cmd.Args) >= 2 {
 		reason = strings.Join(cmd.Args[1:], " ")
 	}
-	_, err := cmd.Matrix.Client().KickUser(cmd.Room.MxRoom().ID, &mautrix.ReqKickUser{Reason: reason, UserID: id.UserID(cmd.Args[0])})
+	userID := id.UserID(cmd.Args[0])
+	// Members are lazy-loaded, so a missing member event doesn't mean the user isn't in the room.
+	if member := cmd.Room.MxRoom().GetMember(userID); member != nil &&
+		(member.Membership == event.MembershipLeave || member.Membership == event.MembershipBan) {
+		cmd.Reply("%s isn't in this room", userID)
+		return
+	} else if !checkMembershipPermission(cmd, "kick", userID) {
+		return
+	}
+	_, err := cmd.Matrix.Client().KickUser(cmd.Room.MxRoom().ID, &mautrix.ReqKickUser{Reason: reason, UserID: userID})
 	if err != nil {
 		debug.Print("Error in kick call:", err)
-		debug.Print("Failed to kick user:", err)
+		cmd.Reply("Failed to kick user: %v", err)
+	}
+}
+
+func cmdIgnore(cmd *Command) {
+	if len(cmd.Args) == 0 {
+		ignored := cmd.Matrix.IgnoredUsers()
+		if len(ignored) == 0 {
+			cmd.Reply("You haven't ignored anyone")
+			return
+		}
+		var buf strings.Builder
+		buf.WriteString("Ignored users:")
+		for _, userID := range ignored {
+			_, _ = fmt.Fprintf(&buf, "\n* %s", userID)
+		}
+		cmd.Reply("%s", buf.String())
+		return
+	} else if len(cmd.Args) != 1 {
+		cmd.Reply("Usage: /ignore [user]")
+		return
+	}
+	userID := id.UserID(cmd.Args[0])
+	if _, _, err := userID.Parse(); err != nil {
+		cmd.Reply("%s is not a valid user ID", userID)
+		return
+	}
+	err := cmd.Matrix.IgnoreUser(userID)
+	if err != nil {
+		cmd.Reply("Failed to ignore user: %v", err)
+	} else {
+		cmd.Reply("Ignored %s", userID)
+	}
+}
+
+func cmdUnignore(cmd *Command) {
+	if len(cmd.Args) != 1 {
+		cmd.Reply("Usage: /unignore <user>")
+		return
+	}
+	userID := id.UserID(cmd.Args[0])
+	if !cmd.Matrix.IsIgnored(userID) {
+		cmd.Reply("%s isn't ignored", userID)
+		return
+	}
+	err := cmd.Matrix.UnignoreUser(userID)
+	if err != nil {
+		cmd.Reply("Failed to unignore user: %v", err)
+	} else {
+		cmd.Reply("Unignored %s", userID)
+	}
+}
+
+var namedPowerLevels = map[string]int{
+	"admin":     100,
+	"moderator": 50,
+	"mod":       50,
+	"default":   0,
+	"user":      0,
+}
+
+func formatPowerLevels(room *rooms.Room, pls *event.PowerLevelsEventContent) string {
+	var buf strings.Builder
+	buf.WriteString("Power levels in this room:\n")
+	userIDs := make([]id.UserID, 0, len(pls.Users))
+	for userID := range pls.Users {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Slice(userIDs, func(i, j int) bool {
+		levelI, levelJ := pls.GetUserLevel(userIDs[i]), pls.GetUserLevel(userIDs[j])
+		if levelI != levelJ {
+			return levelI > levelJ
+		}
+		return userIDs[i] < userIDs[j]
+	})
+	for _, userID := range userIDs {
+		fmt.Fprintf(&buf, "  %4d  %s", pls.GetUserLevel(userID), userID)
+		if member := room.GetMember(userID); member != nil && len(member.Displayname) > 0 {
+			fmt.Fprintf(&buf, " (%s)", member.Displayname)
+		}
+		buf.WriteRune('\n')
+	}
+	fmt.Fprintf(&buf, "  %4d  everyone else\n", pls.UsersDefault)
+	invite := 0
+	if pls.InvitePtr != nil {
+		invite = *pls.InvitePtr
+	}
+	buf.WriteString("Required levels:\n")
+	fmt.Fprintf(&buf, "  %4d  invite\n  %4d  kick\n  %4d  ban\n  %4d  redact others' messages\n",
+		invite, pls.Kick(), pls.Ban(), pls.Redact())
+	fmt.Fprintf(&buf, "  %4d  send messages\n  %4d  change settings\n", pls.EventsDefault, pls.StateDefault())
+	eventTypes := make([]string, 0, len(pls.Events))
+	for eventType := range pls.Events {
+		eventTypes = append(eventTypes, eventType)
+	}
+	sort.Strings(eventTypes)
+	for _, eventType := range eventTypes {
+		fmt.Fprintf(&buf, "  %4d  %s\n", pls.Events[eventType], eventType)
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func cmdPowerLevel(cmd *Command) {
+	const usage = "Usage: /powerlevel [<user> <level|admin|moderator|default>]"
+	room := cmd.Room.MxRoom()
+	plEvent := room.GetStateEvent(event.StatePowerLevels, "")
+	if plEvent == nil {
+		cmd.Reply("This room doesn't have a power level event")
+		return
+	}
+	pls := plEvent.Content.AsPowerLevels()
+	if len(cmd.Args) == 0 {
+		cmd.Reply("%s", formatPowerLevels(room, pls))
+		return
+	} else if len(cmd.Args) != 2 {
+		cmd.Reply(usage)
+		return
+	}
+
+	userID := id.UserID(cmd.Args[0])
+	level, isNamed := namedPowerLevels[strings.ToLower(cmd.Args[1])]
+	if !isNamed {
+		var err error
+		level, err = strconv.Atoi(cmd.Args[1])
+		if err != nil {
+			cmd.Reply(usage)
+			return
+		}
+	}
+	ownUserID := cmd.Matrix.Client().UserID
+	ownLevel := pls.GetUserLevel(ownUserID)
+	if required := pls.GetEventLevel(event.StatePowerLevels); ownLevel < required {
+		cmd.Reply("You need power level %d to change power levels in this room, but yours is %d", required, ownLevel)
+		return
+	} else if level > ownLevel {
+		cmd.Reply("You can't set a power level higher than your own (%d)", ownLevel)
+		return
+	} else if targetLevel := pls.GetUserLevel(userID); userID != ownUserID && targetLevel >= ownLevel {
+		cmd.Reply("You can't change the power level of %s: it (%d) isn't lower than yours (%d)", userID, targetLevel, ownLevel)
+		return
+	}
+
+	// Go through the raw JSON so that fields gomuks doesn't know about are preserved
+	rawContent, err := json.Marshal(&plEvent.Content)
+	if err != nil {
+		cmd.Reply("Failed to read current power levels: %v", err)
+		return
+	}
+	var content map[string]interface{}
+	if err = json.Unmarshal(rawContent, &content); err != nil {
+		cmd.Reply("Failed to read current power levels: %v", err)
+		return
+	}
+	users, _ := content["users"].(map[string]interface{})
+	if users == nil {
+		users = make(map[string]interface{})
+		content["users"] = users
+	}
+	users[string(userID)] = level
+	_, err = cmd.Matrix.Client().SendStateEvent(room.ID, event.StatePowerLevels, "", content)
+	if err != nil {
+		cmd.Reply("Failed to set power level: %v", niceError(err))
+	} else {
+		cmd.Reply("Set power level of %s to %d", userID, level)
+	}
+}
+
+func cmdFollowUpgrade(cmd *Command) {
+	cmd.Room.FollowUpgrade()
+}
+
+func cmdUpgrade(cmd *Command) {
+	if len(cmd.Args) > 1 {
+		cmd.Reply("Usage: /upgrade [room version]")
+		return
+	}
+	room := cmd.Room.MxRoom()
+	if room.IsReplaced() {
+		cmd.Reply("This room has already been upgraded")
+		return
+	}
+	if plEvent := room.GetStateEvent(event.StatePowerLevels, ""); plEvent != nil {
+		pls := plEvent.Content.AsPowerLevels()
+		ownLevel := pls.GetUserLevel(cmd.Matrix.Client().UserID)
+		if required := pls.GetEventLevel(event.StateTombstone); ownLevel < required {
+			cmd.Reply("You need power level %d to upgrade this room, but yours is %d", required, ownLevel)
+			return
+		}
+	}
+	defaultVersion, available, err := cmd.Matrix.RoomVersions()
+	if err != nil {
+		cmd.Reply("Failed to get supported room versions: %v", niceError(err))
+		return
+	}
+	version := defaultVersion
+	if len(cmd.Args) > 0 {
+		version = cmd.Args[0]
+	}
+	if _, ok := available[version]; !ok {
+		versions := make([]string, 0, len(available))
+		for availableVersion, stability := range available {
+			versions = append(versions, fmt.Sprintf("%s (%s)", availableVersion, stability))
+		}
+		sort.Strings(versions)
+		cmd.Reply("Room version %q isn't supported by the server. Supported versions: %s", version, strings.Join(versions, ", "))
+		return
+	}
+	replacement, err := cmd.Matrix.UpgradeRoom(room.ID, version)
+	if err != nil {
+		cmd.Reply("Failed to upgrade room: %v", niceError(err))
+		return
+	}
+	cmd.Reply("Room upgraded to version %s", version)
+	// The tombstone may not have come down sync yet, so the replacement room from the response is used directly
+	if err = cmd.MainView.switchToUpgradedRoom(room, replacement, ""); err != nil {
+		cmd.Reply("Failed to switch to the upgraded room: %v", err)
 	}
 }
 
@@ -694,23 +1445,82 @@ func cmdPrivateMessage(cmd *Command) {
 	cmd.MainView.SwitchRoom("", room)
 }
 
+// parseJoinTarget parses the room to join and the servers to join through. The room can be a room ID, an alias, a
+// matrix.to link or a matrix: URI, and links can have via servers in their query.
+func parseJoinTarget(target string) (roomID id.RoomID, via []string, err error) {
+	if !strings.HasPrefix(target, "https://") && !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "matrix:") {
+		return id.RoomID(target), nil, nil
+	}
+	uri, err := id.ParseMatrixURIOrMatrixToURL(target)
+	if err != nil {
+		return "", nil, err
+	} else if uri.Sigil1 != '!' && uri.Sigil1 != '#' {
+		return "", nil, fmt.Errorf("that link doesn't point to a room")
+	}
+	return id.RoomID(uri.PrimaryIdentifier()), uri.Via, nil
+}
+
 func cmdJoin(cmd *Command) {
 	if len(cmd.Args) == 0 {
-		cmd.Reply("Usage: /join <room>")
+		cmd.Reply("Usage: /join <room ID, alias or link> [via servers...]")
 		return
 	}
-	identifer := id.RoomID(cmd.Args[0])
-	server := ""
-	if len(cmd.Args) > 1 {
-		server = cmd.Args[1]
+	identifier, via, err := parseJoinTarget(cmd.Args[0])
+	if err != nil {
+		cmd.Reply("Failed to parse room link: %v", err)
+		return
 	}
-	room, err := cmd.Matrix.JoinRoom(identifer, server)
-	debug.Print("Join room error:", err)
-	if err == nil {
-		cmd.MainView.AddRoom(room)
+	via = append(via, cmd.Args[1:]...)
+	if len(via) == 0 && strings.HasPrefix(string(identifier), "!") {
+		// Room IDs can't be resolved like aliases, so try the server that created the room if no servers were given.
+		if colon := strings.IndexRune(string(identifier), ':'); colon > 0 {
+			via = []string{string(identifier)[colon+1:]}
+		}
+	}
+	room, err := cmd.Matrix.JoinRoom(identifier, via...)
+	if err != nil {
+		cmd.Reply("Failed to join %s: %v", identifier, niceError(err))
+		return
+	}
+	cmd.MainView.AddRoom(room)
+	if strings.HasPrefix(string(identifier), "!") && len(via) > 0 {
+		cmd.Reply("Joined %s via %s", identifier, strings.Join(via, ", "))
 	}
 }
 
+// cmdDirectory lists the rooms in the public room directory of the user's homeserver or the given server.
+func cmdDirectory(cmd *Command) {
+	var server string
+	args := cmd.Args
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		switch {
+		case args[0] == "--server" && len(args) > 1:
+			server = args[1]
+			args = args[2:]
+		default:
+			cmd.Reply("Usage: /directory [--server <server>] [search term]")
+			return
+		}
+	}
+	searchTerm := strings.Join(args, " ")
+	rooms, err := cmd.Matrix.PublicRooms(server, searchTerm, "", directoryPageSize)
+	if err != nil {
+		cmd.Reply("Failed to get public rooms: %v", niceError(err))
+		return
+	} else if len(rooms.Rooms) == 0 {
+		if len(searchTerm) > 0 {
+			cmd.Reply("No public rooms match \"%s\"", searchTerm)
+		} else {
+			cmd.Reply("The room directory is empty")
+		}
+		return
+	}
+	modal := NewRoomDirectoryModal(cmd.MainView, server, searchTerm, 100, 25)
+	modal.AddRooms(rooms)
+	cmd.MainView.ShowModal(modal)
+	cmd.UI.Render()
+}
+
 func cmdMSendEvent(cmd *Command) {
 	if len(cmd.Args) < 2 {
 		cmd.Reply("Usage: /msend <event type> <content>")
@@ -847,21 +1657,27 @@ func (nkm NewlineKeybindMessage) Name() string {
 }
 
 var toggleMsg = map[string]ToggleMessage{
-	"rooms":         HideMessage("Room list sidebar"),
-	"users":         HideMessage("User list sidebar"),
-	"timestamps":    HideMessage("message timestamps"),
-	"baremessages":  SimpleToggleMessage("bare message view"),
-	"images":        SimpleToggleMessage("image rendering"),
-	"typingnotif":   SimpleToggleMessage("typing notifications"),
-	"emojis":        SimpleToggleMessage("emoji shortcode conversion"),
-	"html":          SimpleToggleMessage("HTML input"),
-	"markdown":      SimpleToggleMessage("markdown input"),
-	"downloads":     SimpleToggleMessage("automatic downloads"),
-	"notifications": SimpleToggleMessage("desktop notifications"),
-	"unverified":    SimpleToggleMessage("sending messages to unverified devices"),
-	"showurls":      SimpleToggleMessage("show URLs in text format"),
-	"inlineurls":    InvertedToggleMessage("use fancy terminal features to render URLs inside text"),
-	"newline":       NewlineKeybindMessage("should <alt+enter> make a new line or send the message"),
+	"rooms":            HideMessage("Room list sidebar"),
+	"users":            HideMessage("User list sidebar"),
+	"timestamps":       HideMessage("message timestamps"),
+	"baremessages":     SimpleToggleMessage("bare message view"),
+	"images":           SimpleToggleMessage("image rendering"),
+	"typingnotif":      SimpleToggleMessage("typing notifications"),
+	"emojis":           SimpleToggleMessage("emoji shortcode conversion"),
+	"html":             SimpleToggleMessage("HTML input"),
+	"markdown":         SimpleToggleMessage("markdown input"),
+	"downloads":        SimpleToggleMessage("automatic downloads"),
+	"notifications":    SimpleToggleMessage("desktop notifications"),
+	"unverified":       SimpleToggleMessage("sending messages to unverified devices"),
+	"showurls":         SimpleToggleMessage("show URLs in text format"),
+	"inlineurls":       InvertedToggleMessage("use fancy terminal features to render URLs inside text"),
+	"newline":          NewlineKeybindMessage("should <alt+enter> make a new line or send the message"),
+	"recoverykey":      InvertedToggleMessage("guided recovery key entry"),
+	"crosssigningkeys": InvertedToggleMessage("loading saved cross-signing keys on startup"),
+	"autotrust":        SimpleToggleMessage("automatically trusting new cross-signed devices"),
+	"sasnumbers":       InvertedToggleMessage("comparing numbers instead of emojis in interactive verification"),
+	"highlighting":     SimpleToggleMessage("syntax highlighting in code blocks"),
+	"graphics":         InvertedToggleMessage("rendering images with sixel or kitty graphics when the terminal supports them"),
 }
 
 func makeUsage() string {
@@ -908,6 +1724,8 @@ func cmdToggle(cmd *Command) {
 			val = &cmd.Config.SendToVerifiedOnly
 		case "showurls":
 			val = &cmd.Config.Preferences.DisableShowURLs
+		case "highlighting":
+			val = &cmd.Config.Preferences.DisableHighlighting
 		case "inlineurls":
 			switch cmd.Config.Preferences.InlineURLMode {
 			case "enable":
@@ -918,8 +1736,38 @@ func cmdToggle(cmd *Command) {
 				cmd.Reply("Force-enabled using fancy terminal features to render URLs inside text. Restart gomuks to apply changes.")
 			}
 			continue
+		case "sasnumbers":
+			switch cmd.Config.Preferences.SASMode {
+			case "decimal":
+				cmd.Config.Preferences.SASMode = "emoji"
+				cmd.Reply("Force-enabled comparing emojis in interactive verification.")
+			default:
+				cmd.Config.Preferences.SASMode = "decimal"
+				cmd.Reply("Force-enabled comparing numbers instead of emojis in interactive verification.")
+			}
+			continue
+		case "graphics":
+			switch cmd.Config.Preferences.ImageMode {
+			case config.ImageModeANSI:
+				cmd.Config.Preferences.ImageMode = ""
+				if config.DetectedImageMode == config.ImageModeANSI {
+					cmd.Reply("Enabled terminal graphics, but your terminal doesn't seem to support sixel or kitty graphics.")
+				} else {
+					cmd.Reply("Enabled rendering images with %s graphics.", config.DetectedImageMode)
+				}
+			default:
+				cmd.Config.Preferences.ImageMode = config.ImageModeANSI
+				cmd.Reply("Force-disabled terminal graphics, images will be rendered with ANSI blocks.")
+			}
+			continue
 		case "newline":
 			val = &cmd.Config.Preferences.AltEnterToSend
+		case "recoverykey":
+			val = &cmd.Config.Preferences.GuidedRecoveryKey
+		case "crosssigningkeys":
+			val = &cmd.Config.LoadCrossSigningKeys
+		case "autotrust":
+			val = &cmd.Config.DisableCrossSigningAutoTrust
 		default:
 			cmd.Reply("Unknown toggle %s. Use /toggle without arguments for a list of togglable things.", thing)
 			return
@@ -936,6 +1784,29 @@ func cmdToggle(cmd *Command) {
 	go cmd.Matrix.SendPreferencesToMatrix()
 }
 
+// hasFlag checks whether the given flag is present in the arguments, ignoring case.
+func hasFlag(args []string, flag string) bool {
+	for _, arg := range args {
+		if strings.ToLower(arg) == flag {
+			return true
+		}
+	}
+	return false
+}
+
 func cmdLogout(cmd *Command) {
-	cmd.Matrix.Logout()
+	keepKeys := hasFlag(cmd.Args, "--keep-keys")
+	text := "Log out and delete all local data of this session, including encryption keys? Keys that aren't " +
+		"backed up or exported will be lost."
+	if keepKeys {
+		text = "Log out and delete the local data of this session? The encryption keys will be kept."
+	}
+	if !cmd.MainView.AskConfirmation("Log out", text, "Log out") {
+		cmd.Reply("Logout cancelled")
+		return
+	}
+	err := cmd.Matrix.Logout(keepKeys)
+	if err != nil {
+		cmd.Reply("Failed to log out: %v", niceError(err))
+	}
 }
@@ -0,0 +1,74 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"go.mau.fi/mauview"
+)
+
+// ConfirmModal asks the user to confirm an action. The cancel button is focused by default, so pressing enter
+// without reading the text doesn't confirm anything.
+type ConfirmModal struct {
+	mauview.Component
+
+	resultChan chan bool
+
+	parent *MainView
+}
+
+func (view *MainView) AskConfirmation(title, text, action string) bool {
+	cm := NewConfirmModal(view, title, text, action)
+	view.ShowModal(cm)
+	view.parent.Render()
+	return <-cm.resultChan
+}
+
+func NewConfirmModal(parent *MainView, title, text, action string) *ConfirmModal {
+	cm := &ConfirmModal{
+		parent:     parent,
+		resultChan: make(chan bool, 1),
+	}
+
+	textView := mauview.NewTextView()
+	textView.SetText(text)
+
+	form := mauview.NewForm()
+	form.
+		SetColumns([]int{1, 20, 1, 20, 1}).
+		SetRows([]int{1, 4, 1, 1, 1})
+	form.AddComponent(textView, 1, 1, 3, 1)
+	form.AddFormItem(mauview.NewButton("Cancel").SetOnClick(cm.ClickCancel), 1, 3, 1, 1)
+	form.AddFormItem(mauview.NewButton(action).SetOnClick(cm.ClickConfirm), 3, 3, 1, 1)
+
+	box := mauview.NewBox(form).SetTitle(title)
+	center := mauview.Center(box, 45, 10).SetAlwaysFocusChild(true)
+	center.Focus()
+	form.FocusNextItem()
+	cm.Component = center
+
+	return cm
+}
+
+func (cm *ConfirmModal) ClickCancel() {
+	cm.parent.HideModal()
+	cm.resultChan <- false
+}
+
+func (cm *ConfirmModal) ClickConfirm() {
+	cm.parent.HideModal()
+	cm.resultChan <- true
+}
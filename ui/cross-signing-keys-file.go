@@ -0,0 +1,171 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build cgo
+
+package ui
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/lib/crosssigningfile"
+	"maunium.net/go/gomuks/lib/notification"
+)
+
+const crossSigningKeysFileName = "cross-signing-keys.json"
+
+func crossSigningKeysPath(cmd *Command) string {
+	return filepath.Join(cmd.Config.AccountConfigDir(), crossSigningKeysFileName)
+}
+
+func saveCrossSigningKeys(path string, userID id.UserID, seeds crypto.CrossSigningSeeds, passphrase string) error {
+	data, err := crosssigningfile.Encrypt(userID, map[id.CrossSigningUsage][]byte{
+		id.XSUsageMaster:      seeds.MasterKey,
+		id.XSUsageSelfSigning: seeds.SelfSigningKey,
+		id.XSUsageUserSigning: seeds.UserSigningKey,
+	}, passphrase)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(path, data, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return nil
+}
+
+func loadCrossSigningKeys(path string, userID id.UserID, passphrase string) (seeds crypto.CrossSigningSeeds, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return seeds, fmt.Errorf("failed to read file: %w", err)
+	}
+	keys, err := crosssigningfile.Decrypt(data, userID, passphrase)
+	if err != nil {
+		return seeds, err
+	}
+	seeds.MasterKey = keys[id.XSUsageMaster]
+	seeds.SelfSigningKey = keys[id.XSUsageSelfSigning]
+	seeds.UserSigningKey = keys[id.XSUsageUserSigning]
+	if seeds.MasterKey == nil || seeds.SelfSigningKey == nil || seeds.UserSigningKey == nil {
+		return seeds, fmt.Errorf("file is missing some cross-signing keys")
+	}
+	return seeds, nil
+}
+
+func cmdCrossSigningSaveToDisk(cmd *Command, mach *crypto.OlmMachine) {
+	passphrase, ok := cmd.MainView.AskPassword("Cross-signing key file", "passphrase", "", true)
+	if !ok {
+		cmd.Reply("Passphrase entry cancelled, keys were not saved to disk")
+		return
+	}
+	path := crossSigningKeysPath(cmd)
+	err := saveCrossSigningKeys(path, mach.Client.UserID, mach.ExportCrossSigningKeys(), passphrase)
+	if err != nil {
+		cmd.Reply("Failed to save cross-signing keys to disk: %v", err)
+		return
+	}
+	if cmd.Config.LoadCrossSigningKeys {
+		cmd.Reply("Saved cross-signing keys to %s", path)
+	} else {
+		cmd.Reply("Saved cross-signing keys to %s. Use `/toggle crosssigningkeys` to load them on startup.", path)
+	}
+}
+
+// checkSavedMasterKey makes sure the saved master key is still the published one, so that outdated keys aren't used
+// after the cross-signing keys were reset from another client. This has to be done before importing the keys, as
+// the public keys of the crypto machine are replaced by the imported ones.
+func checkSavedMasterKey(mach *crypto.OlmMachine, seeds crypto.CrossSigningSeeds) error {
+	published, err := mach.GetCrossSigningPublicKeys(mach.Client.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to get published keys: %w", err)
+	} else if published == nil {
+		return fmt.Errorf("no cross-signing keys are published")
+	}
+	saved, err := olm.NewPkSigningFromSeed(seeds.MasterKey)
+	if err != nil {
+		return fmt.Errorf("invalid saved master key: %w", err)
+	} else if published.MasterKey != saved.PublicKey {
+		return fmt.Errorf("saved master key %s doesn't match published key %s", saved.PublicKey, published.MasterKey)
+	}
+	return nil
+}
+
+// loadSavedCrossSigningKeys asks for the passphrase of the saved cross-signing key file and imports the keys into
+// the crypto machine. It only does something if loading is enabled in the config and the file exists.
+func (view *MainView) loadSavedCrossSigningKeys() {
+	mach, ok := view.matrix.Crypto().(*crypto.OlmMachine)
+	if !ok || !view.config.LoadCrossSigningKeys {
+		return
+	}
+	path := filepath.Join(view.config.AccountConfigDir(), crossSigningKeysFileName)
+	if _, err := os.Stat(path); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			debug.Printf("Failed to check saved cross-signing keys: %v", err)
+		}
+		return
+	}
+	go func() {
+		title := "Saved cross-signing keys"
+		for {
+			passphrase, ok := view.AskPassword(title, "passphrase", "", false)
+			if !ok {
+				debug.Print("Cancelled loading saved cross-signing keys")
+				return
+			}
+			seeds, err := loadCrossSigningKeys(path, mach.Client.UserID, passphrase)
+			if errors.Is(err, crosssigningfile.ErrWrongPassphrase) {
+				title = "Wrong passphrase, try again"
+				continue
+			} else if err != nil {
+				view.reportCrossSigningKeyLoadError("Failed to load saved cross-signing keys: %v", err)
+				return
+			}
+			err = checkSavedMasterKey(mach, seeds)
+			if err != nil {
+				view.reportCrossSigningKeyLoadError("Not using saved cross-signing keys: %v", err)
+				return
+			}
+			err = mach.ImportCrossSigningKeys(seeds)
+			if err != nil {
+				view.reportCrossSigningKeyLoadError("Failed to import saved cross-signing keys: %v", err)
+				return
+			}
+			debug.Print("Loaded saved cross-signing keys")
+			return
+		}
+	}()
+}
+
+// reportCrossSigningKeyLoadError shows an error that happened while loading the saved cross-signing keys on startup.
+// There's no command to reply to, so the error is shown in the current room, or as a notification if no room is open.
+func (view *MainView) reportCrossSigningKeyLoadError(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	debug.Print(message)
+	if view.currentRoom != nil {
+		view.currentRoom.AddServiceMessage(message)
+		view.parent.Render()
+	} else {
+		_ = notification.Send("Saved cross-signing keys", message, false, false)
+	}
+}
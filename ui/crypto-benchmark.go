@@ -0,0 +1,132 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build cgo
+
+package ui
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/event"
+)
+
+const (
+	defaultBenchmarkEvents = 1000
+	maxBenchmarkEvents     = 100000
+	// benchmarkSampleSessions is the maximum number of stored sessions that are used for the store lookups.
+	benchmarkSampleSessions = 100
+)
+
+type benchmarkTimings []time.Duration
+
+func (bt benchmarkTimings) percentile(p float64) time.Duration {
+	if len(bt) == 0 {
+		return 0
+	}
+	return bt[int(p*float64(len(bt)-1))]
+}
+
+func (bt benchmarkTimings) mean() time.Duration {
+	if len(bt) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, timing := range bt {
+		total += timing
+	}
+	return total / time.Duration(len(bt))
+}
+
+func (bt benchmarkTimings) String() string {
+	sort.Slice(bt, func(i, j int) bool {
+		return bt[i] < bt[j]
+	})
+	return fmt.Sprintf("mean %s, p50 %s, p90 %s, p99 %s, max %s", bt.mean(), bt.percentile(0.5),
+		bt.percentile(0.9), bt.percentile(0.99), bt.percentile(1))
+}
+
+// cmdCryptoBenchmark measures how fast events can be decrypted. Each iteration does the same steps as decrypting a
+// Megolm event: the group session is looked up from the crypto store, the ciphertext is decrypted and the payload is
+// parsed. The store lookups use real stored sessions, but the ciphertexts are encrypted with a temporary in-memory
+// session, so nothing is written to the store (unlike DecryptMegolmEvent, which records message indexes).
+func cmdCryptoBenchmark(cmd *Command, mach *crypto.OlmMachine, count int) {
+	sessions, err := mach.CryptoStore.GetAllGroupSessions()
+	if err != nil {
+		cmd.Reply("Failed to get sessions from store: %v", err)
+		return
+	} else if len(sessions) == 0 {
+		cmd.Reply("No Megolm sessions in the store to benchmark with")
+		return
+	} else if len(sessions) > benchmarkSampleSessions {
+		sessions = sessions[:benchmarkSampleSessions]
+	}
+
+	outbound := olm.NewOutboundGroupSession()
+	inbound, err := olm.NewInboundGroupSession([]byte(outbound.Key()))
+	if err != nil {
+		cmd.Reply("Failed to create test session: %v", err)
+		return
+	}
+	ciphertexts := make([][]byte, count)
+	for i := range ciphertexts {
+		payload, _ := json.Marshal(map[string]interface{}{
+			"type":    event.EventMessage.Type,
+			"room_id": sessions[i%len(sessions)].RoomID,
+			"content": event.MessageEventContent{
+				MsgType: event.MsgText,
+				Body:    fmt.Sprintf("Benchmark message #%d", i),
+			},
+		})
+		ciphertexts[i] = outbound.Encrypt(payload)
+	}
+
+	cmd.Reply("Running decryption benchmark with %d events and %d stored sessions (read-only diagnostic)...", count, len(sessions))
+	lookupTimings := make(benchmarkTimings, count)
+	totalTimings := make(benchmarkTimings, count)
+	benchmarkStart := time.Now()
+	for i, ciphertext := range ciphertexts {
+		start := time.Now()
+		stored := sessions[i%len(sessions)]
+		_, err = mach.CryptoStore.GetGroupSession(stored.RoomID, stored.SenderKey, stored.ID())
+		if err != nil {
+			cmd.Reply("Failed to get session %s from store: %v", stored.ID(), err)
+			return
+		}
+		lookupTimings[i] = time.Since(start)
+		plaintext, _, err := inbound.Decrypt(ciphertext)
+		if err != nil {
+			cmd.Reply("Failed to decrypt test event #%d: %v", i, err)
+			return
+		}
+		var evt event.Event
+		err = json.Unmarshal(plaintext, &evt)
+		if err != nil {
+			cmd.Reply("Failed to parse test event #%d: %v", i, err)
+			return
+		}
+		totalTimings[i] = time.Since(start)
+	}
+	elapsed := time.Since(benchmarkStart)
+
+	cmd.Reply("Decrypted %d events in %s (%.1f events/sec)\nPer event: %s\nStore lookups: %s",
+		count, elapsed.Truncate(time.Millisecond), float64(count)/elapsed.Seconds(), totalTimings, lookupTimings)
+}
@@ -19,20 +19,38 @@
 package ui
 
 import (
+	cryptorand "crypto/rand"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/crypto/olm"
 	"maunium.net/go/mautrix/crypto/ssss"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
+	"maunium.net/go/gomuks/debug"
 	ifc "maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/lib/keybackup"
+	"maunium.net/go/gomuks/lib/keyexport"
+	"maunium.net/go/gomuks/matrix/muksevt"
+	"maunium.net/go/gomuks/matrix/rooms"
 )
 
 func autocompleteDeviceUserID(cmd *CommandAutocomplete) (completions []string, newText string) {
@@ -49,14 +67,27 @@ func autocompleteDeviceUserID(cmd *CommandAutocomplete) (completions []string, n
 }
 
 func autocompleteDeviceDeviceID(cmd *CommandAutocomplete) (completions []string, newText string) {
+	var existingID string
+	if len(cmd.Args) > 1 {
+		existingID = cmd.Args[1]
+	}
+	completions, completedDeviceID := completeDeviceID(cmd, id.UserID(cmd.Args[0]), existingID)
+	if len(completions) == 1 {
+		newText = fmt.Sprintf("/%s %s %s ", cmd.OrigCommand, cmd.Args[0], completedDeviceID)
+	}
+	return
+}
+
+// completeDeviceID finds the devices of the given user whose ID or name starts with the given text.
+// If the text is already a full device ID, nothing is completed.
+func completeDeviceID(cmd *CommandAutocomplete, userID id.UserID, existingID string) (completions []string, completedDeviceID id.DeviceID) {
 	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
-	devices, err := mach.CryptoStore.GetDevices(id.UserID(cmd.Args[0]))
+	devices, err := mach.CryptoStore.GetDevices(userID)
 	if len(devices) == 0 || err != nil {
 		return
 	}
-	var completedDeviceID id.DeviceID
-	if len(cmd.Args) > 1 {
-		existingID := strings.ToUpper(cmd.Args[1])
+	if len(existingID) > 0 {
+		existingID = strings.ToUpper(existingID)
 		for _, device := range devices {
 			deviceIDStr := string(device.DeviceID)
 			if deviceIDStr == existingID {
@@ -76,8 +107,20 @@ func autocompleteDeviceDeviceID(cmd *CommandAutocomplete) (completions []string,
 			i++
 		}
 	}
+	return
+}
+
+func autocompleteOwnDevice(cmd *CommandAutocomplete) (completions []string, newText string) {
+	if len(cmd.Args) > 1 {
+		return
+	}
+	var existingID string
+	if len(cmd.Args) == 1 {
+		existingID = cmd.Args[0]
+	}
+	completions, completedDeviceID := completeDeviceID(cmd, cmd.Matrix.Client().UserID, existingID)
 	if len(completions) == 1 {
-		newText = fmt.Sprintf("/%s %s %s ", cmd.OrigCommand, cmd.Args[0], completedDeviceID)
+		newText = fmt.Sprintf("/%s %s", cmd.OrigCommand, completedDeviceID)
 	}
 	return
 }
@@ -98,6 +141,165 @@ func autocompleteDevice(cmd *CommandAutocomplete) ([]string, string) {
 	return autocompleteDeviceDeviceID(cmd)
 }
 
+// ssssSecretTypes are the secrets whose encryption keys are included when listing SSSS key IDs. The client-server API
+// can't list account data, so keys that aren't the default key are only found if they encrypt one of these.
+var ssssSecretTypes = []event.Type{
+	event.AccountDataCrossSigningMaster, event.AccountDataCrossSigningSelf, event.AccountDataCrossSigningUser,
+	accountDataMegolmBackupKey,
+}
+
+// ssssKeyIDCache contains the known SSSS key IDs for autocompletion, so that tab completing doesn't fetch account data
+// on every key press. It's cleared when an SSSS or cross-signing command is run, as those may change the keys.
+var ssssKeyIDCache struct {
+	sync.Mutex
+	userID  id.UserID
+	keyIDs  []string
+	fetched time.Time
+}
+
+// ssssKeyIDCacheTTL is how long the cached key IDs are used before fetching them again, in case another client
+// changed them.
+const ssssKeyIDCacheTTL = 5 * time.Minute
+
+func invalidateSSSSKeyIDCache() {
+	ssssKeyIDCache.Lock()
+	ssssKeyIDCache.keyIDs = nil
+	ssssKeyIDCache.fetched = time.Time{}
+	ssssKeyIDCache.Unlock()
+}
+
+// getCachedSSSSKeyIDs returns the IDs of the default SSSS key and the keys that encrypt any of ssssSecretTypes,
+// fetching them only if they aren't cached yet.
+func getCachedSSSSKeyIDs(mach *crypto.OlmMachine) []string {
+	ssssKeyIDCache.Lock()
+	defer ssssKeyIDCache.Unlock()
+	if ssssKeyIDCache.userID == mach.Client.UserID && time.Since(ssssKeyIDCache.fetched) < ssssKeyIDCacheTTL {
+		return ssssKeyIDCache.keyIDs
+	}
+	keyIDs, err := getKnownSSSSKeyIDs(mach, ssssSecretTypes...)
+	if err != nil {
+		debug.Print("Failed to get SSSS key IDs for autocompletion:", err)
+	}
+	ssssKeyIDCache.userID = mach.Client.UserID
+	ssssKeyIDCache.keyIDs = keyIDs
+	ssssKeyIDCache.fetched = time.Now()
+	return keyIDs
+}
+
+func autocompleteSSSS(cmd *CommandAutocomplete) (completions []string, newText string) {
+	if len(cmd.Args) == 0 || len(cmd.Args) > 2 {
+		return
+	} else if subcommand := strings.ToLower(cmd.Args[0]); subcommand != "set-default" && subcommand != "status" {
+		return
+	} else if endsWithSpace := unicode.IsSpace(rune(cmd.RawArgs[len(cmd.RawArgs)-1])); endsWithSpace == (len(cmd.Args) == 2) {
+		// Only complete the key ID argument, not the subcommand or anything after the key ID
+		return
+	}
+	var prefix string
+	if len(cmd.Args) == 2 {
+		prefix = cmd.Args[1]
+	}
+	for _, keyID := range getCachedSSSSKeyIDs(cmd.Matrix.Crypto().(*crypto.OlmMachine)) {
+		if strings.HasPrefix(keyID, prefix) {
+			completions = append(completions, keyID)
+		}
+	}
+	if len(completions) == 1 {
+		newText = fmt.Sprintf("/%s %s %s", cmd.OrigCommand, cmd.Args[0], completions[0])
+	}
+	return
+}
+
+// cmdDeleteDevice logs out one of the other devices of the account. Without arguments, it lists the devices.
+func cmdDeleteDevice(cmd *Command) {
+	client := cmd.Matrix.Client()
+	if len(cmd.Args) == 0 {
+		cmdListOwnDevices(cmd, client)
+		return
+	} else if len(cmd.Args) > 1 {
+		cmd.Reply("Usage: /%s [device ID]", cmd.OrigCommand)
+		return
+	}
+	deviceID := id.DeviceID(cmd.Args[0])
+	if deviceID == client.DeviceID {
+		cmd.Reply("Refusing to delete the current device, use /logout instead")
+		return
+	}
+	info, err := client.GetDeviceInfo(deviceID)
+	if err != nil {
+		cmd.Reply("Failed to get device %s: %v", deviceID, err)
+		return
+	}
+	confirmed := cmd.MainView.AskConfirmation("Delete device", fmt.Sprintf("Log out %s (%s)? It won't be able "+
+		"to read new messages, and any keys only it has will be lost.", deviceID, info.DisplayName), "Delete")
+	if !confirmed {
+		cmd.Reply("Device %s was not deleted", deviceID)
+		return
+	}
+	err = deleteDevice(client, deviceID, makeUIACallback(cmd, cmd.Matrix, client.UserID))
+	if err != nil {
+		cmd.Reply("Failed to delete device %s: %v", deviceID, err)
+		return
+	}
+
+	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
+	devices, err := mach.CryptoStore.GetDevices(client.UserID)
+	if err == nil {
+		delete(devices, deviceID)
+		err = mach.CryptoStore.PutDevices(client.UserID, devices)
+	}
+	if err != nil {
+		cmd.Reply("Deleted device %s, but failed to remove it from the crypto store: %v", deviceID, err)
+		return
+	}
+	mach.OnDevicesChanged(client.UserID)
+	cmd.Reply("Deleted device %s", deviceID)
+}
+
+func cmdListOwnDevices(cmd *Command, client *mautrix.Client) {
+	resp, err := client.GetDevicesInfo()
+	if err != nil {
+		cmd.Reply("Failed to get device list: %v", err)
+		return
+	}
+	sort.Slice(resp.Devices, func(i, j int) bool {
+		return resp.Devices[i].LastSeenTS > resp.Devices[j].LastSeenTS
+	})
+	var buf strings.Builder
+	for _, device := range resp.Devices {
+		_, _ = fmt.Fprintf(&buf, "%s (%s)", device.DeviceID, device.DisplayName)
+		if device.DeviceID == client.DeviceID {
+			buf.WriteString(" - this device")
+		} else if device.LastSeenTS > 0 {
+			_, _ = fmt.Fprintf(&buf, " - last seen %s from %s",
+				time.Unix(device.LastSeenTS/1000, 0).Format("2006-01-02 15:04"), device.LastSeenIP)
+		}
+		buf.WriteRune('\n')
+	}
+	cmd.Reply("%d devices of %s:\n%sUse /%s <device ID> to delete one.", len(resp.Devices), client.UserID, buf.String(), cmd.OrigCommand)
+}
+
+// deleteDevice deletes the given device, doing user-interactive authentication if the server asks for it.
+// mautrix doesn't handle UIA for device deletion, so this does the same as UploadCrossSigningKeys does internally.
+func deleteDevice(client *mautrix.Client, deviceID id.DeviceID, uiaCallback mautrix.UIACallback) error {
+	req := &mautrix.ReqDeleteDevice{}
+	for {
+		err := client.DeleteDevice(deviceID, req)
+		var httpErr mautrix.HTTPError
+		if !errors.As(err, &httpErr) || !httpErr.IsStatus(http.StatusUnauthorized) {
+			return err
+		}
+		var uia mautrix.RespUserInteractive
+		if json.Unmarshal([]byte(httpErr.ResponseBody), &uia) != nil {
+			return err
+		}
+		req.Auth = uiaCallback(&uia)
+		if req.Auth == nil {
+			return err
+		}
+	}
+}
+
 func getDevice(cmd *Command) *crypto.DeviceIdentity {
 	if len(cmd.Args) < 2 {
 		cmd.Reply("Usage: /%s <user id> <device id> [fingerprint]", cmd.Command)
@@ -123,11 +325,181 @@ func putDevice(cmd *Command, device *crypto.DeviceIdentity, action string) {
 	mach.OnDevicesChanged(device.UserID)
 }
 
+// getDeviceLastActiveRoom finds the room where the device with the given identity key most recently sent an event
+// that was decrypted locally. Only the SQL crypto store keeps the necessary message index metadata.
+func getDeviceLastActiveRoom(mach *crypto.OlmMachine, identityKey id.Curve25519) (roomID id.RoomID, ts int64, found bool) {
+	sqlStore, ok := mach.CryptoStore.(*crypto.SQLCryptoStore)
+	if !ok {
+		return
+	}
+	err := sqlStore.DB.QueryRow(`
+		SELECT igs.room_id, MAX(mi.timestamp) AS last_ts
+		FROM crypto_message_index mi
+		JOIN crypto_megolm_inbound_session igs ON igs.session_id=mi.session_id AND igs.sender_key=mi.sender_key
+		WHERE mi.sender_key=$1 AND igs.account_id=$2
+		GROUP BY igs.room_id
+		ORDER BY last_ts DESC
+		LIMIT 1`,
+		identityKey, sqlStore.AccountID,
+	).Scan(&roomID, &ts)
+	return roomID, ts, err == nil
+}
+
+func formatDeviceLastActive(cmd *Command, mach *crypto.OlmMachine, device *crypto.DeviceIdentity) string {
+	roomID, ts, ok := getDeviceLastActiveRoom(mach, device.IdentityKey)
+	if !ok {
+		return ""
+	}
+	roomName := string(roomID)
+	if room := cmd.Matrix.GetRoom(roomID); room != nil {
+		roomName = room.GetTitle()
+	}
+	return fmt.Sprintf("\n    Last seen sending in %s (%s)", roomName, time.Unix(ts/1000, 0).Format("2006-01-02 15:04"))
+}
+
+// cmdFingerprint shows the keys of the current device. With an argument, the fingerprint is shown in groups of four
+// for reading aloud, and compared with the argument unless it's just --grouped.
+func cmdFingerprint(cmd *Command) {
+	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
+	own := mach.OwnIdentity()
+	if len(cmd.Args) == 0 {
+		cmd.Reply("Device ID: %s\nIdentity key: %s\nFingerprint: %s", own.DeviceID, own.IdentityKey, own.SigningKey)
+		return
+	}
+	grouped := own.Fingerprint()
+	if len(cmd.Args) == 1 && strings.ToLower(cmd.Args[0]) == "--grouped" {
+		cmd.Reply("Fingerprint of %s:\n%s", own.DeviceID, grouped)
+	} else if normalizeFingerprint(strings.Join(cmd.Args, "")) == string(own.SigningKey) {
+		cmd.Reply("Fingerprint of %s:\n%s\nThe given fingerprint matches", own.DeviceID, grouped)
+	} else {
+		cmd.Reply("Fingerprint of %s:\n%s\nThe given fingerprint does NOT match", own.DeviceID, grouped)
+	}
+}
+
+// cmdWhoami summarizes the crypto identity of the current session. Each component is looked up separately, so a
+// missing or broken one doesn't prevent showing the others.
+func cmdWhoami(cmd *Command) {
+	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
+	own := mach.OwnIdentity()
+	cmd.Reply("User ID: %s\nDevice ID: %s\nIdentity key: %s\nSigning key: %s\nCross-signing: %s\nSSSS: %s\nKey backup: %s",
+		own.UserID, own.DeviceID, own.IdentityKey, own.SigningKey,
+		describeCrossSigningState(mach), describeSSSSState(mach), describeKeyBackupState(mach))
+}
+
+func describeCrossSigningState(mach *crypto.OlmMachine) string {
+	if mach.CrossSigningKeys != nil {
+		return fmt.Sprintf("private keys cached (master key %s)", mach.CrossSigningKeys.MasterKey.PublicKey)
+	}
+	published, err := mach.GetCrossSigningPublicKeys(mach.Client.UserID)
+	if err != nil {
+		return fmt.Sprintf("unknown (%v)", err)
+	} else if published == nil {
+		return "not set up"
+	}
+	return fmt.Sprintf("published (master key %s), private keys not cached", published.MasterKey)
+}
+
+func describeSSSSState(mach *crypto.OlmMachine) string {
+	keyID, keyData, err := mach.SSSS.GetDefaultKeyData()
+	if errors.Is(err, mautrix.MNotFound) {
+		return "not set up"
+	} else if err != nil {
+		return fmt.Sprintf("unknown (%v)", err)
+	} else if keyData.Passphrase != nil {
+		return fmt.Sprintf("default key %s (with passphrase)", keyID)
+	}
+	return fmt.Sprintf("default key %s", keyID)
+}
+
+func describeKeyBackupState(mach *crypto.OlmMachine) string {
+	version, err := getKeyBackupVersion(mach.Client)
+	if errors.Is(err, mautrix.MNotFound) {
+		return "not set up"
+	} else if err != nil {
+		return fmt.Sprintf("unknown (%v)", err)
+	}
+	return fmt.Sprintf("version %s (%s, %d keys)", version.Version, version.Algorithm, version.Count)
+}
+
+// deviceTrustCache describes why devices are trusted. Whether a user's self-signing key is trusted through our
+// user-signing key is cached, so listing many devices of the same user doesn't repeat the same lookups.
+type deviceTrustCache struct {
+	mach *crypto.OlmMachine
+	// selfSigningKeys contains the trusted self-signing key of each user, or an empty string if it isn't trusted.
+	selfSigningKeys map[id.UserID]id.Ed25519
+}
+
+func newDeviceTrustCache(mach *crypto.OlmMachine) *deviceTrustCache {
+	return &deviceTrustCache{
+		mach:            mach,
+		selfSigningKeys: make(map[id.UserID]id.Ed25519),
+	}
+}
+
+func (dtc *deviceTrustCache) trustedSelfSigningKey(userID id.UserID) id.Ed25519 {
+	ssk, ok := dtc.selfSigningKeys[userID]
+	if ok {
+		return ssk
+	}
+	dtc.selfSigningKeys[userID] = ""
+	if !dtc.mach.IsUserTrusted(userID) {
+		return ""
+	}
+	keys, err := dtc.mach.CryptoStore.GetCrossSigningKeys(userID)
+	if err != nil {
+		debug.Printf("Failed to get cross-signing keys of %s: %v", userID, err)
+		return ""
+	}
+	masterKey, ok := keys[id.XSUsageMaster]
+	if !ok {
+		return ""
+	}
+	selfSigningKey, ok := keys[id.XSUsageSelfSigning]
+	if !ok {
+		return ""
+	}
+	signed, err := dtc.mach.CryptoStore.IsKeySignedBy(userID, selfSigningKey, userID, masterKey)
+	if err != nil || !signed {
+		return ""
+	}
+	dtc.selfSigningKeys[userID] = selfSigningKey
+	return selfSigningKey
+}
+
+// isCrossSigned returns whether the device is signed by a self-signing key that we trust through our user-signing
+// key (or our own master key for our own devices), regardless of any manual trust decision.
+func (dtc *deviceTrustCache) isCrossSigned(device *crypto.DeviceIdentity) bool {
+	ssk := dtc.trustedSelfSigningKey(device.UserID)
+	if len(ssk) == 0 {
+		return false
+	}
+	signed, err := dtc.mach.CryptoStore.IsKeySignedBy(device.UserID, device.SigningKey, device.UserID, ssk)
+	return err == nil && signed
+}
+
+// describe returns the trust state of the device along with where the trust comes from.
+func (dtc *deviceTrustCache) describe(device *crypto.DeviceIdentity) string {
+	crossSigned := dtc.isCrossSigned(device)
+	switch {
+	case device.Trust == crypto.TrustStateVerified && crossSigned:
+		return "verified (manual, cross-signed)"
+	case device.Trust == crypto.TrustStateVerified:
+		return "verified (manual)"
+	case device.Trust == crypto.TrustStateUnset && crossSigned:
+		return "verified (cross-signed)"
+	case crossSigned:
+		return fmt.Sprintf("%s (cross-signed)", device.Trust)
+	default:
+		return device.Trust.String()
+	}
+}
+
 func cmdDevices(cmd *Command) {
 	if len(cmd.Args) == 0 {
-		cmd.Reply("Usage: /devices <user id>")
+		cmd.Reply("Usage: /devices <user id> [--last-active]")
 		return
 	}
+	showLastActive := hasFlag(cmd.Args[1:], "--last-active")
 	userID := id.UserID(cmd.Args[0])
 	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
 	devices, err := mach.CryptoStore.GetDevices(userID)
@@ -142,13 +514,20 @@ func cmdDevices(cmd *Command) {
 		cmd.Reply("No devices found for %s", userID)
 		return
 	}
+	trustCache := newDeviceTrustCache(mach)
 	var buf strings.Builder
 	for _, device := range devices {
-		trust := device.Trust.String()
-		if device.Trust == crypto.TrustStateUnset && mach.IsDeviceTrusted(device) {
-			trust = "verified (transitive)"
+		if len(device.SigningKey) == 0 || len(device.IdentityKey) == 0 {
+			// Devices without keys (e.g. clients that don't support encryption) can't receive keys or be verified
+			_, _ = fmt.Fprintf(&buf, "%s (%s) - ⚠️ (no encryption keys)\n", device.DeviceID, device.Name)
+			continue
 		}
-		_, _ = fmt.Fprintf(&buf, "%s (%s) - %s\n    Fingerprint: %s\n", device.DeviceID, device.Name, trust, device.Fingerprint())
+		var lastActive string
+		if showLastActive {
+			lastActive = formatDeviceLastActive(cmd, mach, device)
+		}
+		_, _ = fmt.Fprintf(&buf, "%s (%s) - %s\n    Fingerprint: %s%s\n", device.DeviceID, device.Name,
+			trustCache.describe(device), device.Fingerprint(), lastActive)
 	}
 	resp := buf.String()
 	cmd.Reply("%s", resp[:len(resp)-1])
@@ -164,16 +543,68 @@ func cmdDevice(cmd *Command) {
 		deviceType = "Deleted device"
 	}
 	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
-	trustState := device.Trust.String()
-	if device.Trust == crypto.TrustStateUnset && mach.IsDeviceTrusted(device) {
-		trustState = "verified (transitive)"
-	}
+	trustState := newDeviceTrustCache(mach).describe(device)
 	cmd.Reply("%s %s of %s\nFingerprint: %s\nIdentity key: %s\nDevice name: %s\nTrust state: %s",
 		deviceType, device.DeviceID, device.UserID,
 		device.Fingerprint(), device.IdentityKey,
 		device.Name, trustState)
 }
 
+// olmSessionStaleAge is how long an Olm session can go unused before /olm-sessions marks it as possibly stale.
+const olmSessionStaleAge = 7 * 24 * time.Hour
+
+func formatSessionTime(ts time.Time) string {
+	if ts.IsZero() {
+		return "never"
+	}
+	return fmt.Sprintf("%s (%s ago)", ts.Format("2006-01-02 15:04:05"), time.Since(ts).Truncate(time.Second))
+}
+
+func cmdOlmSessions(cmd *Command) {
+	device := getDevice(cmd)
+	if device == nil {
+		return
+	}
+	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
+	sessions, err := mach.CryptoStore.GetSessions(device.IdentityKey)
+	if err != nil {
+		cmd.Reply("Failed to get Olm sessions: %v", err)
+		return
+	} else if len(sessions) == 0 {
+		cmd.Reply("No Olm sessions with %s/%s", device.UserID, device.DeviceID)
+		return
+	}
+	latest, err := mach.CryptoStore.GetLatestSession(device.IdentityKey)
+	if err != nil {
+		cmd.Reply("Failed to get latest Olm session: %v", err)
+		return
+	}
+	var buf strings.Builder
+	_, _ = fmt.Fprintf(&buf, "%d Olm sessions with %s/%s:\n", len(sessions), device.UserID, device.DeviceID)
+	for _, session := range sessions {
+		var flags []string
+		if latest != nil && session.ID() == latest.ID() {
+			flags = append(flags, "active")
+		}
+		lastUsed := session.LastDecryptedTime
+		if session.LastEncryptedTime.After(lastUsed) {
+			lastUsed = session.LastEncryptedTime
+		}
+		if lastUsed.IsZero() || time.Since(lastUsed) > olmSessionStaleAge {
+			flags = append(flags, "possibly stale")
+		}
+		flagText := ""
+		if len(flags) > 0 {
+			flagText = fmt.Sprintf(" (%s)", strings.Join(flags, ", "))
+		}
+		_, _ = fmt.Fprintf(&buf, "%s%s\n    Created: %s\n    Last encrypted: %s\n    Last decrypted: %s\n",
+			session.ID(), flagText, formatSessionTime(session.CreationTime),
+			formatSessionTime(session.LastEncryptedTime), formatSessionTime(session.LastDecryptedTime))
+	}
+	resp := buf.String()
+	cmd.Reply("%s", resp[:len(resp)-1])
+}
+
 func crossSignDevice(cmd *Command, device *crypto.DeviceIdentity) {
 	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
 	err := mach.SignOwnDevice(device)
@@ -184,7 +615,88 @@ func crossSignDevice(cmd *Command, device *crypto.DeviceIdentity) {
 	}
 }
 
+// isAllDevices checks whether the command targets all devices of the user with `--all` or `*` as the device ID.
+func isAllDevices(cmd *Command) bool {
+	return len(cmd.Args) >= 2 && (cmd.Args[1] == "*" || strings.ToLower(cmd.Args[1]) == "--all")
+}
+
+// setAllDevicesTrust sets the trust state of every non-deleted device of the user given in the first argument.
+// Devices that are already in the target state are skipped.
+func setAllDevicesTrust(cmd *Command, trust crypto.TrustState) {
+	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
+	userID := id.UserID(cmd.Args[0])
+	devices, err := mach.CryptoStore.GetDevices(userID)
+	if err != nil {
+		cmd.Reply("Failed to get device list: %v", err)
+		return
+	} else if len(devices) == 0 {
+		cmd.Reply("Fetching device list from server...")
+		devices = mach.LoadDevices(userID)
+	}
+	if len(devices) == 0 {
+		cmd.Reply("No devices found for %s", userID)
+		return
+	}
+	isOwnUser := userID == mach.Client.UserID
+	if trust == crypto.TrustStateVerified && !confirmVerifyAllDevices(cmd, userID, devices) {
+		cmd.Reply("Verification cancelled")
+		return
+	}
+	var changed, skipped int
+	for _, device := range devices {
+		if device.Deleted {
+			continue
+		} else if device.Trust == trust {
+			skipped++
+			continue
+		}
+		if isOwnUser && trust == crypto.TrustStateVerified && device.DeviceID != mach.Client.DeviceID {
+			crossSignDevice(cmd, device)
+		}
+		device.Trust = trust
+		err = mach.CryptoStore.PutDevice(userID, device)
+		if err != nil {
+			cmd.Reply("Failed to save device %s: %v", device.DeviceID, err)
+			continue
+		}
+		changed++
+	}
+	if changed > 0 {
+		mach.OnDevicesChanged(userID)
+	}
+	cmd.Reply("Marked %d devices of %s as %s (%d were already %s)", changed, userID, trust, skipped, trust)
+	if changed > 0 && trust == crypto.TrustStateVerified && !isOwnUser {
+		cmd.Reply("Warning: verifying individual devices of other users is not synced with cross-signing")
+	}
+}
+
+// confirmVerifyAllDevices lists the fingerprints of the devices that would be verified and asks the user to confirm
+// that they've compared them, as verifying own devices also cross-signs them.
+func confirmVerifyAllDevices(cmd *Command, userID id.UserID, devices map[id.DeviceID]*crypto.DeviceIdentity) bool {
+	var lines []string
+	for _, device := range devices {
+		if !device.Deleted && device.Trust != crypto.TrustStateVerified {
+			lines = append(lines, fmt.Sprintf("* %s (%s): %s", device.DeviceID, device.Name, device.Fingerprint()))
+		}
+	}
+	if len(lines) == 0 {
+		return true
+	}
+	sort.Strings(lines)
+	cmd.Reply("Devices of %s that will be verified:\n%s", userID, strings.Join(lines, "\n"))
+	return cmd.MainView.AskConfirmation("Verify all devices", fmt.Sprintf("Verify the %d devices listed in the "+
+		"room? Only continue if you've compared each fingerprint with the device.", len(lines)), "Verify")
+}
+
 func cmdVerifyDevice(cmd *Command) {
+	if isAllDevices(cmd) {
+		if len(cmd.Args) > 2 {
+			cmd.Reply("Fingerprints can't be checked when verifying all devices, compare them with /devices first")
+			return
+		}
+		setAllDevicesTrust(cmd, crypto.TrustStateVerified)
+		return
+	}
 	device := getDevice(cmd)
 	if device == nil {
 		return
@@ -196,84 +708,286 @@ func cmdVerifyDevice(cmd *Command) {
 	if len(cmd.Args) == 2 {
 		mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
 		mach.DefaultSASTimeout = 120 * time.Second
-		modal := NewVerificationModal(cmd.MainView, device, mach.DefaultSASTimeout)
+		modal := NewVerificationModal(cmd.MainView, device, "", mach.DefaultSASTimeout)
 		cmd.MainView.ShowModal(modal)
-		_, err := mach.NewSimpleSASVerificationWith(device, modal)
+		transactionID, err := mach.NewSimpleSASVerificationWith(device, modal)
 		if err != nil {
 			cmd.Reply("Failed to start interactive verification: %v", err)
 			return
 		}
+		modal.SetTransactionID(transactionID)
 	} else {
-		fingerprint := strings.Join(cmd.Args[2:], "")
-		if string(device.SigningKey) != fingerprint {
-			cmd.Reply("Mismatching fingerprint")
-			return
-		}
-		action := "verified"
-		if device.Trust == crypto.TrustStateBlacklisted {
-			action = "unblacklisted and verified"
-		}
-		if device.UserID == cmd.Matrix.Client().UserID {
-			crossSignDevice(cmd, device)
-			device.Trust = crypto.TrustStateVerified
-			putDevice(cmd, device, action)
-		} else {
-			putDevice(cmd, device, action)
-			cmd.Reply("Warning: verifying individual devices of other users is not synced with cross-signing")
-		}
+		verifyDeviceFingerprint(cmd, device, strings.Join(cmd.Args[2:], ""))
 	}
 }
 
-func cmdVerify(cmd *Command) {
-	if len(cmd.Args) < 1 {
-		cmd.Reply("Usage: /%s <user ID> [--force]", cmd.OrigCommand)
+// verifyDeviceFingerprint marks the device as verified if the given fingerprint matches its signing key.
+func verifyDeviceFingerprint(cmd *Command, device *crypto.DeviceIdentity, fingerprint string) {
+	if string(device.SigningKey) != fingerprint {
+		cmd.Reply("Mismatching fingerprint")
 		return
 	}
-	force := len(cmd.Args) >= 2 && strings.ToLower(cmd.Args[1]) == "--force"
-	userID := id.UserID(cmd.Args[0])
-	room := cmd.Room.Room
-	if !room.Encrypted {
-		cmd.Reply("In-room verification is only supported in encrypted rooms")
-		return
+	action := "verified"
+	if device.Trust == crypto.TrustStateBlacklisted {
+		action = "unblacklisted and verified"
 	}
-	if (!room.IsDirect || room.OtherUser != userID) && !force {
-		cmd.Reply("This doesn't seem to be a direct chat. Either switch to a direct chat with %s, "+
-			"or use `--force` to start the verification anyway.", userID)
-		return
+	if device.UserID == cmd.Matrix.Client().UserID {
+		crossSignDevice(cmd, device)
+		device.Trust = crypto.TrustStateVerified
+		putDevice(cmd, device, action)
+	} else {
+		putDevice(cmd, device, action)
+		cmd.Reply("Warning: verifying individual devices of other users is not synced with cross-signing")
 	}
-	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
-	if mach.CrossSigningKeys == nil && !force {
-		cmd.Reply("Cross-signing private keys not cached. Generate or fetch cross-signing keys with `/cross-signing`, " +
-			"or use `--force` to start the verification anyway")
-		return
+}
+
+// profileFingerprintsField is the custom profile field where users can publish their device fingerprints,
+// as an object from device ID to fingerprint.
+const profileFingerprintsField = "net.maunium.gomuks.device_fingerprints"
+
+// maxFingerprintFileSize limits how much is read from the configured fingerprint URL.
+const maxFingerprintFileSize = 64 * 1024
+
+func getProfileFingerprints(client *mautrix.Client, userID id.UserID) (map[id.DeviceID]string, error) {
+	var profile map[string]json.RawMessage
+	_, err := client.MakeRequest("GET", client.BuildClientURL("v3", "profile", userID), nil, &profile)
+	if err != nil {
+		return nil, err
 	}
-	modal := NewVerificationModal(cmd.MainView, &crypto.DeviceIdentity{UserID: userID}, mach.DefaultSASTimeout)
-	_, err := mach.NewInRoomSASVerificationWith(cmd.Room.Room.ID, userID, modal, 120*time.Second)
+	data, ok := profile[profileFingerprintsField]
+	if !ok {
+		return nil, nil
+	}
+	var fingerprints map[id.DeviceID]string
+	err = json.Unmarshal(data, &fingerprints)
 	if err != nil {
-		cmd.Reply("Failed to start in-room verification: %v", err)
-		return
+		return nil, fmt.Errorf("invalid %s field: %w", profileFingerprintsField, err)
 	}
-	cmd.MainView.ShowModal(modal)
+	return fingerprints, nil
 }
 
-func cmdUnverify(cmd *Command) {
-	device := getDevice(cmd)
-	if device == nil {
-		return
+func getURLFingerprints(pattern string, userID id.UserID, deviceID id.DeviceID) (map[id.DeviceID]string, error) {
+	localpart, server, err := userID.Parse()
+	if err != nil {
+		return nil, err
+	}
+	fingerprintURL := strings.NewReplacer(
+		"{user}", url.PathEscape(string(userID)),
+		"{localpart}", url.PathEscape(localpart),
+		"{server}", server,
+		"{device}", url.PathEscape(string(deviceID)),
+	).Replace(pattern)
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	resp, err := httpClient.Get(fingerprintURL)
+	if err != nil {
+		return nil, err
 	}
-	if device.Trust == crypto.TrustStateUnset {
-		cmd.Reply("That device is already not verified")
-		return
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, fingerprintURL)
 	}
-	action := "unverified"
-	if device.Trust == crypto.TrustStateBlacklisted {
-		action = "unblacklisted"
+	var fingerprints map[id.DeviceID]string
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxFingerprintFileSize)).Decode(&fingerprints)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fingerprint file at %s: %w", fingerprintURL, err)
 	}
-	device.Trust = crypto.TrustStateUnset
-	putDevice(cmd, device, action)
+	return fingerprints, nil
 }
 
-func cmdBlacklist(cmd *Command) {
+// cmdVerifyFromProfile verifies a device using the fingerprint the user has published in their profile or at the
+// configured fingerprint URL. The published value is compared exactly like a manually entered fingerprint.
+func cmdVerifyFromProfile(cmd *Command) {
+	device := getDevice(cmd)
+	if device == nil {
+		return
+	} else if device.Trust == crypto.TrustStateVerified {
+		cmd.Reply("That device is already verified")
+		return
+	}
+	source := "profile"
+	fingerprints, err := getProfileFingerprints(cmd.Matrix.Client(), device.UserID)
+	if err != nil {
+		cmd.Reply("Failed to get profile of %s: %v", device.UserID, err)
+		return
+	}
+	if _, ok := fingerprints[device.DeviceID]; !ok && len(cmd.Config.FingerprintURLPattern) > 0 {
+		source = "fingerprint URL"
+		fingerprints, err = getURLFingerprints(cmd.Config.FingerprintURLPattern, device.UserID, device.DeviceID)
+		if err != nil {
+			cmd.Reply("Failed to get published fingerprints of %s: %v", device.UserID, err)
+			return
+		}
+	}
+	published, ok := fingerprints[device.DeviceID]
+	if !ok {
+		cmd.Reply("%s hasn't published a fingerprint for %s. Compare the fingerprint manually and use "+
+			"/verify-device %s %s <fingerprint> instead.", device.UserID, device.DeviceID, device.UserID, device.DeviceID)
+		return
+	}
+	fingerprint := normalizeFingerprint(published)
+	if key, err := base64.RawStdEncoding.DecodeString(fingerprint); err != nil || len(key) != 32 {
+		cmd.Reply("The fingerprint published for %s in the %s is not a valid ed25519 key", device.DeviceID, source)
+		return
+	}
+	cmd.Reply("Comparing against the fingerprint published in the %s of %s", source, device.UserID)
+	verifyDeviceFingerprint(cmd, device, fingerprint)
+}
+
+func cmdVerify(cmd *Command) {
+	if len(cmd.Args) < 1 {
+		cmd.Reply("Usage: /%s <user ID> [--force], /%s <--observe|--show-keys> <user ID> <device ID> "+
+			"or /%s <user ID> <device ID> --from-profile", cmd.OrigCommand, cmd.OrigCommand, cmd.OrigCommand)
+		return
+	}
+	switch strings.ToLower(cmd.Args[0]) {
+	case "--observe":
+		cmd.Args = cmd.Args[1:]
+		cmdVerifyObserve(cmd)
+		return
+	case "--show-keys":
+		cmd.Args = cmd.Args[1:]
+		cmdVerifyShowKeys(cmd)
+		return
+	}
+	if len(cmd.Args) == 3 && strings.ToLower(cmd.Args[2]) == "--from-profile" {
+		cmd.Args = cmd.Args[:2]
+		cmdVerifyFromProfile(cmd)
+		return
+	}
+	force := len(cmd.Args) >= 2 && strings.ToLower(cmd.Args[1]) == "--force"
+	userID := id.UserID(cmd.Args[0])
+	room := cmd.Room.Room
+	if !room.Encrypted {
+		cmd.Reply("In-room verification is only supported in encrypted rooms")
+		return
+	}
+	if (!room.IsDirect || room.OtherUser != userID) && !force {
+		cmd.Reply("This doesn't seem to be a direct chat. Either switch to a direct chat with %s, "+
+			"or use `--force` to start the verification anyway.", userID)
+		return
+	}
+	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
+	if mach.CrossSigningKeys == nil && !force {
+		cmd.Reply("Cross-signing private keys not cached. Generate or fetch cross-signing keys with `/cross-signing`, " +
+			"or use `--force` to start the verification anyway")
+		return
+	}
+	modal := NewVerificationModal(cmd.MainView, &crypto.DeviceIdentity{UserID: userID}, room.ID, mach.DefaultSASTimeout)
+	_, err := mach.NewInRoomSASVerificationWith(cmd.Room.Room.ID, userID, modal, 120*time.Second)
+	if err != nil {
+		cmd.Reply("Failed to start in-room verification: %v", err)
+		return
+	}
+	cmd.MainView.ShowModal(modal)
+}
+
+// cmdVerifyShowKeys prints the full keys of a device and the exact value that manual verification expects.
+func cmdVerifyShowKeys(cmd *Command) {
+	device := getDevice(cmd)
+	if device == nil {
+		return
+	}
+	cmd.Reply("Keys of %s/%s (%s):\n"+
+		"    Identity key (Curve25519): %s\n"+
+		"    Signing key (Ed25519):     %s\n"+
+		"    Fingerprint:               %s\n"+
+		"The fingerprint is the signing key split into groups, spaces are ignored when comparing. "+
+		"To verify manually, compare it with the fingerprint shown on the other device and run:\n"+
+		"    /verify-device %s %s %s",
+		device.UserID, device.DeviceID, device.Name,
+		device.IdentityKey, device.SigningKey, device.Fingerprint(),
+		device.UserID, device.DeviceID, device.SigningKey)
+}
+
+// cmdVerifyObserve starts a to-device SAS verification that only displays and compares the SAS.
+// The transaction is cancelled after the comparison, so the trust state of the device isn't changed.
+func cmdVerifyObserve(cmd *Command) {
+	device := getDevice(cmd)
+	if device == nil {
+		return
+	}
+	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
+	mach.DefaultSASTimeout = 120 * time.Second
+	modal := NewVerificationModal(cmd.MainView, device, "", mach.DefaultSASTimeout)
+	transactionID, err := mach.NewSimpleSASVerificationWith(device, modal)
+	if err != nil {
+		cmd.Reply("Failed to start observer verification: %v", err)
+		return
+	}
+	modal.SetObserveOnly(transactionID)
+	cmd.MainView.ShowModal(modal)
+	cmd.Reply("Started observer verification with %s/%s. This will not establish any trust.", device.UserID, device.DeviceID)
+}
+
+// phraseVerificationTimeout is how long /verify-phrase waits for the other device to enter the phrase.
+const phraseVerificationTimeout = 5 * time.Minute
+
+// cmdVerifyPhrase verifies a device using a secret phrase that both users have agreed on out of band.
+// It's a weaker alternative to SAS for users who can't compare emojis, so it's disabled by default.
+func cmdVerifyPhrase(cmd *Command) {
+	if !cmd.Config.SharedSecretVerification {
+		cmd.Reply("Shared secret phrase verification is disabled. " +
+			"Set `shared_secret_verification: true` in the config to enable it.")
+		return
+	}
+	device := getDevice(cmd)
+	if device == nil {
+		return
+	}
+	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
+	stored, err := mach.CryptoStore.GetDevice(device.UserID, device.DeviceID)
+	if err != nil || stored == nil || stored.SigningKey != device.SigningKey || stored.IdentityKey != device.IdentityKey {
+		cmd.Reply("The keys of %s/%s couldn't be confirmed against the local store", device.UserID, device.DeviceID)
+		return
+	}
+	cmd.Reply("Warning: phrase verification is WEAKER than emoji verification or cross-signing. " +
+		"Only use it with a long phrase that was agreed on in person or over a trusted channel.")
+	phrase, ok := cmd.MainView.AskPassword("Shared secret phrase", "phrase", "", false)
+	if !ok {
+		cmd.Reply("Phrase entry cancelled")
+		return
+	}
+	cmd.Reply("Waiting for %s/%s to enter the phrase...", device.UserID, device.DeviceID)
+	match, err := cmd.Matrix.VerifyWithPhrase(device.UserID, device.DeviceID, phrase, phraseVerificationTimeout)
+	if err != nil {
+		cmd.Reply("Phrase verification failed: %v", err)
+		return
+	} else if !match {
+		cmd.Reply("The phrase or device keys didn't match, %s/%s was not verified", device.UserID, device.DeviceID)
+		return
+	}
+	device.Trust = crypto.TrustStateVerified
+	putDevice(cmd, device, "verified (with a shared phrase)")
+}
+
+func cmdUnverify(cmd *Command) {
+	if isAllDevices(cmd) {
+		setAllDevicesTrust(cmd, crypto.TrustStateUnset)
+		return
+	}
+	device := getDevice(cmd)
+	if device == nil {
+		return
+	}
+	if device.Trust == crypto.TrustStateUnset {
+		cmd.Reply("That device is already not verified")
+		return
+	}
+	action := "unverified"
+	if device.Trust == crypto.TrustStateBlacklisted {
+		action = "unblacklisted"
+	}
+	device.Trust = crypto.TrustStateUnset
+	putDevice(cmd, device, action)
+}
+
+func cmdBlacklist(cmd *Command) {
+	if isAllDevices(cmd) {
+		setAllDevicesTrust(cmd, crypto.TrustStateBlacklisted)
+		return
+	}
 	device := getDevice(cmd)
 	if device == nil {
 		return
@@ -290,8 +1004,31 @@ func cmdBlacklist(cmd *Command) {
 	putDevice(cmd, device, action)
 }
 
+// freshOutboundSessionAge is the age under which /reset-session asks for confirmation before removing the outbound
+// session, as resetting a session that was just created only causes another round of key shares.
+const freshOutboundSessionAge = 10 * time.Minute
+
 func cmdResetSession(cmd *Command) {
-	err := cmd.Matrix.Crypto().(*crypto.OlmMachine).CryptoStore.RemoveOutboundGroupSession(cmd.Room.Room.ID)
+	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
+	if !hasFlag(cmd.Args, "--force") {
+		session, err := mach.CryptoStore.GetOutboundGroupSession(cmd.Room.Room.ID)
+		if err != nil {
+			cmd.Reply("Failed to get outbound group session: %v", err)
+			return
+		} else if session == nil {
+			cmd.Reply("There's no outbound group session in this room")
+			return
+		} else if age := time.Since(session.CreationTime); age < freshOutboundSessionAge {
+			confirmed := cmd.MainView.AskConfirmation("Reset session", fmt.Sprintf("The session was created %s ago "+
+				"and has been used for %d messages. Resetting it will share a new session with every device in the room.",
+				age.Truncate(time.Second), session.MessageCount), "Reset")
+			if !confirmed {
+				cmd.Reply("Outbound group session was not reset")
+				return
+			}
+		}
+	}
+	err := mach.CryptoStore.RemoveOutboundGroupSession(cmd.Room.Room.ID)
 	if err != nil {
 		cmd.Reply("Failed to remove outbound group session: %v", err)
 	} else {
@@ -300,7 +1037,26 @@ func cmdResetSession(cmd *Command) {
 }
 
 func cmdImportKeys(cmd *Command) {
-	path, err := filepath.Abs(cmd.RawArgs)
+	rawPath := strings.TrimSpace(cmd.RawArgs)
+	var useSSSS, thisRoom bool
+	for strings.HasPrefix(rawPath, "--") {
+		var flag string
+		flag, rawPath = nextArg(rawPath)
+		switch strings.ToLower(flag) {
+		case "--use-ssss":
+			useSSSS = true
+		case "--this-room":
+			thisRoom = true
+		default:
+			cmd.Reply("Unknown flag %s", flag)
+			return
+		}
+	}
+	if len(rawPath) == 0 {
+		cmd.Reply("Usage: /%s [--use-ssss] [--this-room] <file>", cmd.OrigCommand)
+		return
+	}
+	path, err := filepath.Abs(rawPath)
 	if err != nil {
 		cmd.Reply("Failed to get absolute path: %v", err)
 		return
@@ -310,36 +1066,346 @@ func cmdImportKeys(cmd *Command) {
 		cmd.Reply("Failed to read %s: %v", path, err)
 		return
 	}
-	passphrase, ok := cmd.MainView.AskPassword("Key import", "passphrase", "", false)
+	passphrase, ok := askExportPassphrase(cmd, "Key import", useSSSS, false)
 	if !ok {
-		cmd.Reply("Passphrase entry cancelled")
 		return
 	}
 	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
-	imported, total, err := mach.ImportKeys(passphrase, data)
+	// The round count is read from the file header, this is only for showing it to the user
+	rounds, _ := keyexport.Rounds(data)
+	decrypted, err := keyexport.Decrypt(passphrase, data)
 	if err != nil {
 		cmd.Reply("Failed to import sessions: %v", err)
-	} else {
-		cmd.Reply("Successfully imported %d/%d sessions", imported, total)
+		return
+	}
+	var sessions []crypto.ExportedSession
+	err = json.Unmarshal(decrypted, &sessions)
+	if err != nil {
+		cmd.Reply("Failed to import sessions: invalid session list: %v", err)
+		return
+	}
+	var added, improved, skipped, conflicting, failed, otherRoom int
+	roomID := cmd.Room.MxRoom().ID
+	for _, session := range sessions {
+		if thisRoom && session.RoomID != roomID {
+			otherRoom++
+			continue
+		}
+		result, err := mergeExportedSession(mach, session)
+		switch {
+		case err != nil:
+			debug.Printf("Failed to import Megolm session %s/%s from file: %v", session.RoomID, session.SessionID, err)
+			failed++
+		case result == sessionMergeAdded:
+			added++
+		case result == sessionMergeImproved:
+			improved++
+		case result == sessionMergeConflict:
+			conflicting++
+		default:
+			skipped++
+		}
+	}
+	var roomMismatch string
+	if thisRoom {
+		roomMismatch = fmt.Sprintf("\n    %d skipped as they're for other rooms", otherRoom)
+	}
+	cmd.Reply("Imported %d of %d sessions from %s (file used %d KDF iterations):\n"+
+		"    %d new, %d replaced with an earlier starting index\n"+
+		"    %d skipped as the local copy is already as good or better\n"+
+		"    %d conflicting with a local session with the same ID, %d invalid%s",
+		added+improved, len(sessions)-otherRoom, path, rounds, added, improved, skipped, conflicting, failed, roomMismatch)
+	if added+improved > 0 {
+		cmd.Matrix.RetryDecryption()
 	}
 }
 
-func exportKeys(cmd *Command, sessions []*crypto.InboundGroupSession) {
+type sessionMergeResult int
+
+const (
+	sessionMergeSkipped sessionMergeResult = iota
+	sessionMergeAdded
+	sessionMergeImproved
+	// sessionMergeConflict means that the session has the same ID as a local session, but a different ratchet.
+	sessionMergeConflict
+)
+
+// mergeExportedSession stores an exported session unless the store already has the same session starting at the
+// same or an earlier message index. A session can only decrypt messages from its first known index onwards, so
+// replacing a session with one that starts later would make older messages undecryptable.
+func mergeExportedSession(mach *crypto.OlmMachine, session crypto.ExportedSession) (sessionMergeResult, error) {
+	if err := validateExportedSession(session); err != nil {
+		return sessionMergeSkipped, err
+	}
+	igs, err := olm.InboundGroupSessionImport([]byte(session.SessionKey))
+	if err != nil {
+		return sessionMergeSkipped, err
+	}
+	imported := &crypto.InboundGroupSession{
+		Internal:         *igs,
+		SigningKey:       session.SenderClaimedKeys.Ed25519,
+		SenderKey:        session.SenderKey,
+		RoomID:           session.RoomID,
+		ForwardingChains: session.ForwardingChains,
+	}
+	existing, err := mach.CryptoStore.GetGroupSession(session.RoomID, session.SenderKey, session.SessionID)
+	if err != nil {
+		return sessionMergeSkipped, fmt.Errorf("failed to get existing session: %w", err)
+	}
+	var existingSession keyexport.Session
+	if existing != nil {
+		existingSession = &existing.Internal
+	}
+	merge, err := keyexport.Compare(existingSession, &imported.Internal)
+	if err != nil {
+		return sessionMergeSkipped, err
+	}
+	var result sessionMergeResult
+	switch merge {
+	case keyexport.MergeAdd:
+		result = sessionMergeAdded
+	case keyexport.MergeReplace:
+		result = sessionMergeImproved
+	case keyexport.MergeConflict:
+		return sessionMergeConflict, nil
+	default:
+		return sessionMergeSkipped, nil
+	}
+	err = mach.CryptoStore.PutGroupSession(imported.RoomID, imported.SenderKey, imported.ID(), imported)
+	if err != nil {
+		return sessionMergeSkipped, fmt.Errorf("failed to store session: %w", err)
+	}
+	return result, nil
+}
+
+// validateExportedSession checks that an entry in a key export file can actually be imported.
+func validateExportedSession(session crypto.ExportedSession) error {
+	if session.Algorithm != id.AlgorithmMegolmV1 {
+		return fmt.Errorf("unsupported algorithm %s", session.Algorithm)
+	} else if len(session.RoomID) == 0 {
+		return fmt.Errorf("missing room ID")
+	} else if len(session.SenderKey) == 0 {
+		return fmt.Errorf("missing sender key")
+	}
+	igs, err := olm.InboundGroupSessionImport([]byte(session.SessionKey))
+	if err != nil {
+		return fmt.Errorf("invalid session key: %w", err)
+	}
+	defer igs.Clear()
+	if igs.ID() != session.SessionID {
+		return fmt.Errorf("session ID mismatch (file says %s, key is for %s)", session.SessionID, igs.ID())
+	}
+	return nil
+}
+
+func cmdVerifyExport(cmd *Command) {
+	if len(cmd.Args) == 0 {
+		cmd.Reply("Usage: /verify-export <file>")
+		return
+	}
 	path, err := filepath.Abs(cmd.RawArgs)
 	if err != nil {
 		cmd.Reply("Failed to get absolute path: %v", err)
 		return
 	}
-	passphrase, ok := cmd.MainView.AskPassword("Key export", "passphrase", "", true)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		cmd.Reply("Failed to read %s: %v", path, err)
+		return
+	}
+	passphrase, ok := cmd.MainView.AskPassword("Key export verification", "passphrase", "", false)
 	if !ok {
 		cmd.Reply("Passphrase entry cancelled")
 		return
 	}
-	export, err := crypto.ExportKeys(passphrase, sessions)
+	decrypted, err := keyexport.Decrypt(passphrase, data)
+	if err != nil {
+		cmd.Reply("FAIL: %s could not be decrypted: %v", path, err)
+		return
+	}
+	var sessions []crypto.ExportedSession
+	err = json.Unmarshal(decrypted, &sessions)
+	if err != nil {
+		cmd.Reply("FAIL: %s decrypted, but the contents are not a valid session list: %v", path, err)
+		return
+	}
+	var problems []string
+	for i, session := range sessions {
+		if err = validateExportedSession(session); err != nil {
+			problems = append(problems, fmt.Sprintf("#%d %s: %v", i+1, session.SessionID, err))
+		}
+	}
+	if len(problems) > 0 {
+		cmd.Reply("FAIL: %s contains %d valid and %d malformed sessions:\n%s",
+			path, len(sessions)-len(problems), len(problems), strings.Join(problems, "\n"))
+	} else {
+		cmd.Reply("PASS: %s contains %d valid sessions", path, len(sessions))
+	}
+}
+
+// nextArg splits the first space-separated word off the given raw argument string.
+func nextArg(raw string) (arg, rest string) {
+	raw = strings.TrimSpace(raw)
+	idx := strings.IndexByte(raw, ' ')
+	if idx < 0 {
+		return raw, ""
+	}
+	return raw[:idx], strings.TrimSpace(raw[idx+1:])
+}
+
+type exportOptions struct {
+	path    string
+	rounds  int
+	useSSSS bool
+}
+
+// parseExportArgs parses the arguments of the export commands, which are the optional `--iterations <N>` and
+// `--use-ssss` flags followed by the file path.
+func parseExportArgs(cmd *Command) (opts exportOptions, ok bool) {
+	opts.rounds = keyexport.DefaultRounds
+	rawPath := strings.TrimSpace(cmd.RawArgs)
+	for strings.HasPrefix(rawPath, "--") {
+		var flag string
+		flag, rawPath = nextArg(rawPath)
+		switch strings.ToLower(flag) {
+		case "--use-ssss":
+			opts.useSSSS = true
+		case "--iterations":
+			var value string
+			value, rawPath = nextArg(rawPath)
+			var err error
+			opts.rounds, err = strconv.Atoi(value)
+			if err != nil || opts.rounds < keyexport.MinRounds || opts.rounds > keyexport.MaxRounds {
+				cmd.Reply("Iteration count must be a number between %d and %d", keyexport.MinRounds, keyexport.MaxRounds)
+				return
+			}
+		default:
+			cmd.Reply("Unknown flag %s", flag)
+			return
+		}
+	}
+	if len(rawPath) == 0 {
+		cmd.Reply("Usage: /%s [--iterations <N>] [--use-ssss] <file>", cmd.OrigCommand)
+		return
+	}
+	var err error
+	opts.path, err = filepath.Abs(rawPath)
+	if err != nil {
+		cmd.Reply("Failed to get absolute path: %v", err)
+		return
+	}
+	return opts, true
+}
+
+// askExportPassphrase asks for the passphrase of a key export file. If useSSSS is true, the SSSS key is requested
+// instead, and its recovery key is used as the passphrase. That way the file can also be imported into other clients
+// by entering the recovery key as the passphrase.
+func askExportPassphrase(cmd *Command, title string, useSSSS, isNew bool) (string, bool) {
+	if useSSSS {
+		key := getSSSS(cmd, cmd.Matrix.Crypto().(*crypto.OlmMachine), false)
+		if key == nil {
+			return "", false
+		}
+		return key.RecoveryKey(), true
+	}
+	passphrase, ok := cmd.MainView.AskPassword(title, "passphrase", "", isNew)
+	if !ok {
+		cmd.Reply("Passphrase entry cancelled")
+	}
+	return passphrase, ok
+}
+
+func exportSessions(sessions []*crypto.InboundGroupSession) ([]byte, error) {
+	export := make([]crypto.ExportedSession, len(sessions))
+	for i, session := range sessions {
+		key, err := session.Internal.Export(session.Internal.FirstKnownIndex())
+		if err != nil {
+			return nil, fmt.Errorf("failed to export session: %w", err)
+		}
+		export[i] = crypto.ExportedSession{
+			Algorithm:        id.AlgorithmMegolmV1,
+			ForwardingChains: session.ForwardingChains,
+			RoomID:           session.RoomID,
+			SenderKey:        session.SenderKey,
+			SenderClaimedKeys: crypto.SenderClaimedKeys{
+				Ed25519: session.SigningKey,
+			},
+			SessionID:  session.ID(),
+			SessionKey: key,
+		}
+	}
+	return json.Marshal(export)
+}
+
+// checkWritableDirectory checks that the given directory exists and that files can be created in it.
+func checkWritableDirectory(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	file, err := os.CreateTemp(dir, ".gomuks-write-check-*")
+	if err != nil {
+		return err
+	}
+	_ = file.Close()
+	return os.Remove(file.Name())
+}
+
+// writeFileAtomic writes the data into a temporary file in the same directory and renames it to the given path once
+// it's fully written, so that a failed or interrupted write never leaves a truncated file at the path.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tempPath := file.Name()
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempPath, perm)
+	}
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		_ = os.Remove(tempPath)
+	}
+	return err
+}
+
+func exportKeys(cmd *Command, sessions []*crypto.InboundGroupSession) {
+	opts, ok := parseExportArgs(cmd)
+	if !ok {
+		return
+	}
+	path := opts.path
+	err := checkWritableDirectory(filepath.Dir(path))
+	if err != nil {
+		cmd.Reply("Can't write to %s: %v", path, err)
+		return
+	}
+	passphrase, ok := askExportPassphrase(cmd, "Key export", opts.useSSSS, true)
+	if !ok {
+		return
+	}
+	data, err := exportSessions(sessions)
+	if err != nil {
+		cmd.Reply("Failed to export sessions: %v", err)
+		return
+	}
+	export, err := keyexport.Encrypt(passphrase, opts.rounds, data)
 	if err != nil {
 		cmd.Reply("Failed to export sessions: %v", err)
+		return
 	}
-	err = ioutil.WriteFile(path, export, 0400)
+	err = writeFileAtomic(path, export, 0400)
 	if err != nil {
 		cmd.Reply("Failed to write sessions to %s: %v", path, err)
 	} else {
@@ -367,20 +1433,191 @@ func cmdExportRoomKeys(cmd *Command) {
 	exportKeys(cmd, sessions)
 }
 
-const ssssHelp = `Usage: /%s <subcommand> [...]
+type trustBundleDevice struct {
+	UserID     id.UserID         `json:"user_id"`
+	DeviceID   id.DeviceID       `json:"device_id"`
+	SigningKey id.Ed25519        `json:"signing_key"`
+	Trust      crypto.TrustState `json:"trust"`
+}
 
-Subcommands:
-* status [key ID] - Check the status of your SSSS.
-* generate [--set-default] - Generate a SSSS key and optionally set it as the default.
-* set-default <key ID> - Set a SSSS key as the default.`
+// trustBundle is a portable list of manual device trust decisions, signed with the device key of the exporter.
+type trustBundle struct {
+	UserID     id.UserID           `json:"user_id"`
+	DeviceID   id.DeviceID         `json:"device_id"`
+	SigningKey id.Ed25519          `json:"signing_key"`
+	Devices    []trustBundleDevice `json:"devices"`
+	Signatures mautrix.Signatures  `json:"signatures,omitempty"`
+}
 
-func cmdSSSS(cmd *Command) {
-	if len(cmd.Args) == 0 {
-		cmd.Reply(ssssHelp, cmd.OrigCommand)
+func cmdExportTrust(cmd *Command) {
+	path, err := filepath.Abs(cmd.RawArgs)
+	if err != nil {
+		cmd.Reply("Failed to get absolute path: %v", err)
 		return
 	}
-
 	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
+	account, err := mach.CryptoStore.GetAccount()
+	if err != nil {
+		cmd.Reply("Failed to get own account: %v", err)
+		return
+	} else if account == nil {
+		cmd.Reply("Own account not found in the crypto store, can't sign the trust bundle")
+		return
+	}
+	own := mach.OwnIdentity()
+	bundle := trustBundle{
+		UserID:     own.UserID,
+		DeviceID:   own.DeviceID,
+		SigningKey: own.SigningKey,
+		Devices:    []trustBundleDevice{},
+	}
+	users := mach.CryptoStore.FilterTrackedUsers(append(getEncryptedRoomMembers(cmd.Config.Rooms), own.UserID))
+	for _, userID := range users {
+		devices, err := mach.CryptoStore.GetDevices(userID)
+		if err != nil {
+			cmd.Reply("Failed to get devices of %s: %v", userID, err)
+			return
+		}
+		for _, device := range devices {
+			if device.Trust == crypto.TrustStateUnset || device.Deleted {
+				continue
+			}
+			bundle.Devices = append(bundle.Devices, trustBundleDevice{
+				UserID:     device.UserID,
+				DeviceID:   device.DeviceID,
+				SigningKey: device.SigningKey,
+				Trust:      device.Trust,
+			})
+		}
+	}
+	sort.Slice(bundle.Devices, func(i, j int) bool {
+		if bundle.Devices[i].UserID != bundle.Devices[j].UserID {
+			return bundle.Devices[i].UserID < bundle.Devices[j].UserID
+		}
+		return bundle.Devices[i].DeviceID < bundle.Devices[j].DeviceID
+	})
+	signature, err := account.Internal.SignJSON(&bundle)
+	if err != nil {
+		cmd.Reply("Failed to sign trust bundle: %v", err)
+		return
+	}
+	bundle.Signatures = mautrix.Signatures{
+		own.UserID: {id.NewKeyID(id.KeyAlgorithmEd25519, own.DeviceID.String()): signature},
+	}
+	data, err := json.MarshalIndent(&bundle, "", "  ")
+	if err != nil {
+		cmd.Reply("Failed to serialize trust bundle: %v", err)
+		return
+	}
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		cmd.Reply("Failed to write trust bundle to %s: %v", path, err)
+	} else {
+		cmd.Reply("Successfully exported trust state of %d devices to %s", len(bundle.Devices), path)
+	}
+}
+
+func cmdImportTrust(cmd *Command) {
+	path, err := filepath.Abs(cmd.RawArgs)
+	if err != nil {
+		cmd.Reply("Failed to get absolute path: %v", err)
+		return
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		cmd.Reply("Failed to read %s: %v", path, err)
+		return
+	}
+	var bundle trustBundle
+	err = json.Unmarshal(data, &bundle)
+	if err != nil {
+		cmd.Reply("Failed to parse trust bundle: %v", err)
+		return
+	}
+	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
+	if bundle.UserID != mach.Client.UserID {
+		cmd.Reply("That trust bundle was exported by %s, refusing to import it", bundle.UserID)
+		return
+	}
+	// The signature is checked against the locally known key of the exporting device rather than the key in the
+	// bundle, as anyone can create a bundle signed with their own key.
+	own := mach.OwnIdentity()
+	exporter, err := mach.CryptoStore.GetDevice(bundle.UserID, bundle.DeviceID)
+	if bundle.DeviceID == own.DeviceID {
+		exporter, err = own, nil
+	}
+	if err != nil {
+		cmd.Reply("Failed to get the exporting device %s, refusing to import the trust bundle: %v", bundle.DeviceID, err)
+		return
+	} else if exporter == nil {
+		cmd.Reply("The exporting device %s is not known locally, refusing to import the trust bundle", bundle.DeviceID)
+		return
+	} else if exporter != own && !mach.IsDeviceTrusted(exporter) {
+		cmd.Reply("The exporting device %s is not verified, verify it before importing its trust bundle", bundle.DeviceID)
+		return
+	} else if exporter.SigningKey != bundle.SigningKey {
+		cmd.Reply("Signing key of the trust bundle doesn't match the exporting device %s, refusing to import it", bundle.DeviceID)
+		return
+	}
+	ok, err := olm.VerifySignatureJSON(&bundle, bundle.UserID, bundle.DeviceID.String(), exporter.SigningKey)
+	if err != nil {
+		cmd.Reply("Failed to verify trust bundle signature, refusing to import it: %v", err)
+		return
+	} else if !ok {
+		cmd.Reply("Trust bundle signature is invalid, refusing to import it")
+		return
+	}
+
+	imported := 0
+	changedUsers := make(map[id.UserID]struct{})
+	for _, entry := range bundle.Devices {
+		device, err := mach.GetOrFetchDevice(entry.UserID, entry.DeviceID)
+		if err != nil {
+			cmd.Reply("Skipping %s/%s: %v", entry.UserID, entry.DeviceID, err)
+			continue
+		}
+		if device.SigningKey != entry.SigningKey {
+			cmd.Reply("Conflict: signing key of %s/%s has changed since the export, not importing its trust state",
+				entry.UserID, entry.DeviceID)
+			continue
+		} else if device.Trust == entry.Trust {
+			continue
+		} else if device.Trust != crypto.TrustStateUnset {
+			cmd.Reply("Conflict: %s/%s is %s locally but %s in the bundle, keeping the local state",
+				entry.UserID, entry.DeviceID, device.Trust, entry.Trust)
+			continue
+		}
+		device.Trust = entry.Trust
+		err = mach.CryptoStore.PutDevice(device.UserID, device)
+		if err != nil {
+			cmd.Reply("Failed to save %s/%s: %v", entry.UserID, entry.DeviceID, err)
+			continue
+		}
+		changedUsers[device.UserID] = struct{}{}
+		imported++
+	}
+	for userID := range changedUsers {
+		mach.OnDevicesChanged(userID)
+	}
+	cmd.Reply("Successfully imported trust state of %d/%d devices", imported, len(bundle.Devices))
+}
+
+const ssssHelp = `Usage: /%s <subcommand> [...]
+
+Subcommands:
+* status [key ID] - Check the status of your SSSS.
+* generate [--set-default] [--id <key ID>] - Generate a SSSS key and optionally set it as the default.
+* set-default <key ID> - Set a SSSS key as the default.
+* change-passphrase - Explains how to change the SSSS passphrase.`
+
+func cmdSSSS(cmd *Command) {
+	if len(cmd.Args) == 0 {
+		cmd.Reply(ssssHelp, cmd.OrigCommand)
+		return
+	}
+
+	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
+	invalidateSSSSKeyIDCache()
 
 	switch strings.ToLower(cmd.Args[0]) {
 	case "status":
@@ -390,19 +1627,53 @@ func cmdSSSS(cmd *Command) {
 		}
 		cmdS4Status(cmd, mach, keyID)
 	case "generate":
-		setDefault := len(cmd.Args) > 1 && strings.ToLower(cmd.Args[1]) == "--set-default"
-		cmdS4Generate(cmd, mach, setDefault)
+		var setDefault bool
+		var keyID string
+		for i := 1; i < len(cmd.Args); i++ {
+			switch strings.ToLower(cmd.Args[i]) {
+			case "--set-default":
+				setDefault = true
+			case "--id":
+				if i+1 >= len(cmd.Args) {
+					cmd.Reply("Usage: /%s generate [--set-default] [--id <key ID>]", cmd.OrigCommand)
+					return
+				}
+				i++
+				keyID = cmd.Args[i]
+			default:
+				cmd.Reply("Unknown flag %s", cmd.Args[i])
+				return
+			}
+		}
+		if len(keyID) > 0 && !checkNewSSSSKeyID(cmd, mach, keyID) {
+			return
+		}
+		cmdS4Generate(cmd, mach, keyID, setDefault)
 	case "set-default":
 		if len(cmd.Args) < 2 {
 			cmd.Reply("Usage: /%s set-default <key ID>", cmd.OrigCommand)
 			return
 		}
 		cmdS4SetDefault(cmd, mach, cmd.Args[1])
+	case "change-passphrase":
+		cmd.Reply(ssssChangePassphraseHelp, cmd.OrigCommand)
 	default:
 		cmd.Reply(ssssHelp, cmd.OrigCommand)
 	}
 }
 
+// ssssChangePassphraseHelp explains why the passphrase can't be changed in-place. The SSSS key is derived from the
+// passphrase with PBKDF2 and the key metadata only stores the salt and iteration count, so there's nothing that could
+// be re-wrapped for a new passphrase while keeping the same key.
+const ssssChangePassphraseHelp = `The SSSS passphrase can't be changed without changing the key.
+
+The key is derived directly from the passphrase, so a new passphrase always
+produces a new key (and a new recovery key). To switch to a new passphrase:
+
+1. Fetch your cross-signing keys with the current key: /cross-signing fetch
+2. Generate a new key with the new passphrase: /%s generate --set-default
+3. Re-upload your cross-signing keys under it: /cross-signing upload`
+
 func cmdS4Status(cmd *Command, mach *crypto.OlmMachine, keyID string) {
 	var keyData *ssss.KeyMetadata
 	var err error
@@ -429,26 +1700,50 @@ func cmdS4Status(cmd *Command, mach *crypto.OlmMachine, keyID string) {
 	cmd.Reply("Default key is set.\n  Key ID: %s\n  Has passphrase: %s\n  Algorithm: %s", keyID, hasPassphrase, algorithm)
 }
 
-func cmdS4Generate(cmd *Command, mach *crypto.OlmMachine, setDefault bool) {
+// ssssKeyIDRegex limits custom key IDs to characters that are safe in account data event types and URL paths.
+var ssssKeyIDRegex = regexp.MustCompile("^[A-Za-z0-9._-]{1,64}$")
+
+// checkNewSSSSKeyID checks that a custom SSSS key ID is well-formed and not already used by another key.
+func checkNewSSSSKeyID(cmd *Command, mach *crypto.OlmMachine, keyID string) bool {
+	if !ssssKeyIDRegex.MatchString(keyID) {
+		cmd.Reply("Invalid key ID %q: must be 1-64 characters of A-Z, a-z, 0-9, '.', '_' or '-'", keyID)
+		return false
+	}
+	_, err := mach.SSSS.GetKeyData(keyID)
+	if err == nil {
+		cmd.Reply("A SSSS key with the ID %s already exists", keyID)
+		return false
+	} else if !errors.Is(err, mautrix.MNotFound) {
+		cmd.Reply("Failed to check if key ID %s is in use: %v", keyID, err)
+		return false
+	}
+	return true
+}
+
+// cmdS4Generate generates a new SSSS key and uploads its metadata. If keyID is empty, a random key ID is used.
+func cmdS4Generate(cmd *Command, mach *crypto.OlmMachine, keyID string, setDefault bool) *ssss.Key {
 	passphrase, ok := cmd.MainView.AskPassword("Passphrase", "", "", true)
 	if !ok {
-		return
+		return nil
 	}
 
 	key, err := ssss.NewKey(passphrase)
 	if err != nil {
 		cmd.Reply("Failed to generate new key: %v", err)
-		return
+		return nil
+	}
+	if len(keyID) > 0 {
+		key.ID = keyID
 	}
 
 	err = mach.SSSS.SetKeyData(key.ID, key.Metadata)
 	if err != nil {
 		cmd.Reply("Failed to upload key metadata: %v", err)
-		return
+		return nil
 	}
 
-	// TODO if we start persisting command replies, the recovery key needs to be moved into a popup
-	cmd.Reply("Successfully generated key %s\nRecovery key: %s", key.ID, key.RecoveryKey())
+	cmd.Reply("Successfully generated key %s", key.ID)
+	cmd.MainView.ShowRecoveryKey(key.ID, key.RecoveryKey())
 
 	if setDefault {
 		err = mach.SSSS.SetDefaultKeyID(key.ID)
@@ -458,6 +1753,7 @@ func cmdS4Generate(cmd *Command, mach *crypto.OlmMachine, setDefault bool) {
 	} else {
 		cmd.Reply("You can use `/%s set-default %s` to set it as the default", cmd.OrigCommand, key.ID)
 	}
+	return key
 }
 
 func cmdS4SetDefault(cmd *Command, mach *crypto.OlmMachine, keyID string) {
@@ -484,17 +1780,34 @@ const crossSigningHelp = `Usage: /%s <subcommand> [...]
 Subcommands:
 * status
     Check the status of your own cross-signing keys.
-* generate [--force]
+* generate [--force] [--preview]
     Generate and upload new cross-signing keys.
     This will prompt you to enter your account password.
     If you already have existing keys, --force is required.
+    With --preview, only show what would be done without changing anything.
 * self-sign
     Sign the current device with cached cross-signing keys.
-* fetch [--save-to-disk]
+* fetch [--save-to-disk] [--recovery-key]
     Fetch your cross-signing keys from SSSS and decrypt them.
-    If --save-to-disk is specified, the keys are saved to disk.
-* upload
-    Upload your cross-signing keys to SSSS.`
+    If --save-to-disk is specified, the keys are also saved to disk,
+    encrypted with a passphrase. Use /toggle crosssigningkeys to load
+    them on startup.
+* upload [--recovery-key] [--all-keys]
+    Upload your cross-signing keys to SSSS.
+    With --all-keys, the keys are encrypted for every known SSSS key
+    (the default key and any key the secrets are already stored under),
+    not just the default one.
+* audit-devices [--sign]
+    List which of your own devices are signed by your self-signing key.
+    With --sign, the unsigned devices that you have verified manually are
+    signed. Unverified devices are never signed automatically.
+* sign-user <user ID> [master key fingerprint]
+    Sign another user's master key with your user-signing key.
+    The fingerprint must be compared with the user out of band. If it's
+    omitted, the fingerprint is shown and nothing is signed.
+
+SSSS commands ask for the passphrase if one is set, with the recovery key
+as a fallback. Use --recovery-key to enter the recovery key directly.`
 
 func cmdCrossSigning(cmd *Command) {
 	if len(cmd.Args) == 0 {
@@ -504,20 +1817,33 @@ func cmdCrossSigning(cmd *Command) {
 
 	client := cmd.Matrix.Client()
 	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
+	invalidateSSSSKeyIDCache()
 
 	switch strings.ToLower(cmd.Args[0]) {
 	case "status":
 		cmdCrossSigningStatus(cmd, mach)
 	case "generate":
-		force := len(cmd.Args) > 1 && strings.ToLower(cmd.Args[1]) == "--force"
-		cmdCrossSigningGenerate(cmd, cmd.Matrix, mach, client, force)
+		force := hasFlag(cmd.Args[1:], "--force")
+		if hasFlag(cmd.Args[1:], "--preview") {
+			cmdCrossSigningGeneratePreview(cmd, mach, force)
+		} else {
+			cmdCrossSigningGenerate(cmd, cmd.Matrix, mach, client, force)
+		}
 	case "fetch":
-		saveToDisk := len(cmd.Args) > 1 && strings.ToLower(cmd.Args[1]) == "--save-to-disk"
-		cmdCrossSigningFetch(cmd, mach, saveToDisk)
+		saveToDisk := hasFlag(cmd.Args[1:], "--save-to-disk")
+		cmdCrossSigningFetch(cmd, mach, saveToDisk, hasFlag(cmd.Args[1:], "--recovery-key"))
 	case "upload":
-		cmdCrossSigningUpload(cmd, mach)
+		if hasFlag(cmd.Args[1:], "--all-keys") {
+			cmdCrossSigningUploadAllKeys(cmd, mach, hasFlag(cmd.Args[1:], "--recovery-key"))
+		} else {
+			cmdCrossSigningUpload(cmd, mach, hasFlag(cmd.Args[1:], "--recovery-key"))
+		}
 	case "self-sign":
 		cmdCrossSigningSelfSign(cmd, mach)
+	case "sign-user":
+		cmdCrossSigningSignUser(cmd, mach)
+	case "audit-devices":
+		cmdCrossSigningAuditDevices(cmd, mach, hasFlag(cmd.Args[1:], "--sign"))
 	default:
 		cmd.Reply(crossSigningHelp, cmd.OrigCommand)
 	}
@@ -543,8 +1869,8 @@ func cmdCrossSigningStatus(cmd *Command, mach *crypto.OlmMachine) {
 	cmd.Reply("Self-signing key: %s", keys.SelfSigningKey)
 }
 
-func cmdCrossSigningFetch(cmd *Command, mach *crypto.OlmMachine, saveToDisk bool) {
-	key := getSSSS(cmd, mach)
+func cmdCrossSigningFetch(cmd *Command, mach *crypto.OlmMachine, saveToDisk, useRecoveryKey bool) {
+	key := getSSSS(cmd, mach, useRecoveryKey)
 	if key == nil {
 		return
 	}
@@ -554,28 +1880,16 @@ func cmdCrossSigningFetch(cmd *Command, mach *crypto.OlmMachine, saveToDisk bool
 		cmd.Reply("Error fetching cross-signing keys: %v", err)
 		return
 	}
+	cmd.Reply("Successfully unlocked cross-signing keys")
 	if saveToDisk {
-		cmd.Reply("Saving keys to disk is not yet implemented")
+		cmdCrossSigningSaveToDisk(cmd, mach)
 	}
-	cmd.Reply("Successfully unlocked cross-signing keys")
 }
 
-func cmdCrossSigningGenerate(cmd *Command, container ifc.MatrixContainer, mach *crypto.OlmMachine, client *mautrix.Client, force bool) {
-	if !force {
-		existingKeys := mach.GetOwnCrossSigningPublicKeys()
-		if existingKeys != nil {
-			cmd.Reply("Found existing cross-signing keys. Use `--force` if you want to overwrite them.")
-			return
-		}
-	}
-
-	keys, err := mach.GenerateCrossSigningKeys()
-	if err != nil {
-		cmd.Reply("Failed to generate cross-signing keys: %v", err)
-		return
-	}
-
-	err = mach.PublishCrossSigningKeys(keys, func(uia *mautrix.RespUserInteractive) interface{} {
+// makeUIACallback returns a callback for user-interactive authentication that asks for the account password, or
+// opens the fallback page in a browser if the server doesn't allow password authentication.
+func makeUIACallback(cmd *Command, container ifc.MatrixContainer, userID id.UserID) mautrix.UIACallback {
+	return func(uia *mautrix.RespUserInteractive) interface{} {
 		if !uia.HasSingleStageFlow(mautrix.AuthTypePassword) {
 			for _, flow := range uia.Flows {
 				if len(flow.Stages) != 1 {
@@ -589,7 +1903,7 @@ func cmdCrossSigningGenerate(cmd *Command, container ifc.MatrixContainer, mach *
 				}
 				return &mautrix.ReqUIAuthFallback{
 					Session: uia.Session,
-					User:    mach.Client.UserID.String(),
+					User:    userID.String(),
 				}
 			}
 			cmd.Reply("No supported authentication mechanisms found")
@@ -604,13 +1918,31 @@ func cmdCrossSigningGenerate(cmd *Command, container ifc.MatrixContainer, mach *
 				Type:    mautrix.AuthTypePassword,
 				Session: uia.Session,
 			},
-			User:     mach.Client.UserID.String(),
+			User:     userID.String(),
 			Password: password,
 		}
-	})
+	}
+}
+
+func cmdCrossSigningGenerate(cmd *Command, container ifc.MatrixContainer, mach *crypto.OlmMachine, client *mautrix.Client, force bool) bool {
+	if !force {
+		existingKeys := mach.GetOwnCrossSigningPublicKeys()
+		if existingKeys != nil {
+			cmd.Reply("Found existing cross-signing keys. Use `--force` if you want to overwrite them.")
+			return false
+		}
+	}
+
+	keys, err := mach.GenerateCrossSigningKeys()
+	if err != nil {
+		cmd.Reply("Failed to generate cross-signing keys: %v", err)
+		return false
+	}
+
+	err = mach.PublishCrossSigningKeys(keys, makeUIACallback(cmd, container, mach.Client.UserID))
 	if err != nil {
 		cmd.Reply("Failed to publish cross-signing keys: %v", err)
-		return
+		return false
 	}
 	cmd.Reply("Successfully generated and published cross-signing keys")
 
@@ -618,9 +1950,44 @@ func cmdCrossSigningGenerate(cmd *Command, container ifc.MatrixContainer, mach *
 	if err != nil {
 		cmd.Reply("Failed to sign master key with device key: %v", err)
 	}
+	return true
+}
+
+// cmdCrossSigningGeneratePreview describes what `generate` would do with the current state of the account. It doesn't
+// make any changes or prompt for anything.
+func cmdCrossSigningGeneratePreview(cmd *Command, mach *crypto.OlmMachine, force bool) {
+	state := getCryptoSetupState(mach)
+	var buf strings.Builder
+	buf.WriteString("Preview only, nothing was changed.\n\n")
+	if state.crossSigning && !force {
+		buf.WriteString("Existing cross-signing keys were found, so `generate` would refuse to run without --force.")
+		cmd.Reply("%s", buf.String())
+		return
+	}
+	buf.WriteString("`generate` would:\n")
+	if state.crossSigning {
+		keys := mach.GetOwnCrossSigningPublicKeys()
+		_, _ = fmt.Fprintf(&buf, "* Replace your existing master key (fingerprint %s). Signatures made with the old keys, "+
+			"including your verifications of other users, would no longer be valid\n", crypto.Fingerprint(keys.MasterKey))
+	}
+	buf.WriteString("* Generate new master, self-signing and user-signing keys\n")
+	buf.WriteString("* Publish them, which requires your account password (or browser authentication)\n")
+	buf.WriteString("* Sign the new master key with this device's key\n")
+	buf.WriteString("\nAfterwards:\n")
+	if len(state.ssssKeyID) > 0 {
+		_, _ = fmt.Fprintf(&buf, "* The new keys would not be in SSSS yet (default key %s), run `/%s upload` to store them\n",
+			state.ssssKeyID, cmd.OrigCommand)
+	} else {
+		buf.WriteString("* SSSS is not set up, so the new keys would only be cached on this device. " +
+			"Use `/ssss generate --set-default` and `/" + cmd.OrigCommand + " upload` to back them up\n")
+	}
+	_, _ = fmt.Fprintf(&buf, "* This device would not be signed by the new self-signing key, run `/%s self-sign` to sign it", cmd.OrigCommand)
+	cmd.Reply("%s", buf.String())
 }
 
-func getSSSS(cmd *Command, mach *crypto.OlmMachine) *ssss.Key {
+// getSSSS asks for the passphrase or recovery key of the default SSSS key. If the key has a passphrase, it's asked
+// first unless useRecoveryKey is set, and the recovery key is offered as a fallback if the passphrase is incorrect.
+func getSSSS(cmd *Command, mach *crypto.OlmMachine, useRecoveryKey bool) *ssss.Key {
 	_, keyData, err := mach.SSSS.GetDefaultKeyData()
 	if err != nil {
 		if errors.Is(err, mautrix.MNotFound) {
@@ -631,46 +1998,89 @@ func getSSSS(cmd *Command, mach *crypto.OlmMachine) *ssss.Key {
 		return nil
 	}
 
-	var key *ssss.Key
-	if keyData.Passphrase != nil && keyData.Passphrase.Algorithm == ssss.PassphraseAlgorithmPBKDF2 {
-		passphrase, ok := cmd.MainView.AskPassword("Passphrase", "", "correct horse battery staple", false)
+	return unlockSSSSKey(cmd, keyData, "", useRecoveryKey)
+}
+
+// maxSSSSPassphraseAttempts is the number of incorrect passphrases after which the recovery key is suggested instead.
+const maxSSSSPassphraseAttempts = 3
+
+// unlockSSSSKey asks for the passphrase or recovery key of the given SSSS key.
+// The name is shown in the prompts if it's not empty.
+func unlockSSSSKey(cmd *Command, keyData *ssss.KeyMetadata, name string, useRecoveryKey bool) *ssss.Key {
+	if useRecoveryKey || keyData.Passphrase == nil || keyData.Passphrase.Algorithm != ssss.PassphraseAlgorithmPBKDF2 {
+		return askSSSSRecoveryKey(cmd, keyData, name)
+	}
+	title := strings.TrimSpace("SSSS key " + name)
+	var status string
+	var failedPassphrases int
+	var isRecoveryKey bool
+	for {
+		input, recoveryKeyMode, ok := cmd.MainView.AskPassphraseOrRecoveryKey(title, status, isRecoveryKey)
 		if !ok {
 			return nil
 		}
-		key, err = keyData.VerifyPassphrase(passphrase)
-		if errors.Is(err, ssss.ErrIncorrectSSSSKey) {
-			cmd.Reply("Incorrect passphrase")
-			return nil
-		}
-	} else {
-		recoveryKey, ok := cmd.MainView.AskPassword("Recovery key", "", "tDAK LMRH PiYE bdzi maCe xLX5 wV6P Nmfd c5mC wLef 15Fs VVSc", false)
-		if !ok {
-			return nil
+		isRecoveryKey = recoveryKeyMode
+		var key *ssss.Key
+		var err error
+		if isRecoveryKey {
+			key, err = keyData.VerifyRecoveryKey(input)
+		} else {
+			key, err = keyData.VerifyPassphrase(input)
 		}
-		key, err = keyData.VerifyRecoveryKey(recoveryKey)
-		if errors.Is(err, ssss.ErrInvalidRecoveryKey) {
-			cmd.Reply("Malformed recovery key")
-			return nil
-		} else if errors.Is(err, ssss.ErrIncorrectSSSSKey) {
-			cmd.Reply("Incorrect recovery key")
+		switch {
+		case err == nil:
+			return key
+		case errors.Is(err, ssss.ErrInvalidRecoveryKey):
+			status = "Malformed recovery key"
+		case errors.Is(err, ssss.ErrIncorrectSSSSKey) && isRecoveryKey:
+			status = "Incorrect recovery key"
+		case errors.Is(err, ssss.ErrIncorrectSSSSKey):
+			failedPassphrases++
+			if failedPassphrases >= maxSSSSPassphraseAttempts {
+				status = "Forgot the passphrase? Try the recovery key"
+				isRecoveryKey = true
+			} else {
+				status = fmt.Sprintf("Incorrect passphrase (%d/%d)", failedPassphrases, maxSSSSPassphraseAttempts)
+			}
+		default:
+			cmd.Reply("Failed to get SSSS key: %v", err)
 			return nil
 		}
 	}
-	// All the errors should already be handled above, this is just for backup
-	if err != nil {
+}
+
+func askSSSSRecoveryKey(cmd *Command, keyData *ssss.KeyMetadata, name string) *ssss.Key {
+	var recoveryKey string
+	var ok bool
+	if cmd.Config.Preferences.GuidedRecoveryKey {
+		recoveryKey, ok = cmd.MainView.AskRecoveryKey(strings.TrimSpace("Recovery key " + name))
+	} else {
+		recoveryKey, ok = cmd.MainView.AskPassword(strings.TrimSpace("Recovery key "+name), "", recoveryKeyPlaceholder, false)
+	}
+	if !ok {
+		return nil
+	}
+	key, err := keyData.VerifyRecoveryKey(recoveryKey)
+	if errors.Is(err, ssss.ErrInvalidRecoveryKey) {
+		cmd.Reply("Malformed recovery key")
+		return nil
+	} else if errors.Is(err, ssss.ErrIncorrectSSSSKey) {
+		cmd.Reply("Incorrect recovery key")
+		return nil
+	} else if err != nil {
 		cmd.Reply("Failed to get SSSS key: %v", err)
 		return nil
 	}
 	return key
 }
 
-func cmdCrossSigningUpload(cmd *Command, mach *crypto.OlmMachine) {
+func cmdCrossSigningUpload(cmd *Command, mach *crypto.OlmMachine, useRecoveryKey bool) {
 	if mach.CrossSigningKeys == nil {
 		cmd.Reply("Cross-signing keys not cached, use `!%s generate` first", cmd.OrigCommand)
 		return
 	}
 
-	key := getSSSS(cmd, mach)
+	key := getSSSS(cmd, mach, useRecoveryKey)
 	if key == nil {
 		return
 	}
@@ -683,6 +2093,98 @@ func cmdCrossSigningUpload(cmd *Command, mach *crypto.OlmMachine) {
 	}
 }
 
+// getKnownSSSSKeyIDs returns the default SSSS key ID and the IDs of all keys that any of the given secrets are currently
+// encrypted with. There's no way to list all account data, so other unused keys can't be found.
+func getKnownSSSSKeyIDs(mach *crypto.OlmMachine, secretTypes ...event.Type) ([]string, error) {
+	var keyIDs []string
+	seen := make(map[string]bool)
+	defaultKeyID, err := mach.SSSS.GetDefaultKeyID()
+	if err == nil {
+		keyIDs = append(keyIDs, defaultKeyID)
+		seen[defaultKeyID] = true
+	} else if !errors.Is(err, ssss.ErrNoDefaultKeyID) && !errors.Is(err, mautrix.MNotFound) {
+		return nil, fmt.Errorf("failed to get default key ID: %w", err)
+	}
+	var otherKeyIDs []string
+	for _, secretType := range secretTypes {
+		var existing ssss.EncryptedAccountDataEventContent
+		err = mach.Client.GetAccountData(secretType.Type, &existing)
+		if errors.Is(err, mautrix.MNotFound) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to get existing %s: %w", secretType.Type, err)
+		}
+		for keyID := range existing.Encrypted {
+			if !seen[keyID] {
+				otherKeyIDs = append(otherKeyIDs, keyID)
+				seen[keyID] = true
+			}
+		}
+	}
+	sort.Strings(otherKeyIDs)
+	return append(keyIDs, otherKeyIDs...), nil
+}
+
+func cmdCrossSigningUploadAllKeys(cmd *Command, mach *crypto.OlmMachine, useRecoveryKey bool) {
+	if mach.CrossSigningKeys == nil {
+		cmd.Reply("Cross-signing keys not cached, use `!%s generate` first", cmd.OrigCommand)
+		return
+	}
+
+	keyIDs, err := getKnownSSSSKeyIDs(mach, event.AccountDataCrossSigningMaster)
+	if err != nil {
+		cmd.Reply("Failed to find SSSS keys: %v", err)
+		return
+	} else if len(keyIDs) == 0 {
+		cmd.Reply("No SSSS keys found, use `/ssss generate --set-default` first")
+		return
+	}
+
+	keys := make([]*ssss.Key, 0, len(keyIDs))
+	results := make([]string, 0, len(keyIDs))
+	failed := false
+	for _, keyID := range keyIDs {
+		keyData, err := mach.SSSS.GetKeyData(keyID)
+		if err != nil {
+			results = append(results, fmt.Sprintf("%s: failed to get key metadata: %v", keyID, err))
+			failed = true
+			continue
+		}
+		cmd.Reply("Unlocking SSSS key %s", keyID)
+		key := unlockSSSSKey(cmd, keyData, keyID, useRecoveryKey)
+		if key == nil {
+			results = append(results, fmt.Sprintf("%s: not unlocked", keyID))
+			failed = true
+			continue
+		}
+		keys = append(keys, key)
+		results = append(results, fmt.Sprintf("%s: unlocked", keyID))
+	}
+	// Uploading replaces the whole encrypted account data event, so any key that wasn't unlocked
+	// would lose access to the secrets.
+	if failed {
+		cmd.Reply("Not all SSSS keys could be unlocked, nothing was uploaded:\n%s", strings.Join(results, "\n"))
+		return
+	}
+
+	secrets := []struct {
+		eventType event.Type
+		seed      []byte
+	}{
+		{event.AccountDataCrossSigningMaster, mach.CrossSigningKeys.MasterKey.Seed},
+		{event.AccountDataCrossSigningSelf, mach.CrossSigningKeys.SelfSigningKey.Seed},
+		{event.AccountDataCrossSigningUser, mach.CrossSigningKeys.UserSigningKey.Seed},
+	}
+	for _, secret := range secrets {
+		err = mach.SSSS.SetEncryptedAccountData(secret.eventType, secret.seed, keys...)
+		if err != nil {
+			cmd.Reply("Failed to upload %s to SSSS: %v", secret.eventType.Type, err)
+			return
+		}
+	}
+	cmd.Reply("Successfully uploaded cross-signing keys to SSSS under %d keys:\n%s", len(keys), strings.Join(results, "\n"))
+}
+
 func cmdCrossSigningSelfSign(cmd *Command, mach *crypto.OlmMachine) {
 	if mach.CrossSigningKeys == nil {
 		cmd.Reply("Cross-signing keys not cached")
@@ -696,3 +2198,1074 @@ func cmdCrossSigningSelfSign(cmd *Command, mach *crypto.OlmMachine) {
 		cmd.Reply("Successfully self-signed. This device is now trusted by other devices")
 	}
 }
+
+func cmdCrossSigningAuditDevices(cmd *Command, mach *crypto.OlmMachine, sign bool) {
+	keys := mach.GetOwnCrossSigningPublicKeys()
+	if keys == nil || len(keys.SelfSigningKey) == 0 {
+		cmd.Reply("Didn't find published cross-signing keys")
+		return
+	}
+	userID := mach.Client.UserID
+	devices, err := mach.CryptoStore.GetDevices(userID)
+	if err != nil {
+		cmd.Reply("Failed to get device list: %v", err)
+		return
+	} else if len(devices) == 0 {
+		devices = mach.LoadDevices(userID)
+	}
+
+	deviceIDs := make([]string, 0, len(devices))
+	for deviceID := range devices {
+		deviceIDs = append(deviceIDs, string(deviceID))
+	}
+	sort.Strings(deviceIDs)
+	var signed, unsigned []string
+	var toSign []*crypto.DeviceIdentity
+	for _, deviceID := range deviceIDs {
+		device := devices[id.DeviceID(deviceID)]
+		isSigned, err := mach.CryptoStore.IsKeySignedBy(userID, device.SigningKey, userID, keys.SelfSigningKey)
+		if err != nil {
+			cmd.Reply("Failed to check signatures of %s: %v", deviceID, err)
+			return
+		}
+		line := fmt.Sprintf("    %s (%s) - %s", device.DeviceID, device.Name, device.Trust)
+		if isSigned {
+			signed = append(signed, line)
+		} else {
+			unsigned = append(unsigned, line)
+			if device.Trust == crypto.TrustStateVerified || device.DeviceID == mach.Client.DeviceID {
+				toSign = append(toSign, device)
+			}
+		}
+	}
+	cmd.Reply("Signed by self-signing key (%d):\n%s\nNot signed (%d):\n%s",
+		len(signed), strings.Join(signed, "\n"), len(unsigned), strings.Join(unsigned, "\n"))
+
+	if len(unsigned) == 0 {
+		return
+	} else if !sign {
+		cmd.Reply("%d of the unsigned devices are verified locally and can be signed with `/%s audit-devices --sign`",
+			len(toSign), cmd.OrigCommand)
+		return
+	} else if mach.CrossSigningKeys == nil {
+		cmd.Reply("Cross-signing keys not cached. Use `/%s fetch` to fetch them from SSSS first.", cmd.OrigCommand)
+		return
+	}
+	for _, device := range toSign {
+		err = mach.SignOwnDevice(device)
+		if err != nil {
+			cmd.Reply("Failed to sign %s: %v", device.DeviceID, err)
+		} else {
+			cmd.Reply("Signed %s (%s)", device.DeviceID, device.Name)
+		}
+	}
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	return strings.Join(strings.Fields(fingerprint), "")
+}
+
+var errMasterKeyChanged = errors.New("master key changed since it was last queried, refusing to sign. " +
+	"Run /crypto resync-devices and compare the new fingerprint with the user")
+
+// queryMasterKey fetches the current master key of a user from the server. The key is compared with the one from the
+// previous query that's in the crypto store, so that a key that changed without the user noticing is never signed.
+func queryMasterKey(mach *crypto.OlmMachine, userID id.UserID) (id.Ed25519, error) {
+	resp, err := mach.Client.QueryKeys(&mautrix.ReqQueryKeys{
+		DeviceKeys: mautrix.DeviceKeysRequest{userID: mautrix.DeviceIDList{}},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to query keys: %w", err)
+	}
+	masterKeys, ok := resp.MasterKeys[userID]
+	if !ok {
+		return "", nil
+	}
+	masterKey := masterKeys.FirstKey()
+	storedKeys, err := mach.CryptoStore.GetCrossSigningKeys(userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get stored keys: %w", err)
+	} else if storedKey, ok := storedKeys[id.XSUsageMaster]; ok && storedKey != masterKey {
+		return "", errMasterKeyChanged
+	}
+	return masterKey, nil
+}
+
+func cmdCrossSigningSignUser(cmd *Command, mach *crypto.OlmMachine) {
+	if len(cmd.Args) < 2 {
+		cmd.Reply("Usage: /%s sign-user <user ID> [master key fingerprint]", cmd.OrigCommand)
+		return
+	} else if mach.CrossSigningKeys == nil || mach.CrossSigningKeys.UserSigningKey == nil {
+		cmd.Reply("Cross-signing keys not cached. Use `/%s fetch` to fetch them from SSSS first.", cmd.OrigCommand)
+		return
+	}
+	userID := id.UserID(cmd.Args[1])
+	if userID == mach.Client.UserID {
+		cmd.Reply("You can't sign your own master key with the user-signing key. Use `/%s self-sign` instead.", cmd.OrigCommand)
+		return
+	}
+	masterKey, err := queryMasterKey(mach, userID)
+	if err != nil {
+		cmd.Reply("Failed to get cross-signing keys of %s: %v", userID, err)
+		return
+	} else if len(masterKey) == 0 {
+		cmd.Reply("%s doesn't have a published master key", userID)
+		return
+	}
+	fingerprint := crypto.Fingerprint(masterKey)
+	if len(cmd.Args) < 3 {
+		cmd.Reply("Master key fingerprint of %s: %s\n"+
+			"Compare it with the user out of band, then run `/%s sign-user %s <fingerprint>` to sign it.",
+			userID, fingerprint, cmd.OrigCommand, userID)
+		return
+	} else if normalizeFingerprint(strings.Join(cmd.Args[2:], "")) != normalizeFingerprint(fingerprint) {
+		cmd.Reply("Fingerprint mismatch: the master key of %s has the fingerprint %s. Nothing was signed.", userID, fingerprint)
+		return
+	}
+	err = mach.SignUser(userID, masterKey)
+	if err != nil {
+		cmd.Reply("Failed to sign master key of %s: %v", userID, err)
+		return
+	}
+	marked, err := markCrossSignedDevicesTrusted(mach, userID)
+	if err != nil {
+		cmd.Reply("Signed the master key of %s, but failed to update local device trust: %v", userID, err)
+	} else {
+		cmd.Reply("Successfully signed the master key of %s. Marked %d cross-signed devices as trusted", userID, marked)
+	}
+}
+
+// markCrossSignedDevicesTrusted marks the devices of a user that are trusted through cross-signing as verified in the
+// local store, so that the trust applies immediately instead of only after their device list is re-fetched.
+func markCrossSignedDevicesTrusted(mach *crypto.OlmMachine, userID id.UserID) (int, error) {
+	devices, err := mach.CryptoStore.GetDevices(userID)
+	if err != nil {
+		return 0, err
+	}
+	var marked int
+	for _, device := range devices {
+		if device.Trust != crypto.TrustStateUnset || !mach.IsDeviceTrusted(device) {
+			continue
+		}
+		device.Trust = crypto.TrustStateVerified
+		err = mach.CryptoStore.PutDevice(userID, device)
+		if err != nil {
+			return marked, fmt.Errorf("failed to update %s: %w", device.DeviceID, err)
+		}
+		marked++
+	}
+	if marked > 0 {
+		mach.OnDevicesChanged(userID)
+	}
+	return marked, nil
+}
+
+const cryptoHelp = `Usage: /%s <subcommand> [...]
+
+Subcommands:
+* setup [--confirm]
+    Walk through the first-time encryption setup: SSSS, cross-signing and
+    self-signing this device. Steps that are already done are skipped and
+    each remaining step is confirmed separately.
+* resync-devices
+    Re-query the device lists of all tracked users from the server.
+* pending-verifications
+    List incoming verification requests that haven't been answered yet.
+    Incoming in-room requests aren't supported and are cancelled.
+* accept-verification <user ID> <device ID>
+    Accept a pending verification request and start emoji verification.
+* reject-verification <user ID> <device ID>
+    Reject a pending verification request.
+* rotate-device [--confirm] [--logout-old]
+    Log in as a new device with fresh device keys, carrying over Megolm
+    sessions and optionally logging out the old device. Advanced.
+* share-session-now
+    Share a fresh outbound Megolm session with all devices in the current
+    room that are allowed to receive keys, so that new members can decrypt
+    the next message without waiting for it.
+* benchmark [events]
+    Measure how fast events can be decrypted with the current crypto store.
+    Read-only diagnostic, defaults to 1000 events.
+* unverified-rooms [--refresh]
+    List encrypted rooms that contain unverified devices, sorted by the
+    number of unverified devices. Uses cached device lists unless
+    --refresh is given.
+* cache <status|clear>
+    Show which secrets are held in memory, or wipe them immediately.`
+
+func cmdCrypto(cmd *Command) {
+	if len(cmd.Args) == 0 {
+		cmd.Reply(cryptoHelp, cmd.OrigCommand)
+		return
+	}
+
+	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
+
+	switch strings.ToLower(cmd.Args[0]) {
+	case "setup":
+		cmdCryptoSetup(cmd, mach, hasFlag(cmd.Args[1:], "--confirm"))
+	case "resync-devices":
+		cmdCryptoResyncDevices(cmd, mach)
+	case "pending-verifications":
+		cmdCryptoPendingVerifications(cmd)
+	case "accept-verification", "reject-verification":
+		if len(cmd.Args) < 3 {
+			cmd.Reply("Usage: /%s %s <user ID> <device ID>", cmd.OrigCommand, cmd.Args[0])
+			return
+		}
+		cmdCryptoAnswerVerification(cmd, mach, id.UserID(cmd.Args[1]), id.DeviceID(cmd.Args[2]),
+			strings.ToLower(cmd.Args[0]) == "accept-verification")
+	case "share-session-now", "share-with-room":
+		cmdCryptoShareSessionNow(cmd, mach)
+	case "rotate-device":
+		cmdCryptoRotateDevice(cmd, mach, hasFlag(cmd.Args[1:], "--confirm"), hasFlag(cmd.Args[1:], "--logout-old"))
+	case "benchmark":
+		count := defaultBenchmarkEvents
+		if len(cmd.Args) > 1 {
+			var err error
+			count, err = strconv.Atoi(cmd.Args[1])
+			if err != nil || count < 1 || count > maxBenchmarkEvents {
+				cmd.Reply("Event count must be a number between 1 and %d", maxBenchmarkEvents)
+				return
+			}
+		}
+		cmdCryptoBenchmark(cmd, mach, count)
+	case "unverified-rooms":
+		cmdCryptoUnverifiedRooms(cmd, mach, hasFlag(cmd.Args[1:], "--refresh"))
+	case "cache":
+		if len(cmd.Args) < 2 {
+			cmd.Reply("Usage: /%s cache <status|clear>", cmd.OrigCommand)
+			return
+		}
+		switch strings.ToLower(cmd.Args[1]) {
+		case "status":
+			cmdCryptoCacheStatus(cmd, mach)
+		case "clear":
+			cmdCryptoCacheClear(cmd, mach)
+		default:
+			cmd.Reply("Usage: /%s cache <status|clear>", cmd.OrigCommand)
+		}
+	default:
+		cmd.Reply(cryptoHelp, cmd.OrigCommand)
+	}
+}
+
+// cmdCryptoShareSessionNow shares a new outbound group session in the current room. mautrix can't add devices to an
+// outbound session that has already been shared, so the old session is dropped and a new one is shared with everyone.
+func cmdCryptoShareSessionNow(cmd *Command, mach *crypto.OlmMachine) {
+	room := cmd.Room.MxRoom()
+	if !room.Encrypted {
+		cmd.Reply("This room is not encrypted")
+		return
+	}
+	members := room.GetMemberList()
+	var eligible, withheld int
+	for _, userID := range members {
+		devices, err := mach.CryptoStore.GetDevices(userID)
+		if err != nil {
+			cmd.Reply("Failed to get devices of %s: %v", userID, err)
+			return
+		}
+		for _, device := range devices {
+			if userID == mach.Client.UserID && device.DeviceID == mach.Client.DeviceID {
+				continue
+			} else if device.Trust == crypto.TrustStateBlacklisted || (!mach.AllowUnverifiedDevices && !mach.IsDeviceTrusted(device)) {
+				withheld++
+			} else {
+				eligible++
+			}
+		}
+	}
+	err := mach.CryptoStore.RemoveOutboundGroupSession(room.ID)
+	if err != nil {
+		cmd.Reply("Failed to remove old outbound group session: %v", err)
+		return
+	}
+	err = mach.ShareGroupSession(room.ID, members)
+	if err != nil {
+		cmd.Reply("Failed to share group session: %v", err)
+		return
+	}
+	session, err := mach.CryptoStore.GetOutboundGroupSession(room.ID)
+	if err != nil || session == nil {
+		cmd.Reply("Shared a new group session with %d devices of %d users (withheld from %d devices by policy)",
+			eligible, len(members), withheld)
+	} else {
+		cmd.Reply("Shared group session %s with %d devices of %d users (withheld from %d devices by policy)",
+			session.ID(), eligible, len(members), withheld)
+	}
+}
+
+// deviceResyncBatchSize is the maximum number of users whose keys are queried in a single request.
+const deviceResyncBatchSize = 50
+
+func getEncryptedRoomMembers(cache *rooms.RoomCache) []id.UserID {
+	userIDs := make(map[id.UserID]struct{})
+	// Unloading is disabled for the same reason as in RoomCache.FindSharedRooms
+	cache.DisableUnloading()
+	cache.Lock()
+	for _, room := range cache.Map {
+		if !room.Encrypted || room.HasLeft {
+			continue
+		}
+		for userID, member := range room.GetMembers() {
+			if member.Membership == event.MembershipJoin || member.Membership == event.MembershipInvite {
+				userIDs[userID] = struct{}{}
+			}
+		}
+	}
+	cache.Unlock()
+	cache.EnableUnloading()
+	list := make([]id.UserID, 0, len(userIDs))
+	for userID := range userIDs {
+		list = append(list, userID)
+	}
+	return list
+}
+
+func describeCachedCrossSigningKeys(keys *crypto.CrossSigningKeysCache) string {
+	var cached []string
+	if keys.MasterKey != nil {
+		cached = append(cached, "master")
+	}
+	if keys.SelfSigningKey != nil {
+		cached = append(cached, "self-signing")
+	}
+	if keys.UserSigningKey != nil {
+		cached = append(cached, "user-signing")
+	}
+	return strings.Join(cached, ", ")
+}
+
+// cmdCryptoCacheStatus shows which secrets are held in memory. SSSS keys are never cached: they're derived from the
+// passphrase or recovery key for each command and dropped afterwards.
+func cmdCryptoCacheStatus(cmd *Command, mach *crypto.OlmMachine) {
+	crossSigning := "not cached"
+	if mach.CrossSigningKeys != nil {
+		crossSigning = fmt.Sprintf("cached (%s)", describeCachedCrossSigningKeys(mach.CrossSigningKeys))
+	}
+	cmd.Reply("Secrets in memory:\nCross-signing private keys: %s\n"+
+		"SSSS keys: never cached, the passphrase or recovery key is asked for every command", crossSigning)
+}
+
+func cmdCryptoCacheClear(cmd *Command, mach *crypto.OlmMachine) {
+	if mach.CrossSigningKeys == nil {
+		cmd.Reply("No secrets are cached in memory")
+		return
+	}
+	cleared := describeCachedCrossSigningKeys(mach.CrossSigningKeys)
+	mach.CrossSigningKeys = nil
+	cmd.Reply("Cleared cached cross-signing private keys (%s). Use `/cross-signing fetch` to unlock them again.", cleared)
+}
+
+type unverifiedRoom struct {
+	id           id.RoomID
+	name         string
+	members      []id.UserID
+	unverified   int
+	unknownUsers int
+}
+
+func getEncryptedRooms(cache *rooms.RoomCache) []*unverifiedRoom {
+	var encryptedRooms []*unverifiedRoom
+	// Unloading is disabled for the same reason as in RoomCache.FindSharedRooms
+	cache.DisableUnloading()
+	cache.Lock()
+	for _, room := range cache.Map {
+		if !room.Encrypted || room.HasLeft {
+			continue
+		}
+		info := &unverifiedRoom{id: room.ID, name: room.GetTitle()}
+		for userID, member := range room.GetMembers() {
+			if member.Membership == event.MembershipJoin || member.Membership == event.MembershipInvite {
+				info.members = append(info.members, userID)
+			}
+		}
+		encryptedRooms = append(encryptedRooms, info)
+	}
+	cache.Unlock()
+	cache.EnableUnloading()
+	return encryptedRooms
+}
+
+// cmdCryptoUnverifiedRooms lists the encrypted rooms that contain devices which aren't trusted. Members whose device
+// list isn't known at all are counted separately, as their devices can't be checked.
+func cmdCryptoUnverifiedRooms(cmd *Command, mach *crypto.OlmMachine, refresh bool) {
+	if refresh {
+		cmdCryptoResyncDevices(cmd, mach)
+	}
+	encryptedRooms := getEncryptedRooms(cmd.Config.Rooms)
+	unverifiedByUser := make(map[id.UserID]int)
+	var results []*unverifiedRoom
+	for _, room := range encryptedRooms {
+		for _, userID := range room.members {
+			unverified, ok := unverifiedByUser[userID]
+			if !ok {
+				devices, err := mach.CryptoStore.GetDevices(userID)
+				if err != nil {
+					cmd.Reply("Failed to get devices of %s: %v", userID, err)
+					return
+				} else if len(devices) == 0 {
+					unverified = -1
+				}
+				for _, device := range devices {
+					if device.Trust != crypto.TrustStateBlacklisted && !mach.IsDeviceTrusted(device) {
+						unverified++
+					}
+				}
+				unverifiedByUser[userID] = unverified
+			}
+			if unverified < 0 {
+				room.unknownUsers++
+			} else {
+				room.unverified += unverified
+			}
+		}
+		if room.unverified > 0 || room.unknownUsers > 0 {
+			results = append(results, room)
+		}
+	}
+	if len(results) == 0 {
+		cmd.Reply("All devices in your %d encrypted rooms are verified", len(encryptedRooms))
+		return
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].unverified != results[j].unverified {
+			return results[i].unverified > results[j].unverified
+		}
+		return results[i].unknownUsers > results[j].unknownUsers
+	})
+	var buf strings.Builder
+	_, _ = fmt.Fprintf(&buf, "%d of %d encrypted rooms contain unverified devices:\n", len(results), len(encryptedRooms))
+	for _, room := range results {
+		_, _ = fmt.Fprintf(&buf, "%d unverified devices", room.unverified)
+		if room.unknownUsers > 0 {
+			_, _ = fmt.Fprintf(&buf, " (+%d users with unknown devices)", room.unknownUsers)
+		}
+		_, _ = fmt.Fprintf(&buf, " - %s (%s)\n", room.name, room.id)
+	}
+	resp := buf.String()
+	cmd.Reply("%s", resp[:len(resp)-1])
+}
+
+func deviceListChanged(before, after map[id.DeviceID]*crypto.DeviceIdentity) bool {
+	if len(before) != len(after) {
+		return true
+	}
+	for deviceID, device := range after {
+		prev, ok := before[deviceID]
+		if !ok || prev.SigningKey != device.SigningKey || prev.IdentityKey != device.IdentityKey {
+			return true
+		}
+	}
+	return false
+}
+
+func cmdCryptoResyncDevices(cmd *Command, mach *crypto.OlmMachine) {
+	users := mach.CryptoStore.FilterTrackedUsers(getEncryptedRoomMembers(cmd.Config.Rooms))
+	if len(users) == 0 {
+		cmd.Reply("No tracked users found")
+		return
+	}
+
+	batches := (len(users) + deviceResyncBatchSize - 1) / deviceResyncBatchSize
+	progress := cmd.MainView.OpenSyncingModal()
+	progress.SetSteps(batches)
+	changed := 0
+	for start := 0; start < len(users); start += deviceResyncBatchSize {
+		end := start + deviceResyncBatchSize
+		if end > len(users) {
+			end = len(users)
+		}
+		batch := users[start:end]
+		progress.SetMessage(fmt.Sprintf("Resyncing devices (%d/%d users)", end, len(users)))
+		cmd.UI.Render()
+
+		before := make(map[id.UserID]map[id.DeviceID]*crypto.DeviceIdentity, len(batch))
+		for _, userID := range batch {
+			before[userID], _ = mach.CryptoStore.GetDevices(userID)
+		}
+		mach.HandleDeviceLists(&mautrix.DeviceLists{Changed: batch}, "")
+		for _, userID := range batch {
+			after, err := mach.CryptoStore.GetDevices(userID)
+			if err == nil && deviceListChanged(before[userID], after) {
+				changed++
+			}
+		}
+		progress.Step()
+	}
+	progress.Close()
+	cmd.Reply("Resynced device lists of %d users, %d of them had changes", len(users), changed)
+}
+
+const keyBackupHelp = `Usage: /%s <subcommand> [...]
+
+Subcommands:
+* sessions [--room <room ID>]
+    List the sessions in the server-side key backup without importing
+    anything, and compare them against the local store.`
+
+func cmdKeyBackup(cmd *Command) {
+	if len(cmd.Args) == 0 {
+		cmd.Reply(keyBackupHelp, cmd.OrigCommand)
+		return
+	}
+
+	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
+
+	switch strings.ToLower(cmd.Args[0]) {
+	case "sessions":
+		var roomID id.RoomID
+		if len(cmd.Args) > 2 && strings.ToLower(cmd.Args[1]) == "--room" {
+			roomID = id.RoomID(cmd.Args[2])
+		} else if len(cmd.Args) > 1 {
+			cmd.Reply("Usage: /%s sessions [--room <room ID>]", cmd.OrigCommand)
+			return
+		}
+		cmdKeyBackupSessions(cmd, mach, roomID)
+	default:
+		cmd.Reply(keyBackupHelp, cmd.OrigCommand)
+	}
+}
+
+type keyBackupVersion struct {
+	Algorithm string          `json:"algorithm"`
+	AuthData  json.RawMessage `json:"auth_data"`
+	Count     int             `json:"count"`
+	ETag      string          `json:"etag"`
+	Version   string          `json:"version"`
+}
+
+type keyBackupSession struct {
+	FirstMessageIndex int             `json:"first_message_index"`
+	ForwardedCount    int             `json:"forwarded_count"`
+	IsVerified        bool            `json:"is_verified"`
+	SessionData       json.RawMessage `json:"session_data"`
+}
+
+type keyBackupRoom struct {
+	Sessions map[id.SessionID]keyBackupSession `json:"sessions"`
+}
+
+func getKeyBackupVersion(client *mautrix.Client) (*keyBackupVersion, error) {
+	var resp keyBackupVersion
+	_, err := client.MakeRequest("GET", client.BuildClientURL("v3", "room_keys", "version"), nil, &resp)
+	return &resp, err
+}
+
+// getKeyBackupRooms fetches the encrypted sessions in the given backup version,
+// either for a single room or for all rooms if roomID is empty.
+func getKeyBackupRooms(client *mautrix.Client, version string, roomID id.RoomID) (map[id.RoomID]keyBackupRoom, error) {
+	query := map[string]string{"version": version}
+	if len(roomID) > 0 {
+		var resp keyBackupRoom
+		url := client.BuildURLWithQuery(mautrix.ClientURLPath{"v3", "room_keys", "keys", roomID}, query)
+		_, err := client.MakeRequest("GET", url, nil, &resp)
+		if err != nil {
+			return nil, err
+		}
+		return map[id.RoomID]keyBackupRoom{roomID: resp}, nil
+	}
+	var resp struct {
+		Rooms map[id.RoomID]keyBackupRoom `json:"rooms"`
+	}
+	url := client.BuildURLWithQuery(mautrix.ClientURLPath{"v3", "room_keys", "keys"}, query)
+	_, err := client.MakeRequest("GET", url, nil, &resp)
+	return resp.Rooms, err
+}
+
+func cmdKeyBackupSessions(cmd *Command, mach *crypto.OlmMachine, roomID id.RoomID) {
+	client := cmd.Matrix.Client()
+	version, err := getKeyBackupVersion(client)
+	if errors.Is(err, mautrix.MNotFound) {
+		cmd.Reply("No key backup found on the server")
+		return
+	} else if err != nil {
+		cmd.Reply("Failed to get key backup version: %v", err)
+		return
+	}
+	backupRooms, err := getKeyBackupRooms(client, version.Version, roomID)
+	if err != nil {
+		cmd.Reply("Failed to get sessions in key backup: %v", err)
+		return
+	}
+
+	var localSessions []*crypto.InboundGroupSession
+	if len(roomID) > 0 {
+		localSessions, err = mach.CryptoStore.GetGroupSessionsForRoom(roomID)
+	} else {
+		localSessions, err = mach.CryptoStore.GetAllGroupSessions()
+	}
+	if err != nil {
+		cmd.Reply("Failed to get local sessions: %v", err)
+		return
+	}
+	local := make(map[id.SessionID]struct{}, len(localSessions))
+	for _, session := range localSessions {
+		local[session.ID()] = struct{}{}
+	}
+
+	roomIDs := make([]id.RoomID, 0, len(backupRooms))
+	for backupRoomID := range backupRooms {
+		roomIDs = append(roomIDs, backupRoomID)
+	}
+	sort.Slice(roomIDs, func(i, j int) bool {
+		return roomIDs[i] < roomIDs[j]
+	})
+
+	var buf strings.Builder
+	total, missing := 0, 0
+	inBackup := make(map[id.SessionID]struct{})
+	for _, backupRoomID := range roomIDs {
+		sessions := backupRooms[backupRoomID].Sessions
+		roomMissing := 0
+		for sessionID := range sessions {
+			inBackup[sessionID] = struct{}{}
+			if _, ok := local[sessionID]; !ok {
+				roomMissing++
+			}
+			if len(roomID) > 0 {
+				marker := ""
+				if _, ok := local[sessionID]; !ok {
+					marker = " (missing locally)"
+				}
+				_, _ = fmt.Fprintf(&buf, "%s%s\n", sessionID, marker)
+			}
+		}
+		if len(roomID) == 0 {
+			_, _ = fmt.Fprintf(&buf, "%s: %d sessions, %d missing locally\n", backupRoomID, len(sessions), roomMissing)
+		}
+		total += len(sessions)
+		missing += roomMissing
+	}
+	notBackedUp := 0
+	for sessionID := range local {
+		if _, ok := inBackup[sessionID]; !ok {
+			notBackedUp++
+		}
+	}
+	_, _ = fmt.Fprintf(&buf, "Backup version %s (%s) has %d sessions in %d rooms. "+
+		"%d of them are missing locally and %d local sessions are not in the backup.",
+		version.Version, version.Algorithm, total, len(backupRooms), missing, notBackedUp)
+	cmd.Reply("%s", buf.String())
+}
+
+// accountDataMegolmBackupKey is the SSSS secret that contains the private key of the server-side key backup.
+var accountDataMegolmBackupKey = event.Type{Type: "m.megolm_backup.v1", Class: event.AccountDataEventType}
+
+// keyBackupSessionData is the decrypted session_data of a session in the key backup.
+type keyBackupSessionData struct {
+	Algorithm         id.Algorithm             `json:"algorithm"`
+	ForwardingChains  []string                 `json:"forwarding_curve25519_key_chain"`
+	SenderClaimedKeys crypto.SenderClaimedKeys `json:"sender_claimed_keys"`
+	SenderKey         id.SenderKey             `json:"sender_key"`
+	SessionKey        string                   `json:"session_key"`
+}
+
+func decryptKeyBackupSession(privateKey []byte, session keyBackupSession) (*keyBackupSessionData, error) {
+	var encrypted keybackup.SessionData
+	err := json.Unmarshal(session.SessionData, &encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse session data: %w", err)
+	}
+	decrypted, err := keybackup.Decrypt(privateKey, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	var data keyBackupSessionData
+	err = json.Unmarshal(decrypted, &data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse decrypted session: %w", err)
+	}
+	return &data, nil
+}
+
+// getKeyBackupPrivateKey fetches the private key of the given key backup version from SSSS and checks that it
+// matches the public key of the backup.
+func getKeyBackupPrivateKey(cmd *Command, mach *crypto.OlmMachine, version *keyBackupVersion, useRecoveryKey bool) []byte {
+	if version.Algorithm != keybackup.Algorithm {
+		cmd.Reply("Unsupported key backup algorithm %s", version.Algorithm)
+		return nil
+	}
+	var authData keybackup.AuthData
+	err := json.Unmarshal(version.AuthData, &authData)
+	if err != nil {
+		cmd.Reply("Failed to parse key backup auth data: %v", err)
+		return nil
+	}
+	key := getSSSS(cmd, mach, useRecoveryKey)
+	if key == nil {
+		return nil
+	}
+	privateKey, err := mach.SSSS.GetDecryptedAccountData(accountDataMegolmBackupKey, key)
+	if errors.Is(err, mautrix.MNotFound) {
+		cmd.Reply("The key backup decryption key is not stored in SSSS")
+		return nil
+	} else if err != nil {
+		cmd.Reply("Failed to get key backup decryption key from SSSS: %v", err)
+		return nil
+	}
+	publicKey, err := keybackup.PublicKey(privateKey)
+	if err != nil {
+		cmd.Reply("Invalid key backup decryption key in SSSS: %v", err)
+		return nil
+	} else if publicKey != strings.TrimRight(authData.PublicKey, "=") {
+		cmd.Reply("The key backup decryption key in SSSS is not for backup version %s", version.Version)
+		return nil
+	}
+	return privateKey
+}
+
+// cmdImportBackup downloads the server-side key backup and imports the sessions in it. Sessions that can't be
+// decrypted or imported are counted and skipped, the rest of the backup is still imported.
+func cmdImportBackup(cmd *Command) {
+	var roomID id.RoomID
+	for i, arg := range cmd.Args {
+		if strings.ToLower(arg) == "--room" && i+1 < len(cmd.Args) {
+			roomID = id.RoomID(cmd.Args[i+1])
+		}
+	}
+	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
+	client := cmd.Matrix.Client()
+	version, err := getKeyBackupVersion(client)
+	if errors.Is(err, mautrix.MNotFound) {
+		cmd.Reply("No key backup found on the server")
+		return
+	} else if err != nil {
+		cmd.Reply("Failed to get key backup version: %v", err)
+		return
+	}
+	privateKey := getKeyBackupPrivateKey(cmd, mach, version, hasFlag(cmd.Args, "--recovery-key"))
+	if privateKey == nil {
+		return
+	}
+	backupRooms, err := getKeyBackupRooms(client, version.Version, roomID)
+	if err != nil {
+		cmd.Reply("Failed to get sessions in key backup: %v", err)
+		return
+	}
+
+	progress := cmd.MainView.OpenSyncingModal()
+	progress.SetSteps(len(backupRooms))
+	var total, added, improved, skipped, conflicting, failed, undecryptable int
+	for backupRoomID, room := range backupRooms {
+		progress.SetMessage(fmt.Sprintf("Importing sessions from key backup (%d imported)", added+improved))
+		cmd.UI.Render()
+		for sessionID, session := range room.Sessions {
+			total++
+			data, err := decryptKeyBackupSession(privateKey, session)
+			if err != nil {
+				debug.Printf("Failed to decrypt Megolm session %s/%s from key backup: %v", backupRoomID, sessionID, err)
+				undecryptable++
+				continue
+			}
+			result, err := mergeExportedSession(mach, crypto.ExportedSession{
+				Algorithm:         data.Algorithm,
+				ForwardingChains:  data.ForwardingChains,
+				RoomID:            backupRoomID,
+				SenderKey:         data.SenderKey,
+				SenderClaimedKeys: data.SenderClaimedKeys,
+				SessionID:         sessionID,
+				SessionKey:        data.SessionKey,
+			})
+			switch {
+			case err != nil:
+				debug.Printf("Failed to import Megolm session %s/%s from key backup: %v", backupRoomID, sessionID, err)
+				failed++
+			case result == sessionMergeAdded:
+				added++
+			case result == sessionMergeImproved:
+				improved++
+			case result == sessionMergeConflict:
+				conflicting++
+			default:
+				skipped++
+			}
+		}
+		progress.Step()
+	}
+	progress.Close()
+	cmd.Reply("Imported %d of %d sessions from key backup version %s:\n"+
+		"    %d new, %d replaced with an earlier starting index\n"+
+		"    %d skipped as the local copy is already as good or better\n"+
+		"    %d conflicting with a local session with the same ID\n"+
+		"    %d could not be decrypted, %d invalid",
+		added+improved, total, version.Version, added, improved, skipped, conflicting, undecryptable, failed)
+	if added+improved > 0 {
+		cmd.Matrix.RetryDecryption()
+	}
+}
+
+const rotateDeviceWarning = `Warning: rotating device keys creates a completely new device.
+* Other users will see a new, unverified device and have to verify it again.
+* Cross-signing keys are not transferred, use /cross-signing fetch afterwards.
+* Only the Megolm sessions in the local store are carried over.
+Run /%s rotate-device --confirm [--logout-old] to continue.`
+
+func cmdCryptoRotateDevice(cmd *Command, mach *crypto.OlmMachine, confirm, logoutOld bool) {
+	if !confirm {
+		cmd.Reply(rotateDeviceWarning, cmd.OrigCommand)
+		return
+	}
+	if _, ok := mach.CryptoStore.(*crypto.SQLCryptoStore); !ok {
+		cmd.Reply("Rotating device keys is not supported with the legacy crypto store")
+		return
+	}
+
+	sessions, err := mach.CryptoStore.GetAllGroupSessions()
+	if err != nil {
+		cmd.Reply("Failed to get sessions to export: %v", err)
+		return
+	}
+	passphraseBytes := make([]byte, 32)
+	_, err = cryptorand.Read(passphraseBytes)
+	if err != nil {
+		cmd.Reply("Failed to generate export passphrase: %v", err)
+		return
+	}
+	passphrase := base64.RawStdEncoding.EncodeToString(passphraseBytes)
+	export, err := crypto.ExportKeys(passphrase, sessions)
+	if err != nil {
+		cmd.Reply("Failed to export sessions: %v", err)
+		return
+	}
+	cmd.Reply("Step 1/4: exported %d sessions", len(sessions))
+
+	password, ok := cmd.MainView.AskPassword("Account password", "", "correct horse battery staple", false)
+	if !ok {
+		cmd.Reply("Password entry cancelled, device was not rotated")
+		return
+	}
+	oldDeviceID, err := cmd.Matrix.RotateDevice(password)
+	if err != nil {
+		cmd.Reply("Failed to log in as a new device: %v", err)
+		return
+	}
+	client := cmd.Matrix.Client()
+	// The old machine was dropped along with its cached keys and hooks, everything below must use the new one
+	mach = cmd.Matrix.Crypto().(*crypto.OlmMachine)
+	cmd.MainView.setupVerificationInbox()
+	cmd.Reply("Step 2/4: logged in as new device %s with fingerprint %s", client.DeviceID, mach.Fingerprint())
+
+	imported, total, err := mach.ImportKeys(passphrase, export)
+	if err != nil {
+		cmd.Reply("Failed to import sessions into the new device: %v", err)
+	} else {
+		cmd.Reply("Step 3/4: imported %d/%d sessions", imported, total)
+		cmd.Matrix.RetryDecryption()
+	}
+
+	if !logoutOld {
+		cmd.Reply("Step 4/4: skipped, old device %s is still logged in", oldDeviceID)
+		return
+	}
+	err = client.DeleteDevice(oldDeviceID, &mautrix.ReqDeleteDevice{
+		Auth: &mautrix.ReqUIAuthLogin{
+			BaseAuthData: mautrix.BaseAuthData{Type: mautrix.AuthTypePassword},
+			User:         client.UserID.String(),
+			Password:     password,
+		},
+	})
+	if err != nil {
+		cmd.Reply("Failed to log out old device %s: %v", oldDeviceID, err)
+	} else {
+		cmd.Reply("Step 4/4: logged out old device %s", oldDeviceID)
+	}
+}
+
+func formatKeyRequestDeviceTrust(mach *crypto.OlmMachine, userID id.UserID, deviceID id.DeviceID) string {
+	device, err := mach.CryptoStore.GetDevice(userID, deviceID)
+	if err != nil || device == nil {
+		return "unknown device"
+	} else if device.Trust == crypto.TrustStateUnset && mach.IsDeviceTrusted(device) {
+		return "verified (transitive)"
+	}
+	return device.Trust.String()
+}
+
+func cmdKeyRequests(cmd *Command) {
+	if len(cmd.Args) > 0 {
+		if strings.ToLower(cmd.Args[0]) != "fulfill" || len(cmd.Args) < 2 {
+			cmd.Reply("Usage: /key-requests [fulfill <number>]")
+			return
+		}
+		requestID, err := strconv.Atoi(strings.TrimPrefix(cmd.Args[1], "#"))
+		if err != nil {
+			cmd.Reply("Invalid key request number %q", cmd.Args[1])
+			return
+		}
+		err = cmd.Matrix.FulfillKeyRequest(requestID)
+		if err != nil {
+			cmd.Reply("Failed to fulfill key request: %v", err)
+		} else {
+			cmd.Reply("Forwarded the requested session for key request #%d", requestID)
+		}
+		return
+	}
+
+	requests := cmd.Matrix.KeyRequests()
+	if len(requests) == 0 {
+		cmd.Reply("No key requests received since gomuks was started")
+		return
+	}
+	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
+	var buf strings.Builder
+	_, _ = fmt.Fprintf(&buf, "%d recent key requests:\n", len(requests))
+	for _, req := range requests {
+		status := string(req.Status)
+		if len(req.Reason) > 0 {
+			status = fmt.Sprintf("%s (%s)", status, req.Reason)
+		}
+		_, _ = fmt.Fprintf(&buf, "#%d %s %s (%s), received %s ago\n    Session %s in %s - %s\n",
+			req.ID, req.UserID, req.DeviceID, formatKeyRequestDeviceTrust(mach, req.UserID, req.DeviceID),
+			time.Since(req.Received).Truncate(time.Second), req.SessionID, req.RoomID, status)
+	}
+	_, _ = fmt.Fprintf(&buf, "Verify the device, then use /key-requests fulfill <number> to answer pending requests")
+	cmd.Reply("%s", buf.String())
+}
+
+type undecryptableSession struct {
+	id        id.SessionID
+	senderKey id.SenderKey
+	sender    id.UserID
+	count     int
+	earliest  time.Time
+}
+
+// cmdUndecryptable counts the messages in the loaded timeline of the current room that couldn't be decrypted and
+// groups them by Megolm session, so it's easier to see which keys are worth requesting.
+func cmdUndecryptable(cmd *Command) {
+	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
+	roomID := cmd.Room.Room.ID
+	undecryptable := cmd.Room.content.getUndecryptableMessages()
+	if len(undecryptable) == 0 {
+		cmd.Reply("All loaded messages in this room were decrypted")
+		return
+	}
+	sessions := make(map[id.SessionID]*undecryptableSession)
+	for _, msg := range undecryptable {
+		content := msg.Event.Content.Parsed.(*muksevt.BadEncryptedContent).Original
+		session, ok := sessions[content.SessionID]
+		if !ok {
+			session = &undecryptableSession{
+				id:        content.SessionID,
+				senderKey: content.SenderKey,
+				sender:    msg.SenderID,
+				earliest:  msg.Timestamp,
+			}
+			sessions[content.SessionID] = session
+		} else if msg.Timestamp.Before(session.earliest) {
+			session.earliest = msg.Timestamp
+		}
+		session.count++
+	}
+	sorted := make([]*undecryptableSession, 0, len(sessions))
+	for _, session := range sessions {
+		sorted = append(sorted, session)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].earliest.Before(sorted[j].earliest)
+	})
+
+	var buf strings.Builder
+	missing := 0
+	for _, session := range sorted {
+		status := "missing"
+		stored, err := mach.CryptoStore.GetGroupSession(roomID, session.senderKey, session.id)
+		if err != nil {
+			status = fmt.Sprintf("failed to check store: %v", err)
+		} else if stored != nil {
+			status = "key available, use /decrypt"
+		} else {
+			missing++
+		}
+		_, _ = fmt.Fprintf(&buf, "\n* %s from %s: %d messages, earliest %s (%s)", session.id, session.sender,
+			session.count, session.earliest.Format("2006-01-02 15:04:05"), status)
+	}
+	cmd.Reply("%d undecryptable messages in the loaded timeline from %d sessions, %d of which are missing:%s",
+		len(undecryptable), len(sessions), missing, buf.String())
+}
+
+// cmdKeyRequest requests the session of an undecryptable message. The message can be given as an event ID, or
+// selected in the room if there's no event ID.
+func cmdKeyRequest(cmd *Command) {
+	resend := hasFlag(cmd.Args, "--resend")
+	var eventID string
+	for _, arg := range cmd.Args {
+		if !strings.HasPrefix(arg, "--") {
+			eventID = arg
+			break
+		}
+	}
+	if len(eventID) == 0 {
+		if resend {
+			cmd.Room.StartSelecting(SelectKeyRequest, "--resend")
+		} else {
+			cmd.Room.StartSelecting(SelectKeyRequest, "")
+		}
+		return
+	} else if eventID[0] != '$' {
+		cmd.Reply("Usage: /keyrequest [event ID] [--resend]")
+		return
+	}
+	cmd.Room.RequestSession(id.EventID(eventID), resend)
+}
+
+// cmdDecrypt retries decrypting an undecryptable message, given as an event ID or selected in the room.
+func cmdDecrypt(cmd *Command) {
+	if len(cmd.Args) == 0 {
+		cmd.Room.StartSelecting(SelectDecrypt, "")
+	} else if len(cmd.Args) == 1 && strings.HasPrefix(cmd.Args[0], "$") {
+		cmd.Room.Redecrypt(id.EventID(cmd.Args[0]))
+	} else {
+		cmd.Reply("Usage: /decrypt [event ID]")
+	}
+}
+
+func cmdCryptoPendingVerifications(cmd *Command) {
+	pending := verifications.List()
+	if len(pending) == 0 {
+		cmd.Reply("No pending verification requests")
+		return
+	}
+	var buf strings.Builder
+	_, _ = fmt.Fprintf(&buf, "%d pending verification requests:\n", len(pending))
+	for _, req := range pending {
+		_, _ = fmt.Fprintf(&buf, "%s %s (%s), received %s ago\n", req.Device.UserID, req.Device.DeviceID,
+			req.Device.Name, time.Since(req.Received).Truncate(time.Second))
+	}
+	_, _ = fmt.Fprintf(&buf, "Use /%s accept-verification or reject-verification to answer", cmd.OrigCommand)
+	cmd.Reply("%s", buf.String())
+}
+
+func cmdCryptoAnswerVerification(cmd *Command, mach *crypto.OlmMachine, userID id.UserID, deviceID id.DeviceID, accept bool) {
+	req := verifications.Pop(userID, deviceID)
+	if req == nil {
+		cmd.Reply("No pending verification request from %s/%s", userID, deviceID)
+		return
+	}
+	cmd.UI.Render()
+	if !accept {
+		err := mach.SendSASVerificationCancel(userID, deviceID, req.TransactionID, "Not accepted by user", event.VerificationCancelByUser)
+		if err != nil {
+			cmd.Reply("Failed to reject verification request: %v", err)
+		} else {
+			cmd.Reply("Rejected verification request from %s/%s", userID, deviceID)
+		}
+		return
+	}
+	modal := NewVerificationModal(cmd.MainView, req.Device, "", mach.DefaultSASTimeout)
+	modal.SetTransactionID(req.TransactionID)
+	cmd.MainView.ShowModal(modal)
+	verifications.Accept(userID, req.TransactionID, modal)
+	err := cmd.Matrix.ReplayVerificationRequest(userID, req.TransactionID)
+	// The machine asks the AcceptVerificationFrom hook synchronously, so if the transaction is still marked as
+	// accepted, the machine cancelled the request before getting that far.
+	if verifications.popAccepted(userID, req.TransactionID) != nil {
+		cmd.MainView.HideModal()
+		if err == nil {
+			err = errors.New("the request was cancelled, see the debug log for details")
+		}
+		cmd.Reply("Failed to accept verification request: %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build cgo
+
+package ui
+
+import (
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/crypto/ssss"
+	"maunium.net/go/mautrix/event"
+)
+
+// cryptoSetupState describes which of the encryption setup steps have already been done.
+type cryptoSetupState struct {
+	ssssKeyID          string
+	crossSigning       bool
+	crossSigningInSSSS bool
+	selfSigned         bool
+}
+
+func getCryptoSetupState(mach *crypto.OlmMachine) (state cryptoSetupState) {
+	state.ssssKeyID, _ = mach.SSSS.GetDefaultKeyID()
+	keys := mach.GetOwnCrossSigningPublicKeys()
+	state.crossSigning = keys != nil
+	if len(state.ssssKeyID) > 0 && state.crossSigning {
+		var existing ssss.EncryptedAccountDataEventContent
+		err := mach.Client.GetAccountData(event.AccountDataCrossSigningMaster.Type, &existing)
+		if err == nil {
+			_, state.crossSigningInSSSS = existing.Encrypted[state.ssssKeyID]
+		}
+	}
+	if keys != nil && len(keys.SelfSigningKey) > 0 {
+		own := mach.OwnIdentity()
+		state.selfSigned, _ = mach.CryptoStore.IsKeySignedBy(own.UserID, own.SigningKey, own.UserID, keys.SelfSigningKey)
+	}
+	return
+}
+
+func formatSetupStep(done bool, description string) string {
+	if done {
+		return fmt.Sprintf("[done] %s", description)
+	}
+	return fmt.Sprintf("[todo] %s", description)
+}
+
+func (state cryptoSetupState) String() string {
+	return strings.Join([]string{
+		formatSetupStep(len(state.ssssKeyID) > 0, "1. Generate a default SSSS key"),
+		formatSetupStep(state.crossSigning, "2. Generate and publish cross-signing keys"),
+		formatSetupStep(state.crossSigningInSSSS, "3. Upload cross-signing keys to SSSS"),
+		formatSetupStep(state.selfSigned, "4. Sign this device with the self-signing key"),
+	}, "\n")
+}
+
+// confirmSetupStep asks the user whether to run a setup step. Declining stops the setup, as the later steps depend on
+// the earlier ones.
+func confirmSetupStep(cmd *Command, step int, description string) bool {
+	if !cmd.MainView.AskConfirmation("Encryption setup", fmt.Sprintf("Step %d/4: %s?", step, description), "Continue") {
+		cmd.Reply("Setup stopped before step %d. Run setup again to continue from there.", step)
+		return false
+	}
+	cmd.Reply("Step %d/4: %s", step, description)
+	return true
+}
+
+const cryptoSetupIntro = `Encryption setup for %s (%s):
+
+%s
+
+Steps that are already done will be skipped, and you'll be asked to confirm
+each remaining step before it's run. You'll be asked for a new SSSS
+passphrase and your account password as needed. Store the recovery key
+that is shown after generating the SSSS key somewhere safe.
+
+Server-side key backups can't be created by gomuks, so they're not part of
+the setup. Use another client to create one if you need it.
+
+Run /%s setup --confirm to start.`
+
+// cmdCryptoSetup walks through the first-time encryption setup by running the SSSS and cross-signing
+// commands in order. Without --confirm, it only shows which steps are still needed.
+func cmdCryptoSetup(cmd *Command, mach *crypto.OlmMachine, confirm bool) {
+	state := getCryptoSetupState(mach)
+	if !confirm {
+		cmd.Reply(cryptoSetupIntro, mach.Client.UserID, mach.Client.DeviceID, state, cmd.OrigCommand)
+		return
+	}
+
+	var key *ssss.Key
+	if len(state.ssssKeyID) == 0 {
+		if !confirmSetupStep(cmd, 1, "generate a default SSSS key") {
+			return
+		}
+		key = cmdS4Generate(cmd, mach, "", true)
+		if key == nil {
+			cmd.Reply("Setup aborted at step 1")
+			return
+		}
+		state.ssssKeyID = key.ID
+	}
+
+	if !state.crossSigning {
+		if !confirmSetupStep(cmd, 2, "generate and publish cross-signing keys") {
+			return
+		}
+		if !cmdCrossSigningGenerate(cmd, cmd.Matrix, mach, mach.Client, false) {
+			cmd.Reply("Setup aborted at step 2")
+			return
+		}
+		state.crossSigning = true
+	}
+
+	if !state.crossSigningInSSSS {
+		if mach.CrossSigningKeys == nil {
+			cmd.Reply("Cross-signing private keys aren't cached on this device. " +
+				"Fetch or regenerate them with /cross-signing, then run setup again")
+			return
+		} else if !confirmSetupStep(cmd, 3, "upload cross-signing keys to SSSS") {
+			return
+		} else if key == nil {
+			key = getSSSS(cmd, mach, false)
+			if key == nil {
+				cmd.Reply("Setup aborted at step 3")
+				return
+			}
+		}
+		err := mach.UploadCrossSigningKeysToSSSS(key, mach.CrossSigningKeys)
+		if err != nil {
+			cmd.Reply("Failed to upload keys to SSSS: %v", err)
+			return
+		}
+		state.crossSigningInSSSS = true
+	}
+
+	if !state.selfSigned {
+		if mach.CrossSigningKeys == nil {
+			cmd.Reply("Cross-signing private keys aren't cached, can't sign this device")
+			return
+		} else if !confirmSetupStep(cmd, 4, "sign this device with the self-signing key") {
+			return
+		}
+		err := mach.SignOwnDevice(mach.OwnIdentity())
+		if err != nil {
+			cmd.Reply("Failed to self-sign: %v", err)
+			return
+		}
+		state.selfSigned = true
+	}
+
+	cmd.Reply("Encryption setup finished:\n%s", state)
+}
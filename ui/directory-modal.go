@@ -0,0 +1,243 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.mau.fi/mauview"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/config"
+	"maunium.net/go/gomuks/debug"
+	ifc "maunium.net/go/gomuks/interface"
+)
+
+// directoryPageSize is the number of rooms requested from the room directory at once.
+const directoryPageSize = 30
+
+// RoomDirectoryModal is a list of rooms in a public room directory. More rooms are loaded when moving past the last
+// one, and confirming a room joins it.
+type RoomDirectoryModal struct {
+	mauview.Component
+
+	container *mauview.Box
+
+	list   *mauview.TextView
+	status *mauview.TextField
+
+	server     string
+	searchTerm string
+	total      int
+	rooms      []*ifc.PublicRoom
+	nextBatch  string
+	selected   int
+	loading    bool
+
+	parent *MainView
+}
+
+// NewRoomDirectoryModal creates a modal for browsing the directory of the given server, or the user's own homeserver
+// if the server is empty.
+func NewRoomDirectoryModal(parent *MainView, server, searchTerm string, width, height int) *RoomDirectoryModal {
+	rdm := &RoomDirectoryModal{
+		parent:     parent,
+		server:     server,
+		searchTerm: searchTerm,
+	}
+
+	rdm.list = mauview.NewTextView().SetRegions(true)
+	rdm.status = mauview.NewTextField()
+
+	flex := mauview.NewFlex().
+		SetDirection(mauview.FlexRow).
+		AddProportionalComponent(rdm.list, 1).
+		AddFixedComponent(rdm.status, 1)
+
+	title := "Room directory"
+	if len(server) > 0 {
+		title += " of " + server
+	}
+	if len(searchTerm) > 0 {
+		title += fmt.Sprintf(" matching \"%s\"", searchTerm)
+	}
+	rdm.container = mauview.NewBox(flex).
+		SetBorder(true).
+		SetTitle(title).
+		SetBlurCaptureFunc(func() bool {
+			rdm.parent.HideModal()
+			return true
+		})
+
+	rdm.Component = mauview.Center(rdm.container, width, height).SetAlwaysFocusChild(true)
+
+	return rdm
+}
+
+func (rdm *RoomDirectoryModal) Focus() {
+	rdm.container.Focus()
+}
+
+func (rdm *RoomDirectoryModal) Blur() {
+	rdm.container.Blur()
+}
+
+func (rdm *RoomDirectoryModal) formatRoom(room *ifc.PublicRoom) string {
+	name := room.Name
+	if len(name) == 0 {
+		name = string(room.Alias)
+	}
+	if len(name) == 0 {
+		name = string(room.RoomID)
+	}
+	var buf strings.Builder
+	buf.WriteString(escapeTextViewTags(name))
+	if len(room.Alias) > 0 && string(room.Alias) != name {
+		_, _ = fmt.Fprintf(&buf, " (%s)", escapeTextViewTags(string(room.Alias)))
+	}
+	if room.Members == 1 {
+		buf.WriteString(" - 1 member")
+	} else {
+		_, _ = fmt.Fprintf(&buf, " - %d members", room.Members)
+	}
+	return buf.String()
+}
+
+// AddRooms appends a page of the directory to the list.
+func (rdm *RoomDirectoryModal) AddRooms(rooms *ifc.PublicRooms) {
+	if rooms.Total > 0 {
+		rdm.total = rooms.Total
+	}
+	rdm.nextBatch = rooms.NextBatch
+	for _, room := range rooms.Rooms {
+		fmt.Fprintf(rdm.list, `["%d"]%s[""]%s`, len(rdm.rooms), rdm.formatRoom(room), "\n")
+		if len(room.Topic) > 0 {
+			fmt.Fprintf(rdm.list, "    %s\n", escapeTextViewTags(strings.ReplaceAll(room.Topic, "\n", " ")))
+		}
+		fmt.Fprintln(rdm.list)
+		rdm.rooms = append(rdm.rooms, room)
+	}
+	if len(rdm.rooms) > 0 && len(rdm.list.GetHighlights()) == 0 {
+		rdm.list.Highlight(strconv.Itoa(rdm.selected))
+	}
+	rdm.updateStatus()
+}
+
+func (rdm *RoomDirectoryModal) updateStatus() {
+	total := rdm.total
+	if total < len(rdm.rooms) {
+		total = len(rdm.rooms)
+	}
+	if rdm.loading {
+		rdm.status.SetText(fmt.Sprintf("Showing %d of about %d rooms, loading more...", len(rdm.rooms), total))
+	} else if len(rdm.nextBatch) > 0 {
+		rdm.status.SetText(fmt.Sprintf("Showing %d of about %d rooms, move past the last one to load more", len(rdm.rooms), total))
+	} else {
+		rdm.status.SetText(fmt.Sprintf("Showing all %d rooms, press enter to join one", len(rdm.rooms)))
+	}
+}
+
+func (rdm *RoomDirectoryModal) loadMore() {
+	rdm.loading = true
+	rdm.updateStatus()
+	go func() {
+		defer debug.Recover()
+		rooms, err := rdm.parent.matrix.PublicRooms(rdm.server, rdm.searchTerm, rdm.nextBatch, directoryPageSize)
+		rdm.loading = false
+		if err != nil {
+			rdm.status.SetText(fmt.Sprintf("Failed to load more rooms: %v", err))
+		} else {
+			rdm.AddRooms(rooms)
+			rdm.selectRoom(rdm.selected + 1)
+		}
+		rdm.parent.parent.Render()
+	}()
+}
+
+func (rdm *RoomDirectoryModal) selectRoom(index int) {
+	if len(rdm.rooms) == 0 {
+		return
+	} else if index >= len(rdm.rooms) && len(rdm.nextBatch) > 0 {
+		if !rdm.loading {
+			rdm.loadMore()
+		}
+		return
+	}
+	rdm.selected = (index + len(rdm.rooms)) % len(rdm.rooms)
+	rdm.list.Highlight(strconv.Itoa(rdm.selected))
+	rdm.list.ScrollToHighlight()
+}
+
+// joinSelected joins the selected room, or just switches to it if it's already joined. Rooms are joined through
+// their alias when they have one, so that rooms on other servers can be joined without knowing which servers are in
+// them.
+func (rdm *RoomDirectoryModal) joinSelected() {
+	if len(rdm.rooms) == 0 {
+		return
+	}
+	publicRoom := rdm.rooms[rdm.selected]
+	go func() {
+		defer debug.Recover()
+		room := rdm.parent.matrix.GetRoom(publicRoom.RoomID)
+		if room == nil || room.HasLeft || room.SessionMember == nil || room.SessionMember.Membership != event.MembershipJoin {
+			identifier := publicRoom.RoomID
+			if len(publicRoom.Alias) > 0 {
+				identifier = id.RoomID(publicRoom.Alias)
+			}
+			var err error
+			room, err = rdm.parent.matrix.JoinRoom(identifier, rdm.server)
+			if err != nil {
+				if roomView := rdm.parent.currentRoom; roomView != nil {
+					roomView.AddServiceMessage(fmt.Sprintf("Failed to join %s: %v", identifier, err))
+				}
+				rdm.parent.parent.Render()
+				return
+			}
+		}
+		rdm.parent.AddRoom(room)
+		rdm.parent.SwitchRoom("", room)
+		rdm.parent.parent.Render()
+	}()
+}
+
+func (rdm *RoomDirectoryModal) OnKeyEvent(event mauview.KeyEvent) bool {
+	kb := config.Keybind{
+		Key: event.Key(),
+		Ch:  event.Rune(),
+		Mod: event.Modifiers(),
+	}
+	switch rdm.parent.config.Keybindings.Modal[kb] {
+	case "cancel":
+		rdm.parent.HideModal()
+		return true
+	case "select_next":
+		rdm.selectRoom(rdm.selected + 1)
+		return true
+	case "select_prev":
+		rdm.selectRoom(rdm.selected - 1)
+		return true
+	case "confirm":
+		rdm.parent.HideModal()
+		rdm.joinSelected()
+		return true
+	}
+	return rdm.list.OnKeyEvent(event)
+}
@@ -0,0 +1,214 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/kyokomi/emoji/v2"
+
+	"maunium.net/go/gomuks/lib/util"
+)
+
+// commonEmojis are the shortcodes of emojis that are suggested before other matches, in order, until the usage
+// counters say otherwise.
+var commonEmojis = []string{
+	":+1:", ":joy:", ":heart:", ":smile:", ":slightly_smiling_face:", ":tada:", ":pray:", ":sob:", ":thinking_face:",
+	":fire:", ":eyes:", ":sweat_smile:", ":heart_eyes:", ":grin:", ":wink:", ":cry:", ":ok_hand:", ":100:",
+	":white_check_mark:", ":rofl:", ":clap:", ":wave:", ":smiley:", ":laughing:", ":blush:", ":thumbsdown:",
+}
+
+var commonEmojiRanks map[string]int
+var commonEmojiRanksOnce sync.Once
+
+// commonEmojiRank returns the position of the given emoji in commonEmojis, or the length of the list if it's not there.
+func commonEmojiRank(value string) int {
+	commonEmojiRanksOnce.Do(func() {
+		commonEmojiRanks = make(map[string]int, len(commonEmojis))
+		codeMap := emoji.CodeMap()
+		for rank, name := range commonEmojis {
+			if value, ok := codeMap[name]; ok {
+				if _, exists := commonEmojiRanks[value]; !exists {
+					commonEmojiRanks[value] = rank
+				}
+			}
+		}
+	})
+	rank, ok := commonEmojiRanks[value]
+	if !ok {
+		return len(commonEmojis)
+	}
+	return rank
+}
+
+// maxEmojiSuggestions is the number of emoji completions that are shown in the status bar.
+const maxEmojiSuggestions = 10
+
+var emojiShortcodeRegex = regexp.MustCompile(`:[^\s:]+:`)
+
+type emojiCompletion struct {
+	name  string
+	value string
+	usage int
+	// custom is true for custom emoticons, which are inserted as the shortcode and replaced when sending.
+	custom bool
+}
+
+func (ec emojiCompletion) String() string {
+	if ec.custom {
+		return ec.name
+	}
+	return ec.value + " " + ec.name
+}
+
+// emojiQuery checks if the given word is an emoji shortcode being typed. The trigger must be at the start of the word
+// or after a character that isn't a letter or number, so that things like URLs and user IDs aren't completed. The
+// returned query is the shortcode with the trigger replaced by a colon, and offset is the byte index of the trigger
+// in the word.
+func (view *RoomView) emojiQuery(word string) (query string, offset int, ok bool) {
+	trigger := view.config.EmojiAutocompleteTrigger
+	if len(trigger) == 0 {
+		return
+	}
+	trimmed := strings.TrimSuffix(word, ":")
+	offset = strings.LastIndex(trimmed, trigger)
+	if offset < 0 || strings.Contains(trimmed[:offset], "://") {
+		return
+	} else if offset > 0 {
+		prev, _ := utf8.DecodeLastRuneInString(trimmed[:offset])
+		if unicode.IsLetter(prev) || unicode.IsDigit(prev) {
+			return
+		}
+	}
+	name := trimmed[offset+len(trigger):]
+	if len(name) == 0 || strings.ContainsAny(name, "/:") {
+		return
+	}
+	for _, char := range name {
+		if unicode.IsSpace(char) {
+			return
+		}
+	}
+	return ":" + name + word[len(trimmed):], offset, true
+}
+
+// AutocompleteEmoji finds the emojis whose shortcode starts with the given query, ranked by how often they've been
+// used. Emojis with multiple matching shortcodes are only included once. If the query is a complete shortcode, only
+// that emoji is returned.
+func (view *RoomView) AutocompleteEmoji(query string) []emojiCompletion {
+	var completions []emojiCompletion
+	byValue := make(map[string]int)
+	for name, value := range emoji.CodeMap() {
+		if name == query {
+			return []emojiCompletion{{name: name, value: value}}
+		} else if !strings.HasPrefix(name, query) {
+			continue
+		}
+		if index, exists := byValue[value]; exists {
+			existing := completions[index].name
+			if len(name) < len(existing) || (len(name) == len(existing) && name < existing) {
+				completions[index].name = name
+			}
+		} else {
+			byValue[value] = len(completions)
+			completions = append(completions, emojiCompletion{name: name, value: value})
+		}
+	}
+	for shortcode := range view.parent.matrix.CustomEmotes(view.Room.ID) {
+		name := ":" + shortcode + ":"
+		if name == query {
+			return []emojiCompletion{{name: name, value: name, custom: true}}
+		} else if strings.HasPrefix(name, query) {
+			completions = append(completions, emojiCompletion{name: name, value: name, custom: true})
+		}
+	}
+	for i := range completions {
+		completions[i].usage = view.config.GetEmojiUsage(completions[i].value)
+	}
+	sort.Slice(completions, func(i, j int) bool {
+		a, b := completions[i], completions[j]
+		if a.usage != b.usage {
+			return a.usage > b.usage
+		} else if rankA, rankB := commonEmojiRank(a.value), commonEmojiRank(b.value); rankA != rankB {
+			return rankA < rankB
+		}
+		return a.name < b.name
+	})
+	return completions
+}
+
+// tabCompleteEmoji completes the emoji shortcode that starts at the given byte index of the text before the cursor.
+// A single match is inserted directly. Otherwise the shortcode is extended as far as possible and the best matches
+// are shown in the status bar, and pressing tab again inserts the first one.
+func (view *RoomView) tabCompleteEmoji(text, beforeCursor string, start int, query string) {
+	completions := view.AutocompleteEmoji(query)
+	if len(completions) == 0 {
+		view.SetCompletions([]string{})
+		return
+	}
+
+	var insert string
+	var suggestions []string
+	alreadySuggested := len(view.completions.list) > 0 && view.completions.textCache == text &&
+		view.completions.time.Add(10*time.Second).After(time.Now())
+	if len(completions) == 1 || alreadySuggested {
+		insert = completions[0].value + " "
+		view.config.AddEmojiUsage(completions[0].value)
+	} else {
+		names := make([]string, len(completions))
+		for i, completion := range completions {
+			names[i] = completion.name
+		}
+		if prefix := util.LongestCommonPrefix(names); len(prefix) > len(query) {
+			insert = view.config.EmojiAutocompleteTrigger + prefix[1:]
+		}
+		for i, completion := range completions {
+			if i >= maxEmojiSuggestions {
+				suggestions = append(suggestions, "…")
+				break
+			}
+			suggestions = append(suggestions, completion.String())
+		}
+	}
+
+	newText := text
+	if len(insert) > 0 {
+		newText = beforeCursor[:start] + insert + text[len(beforeCursor):]
+	}
+	view.input.SetTextAndMoveCursor(newText)
+	view.SetCompletions(suggestions)
+}
+
+// countEmojiShortcodes adds the emojis typed as shortcodes in the given message to the usage counters.
+func (view *RoomView) countEmojiShortcodes(text string) {
+	var used []string
+	codeMap := emoji.CodeMap()
+	for _, name := range emojiShortcodeRegex.FindAllString(text, -1) {
+		if value, ok := codeMap[name]; ok {
+			used = append(used, value)
+		}
+	}
+	if len(used) > 0 {
+		view.config.AddEmojiUsage(used...)
+	}
+}
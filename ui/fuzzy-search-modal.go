@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/lithammer/fuzzysearch/fuzzy"
 
@@ -33,6 +34,20 @@ import (
 	"maunium.net/go/gomuks/matrix/rooms"
 )
 
+// fuzzySearchCandidate is a string that a room can be found with. Rooms can have several candidates, like the name,
+// the canonical alias and the name of the other user in direct chats.
+type fuzzySearchCandidate struct {
+	room *rooms.Room
+	text string
+}
+
+// fuzzySearchMatch is a room that matched the query, with the distance of its best matching candidate.
+type fuzzySearchMatch struct {
+	room     *rooms.Room
+	distance int
+	prefix   bool
+}
+
 type FuzzySearchModal struct {
 	mauview.Component
 
@@ -41,11 +56,12 @@ type FuzzySearchModal struct {
 	search  *mauview.InputArea
 	results *mauview.TextView
 
-	matches  fuzzy.Ranks
+	matches  []fuzzySearchMatch
 	selected int
 
-	roomList   []*rooms.Room
-	roomTitles []string
+	candidates     []fuzzySearchCandidate
+	candidateTexts []string
+	roomList       []*rooms.Room
 
 	parent *MainView
 }
@@ -79,6 +95,8 @@ func NewFuzzySearchModal(mainView *MainView, width int, height int) *FuzzySearch
 
 	fs.Component = mauview.Center(fs.container, width, height).SetAlwaysFocusChild(true)
 
+	fs.changeHandler("")
+
 	return fs
 }
 
@@ -90,38 +108,145 @@ func (fs *FuzzySearchModal) Blur() {
 	fs.container.Blur()
 }
 
+func (fs *FuzzySearchModal) addCandidate(room *rooms.Room, text string) {
+	if len(text) == 0 {
+		return
+	}
+	fs.candidates = append(fs.candidates, fuzzySearchCandidate{room: room, text: text})
+	fs.candidateTexts = append(fs.candidateTexts, text)
+}
+
+// InitList collects the strings that rooms can be found with. Only cached values are used, so that opening the
+// switcher doesn't load every room from disk.
 func (fs *FuzzySearchModal) InitList(rooms map[id.RoomID]*RoomView) {
-	for _, room := range rooms {
-		if room.Room.IsReplaced() {
-			//if _, ok := rooms[room.Room.ReplacedBy()]; ok
+	for _, roomView := range rooms {
+		room := roomView.Room
+		if room.IsReplaced() {
 			continue
 		}
-		fs.roomList = append(fs.roomList, room.Room)
-		fs.roomTitles = append(fs.roomTitles, room.Room.GetTitle())
+		fs.roomList = append(fs.roomList, room)
+		title := room.GetTitle()
+		fs.addCandidate(room, title)
+		if alias := cachedCanonicalAlias(room); len(alias) > 0 && alias != title {
+			fs.addCandidate(room, alias)
+		}
+		if room.IsDirect && len(room.OtherUser) > 0 {
+			fs.addCandidate(room, string(room.OtherUser))
+			if room.Loaded() {
+				if member := room.GetMember(room.OtherUser); member != nil && member.Displayname != title {
+					fs.addCandidate(room, member.Displayname)
+				}
+			}
+		}
+	}
+}
+
+// cachedCanonicalAlias returns the canonical alias of the room without loading the room state.
+func cachedCanonicalAlias(room *rooms.Room) string {
+	if room.CanonicalAliasCache == "-" {
+		return ""
+	}
+	return string(room.CanonicalAliasCache)
+}
+
+// roomPriority ranks rooms with mentions first, then rooms with unread messages and finally the rest.
+func roomPriority(room *rooms.Room) int {
+	switch {
+	case room.Highlighted():
+		return 2
+	case room.HasNewMessages():
+		return 1
+	default:
+		return 0
+	}
+}
+
+// findMatches finds the rooms matching the query. Rooms where the query is a prefix of a name come first, then rooms
+// are ranked by unread status, how recently they had messages and finally how well they matched. With an empty query,
+// all rooms are listed.
+func (fs *FuzzySearchModal) findMatches(query string) []fuzzySearchMatch {
+	var matches []fuzzySearchMatch
+	if len(query) == 0 {
+		matches = make([]fuzzySearchMatch, len(fs.roomList))
+		for i, room := range fs.roomList {
+			matches[i] = fuzzySearchMatch{room: room}
+		}
+	} else {
+		bestMatch := make(map[*rooms.Room]int)
+		lowerQuery := strings.ToLower(query)
+		for _, rank := range fuzzy.RankFindFold(query, fs.candidateTexts) {
+			candidate := fs.candidates[rank.OriginalIndex]
+			match := fuzzySearchMatch{
+				room:     candidate.room,
+				distance: rank.Distance,
+				prefix:   strings.HasPrefix(strings.ToLower(candidate.text), lowerQuery),
+			}
+			if index, ok := bestMatch[candidate.room]; !ok {
+				bestMatch[candidate.room] = len(matches)
+				matches = append(matches, match)
+			} else if existing := matches[index]; (match.prefix && !existing.prefix) ||
+				(match.prefix == existing.prefix && match.distance < existing.distance) {
+				matches[index] = match
+			}
+		}
 	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.prefix != b.prefix {
+			return a.prefix
+		} else if priorityA, priorityB := roomPriority(a.room), roomPriority(b.room); priorityA != priorityB {
+			return priorityA > priorityB
+		} else if !a.room.LastReceivedMessage.Equal(b.room.LastReceivedMessage) {
+			return a.room.LastReceivedMessage.After(b.room.LastReceivedMessage)
+		}
+		return a.distance < b.distance
+	})
+	return matches
+}
+
+func (fs *FuzzySearchModal) formatMatch(match fuzzySearchMatch) string {
+	room := match.room
+	var buf strings.Builder
+	buf.WriteString(escapeTextViewTags(room.GetTitle()))
+	if room.IsDirect && len(room.OtherUser) > 0 {
+		_, _ = fmt.Fprintf(&buf, " [gray](%s)[-]", escapeTextViewTags(string(room.OtherUser)))
+	} else if alias := cachedCanonicalAlias(room); len(alias) > 0 && alias != room.GetTitle() {
+		_, _ = fmt.Fprintf(&buf, " [gray](%s)[-]", escapeTextViewTags(alias))
+	}
+	if room.Highlighted() {
+		_, _ = fmt.Fprintf(&buf, " [red](%d)[-]", room.UnreadCount())
+	} else if unread := room.UnreadCount(); unread > 0 {
+		_, _ = fmt.Fprintf(&buf, " [yellow](%d)[-]", unread)
+	}
+	return buf.String()
 }
 
 func (fs *FuzzySearchModal) changeHandler(str string) {
 	// Get matches and display in result box
-	fs.matches = fuzzy.RankFindFold(str, fs.roomTitles)
-	if len(str) > 0 && len(fs.matches) > 0 {
-		sort.Sort(fs.matches)
-		fs.results.Clear()
-		for _, match := range fs.matches {
-			fmt.Fprintf(fs.results, `["%d"]%s[""]%s`, match.OriginalIndex, match.Target, "\n")
+	fs.matches = fs.findMatches(str)
+	fs.results.Clear()
+	fs.selected = 0
+	if len(fs.matches) > 0 {
+		for i, match := range fs.matches {
+			fmt.Fprintf(fs.results, `["%d"]%s[""]%s`, i, fs.formatMatch(match), "\n")
 		}
-		//fs.parent.parent.Render()
-		fs.results.Highlight(strconv.Itoa(fs.matches[0].OriginalIndex))
-		fs.selected = 0
+		fs.results.Highlight("0")
 		fs.results.ScrollToBeginning()
 	} else {
-		fs.results.Clear()
 		fs.results.Highlight()
 	}
 }
 
+func (fs *FuzzySearchModal) selectMatch(index int) {
+	if len(fs.matches) == 0 {
+		return
+	}
+	fs.selected = (index + len(fs.matches)) % len(fs.matches)
+	fs.results.Highlight(strconv.Itoa(fs.selected))
+	fs.results.ScrollToHighlight()
+}
+
 func (fs *FuzzySearchModal) OnKeyEvent(event mauview.KeyEvent) bool {
-	highlights := fs.results.GetHighlights()
 	kb := config.Keybind{
 		Key: event.Key(),
 		Ch:  event.Rune(),
@@ -133,28 +258,17 @@ func (fs *FuzzySearchModal) OnKeyEvent(event mauview.KeyEvent) bool {
 		fs.parent.HideModal()
 		return true
 	case "select_next":
-		// Cycle highlighted area to next match
-		if len(highlights) > 0 {
-			fs.selected = (fs.selected + 1) % len(fs.matches)
-			fs.results.Highlight(strconv.Itoa(fs.matches[fs.selected].OriginalIndex))
-			fs.results.ScrollToHighlight()
-		}
+		fs.selectMatch(fs.selected + 1)
 		return true
 	case "select_prev":
-		if len(highlights) > 0 {
-			fs.selected = (fs.selected - 1) % len(fs.matches)
-			if fs.selected < 0 {
-				fs.selected += len(fs.matches)
-			}
-			fs.results.Highlight(strconv.Itoa(fs.matches[fs.selected].OriginalIndex))
-			fs.results.ScrollToHighlight()
-		}
+		fs.selectMatch(fs.selected - 1)
 		return true
 	case "confirm":
 		// Switch room to currently selected room
-		if len(highlights) > 0 {
-			debug.Print("Fuzzy Selected Room:", fs.roomList[fs.matches[fs.selected].OriginalIndex].GetTitle())
-			fs.parent.SwitchRoom(fs.roomList[fs.matches[fs.selected].OriginalIndex].Tags()[0].Tag, fs.roomList[fs.matches[fs.selected].OriginalIndex])
+		if len(fs.matches) > 0 {
+			room := fs.matches[fs.selected].room
+			debug.Print("Fuzzy Selected Room:", room.GetTitle())
+			fs.parent.SwitchRoom(room.Tags()[0].Tag, room)
 		}
 		fs.parent.HideModal()
 		fs.results.Clear()
@@ -0,0 +1,103 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"go.mau.fi/mauview"
+
+	"maunium.net/go/gomuks/lib/ansimage"
+	"maunium.net/go/gomuks/ui/messages"
+)
+
+// rawScreen is implemented by the terminfo screen of tcell. TPuts writes a string to the terminal as-is when the
+// screen isn't in the middle of drawing a frame.
+type rawScreen interface {
+	Show()
+	Size() (int, int)
+	TPuts(string)
+}
+
+// graphicsLayer draws the images that use the sixel or kitty graphics protocols. tcell can only draw text, so the
+// image placements are collected while drawing a frame and written to the terminal directly after tcell has shown it.
+type graphicsLayer struct {
+	lock   sync.Mutex
+	queued []*messages.GraphicsPlacement
+	shown  map[string]*messages.GraphicsPlacement
+
+	width, height int
+}
+
+func placementKey(placement *messages.GraphicsPlacement) string {
+	return fmt.Sprintf("%s@%d,%d", placement.Key, placement.X, placement.Y)
+}
+
+// add queues an image to be drawn after the current frame.
+func (gl *graphicsLayer) add(placement *messages.GraphicsPlacement) {
+	gl.lock.Lock()
+	gl.queued = append(gl.queued, placement)
+	gl.lock.Unlock()
+}
+
+// flush shows the drawn frame and writes the images queued while drawing it. Images that are already on the terminal
+// at the same position aren't written again, and kitty placements that are no longer visible are deleted. If hidden is
+// true, e.g. because a modal is open over the images, the queued images are dropped.
+func (gl *graphicsLayer) flush(screen mauview.Screen, hidden bool) {
+	gl.lock.Lock()
+	defer gl.lock.Unlock()
+	queued := gl.queued
+	gl.queued = nil
+	if hidden {
+		queued = nil
+	}
+	raw, ok := screen.(rawScreen)
+	if !ok {
+		return
+	}
+	if width, height := raw.Size(); width != gl.width || height != gl.height {
+		// tcell clears the terminal when it's resized
+		gl.width, gl.height = width, height
+		gl.shown = nil
+	}
+
+	current := make(map[string]*messages.GraphicsPlacement, len(queued))
+	for _, placement := range queued {
+		current[placementKey(placement)] = placement
+	}
+	var buf strings.Builder
+	for key, placement := range gl.shown {
+		if _, stillShown := current[key]; !stillShown && placement.KittyID != 0 {
+			buf.WriteString(ansimage.DeleteKitty(placement.KittyID))
+		}
+	}
+	for key, placement := range current {
+		if _, alreadyShown := gl.shown[key]; !alreadyShown {
+			buf.WriteString(ansimage.PlaceGraphics(placement.Sequence, placement.X, placement.Y))
+		}
+	}
+	gl.shown = current
+	if buf.Len() == 0 {
+		return
+	}
+	// Show the frame first, so that tcell doesn't draw the blank cells under the images over them afterwards.
+	// The Show call of the application after drawing then has nothing left to draw.
+	raw.Show()
+	raw.TPuts(buf.String())
+}
@@ -29,16 +29,34 @@ import (
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
+	ifc "maunium.net/go/gomuks/interface"
 	"maunium.net/go/gomuks/matrix/rooms"
 	"maunium.net/go/gomuks/ui/widget"
 )
 
 type MemberList struct {
-	list roomMemberList
+	list   roomMemberList
+	matrix ifc.MatrixContainer
 }
 
-func NewMemberList() *MemberList {
-	return &MemberList{}
+func NewMemberList(matrix ifc.MatrixContainer) *MemberList {
+	return &MemberList{matrix: matrix}
+}
+
+// presenceIndicator returns the symbol and color used to show the presence of a user. Unknown presence is shown as
+// a space.
+func presenceIndicator(presence *event.PresenceEventContent) (rune, tcell.Color) {
+	if presence == nil {
+		return ' ', tcell.ColorDefault
+	}
+	switch presence.Presence {
+	case event.PresenceOnline:
+		return '●', tcell.ColorGreen
+	case event.PresenceUnavailable:
+		return '●', tcell.ColorYellow
+	default:
+		return '○', tcell.ColorGray
+	}
 }
 
 type memberListItem struct {
@@ -109,20 +127,27 @@ func (ml *MemberList) Update(data map[id.UserID]*rooms.Member, levels *event.Pow
 func (ml *MemberList) Draw(screen mauview.Screen) {
 	width, _ := screen.Size()
 	sigilStyle := tcell.StyleDefault.Background(tcell.ColorGreen).Foreground(tcell.ColorDefault)
+	showPresence := ml.matrix.PresenceEnabled()
 	for y, member := range ml.list {
 		if member.Sigil != ' ' {
 			screen.SetCell(0, y, sigilStyle, member.Sigil)
 		}
+		x := 1
+		if showPresence {
+			symbol, color := presenceIndicator(ml.matrix.GetPresence(member.UserID))
+			screen.SetCell(x, y, tcell.StyleDefault.Foreground(color), symbol)
+			x += 2
+		}
 		if member.Membership == "invite" {
-			widget.WriteLineSimpleColor(screen, member.Displayname, 2, y, member.Color)
-			screen.SetCell(1, y, tcell.StyleDefault, '(')
-			if sw := runewidth.StringWidth(member.Displayname); sw+2 < width {
-				screen.SetCell(sw+2, y, tcell.StyleDefault, ')')
+			widget.WriteLineSimpleColor(screen, member.Displayname, x+1, y, member.Color)
+			screen.SetCell(x, y, tcell.StyleDefault, '(')
+			if sw := runewidth.StringWidth(member.Displayname); x+sw+1 < width {
+				screen.SetCell(x+sw+1, y, tcell.StyleDefault, ')')
 			} else {
 				screen.SetCell(width-1, y, tcell.StyleDefault, ')')
 			}
 		} else {
-			widget.WriteLineSimpleColor(screen, member.Displayname, 1, y, member.Color)
+			widget.WriteLineSimpleColor(screen, member.Displayname, x, y, member.Color)
 		}
 	}
 }
@@ -35,6 +35,7 @@ import (
 	"maunium.net/go/gomuks/debug"
 	ifc "maunium.net/go/gomuks/interface"
 	"maunium.net/go/gomuks/lib/open"
+	"maunium.net/go/gomuks/matrix/muksevt"
 	"maunium.net/go/gomuks/ui/messages"
 	"maunium.net/go/gomuks/ui/widget"
 )
@@ -71,6 +72,16 @@ type MessageView struct {
 	msgBufferLock sync.RWMutex
 	msgBuffer     []*messages.UIMessage
 	selected      *messages.UIMessage
+	// membershipSummaries maps collapsed membership events and messages from ignored users to the line that stands in
+	// for them.
+	membershipSummaries map[*messages.UIMessage]*messages.UIMessage
+	// expandedMembership contains the groups of membership events that have been expanded or collapsed manually,
+	// keyed by the ID of the first event in the group.
+	expandedMembership map[id.EventID]bool
+	// expandAllMembership is the default state of membership event groups that haven't been toggled manually.
+	expandAllMembership bool
+	// expandedIgnored contains the messages from ignored users that have been expanded manually.
+	expandedIgnored map[id.EventID]bool
 
 	initialHistoryLoaded bool
 }
@@ -88,6 +99,10 @@ func NewMessageView(parent *RoomView) *MessageView {
 		messageIDs: make(map[id.EventID]*messages.UIMessage),
 		msgBuffer:  make([]*messages.UIMessage, 0),
 
+		membershipSummaries: make(map[*messages.UIMessage]*messages.UIMessage),
+		expandedMembership:  make(map[id.EventID]bool),
+		expandedIgnored:     make(map[id.EventID]bool),
+
 		_widestSender:     5,
 		_prevWidestSender: 0,
 
@@ -106,6 +121,7 @@ func (view *MessageView) Unload() {
 	view.messageIDs = make(map[id.EventID]*messages.UIMessage)
 	view.msgBuffer = make([]*messages.UIMessage, 0)
 	view.messages = make([]*messages.UIMessage, 0)
+	view.membershipSummaries = make(map[*messages.UIMessage]*messages.UIMessage)
 	view.initialHistoryLoaded = false
 	view.ScrollOffset = 0
 	view._widestSender = 5
@@ -180,13 +196,22 @@ func (view *MessageView) AddMessage(ifcMessage ifc.Message, direction MessageDir
 			view.ScrollOffset += message.Height()
 		}
 		view.messagesLock.Lock()
+		// The read marker goes between the fully read message and the first message after it.
+		afterFullyRead := len(view.messages) > 0 &&
+			containsEvent(view.messages[len(view.messages)-1:], view.parent.Room.GetFullyRead())
 		if len(view.messages) > 0 && !view.messages[len(view.messages)-1].SameDate(message) {
 			view.messages = append(view.messages, makeDateChange(message), message)
 		} else {
 			view.messages = append(view.messages, message)
 		}
 		view.messagesLock.Unlock()
-		view.appendBuffer(message)
+		if view.isCollapsible(message) || view.isFromIgnoredUser(message) || afterFullyRead {
+			// The message may belong to a collapsed group, be hidden or need the read marker before it, so rebuild
+			// the buffer on the next draw.
+			view.invalidateBuffer()
+		} else {
+			view.appendBuffer(message)
+		}
 	} else if direction == PrependMessage {
 		view.messagesLock.Lock()
 		if len(view.messages) > 0 && !view.messages[0].SameDate(message) {
@@ -220,6 +245,21 @@ func (view *MessageView) replaceMessage(original *messages.UIMessage, new *messa
 	view.messagesLock.Unlock()
 }
 
+// messageAfter returns the first message after the given event that isn't a date change or other service line.
+func (view *MessageView) messageAfter(eventID id.EventID) *messages.UIMessage {
+	view.messagesLock.RLock()
+	defer view.messagesLock.RUnlock()
+	found := false
+	for _, msg := range view.messages {
+		if found && msg.Event != nil {
+			return msg
+		} else if msg.ID() == eventID {
+			found = true
+		}
+	}
+	return nil
+}
+
 func (view *MessageView) getMessageByID(id id.EventID) *messages.UIMessage {
 	if id == "" {
 		return nil
@@ -233,6 +273,23 @@ func (view *MessageView) getMessageByID(id id.EventID) *messages.UIMessage {
 	return msg
 }
 
+// getUndecryptableMessages returns the loaded messages that still couldn't be decrypted.
+func (view *MessageView) getUndecryptableMessages() []*messages.UIMessage {
+	view.messagesLock.RLock()
+	defer view.messagesLock.RUnlock()
+	var undecryptable []*messages.UIMessage
+	for _, msg := range view.messages {
+		if msg.Event == nil {
+			continue
+		}
+		content, ok := msg.Event.Content.Parsed.(*muksevt.BadEncryptedContent)
+		if ok && content.Original != nil {
+			undecryptable = append(undecryptable, msg)
+		}
+	}
+	return undecryptable
+}
+
 func (view *MessageView) deleteMessageID(id id.EventID) {
 	if id == "" {
 		return
@@ -278,9 +335,16 @@ func (view *MessageView) replaceBuffer(original *messages.UIMessage, new *messag
 			break
 		}
 	}
+	_, collapsed := view.membershipSummaries[original]
 	view.msgBufferLock.RUnlock()
 
-	if start == -1 {
+	if start == -1 && view.isFromIgnoredUser(original) {
+		// Membership events of ignored users aren't shown at all.
+		return
+	} else if start == -1 && collapsed {
+		view.invalidateBuffer()
+		return
+	} else if start == -1 {
 		debug.Print("Called replaceBuffer() with message that was not in the buffer:", original)
 		//debug.PrintStack()
 		view.appendBuffer(new)
@@ -320,7 +384,8 @@ func (view *MessageView) recalculateBuffers() {
 	recalculateMessageBuffers := view.width() != view.prevWidth() ||
 		view.widestSender() != view.prevWidestSender() ||
 		view.prevPrefs.BareMessageView != prefs.BareMessageView ||
-		view.prevPrefs.DisableImages != prefs.DisableImages
+		view.prevPrefs.DisableImages != prefs.DisableImages ||
+		view.prevPrefs.ImageMode != prefs.ImageMode
 	view.messagesLock.RLock()
 	view.msgBufferLock.Lock()
 	if recalculateMessageBuffers || len(view.messages) != view.prevMsgCount {
@@ -332,16 +397,39 @@ func (view *MessageView) recalculateBuffers() {
 			}
 		}
 		view.msgBuffer = []*messages.UIMessage{}
+		view.membershipSummaries = make(map[*messages.UIMessage]*messages.UIMessage)
 		view.prevMsgCount = 0
-		for i, message := range view.messages {
+		fullyRead := view.parent.Room.GetFullyRead()
+		for i := 0; i < len(view.messages); i++ {
+			message := view.messages[i]
 			if message == nil {
 				debug.Print("O.o found nil message at", i)
 				break
 			}
+			run := 1
+			if !view.isFromIgnoredUser(message) {
+				run = view.membershipRunLength(i)
+				if run < 2 || run < view.config.CollapseMembershipThreshold {
+					run = 1
+				}
+			}
+			group := view.messages[i : i+run]
 			if recalculateMessageBuffers {
-				message.CalculateBuffer(prefs, width)
+				for _, msg := range group {
+					msg.CalculateBuffer(prefs, width)
+				}
+			}
+			if view.isFromIgnoredUser(message) {
+				view.appendIgnoredMessageUnlocked(message, prefs, width)
+			} else if run > 1 {
+				view.appendMembershipGroupUnlocked(group, prefs, width)
+			} else {
+				view.appendBufferUnlocked(message)
+			}
+			i += run - 1
+			if i < len(view.messages)-1 && containsEvent(group, fullyRead) {
+				view.appendReadMarkerUnlocked(message, prefs, width)
 			}
-			view.appendBufferUnlocked(message)
 		}
 	}
 	view.msgBufferLock.Unlock()
@@ -350,6 +438,138 @@ func (view *MessageView) recalculateBuffers() {
 	view.prevPrefs = prefs
 }
 
+// containsEvent returns whether one of the given messages is the given event.
+func containsEvent(group []*messages.UIMessage, eventID id.EventID) bool {
+	if len(eventID) == 0 {
+		return false
+	}
+	for _, message := range group {
+		if message.ID() == eventID {
+			return true
+		}
+	}
+	return false
+}
+
+// appendReadMarkerUnlocked adds the divider that marks where the user stopped reading to the buffer.
+func (view *MessageView) appendReadMarkerUnlocked(after *messages.UIMessage, prefs config.UserPreferences, width int) {
+	marker := messages.NewReadMarkerMessage(after.Timestamp)
+	marker.CalculateBuffer(prefs, width)
+	for i := 0; i < marker.Height(); i++ {
+		view.msgBuffer = append(view.msgBuffer, marker)
+	}
+}
+
+// isCollapsible returns whether the message is a membership event that can be collapsed into a summary line.
+func (view *MessageView) isCollapsible(message *messages.UIMessage) bool {
+	return view.config.CanCollapseMembership(string(message.MembershipChange)) && !view.isFromIgnoredUser(message)
+}
+
+// isOwnMessage returns whether the message is a non-state event sent by the current user, which get a send status
+// indicator.
+func (view *MessageView) isOwnMessage(message *messages.UIMessage) bool {
+	return message.Event != nil && !message.IsService && message.Event.StateKey == nil &&
+		message.SenderID == view.config.UserID
+}
+
+// isFromIgnoredUser returns whether the message was sent by an ignored user, or is a membership event of one.
+func (view *MessageView) isFromIgnoredUser(message *messages.UIMessage) bool {
+	if message.Event == nil {
+		return false
+	}
+	mx := view.parent.parent.matrix
+	if mx.IsIgnored(message.SenderID) {
+		return true
+	}
+	stateKey := message.Event.StateKey
+	return len(message.MembershipChange) > 0 && stateKey != nil && mx.IsIgnored(id.UserID(*stateKey))
+}
+
+// appendIgnoredMessageUnlocked adds a placeholder line for a message from an ignored user to the buffer, followed by
+// the message itself if it has been expanded. Membership events of ignored users are left out completely.
+func (view *MessageView) appendIgnoredMessageUnlocked(message *messages.UIMessage, prefs config.UserPreferences, width int) {
+	view.prevMsgCount++
+	if len(message.MembershipChange) > 0 {
+		return
+	}
+	expanded := view.expandedIgnored[message.ID()]
+	placeholder := messages.NewIgnoredMessage(message, expanded)
+	placeholder.CalculateBuffer(prefs, width)
+	for i := 0; i < placeholder.Height(); i++ {
+		view.msgBuffer = append(view.msgBuffer, placeholder)
+	}
+	view.membershipSummaries[message] = placeholder
+	if expanded {
+		for i := 0; i < message.Height(); i++ {
+			view.msgBuffer = append(view.msgBuffer, message)
+		}
+	}
+}
+
+// toggleIgnoredMessage shows or hides the message from an ignored user behind the given placeholder line.
+func (view *MessageView) toggleIgnoredMessage(ignored *messages.IgnoredMessage) {
+	view.msgBufferLock.Lock()
+	view.expandedIgnored[ignored.Message.ID()] = !ignored.Expanded
+	view.prevMsgCount = -1
+	view.msgBufferLock.Unlock()
+}
+
+// membershipRunLength returns the number of consecutive collapsible membership events starting at the given index.
+func (view *MessageView) membershipRunLength(start int) int {
+	end := start
+	for end < len(view.messages) && view.messages[end] != nil && view.isCollapsible(view.messages[end]) {
+		end++
+	}
+	return end - start
+}
+
+// appendMembershipGroupUnlocked adds a summary line for the given membership events to the buffer, followed by the
+// events themselves if the group is expanded.
+func (view *MessageView) appendMembershipGroupUnlocked(group []*messages.UIMessage, prefs config.UserPreferences, width int) {
+	expanded, ok := view.expandedMembership[group[0].ID()]
+	if !ok {
+		expanded = view.expandAllMembership
+	}
+	summary := messages.NewMembershipSummaryMessage(group, expanded)
+	summary.CalculateBuffer(prefs, width)
+	for i := 0; i < summary.Height(); i++ {
+		view.msgBuffer = append(view.msgBuffer, summary)
+	}
+	for _, message := range group {
+		view.membershipSummaries[message] = summary
+		if expanded {
+			for i := 0; i < message.Height(); i++ {
+				view.msgBuffer = append(view.msgBuffer, message)
+			}
+		}
+	}
+	view.prevMsgCount += len(group)
+}
+
+// invalidateBuffer makes the next draw rebuild the message buffer.
+func (view *MessageView) invalidateBuffer() {
+	view.msgBufferLock.Lock()
+	view.prevMsgCount = -1
+	view.msgBufferLock.Unlock()
+}
+
+// toggleMembershipGroup expands or collapses the membership events behind the given summary line.
+func (view *MessageView) toggleMembershipGroup(summary *messages.MembershipSummary) {
+	view.msgBufferLock.Lock()
+	view.expandedMembership[summary.Messages[0].ID()] = !summary.Expanded
+	view.prevMsgCount = -1
+	view.msgBufferLock.Unlock()
+}
+
+// ToggleAllMembership expands or collapses all groups of membership events in the room.
+func (view *MessageView) ToggleAllMembership() {
+	view.msgBufferLock.Lock()
+	view.expandAllMembership = !view.expandAllMembership
+	view.expandedMembership = make(map[id.EventID]bool)
+	view.prevMsgCount = -1
+	view.msgBufferLock.Unlock()
+}
+
 func (view *MessageView) SetSelected(message *messages.UIMessage) {
 	if view.selected != nil {
 		view.selected.IsSelected = false
@@ -365,6 +585,13 @@ func (view *MessageView) SetSelected(message *messages.UIMessage) {
 }
 
 func (view *MessageView) handleMessageClick(message *messages.UIMessage, mod tcell.ModMask) bool {
+	if summary, ok := message.Renderer.(*messages.MembershipSummary); ok {
+		view.toggleMembershipGroup(summary)
+		return true
+	} else if ignored, ok := message.Renderer.(*messages.IgnoredMessage); ok {
+		view.toggleIgnoredMessage(ignored)
+		return true
+	}
 	if msg, ok := message.Renderer.(*messages.FileMessage); ok && mod > 0 && !msg.Thumbnail.IsEmpty() {
 		debug.Print("Opening thumbnail", msg.ThumbnailPath())
 		open.Open(msg.ThumbnailPath())
@@ -475,6 +702,38 @@ func (view *MessageView) AddScrollOffset(diff int) {
 	}
 }
 
+// ScrollToMessage scrolls the view so that the given message is in the middle, unless it's already fully visible.
+// If the message is in a collapsed group of membership events, the summary line is scrolled to instead.
+func (view *MessageView) ScrollToMessage(message *messages.UIMessage) {
+	view.msgBufferLock.RLock()
+	start := view.bufferIndexUnlocked(message)
+	if summary, ok := view.membershipSummaries[message]; ok && start == -1 {
+		message = summary
+		start = view.bufferIndexUnlocked(summary)
+	}
+	totalHeight := len(view.msgBuffer)
+	view.msgBufferLock.RUnlock()
+	if start == -1 {
+		return
+	}
+	height := view.Height()
+	indexOffset := totalHeight - view.ScrollOffset - height
+	if start >= indexOffset && start+message.Height() <= indexOffset+height {
+		return
+	}
+	view.ScrollOffset = 0
+	view.AddScrollOffset(totalHeight - start - height/2)
+}
+
+func (view *MessageView) bufferIndexUnlocked(message *messages.UIMessage) int {
+	for index, meta := range view.msgBuffer {
+		if meta == message {
+			return index
+		}
+	}
+	return -1
+}
+
 func (view *MessageView) setSize(width, height int) {
 	atomic.StoreUint32(&view._width, uint32(width))
 	atomic.StoreUint32(&view._height, uint32(height))
@@ -669,11 +928,18 @@ func (view *MessageView) Draw(screen mauview.Screen) {
 			// TODO add better indicator for edits
 			screen.SetCell(usernameX+view.widestSender(), line, tcell.StyleDefault.Foreground(tcell.ColorDarkRed), '*')
 		}
+		if !bareMode && view.isOwnMessage(msg) {
+			indicator, color := msg.StatusIndicator()
+			screen.SetCell(messageX-1, line, tcell.StyleDefault.Foreground(color), indicator)
+		}
 
 		for i := index - 1; i >= 0 && view.msgBuffer[i] == msg; i-- {
 			line--
 		}
 		msg.Draw(mauview.NewProxyScreen(screen, messageX, line, view.width()-messageX, msg.Height()))
+		if fileMsg, ok := msg.Renderer.(*messages.FileMessage); ok && fileMsg.Graphics() != nil {
+			view.parent.parent.graphics.add(fileMsg.Graphics())
+		}
 		line += msg.Height()
 
 		prevMsg = msg
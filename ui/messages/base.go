@@ -19,8 +19,11 @@ package messages
 import (
 	"fmt"
 	"sort"
+	"strings"
 	"time"
 
+	"github.com/mattn/go-runewidth"
+
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
@@ -46,6 +49,8 @@ type MessageRenderer interface {
 type ReactionItem struct {
 	Key   string
 	Count int
+	// Own is set if the user has reacted with this key.
+	Own bool
 }
 
 func (ri ReactionItem) String() string {
@@ -79,13 +84,39 @@ type UIMessage struct {
 	IsHighlight        bool
 	IsService          bool
 	IsSelected         bool
+	IsMarked           bool
+	SpoilersRevealed   bool
+	IsSearchMatch      bool
+	IsCurrentMatch     bool
 	Edited             bool
+	MembershipChange   MembershipChange
 	Event              *muksevt.Event
 	ReplyTo            *UIMessage
 	Reactions          ReactionSlice
+	ReadReceipts       []ReadReceipt
 	Renderer           MessageRenderer
+	// SendError is the reason sending the message failed, if State is StateSendFail.
+	SendError string
+}
+
+// ReadReceipt is a user whose last read event is the message it's attached to.
+type ReadReceipt struct {
+	UserID id.UserID
+	Name   string
 }
 
+// Initial returns the first letter of the user's name, which is what's shown next to the message.
+func (rr ReadReceipt) Initial() string {
+	name := []rune(strings.TrimPrefix(rr.Name, "@"))
+	if len(name) == 0 {
+		return "?"
+	}
+	return strings.ToUpper(string(name[0]))
+}
+
+// maxReadReceipts is the number of read receipts drawn next to a message before the rest are collapsed into a count.
+const maxReadReceipts = 5
+
 func (msg *UIMessage) GetEvent() *muksevt.Event {
 	if msg == nil {
 		return nil
@@ -103,16 +134,7 @@ func newUIMessage(evt *muksevt.Event, displayname string, renderer MessageRender
 		msgtype = event.MessageType(evt.Type.String())
 	}
 
-	reactions := make(ReactionSlice, 0, len(evt.Unsigned.Relations.Annotations.Map))
-	for key, count := range evt.Unsigned.Relations.Annotations.Map {
-		reactions = append(reactions, ReactionItem{
-			Key:   key,
-			Count: count,
-		})
-	}
-	sort.Sort(reactions)
-
-	return &UIMessage{
+	msg := &UIMessage{
 		SenderID:           evt.Sender,
 		SenderName:         displayname,
 		Timestamp:          unixToTime(evt.Timestamp),
@@ -125,29 +147,59 @@ func newUIMessage(evt *muksevt.Event, displayname string, renderer MessageRender
 		IsHighlight:        false,
 		IsService:          false,
 		Edited:             len(evt.Gomuks.Edits) > 0,
-		Reactions:          reactions,
 		Event:              evt,
 		Renderer:           renderer,
 	}
+	msg.SetReactions(evt, "")
+	return msg
 }
 
-func (msg *UIMessage) AddReaction(key string) {
-	found := false
-	for i, rs := range msg.Reactions {
-		if rs.Key == key {
-			rs.Count++
-			msg.Reactions[i] = rs
-			found = true
-			break
+// SetReactions replaces the reactions of the message with the aggregated reactions of the given event. Reactions
+// sent by ownUserID are marked so that they can be highlighted.
+func (msg *UIMessage) SetReactions(evt *muksevt.Event, ownUserID id.UserID) {
+	own := make(map[string]bool)
+	for _, reaction := range evt.Gomuks.Reactions {
+		if reaction.Sender == ownUserID {
+			own[reaction.Key] = true
 		}
 	}
-	if !found {
-		msg.Reactions = append(msg.Reactions, ReactionItem{
-			Key:   key,
-			Count: 1,
-		})
+	reactions := make(ReactionSlice, 0, len(evt.Unsigned.Relations.Annotations.Map))
+	for key, count := range evt.Unsigned.Relations.Annotations.Map {
+		if count > 0 {
+			reactions = append(reactions, ReactionItem{
+				Key:   key,
+				Count: count,
+				Own:   own[key],
+			})
+		}
+	}
+	sort.Sort(reactions)
+	msg.Reactions = reactions
+	if msg.Event != nil && msg.Event != evt {
+		msg.Event.Gomuks.Reactions = evt.Gomuks.Reactions
+		msg.Event.Unsigned.Relations.Annotations.Map = evt.Unsigned.Relations.Annotations.Map
+	}
+}
+
+// GetOwnReaction returns the ID of the reaction the given user sent with the given key, if there is one.
+func (msg *UIMessage) GetOwnReaction(ownUserID id.UserID, key string) id.EventID {
+	if msg.Event == nil {
+		return ""
 	}
-	sort.Sort(msg.Reactions)
+	for reactionID, reaction := range msg.Event.Gomuks.Reactions {
+		if reaction.Sender == ownUserID && reaction.Key == key {
+			return reactionID
+		}
+	}
+	return ""
+}
+
+// SetReadReceipts replaces the users who have read up to this message.
+func (msg *UIMessage) SetReadReceipts(receipts []ReadReceipt) {
+	sort.Slice(receipts, func(i, j int) bool {
+		return receipts[i].Name < receipts[j].Name
+	})
+	msg.ReadReceipts = receipts
 }
 
 func unixToTime(unix int64) time.Time {
@@ -162,6 +214,8 @@ func unixToTime(unix int64) time.Time {
 //
 // If the message is being sent, the sender is "Sending...".
 // If sending has failed, the sender is "Error".
+// If sending has failed and will be retried, the sender is "Retrying...".
+// If the message is waiting for earlier messages to be sent, the sender is "Queued".
 // If the message is an emote, the sender is blank.
 // In any other case, the sender is the display name of the user who sent the message.
 func (msg *UIMessage) Sender() string {
@@ -170,6 +224,10 @@ func (msg *UIMessage) Sender() string {
 		return "Sending..."
 	case muksevt.StateSendFail:
 		return "Error"
+	case muksevt.StateSendRetry:
+		return "Retrying..."
+	case muksevt.StateQueued:
+		return "Queued"
 	}
 	switch msg.Type {
 	case "m.emote":
@@ -194,6 +252,10 @@ func (msg *UIMessage) getStateSpecificColor() tcell.Color {
 		return tcell.ColorGray
 	case muksevt.StateSendFail:
 		return tcell.ColorRed
+	case muksevt.StateSendRetry:
+		return tcell.ColorYellow
+	case muksevt.StateQueued:
+		return tcell.ColorDarkCyan
 	case muksevt.StateDefault:
 		fallthrough
 	default:
@@ -201,10 +263,29 @@ func (msg *UIMessage) getStateSpecificColor() tcell.Color {
 	}
 }
 
+// StatusIndicator returns the character drawn next to messages sent by the current user to show whether the message
+// is still being sent, has been sent or failed to send.
+func (msg *UIMessage) StatusIndicator() (rune, tcell.Color) {
+	switch msg.State {
+	case muksevt.StateLocalEcho:
+		return '○', tcell.ColorGray
+	case muksevt.StateSendFail:
+		return '✗', tcell.ColorRed
+	case muksevt.StateSendRetry:
+		return '↻', tcell.ColorYellow
+	case muksevt.StateQueued:
+		return '…', tcell.ColorDarkCyan
+	default:
+		return '✓', tcell.ColorGreen
+	}
+}
+
 // SenderColor returns the color the name of the sender should be shown in.
 //
 // If the message is being sent, the color is gray.
 // If sending has failed, the color is red.
+// If sending will be retried, the color is yellow.
+// If the message is queued, the color is dark cyan.
 //
 // In any other case, the color is whatever is specified in the Message struct.
 // Usually that means it is the hash-based color of the sender (see ui/widget/color.go)
@@ -260,7 +341,7 @@ func (msg *UIMessage) ReplyHeight() int {
 }
 
 func (msg *UIMessage) ReactionHeight() int {
-	if len(msg.Reactions) > 0 {
+	if len(msg.Reactions) > 0 || len(msg.ReadReceipts) > 0 {
 		return 1
 	}
 	return 0
@@ -307,15 +388,20 @@ func (msg *UIMessage) SetIsHighlight(isHighlight bool) {
 }
 
 func (msg *UIMessage) DrawReactions(screen mauview.Screen) {
-	if len(msg.Reactions) == 0 {
+	if msg.ReactionHeight() == 0 {
 		return
 	}
 	width, height := screen.Size()
 	screen = mauview.NewProxyScreen(screen, 0, height-1, width, 1)
+	width -= msg.drawReadReceipts(screen, width)
 
 	x := 0
 	for _, reaction := range msg.Reactions {
-		_, drawn := mauview.PrintWithStyle(screen, reaction.String(), x, 0, width-x, mauview.AlignLeft, tcell.StyleDefault.Foreground(mauview.Styles.PrimaryTextColor).Background(tcell.ColorDarkGreen))
+		style := tcell.StyleDefault.Foreground(mauview.Styles.PrimaryTextColor).Background(tcell.ColorDarkGreen)
+		if reaction.Own {
+			style = style.Background(tcell.ColorDarkBlue).Bold(true)
+		}
+		_, drawn := mauview.PrintWithStyle(screen, reaction.String(), x, 0, width-x, mauview.AlignLeft, style)
 		x += drawn + 1
 		if x >= width {
 			break
@@ -323,19 +409,66 @@ func (msg *UIMessage) DrawReactions(screen mauview.Screen) {
 	}
 }
 
+// drawReadReceipts draws the initials of the users who have read up to this message at the right edge of the line
+// and returns the number of cells used.
+func (msg *UIMessage) drawReadReceipts(screen mauview.Screen, width int) int {
+	if len(msg.ReadReceipts) == 0 {
+		return 0
+	}
+	receipts := msg.ReadReceipts
+	var overflow string
+	if len(receipts) > maxReadReceipts {
+		receipts = receipts[:maxReadReceipts-1]
+		overflow = fmt.Sprintf("+%d", len(msg.ReadReceipts)-len(receipts))
+	}
+	used := runewidth.StringWidth(overflow)
+	for _, receipt := range receipts {
+		used += runewidth.StringWidth(receipt.Initial()) + 1
+	}
+	if len(overflow) == 0 {
+		used--
+	}
+	if used >= width {
+		return 0
+	}
+	x := width - used
+	for _, receipt := range receipts {
+		style := tcell.StyleDefault.Foreground(widget.GetHashColor(receipt.UserID)).Bold(true)
+		_, drawn := mauview.PrintWithStyle(screen, receipt.Initial(), x, 0, width-x, mauview.AlignLeft, style)
+		x += drawn + 1
+	}
+	if len(overflow) > 0 {
+		style := tcell.StyleDefault.Foreground(tcell.ColorGray)
+		mauview.PrintWithStyle(screen, overflow, x, 0, width-x, mauview.AlignLeft, style)
+	}
+	// Leave a gap between the read receipts and the reactions
+	return used + 1
+}
+
 func (msg *UIMessage) Draw(screen mauview.Screen) {
 	proxyScreen := msg.DrawReply(screen)
 	msg.Renderer.Draw(proxyScreen, msg)
 	msg.DrawReactions(proxyScreen)
-	if msg.IsSelected {
-		w, h := screen.Size()
-		for x := 0; x < w; x++ {
-			for y := 0; y < h; y++ {
-				mainc, combc, style, _ := screen.GetContent(x, y)
-				_, bg, _ := style.Decompose()
-				if bg == tcell.ColorDefault {
-					screen.SetContent(x, y, mainc, combc, style.Background(tcell.ColorDarkGreen))
-				}
+	switch {
+	case msg.IsSelected:
+		highlightBackground(screen, tcell.ColorDarkGreen)
+	case msg.IsMarked:
+		highlightBackground(screen, tcell.ColorDarkMagenta)
+	case msg.IsCurrentMatch:
+		highlightBackground(screen, tcell.ColorDarkCyan)
+	case msg.IsSearchMatch:
+		highlightBackground(screen, tcell.ColorDarkSlateGray)
+	}
+}
+
+func highlightBackground(screen mauview.Screen, color tcell.Color) {
+	w, h := screen.Size()
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			mainc, combc, style, _ := screen.GetContent(x, y)
+			_, bg, _ := style.Decompose()
+			if bg == tcell.ColorDefault {
+				screen.SetContent(x, y, mainc, combc, style.Background(color))
 			}
 		}
 	}
@@ -367,8 +500,13 @@ func (msg *UIMessage) DrawReply(screen mauview.Screen) mauview.Screen {
 	}
 	width, height := screen.Size()
 	replyHeight := msg.ReplyTo.Height()
-	widget.WriteLineSimpleColor(screen, "In reply to", 1, 0, tcell.ColorGreen)
-	widget.WriteLineSimpleColor(screen, msg.ReplyTo.SenderName, 13, 0, msg.ReplyTo.SenderColor())
+	if msg.Relation.Type == muksevt.RelThread {
+		widget.WriteLineSimpleColor(screen, "In thread of", 1, 0, tcell.ColorGreen)
+		widget.WriteLineSimpleColor(screen, msg.ReplyTo.SenderName, 14, 0, msg.ReplyTo.SenderColor())
+	} else {
+		widget.WriteLineSimpleColor(screen, "In reply to", 1, 0, tcell.ColorGreen)
+		widget.WriteLineSimpleColor(screen, msg.ReplyTo.SenderName, 13, 0, msg.ReplyTo.SenderColor())
+	}
 	for y := 0; y < 1+replyHeight; y++ {
 		screen.SetCell(0, y, tcell.StyleDefault, '▊')
 	}
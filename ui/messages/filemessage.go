@@ -19,6 +19,7 @@ package messages
 import (
 	"bytes"
 	"fmt"
+	"hash/fnv"
 	"image"
 	"image/color"
 
@@ -49,7 +50,19 @@ type FileMessage struct {
 	eventID id.EventID
 
 	imageData []byte
-	buffer    []tstring.TString
+	// image is the decoded imageData, cached so that the image doesn't have to be decoded again on every resize.
+	image  image.Image
+	buffer []tstring.TString
+
+	// graphics is the sixel or kitty escape sequence used to draw the image. useGraphics is false when the image is
+	// rendered with ANSI blocks instead.
+	useGraphics  bool
+	graphics     string
+	graphicsMode string
+	graphicsCols int
+	graphicsRows int
+	// placement is the position where the last Draw call placed the graphics, or nil if it didn't.
+	placement *GraphicsPlacement
 
 	matrix ifc.MatrixContainer
 }
@@ -85,7 +98,9 @@ func (msg *FileMessage) Clone() MessageRenderer {
 		Body:      msg.Body,
 		URL:       msg.URL,
 		Thumbnail: msg.Thumbnail,
+		eventID:   msg.eventID,
 		imageData: data,
+		image:     msg.image,
 		matrix:    msg.matrix,
 	}
 }
@@ -134,6 +149,28 @@ func (msg *FileMessage) DownloadPreview() {
 	}
 	debug.Print("File", url, "loaded.")
 	msg.imageData = data
+	// Decode the image right away so it doesn't need to be done when drawing
+	msg.decodeImage()
+}
+
+func (msg *FileMessage) decodeImage() image.Image {
+	if msg.image == nil && len(msg.imageData) > 0 {
+		img, _, err := image.Decode(bytes.NewReader(msg.imageData))
+		if err != nil {
+			debug.Print("File could not be decoded:", err)
+			return nil
+		}
+		msg.image = img
+	}
+	return msg.image
+}
+
+// graphicsID returns the image ID used for the kitty graphics protocol.
+func (msg *FileMessage) graphicsID() uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(msg.eventID))
+	// Zero isn't a valid image ID
+	return h.Sum32() | 1
 }
 
 func (msg *FileMessage) ThumbnailPath() string {
@@ -144,6 +181,7 @@ func (msg *FileMessage) CalculateBuffer(prefs config.UserPreferences, width int,
 	if width < 2 {
 		return
 	}
+	msg.useGraphics = false
 
 	if prefs.BareMessageView || prefs.DisableImages || len(msg.imageData) == 0 {
 		url := msg.matrix.GetDownloadURL(msg.URL)
@@ -160,16 +198,23 @@ func (msg *FileMessage) CalculateBuffer(prefs config.UserPreferences, width int,
 		return
 	}
 
-	img, _, err := image.DecodeConfig(bytes.NewReader(msg.imageData))
-	if err != nil {
-		debug.Print("File could not be decoded:", err)
+	img := msg.decodeImage()
+	if img == nil {
+		msg.buffer = []tstring.TString{tstring.NewColorTString("Failed to display image", tcell.ColorRed)}
+		return
 	}
-	imgWidth := img.Width
-	if img.Width > width {
+
+	if mode := prefs.GetImageMode(); mode != config.ImageModeANSI {
+		msg.calculateGraphics(img, mode, width)
+		return
+	}
+
+	imgWidth := img.Bounds().Dx()
+	if imgWidth > width {
 		imgWidth = width / 3
 	}
 
-	ansFile, err := ansimage.NewScaledFromReader(bytes.NewReader(msg.imageData), 0, imgWidth, color.Black)
+	ansFile, err := ansimage.NewScaledFromImage(img, 0, imgWidth, color.Black)
 	if err != nil {
 		msg.buffer = []tstring.TString{tstring.NewColorTString("Failed to display image", tcell.ColorRed)}
 		debug.Print("Failed to display image:", err)
@@ -179,11 +224,106 @@ func (msg *FileMessage) CalculateBuffer(prefs config.UserPreferences, width int,
 	msg.buffer = ansFile.Render()
 }
 
+// calculateGraphics encodes the image for the given graphics protocol. The encoded image is reused as long as the
+// size and protocol stay the same. The buffer is filled with empty lines to reserve space for the image.
+func (msg *FileMessage) calculateGraphics(img image.Image, mode string, width int) {
+	cols, rows := ansimage.CellSize(img.Bounds().Dx(), img.Bounds().Dy(), width/2)
+	if cols == 0 {
+		msg.buffer = []tstring.TString{}
+		return
+	}
+	if msg.graphics == "" || msg.graphicsMode != mode || msg.graphicsCols != cols || msg.graphicsRows != rows {
+		var sequence string
+		if mode == config.ImageModeKitty {
+			var err error
+			sequence, err = ansimage.EncodeKitty(img, msg.graphicsID(), cols, rows)
+			if err != nil {
+				msg.buffer = []tstring.TString{tstring.NewColorTString("Failed to display image", tcell.ColorRed)}
+				debug.Print("Failed to display image:", err)
+				return
+			}
+		} else {
+			sequence = ansimage.EncodeSixel(img, cols, rows, color.Black)
+		}
+		msg.graphics = sequence
+		msg.graphicsMode = mode
+		msg.graphicsCols = cols
+		msg.graphicsRows = rows
+	}
+	msg.useGraphics = true
+	msg.buffer = make([]tstring.TString, rows)
+	for i := range msg.buffer {
+		msg.buffer[i] = tstring.NewBlankTString()
+	}
+}
+
+// GraphicsPlacement is an image that was placed on the screen by a Draw call. Graphics protocols can't be drawn through
+// tcell, so the image has to be written to the terminal separately after the frame is shown.
+type GraphicsPlacement struct {
+	// Key identifies the image and its encoding. Placements with the same key and position are drawn identically.
+	Key string
+	// KittyID is the image ID used with the kitty graphics protocol, or zero for sixel images.
+	KittyID uint32
+	// X and Y are the position of the top left corner of the image on the terminal.
+	X, Y     int
+	Sequence string
+}
+
+// Graphics returns the image placed by the last Draw call, or nil if the image wasn't drawn with a graphics protocol.
+func (msg *FileMessage) Graphics() *GraphicsPlacement {
+	return msg.placement
+}
+
+// graphicsCellStyle is used for the blank cells under images. Italic spaces look like normal spaces, but the different
+// style makes tcell redraw the cells once they're no longer under the image, which clears any sixel leftovers.
+var graphicsCellStyle = tcell.StyleDefault.Italic(true)
+
+// absolutePosition converts a position on the given screen to a position on the terminal. ok is false if the given
+// area isn't completely visible: graphics can't be clipped like text, so images that are only partially visible
+// aren't drawn at all.
+func absolutePosition(screen mauview.Screen, x, y, width, height int) (absX, absY int, ok bool) {
+	for {
+		proxy, isProxy := screen.(*mauview.ProxyScreen)
+		if !isProxy {
+			screenWidth, screenHeight := screen.Size()
+			return x, y, x >= 0 && y >= 0 && x+width <= screenWidth && y+height <= screenHeight
+		}
+		if x < 0 || y < 0 || (proxy.Width > 0 && x+width > proxy.Width) || (proxy.Height > 0 && y+height > proxy.Height) {
+			return 0, 0, false
+		}
+		x += proxy.OffsetX
+		y += proxy.OffsetY
+		screen = proxy.Parent
+	}
+}
+
 func (msg *FileMessage) Height() int {
 	return len(msg.buffer)
 }
 
 func (msg *FileMessage) Draw(screen mauview.Screen, _ *UIMessage) {
+	msg.placement = nil
+	if msg.useGraphics {
+		x, y, ok := absolutePosition(screen, 0, 0, msg.graphicsCols, msg.graphicsRows)
+		if !ok {
+			return
+		}
+		for cellY := 0; cellY < msg.graphicsRows; cellY++ {
+			for cellX := 0; cellX < msg.graphicsCols; cellX++ {
+				screen.SetContent(cellX, cellY, ' ', nil, graphicsCellStyle)
+			}
+		}
+		msg.placement = &GraphicsPlacement{
+			Key:      fmt.Sprintf("%s/%s/%dx%d", msg.eventID, msg.graphicsMode, msg.graphicsCols, msg.graphicsRows),
+			X:        x,
+			Y:        y,
+			Sequence: msg.graphics,
+		}
+		if msg.graphicsMode == config.ImageModeKitty {
+			msg.placement.KittyID = msg.graphicsID()
+		}
+		return
+	}
 	for y, line := range msg.buffer {
 		line.Draw(screen, 0, y)
 	}
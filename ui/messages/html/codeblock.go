@@ -17,16 +17,28 @@
 package html
 
 import (
+	"github.com/mattn/go-runewidth"
+
 	"go.mau.fi/mauview"
 	"go.mau.fi/tcell"
 )
 
+// CodeBlockEntity is a preformatted block of code. It's drawn inside a box that has the language in the top border.
 type CodeBlockEntity struct {
 	*ContainerEntity
 	Background tcell.Style
+	// Text is the raw code inside the block with whitespace preserved.
+	Text string
+	// Language is the language hint from the class attribute, or an empty string if there was no hint.
+	Language string
 }
 
-func NewCodeBlockEntity(children []Entity, background tcell.Style) *CodeBlockEntity {
+const (
+	codeBlockBorderWidth  = 2
+	codeBlockBorderHeight = 1
+)
+
+func NewCodeBlockEntity(children []Entity, background tcell.Style, text, language string) *CodeBlockEntity {
 	return &CodeBlockEntity{
 		ContainerEntity: &ContainerEntity{
 			BaseEntity: &BaseEntity{
@@ -36,6 +48,8 @@ func NewCodeBlockEntity(children []Entity, background tcell.Style) *CodeBlockEnt
 			Children: children,
 		},
 		Background: background,
+		Text:       text,
+		Language:   language,
 	}
 }
 
@@ -43,12 +57,67 @@ func (ce *CodeBlockEntity) Clone() Entity {
 	return &CodeBlockEntity{
 		ContainerEntity: ce.ContainerEntity.Clone().(*ContainerEntity),
 		Background:      ce.Background,
+		Text:            ce.Text,
+		Language:        ce.Language,
 	}
 }
 
+func (ce *CodeBlockEntity) PlainText() string {
+	return ce.Text
+}
+
+// hasBorder returns whether there's enough space to draw the box around the code.
+func (ce *CodeBlockEntity) hasBorder(width int) bool {
+	return width > codeBlockBorderWidth*2+1
+}
+
+func (ce *CodeBlockEntity) CalculateBuffer(width, startX int, ctx DrawContext) int {
+	if !ce.hasBorder(width) {
+		return ce.ContainerEntity.CalculateBuffer(width, startX, ctx)
+	}
+	ce.ContainerEntity.CalculateBuffer(width-codeBlockBorderWidth*2, startX, ctx)
+	ce.height += codeBlockBorderHeight * 2
+	return ce.startX
+}
+
 func (ce *CodeBlockEntity) Draw(screen mauview.Screen, ctx DrawContext) {
 	screen.Fill(' ', ce.Background)
-	ce.ContainerEntity.Draw(screen, ctx)
+	width, _ := screen.Size()
+	if !ce.hasBorder(width) {
+		ce.ContainerEntity.Draw(screen, ctx)
+		return
+	}
+	ce.ContainerEntity.Draw(&mauview.ProxyScreen{
+		Parent:  screen,
+		OffsetX: codeBlockBorderWidth,
+		OffsetY: codeBlockBorderHeight,
+		Width:   width - codeBlockBorderWidth*2,
+		Height:  ce.height - codeBlockBorderHeight*2,
+		Style:   ce.Background,
+	}, ctx)
+
+	border := ce.Background.Foreground(tcell.ColorGray)
+	bottom := ce.height - 1
+	for x := 1; x < width-1; x++ {
+		screen.SetContent(x, 0, '─', nil, border)
+		screen.SetContent(x, bottom, '─', nil, border)
+	}
+	for y := 1; y < bottom; y++ {
+		screen.SetContent(0, y, '│', nil, border)
+		screen.SetContent(width-1, y, '│', nil, border)
+	}
+	screen.SetContent(0, 0, '┌', nil, border)
+	screen.SetContent(width-1, 0, '┐', nil, border)
+	screen.SetContent(0, bottom, '└', nil, border)
+	screen.SetContent(width-1, bottom, '┘', nil, border)
+	if len(ce.Language) > 0 {
+		label := " " + runewidth.Truncate(ce.Language, width-6, "…") + " "
+		x := 2
+		for _, char := range label {
+			screen.SetContent(x, 0, char, nil, border)
+			x += runewidth.RuneWidth(char)
+		}
+	}
 }
 
 func (ce *CodeBlockEntity) AdjustStyle(fn AdjustStyleFunc, reason AdjustStyleReason) Entity {
@@ -32,8 +32,9 @@ const (
 )
 
 type DrawContext struct {
-	IsSelected   bool
-	BareMessages bool
+	IsSelected     bool
+	RevealSpoilers bool
+	BareMessages   bool
 }
 
 type Entity interface {
@@ -0,0 +1,115 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package html
+
+import (
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/alecthomas/chroma"
+	"github.com/alecthomas/chroma/styles"
+
+	"go.mau.fi/tcell"
+	"go.mau.fi/tcell/terminfo"
+
+	"maunium.net/go/gomuks/config"
+)
+
+// DefaultCodeTheme is the chroma style used for syntax highlighting if no theme is configured.
+const DefaultCodeTheme = "solarized-dark"
+
+var (
+	colorSupportOnce      sync.Once
+	highlightingSupported bool
+)
+
+// terminalSupportsHighlighting checks if the terminal has enough colors for syntax highlighting to look reasonable.
+// With only 8 or 16 colors, the theme colors get mapped to the basic colors and the result is mostly unreadable.
+func terminalSupportsHighlighting() bool {
+	colorSupportOnce.Do(func() {
+		if colorTerm := os.Getenv("COLORTERM"); colorTerm == "truecolor" || colorTerm == "24bit" {
+			highlightingSupported = true
+			return
+		}
+		ti, err := terminfo.LookupTerminfo(os.Getenv("TERM"))
+		highlightingSupported = err == nil && ti.Colors >= 256
+	})
+	return highlightingSupported
+}
+
+// codeTheme returns the chroma style to highlight code blocks with, or nil if highlighting is disabled.
+func codeTheme(prefs *config.UserPreferences) *chroma.Style {
+	if prefs.DisableHighlighting || !terminalSupportsHighlighting() {
+		return nil
+	}
+	if style, ok := styles.Registry[strings.ToLower(prefs.CodeTheme)]; ok {
+		return style
+	}
+	return styles.Get(DefaultCodeTheme)
+}
+
+type highlightCacheKey struct {
+	text     string
+	language string
+	theme    string
+}
+
+type highlightCacheEntry struct {
+	children   []Entity
+	background tcell.Style
+}
+
+// maxHighlightCacheSize is the number of highlighted code blocks to keep in the cache. The cache is simply emptied
+// when it's full, since the same code blocks are usually parsed again in quick succession (e.g. when loading history
+// or re-rendering edits).
+const maxHighlightCacheSize = 256
+
+var (
+	highlightCache     = make(map[highlightCacheKey]highlightCacheEntry)
+	highlightCacheLock sync.Mutex
+)
+
+func cloneEntities(entities []Entity) []Entity {
+	cloned := make([]Entity, len(entities))
+	for i, entity := range entities {
+		cloned[i] = entity.Clone()
+	}
+	return cloned
+}
+
+func getCachedHighlight(key highlightCacheKey) ([]Entity, tcell.Style, bool) {
+	highlightCacheLock.Lock()
+	defer highlightCacheLock.Unlock()
+	entry, ok := highlightCache[key]
+	if !ok {
+		return nil, tcell.StyleDefault, false
+	}
+	return cloneEntities(entry.children), entry.background, true
+}
+
+func cacheHighlight(key highlightCacheKey, children []Entity, background tcell.Style) {
+	highlightCacheLock.Lock()
+	defer highlightCacheLock.Unlock()
+	if len(highlightCache) >= maxHighlightCacheSize {
+		highlightCache = make(map[highlightCacheKey]highlightCacheEntry)
+	}
+	highlightCache[key] = highlightCacheEntry{
+		children:   cloneEntities(children),
+		background: background,
+	}
+}
@@ -24,7 +24,6 @@ import (
 
 	"github.com/alecthomas/chroma"
 	"github.com/alecthomas/chroma/lexers"
-	"github.com/alecthomas/chroma/styles"
 	"github.com/lucasb-eyer/go-colorful"
 	"golang.org/x/net/html"
 	"mvdan.cc/xurls/v2"
@@ -45,8 +44,7 @@ type htmlParser struct {
 	room  *rooms.Room
 	evt   *muksevt.Event
 
-	preserveWhitespace bool
-	linkIDCounter      int
+	linkIDCounter int
 }
 
 func AdjustStyleBold(style tcell.Style) tcell.Style {
@@ -258,6 +256,13 @@ func (parser *htmlParser) imageToEntity(node *html.Node) Entity {
 		},
 		Text: alt,
 	}
+	if parser.hasAttribute(node, "data-mx-emoticon") {
+		// Custom emoticons are shown as their shortcode, which is usually the alt text already.
+		if !strings.HasPrefix(alt, ":") || !strings.HasSuffix(alt, ":") {
+			entity.Text = ":" + strings.Trim(alt, ":") + ":"
+		}
+		entity.Style = entity.Style.Foreground(tcell.ColorYellow)
+	}
 	// TODO add click action and underline on hover for inline images
 	return entity
 }
@@ -289,70 +294,193 @@ func tokenToTextEntity(style *chroma.Style, token *chroma.Token) *TextEntity {
 	}
 }
 
+// plainCodeEntities splits unhighlighted code into text and break entities.
+func plainCodeEntities(text string) (children []Entity) {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if len(line) > 0 {
+			children = append(children, NewTextEntity(line))
+		}
+		if i < len(lines)-1 {
+			children = append(children, NewBreakEntity())
+		}
+	}
+	return
+}
+
 func (parser *htmlParser) syntaxHighlight(text, language string) Entity {
+	style := codeTheme(parser.prefs)
+	if style == nil {
+		return NewCodeBlockEntity(plainCodeEntities(text), tcell.StyleDefault, text, language)
+	}
+	cacheKey := highlightCacheKey{text: text, language: language, theme: style.Name}
+	if children, background, ok := getCachedHighlight(cacheKey); ok {
+		return NewCodeBlockEntity(children, background, text, language)
+	}
+
 	lexer := lexers.Get(strings.ToLower(language))
 	if lexer == nil {
 		lexer = lexers.Get("plaintext")
 	}
 	iter, err := lexer.Tokenise(nil, text)
 	if err != nil {
-		return nil
+		return NewCodeBlockEntity(plainCodeEntities(text), tcell.StyleDefault, text, language)
 	}
-	// TODO allow changing theme
-	style := styles.SolarizedDark
 
 	tokens := iter.Tokens()
 
 	var children []Entity
 	for _, token := range tokens {
-		if token.Value == "\n" {
-			children = append(children, NewBreakEntity())
-
-		} else if token.Type.String() == "CommentSingle" {
-			children = append(children, tokenToTextEntity(style, &token))
-			children = append(children, NewBreakEntity())
-
-		} else if token.Type.String() == "CommentMultiline" {
-			lines := strings.Split(token.Value, "\n")
-			for i, line := range lines {
+		// Tokens can contain newlines anywhere (e.g. whitespace tokens that include the indentation of the next line),
+		// so split all of them into lines instead of putting newlines inside text entities.
+		lines := strings.Split(token.Value, "\n")
+		for i, line := range lines {
+			if len(line) > 0 {
 				t := token.Clone()
 				t.Value = line
 				children = append(children, tokenToTextEntity(style, &t))
+			}
+			if i < len(lines)-1 {
+				children = append(children, NewBreakEntity())
+			}
+		}
+	}
+	// The lexer always adds a newline to the end, which would show up as an empty line at the end of the block
+	for len(children) > 0 {
+		if _, isBreak := children[len(children)-1].(*BreakEntity); !isBreak {
+			break
+		}
+		children = children[:len(children)-1]
+	}
+
+	background := styleEntryToStyle(style.Get(chroma.Background))
+	cacheHighlight(cacheKey, children, background)
+	return NewCodeBlockEntity(children, background, text, language)
+}
 
-				if i < len(lines)-1 {
-					children = append(children, NewBreakEntity())
+// codeTabWidth is the number of spaces tabs in code blocks are expanded to.
+const codeTabWidth = 4
+
+// nodeText returns the text inside the given node with all whitespace preserved. Line breaks are converted to
+// newlines and all other tags are ignored.
+func nodeText(node *html.Node) string {
+	var buf strings.Builder
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		for ; node != nil; node = node.NextSibling {
+			switch node.Type {
+			case html.TextNode:
+				buf.WriteString(node.Data)
+			case html.ElementNode:
+				if node.Data == "br" {
+					buf.WriteRune('\n')
+				} else {
+					walk(node.FirstChild)
 				}
 			}
-
-		} else {
-			children = append(children, tokenToTextEntity(style, &token))
 		}
 	}
+	walk(node)
+	return buf.String()
+}
 
-	return NewCodeBlockEntity(children, styleEntryToStyle(style.Get(chroma.Background)))
+// codeLanguage finds the language hint from the class attribute of the given node.
+func (parser *htmlParser) codeLanguage(node *html.Node) string {
+	for _, class := range strings.Fields(parser.getAttribute(node, "class")) {
+		if strings.HasPrefix(class, "language-") {
+			return class[len("language-"):]
+		} else if strings.HasPrefix(class, "lang-") {
+			return class[len("lang-"):]
+		}
+	}
+	return ""
 }
 
 func (parser *htmlParser) codeblockToEntity(node *html.Node) Entity {
-	lang := "plaintext"
-	// TODO allow disabling syntax highlighting
-	if node.FirstChild != nil && node.FirstChild.Type == html.ElementNode && node.FirstChild.Data == "code" {
-		node = node.FirstChild
-		attr := parser.getAttribute(node, "class")
-		for _, class := range strings.Split(attr, " ") {
-			if strings.HasPrefix(class, "language-") {
-				lang = class[len("language-"):]
-				break
-			}
+	lang := parser.codeLanguage(node)
+	// Find the <code> tag inside the <pre>, ignoring whitespace around it
+	var code *html.Node
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == html.ElementNode && child.Data == "code" && code == nil {
+			code = child
+		} else if child.Type != html.TextNode || len(strings.TrimSpace(child.Data)) > 0 {
+			code = nil
+			break
 		}
 	}
-	parser.preserveWhitespace = true
-	text := (&ContainerEntity{
-		Children: parser.nodeToEntities(node.FirstChild),
-	}).PlainText()
-	parser.preserveWhitespace = false
+	if code != nil {
+		node = code
+		if codeLang := parser.codeLanguage(code); len(codeLang) > 0 {
+			lang = codeLang
+		}
+	}
+	text := nodeText(node.FirstChild)
+	text = strings.ReplaceAll(text, "\t", strings.Repeat(" ", codeTabWidth))
+	// A single leading newline is ignored in <pre> tags
+	text = strings.TrimPrefix(text, "\n")
+	text = strings.TrimRight(text, "\n")
 	return parser.syntaxHighlight(text, lang)
 }
 
+func (parser *htmlParser) tableCellAlign(node *html.Node) TableAlign {
+	align := strings.ToLower(parser.getAttribute(node, "align"))
+	if len(align) == 0 {
+		for _, declaration := range strings.Split(parser.getAttribute(node, "style"), ";") {
+			parts := strings.SplitN(declaration, ":", 2)
+			if len(parts) == 2 && strings.TrimSpace(strings.ToLower(parts[0])) == "text-align" {
+				align = strings.TrimSpace(strings.ToLower(parts[1]))
+			}
+		}
+	}
+	switch align {
+	case "center":
+		return TableAlignCenter
+	case "right":
+		return TableAlignRight
+	default:
+		return TableAlignLeft
+	}
+}
+
+func (parser *htmlParser) tableRowToCells(node *html.Node) (cells []TableCell) {
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type != html.ElementNode || (child.Data != "td" && child.Data != "th") {
+			continue
+		}
+		text := (&ContainerEntity{
+			Children: parser.nodeToEntities(child.FirstChild),
+		}).PlainText()
+		cells = append(cells, TableCell{
+			Text:   strings.Join(strings.Fields(text), " "),
+			Header: child.Data == "th",
+			Align:  parser.tableCellAlign(child),
+		})
+	}
+	return
+}
+
+func (parser *htmlParser) tableToEntity(node *html.Node) Entity {
+	var rows [][]TableCell
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type != html.ElementNode {
+				continue
+			}
+			switch child.Data {
+			case "thead", "tbody", "tfoot":
+				walk(child)
+			case "tr":
+				if cells := parser.tableRowToCells(child); len(cells) > 0 {
+					rows = append(rows, cells)
+				}
+			}
+		}
+	}
+	walk(node)
+	return NewTableEntity(rows)
+}
+
 func (parser *htmlParser) tagNodeToEntity(node *html.Node) Entity {
 	switch node.Data {
 	case "blockquote":
@@ -371,6 +499,8 @@ func (parser *htmlParser) tagNodeToEntity(node *html.Node) Entity {
 		return parser.imageToEntity(node)
 	case "pre":
 		return parser.codeblockToEntity(node)
+	case "table":
+		return parser.tableToEntity(node)
 	case "hr":
 		return NewHorizontalLineEntity()
 	case "mx-reply":
@@ -445,10 +575,8 @@ func TextToEntity(text string, eventID id.EventID, linkify bool) Entity {
 func (parser *htmlParser) singleNodeToEntity(node *html.Node) Entity {
 	switch node.Type {
 	case html.TextNode:
-		if !parser.preserveWhitespace {
-			node.Data = strings.ReplaceAll(node.Data, "\n", "")
-			node.Data = spaces.ReplaceAllLiteralString(node.Data, " ")
-		}
+		node.Data = strings.ReplaceAll(node.Data, "\n", "")
+		node.Data = spaces.ReplaceAllLiteralString(node.Data, " ")
 		return TextToEntity(node.Data, parser.evt.ID, parser.prefs.EnableInlineURLs())
 	case html.ElementNode:
 		parsed := parser.tagNodeToEntity(node)
@@ -66,7 +66,7 @@ func (se *SpoilerEntity) GetTag() string {
 }
 
 func (se *SpoilerEntity) Draw(screen mauview.Screen, ctx DrawContext) {
-	if ctx.IsSelected {
+	if ctx.RevealSpoilers {
 		se.visible.Draw(screen, ctx)
 	} else {
 		se.hidden.Draw(screen, ctx)
@@ -0,0 +1,229 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package html
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mattn/go-runewidth"
+
+	"go.mau.fi/mauview"
+
+	"maunium.net/go/gomuks/ui/widget"
+)
+
+type TableAlign int
+
+const (
+	TableAlignLeft TableAlign = iota
+	TableAlignCenter
+	TableAlignRight
+)
+
+type TableCell struct {
+	Text   string
+	Header bool
+	Align  TableAlign
+}
+
+// TableEntity is a table drawn inside a box with the columns aligned. Cells only contain plain text.
+type TableEntity struct {
+	*BaseEntity
+	Rows [][]TableCell
+
+	columnWidths []int
+}
+
+// tableCellPadding is the number of spaces on both sides of the cell content.
+const tableCellPadding = 1
+
+func NewTableEntity(rows [][]TableCell) *TableEntity {
+	return &TableEntity{
+		BaseEntity: &BaseEntity{
+			Tag:   "table",
+			Block: true,
+		},
+		Rows: rows,
+	}
+}
+
+func (te *TableEntity) AdjustStyle(fn AdjustStyleFunc, reason AdjustStyleReason) Entity {
+	te.BaseEntity = te.BaseEntity.AdjustStyle(fn, reason).(*BaseEntity)
+	return te
+}
+
+func (te *TableEntity) Clone() Entity {
+	rows := make([][]TableCell, len(te.Rows))
+	for i, row := range te.Rows {
+		rows[i] = make([]TableCell, len(row))
+		copy(rows[i], row)
+	}
+	return &TableEntity{
+		BaseEntity: te.BaseEntity.Clone().(*BaseEntity),
+		Rows:       rows,
+	}
+}
+
+func (te *TableEntity) IsEmpty() bool {
+	return len(te.Rows) == 0
+}
+
+func (te *TableEntity) columnCount() int {
+	count := 0
+	for _, row := range te.Rows {
+		if len(row) > count {
+			count = len(row)
+		}
+	}
+	return count
+}
+
+// hasHeaderSeparator returns whether there should be a line between the first row and the rest of the table.
+func (te *TableEntity) hasHeaderSeparator() bool {
+	if len(te.Rows) < 2 {
+		return false
+	}
+	for _, cell := range te.Rows[0] {
+		if !cell.Header {
+			return false
+		}
+	}
+	return true
+}
+
+func (te *TableEntity) CalculateBuffer(width, startX int, ctx DrawContext) int {
+	te.BaseEntity.CalculateBuffer(width, startX, ctx)
+	columns := te.columnCount()
+	te.columnWidths = make([]int, columns)
+	for _, row := range te.Rows {
+		for i, cell := range row {
+			if cellWidth := runewidth.StringWidth(cell.Text); cellWidth > te.columnWidths[i] {
+				te.columnWidths[i] = cellWidth
+			}
+		}
+	}
+	// Shrink the widest column until the table fits or all columns are one cell wide
+	available := width - (columns + 1) - columns*tableCellPadding*2
+	for {
+		total, widest := 0, 0
+		for i, columnWidth := range te.columnWidths {
+			total += columnWidth
+			if columnWidth > te.columnWidths[widest] {
+				widest = i
+			}
+		}
+		if total <= available || te.columnWidths[widest] <= 1 {
+			break
+		}
+		te.columnWidths[widest]--
+	}
+
+	te.height = len(te.Rows) + 2
+	if te.hasHeaderSeparator() {
+		te.height++
+	}
+	return te.startX
+}
+
+// drawSeparator draws a horizontal border line using the given characters for the left end, column separators and
+// the right end.
+func (te *TableEntity) drawSeparator(screen mauview.Screen, y int, left, middle, right rune) {
+	x := 0
+	screen.SetContent(x, y, left, nil, te.Style)
+	for i, columnWidth := range te.columnWidths {
+		for j := 0; j < columnWidth+tableCellPadding*2; j++ {
+			x++
+			screen.SetContent(x, y, '─', nil, te.Style)
+		}
+		x++
+		if i == len(te.columnWidths)-1 {
+			screen.SetContent(x, y, right, nil, te.Style)
+		} else {
+			screen.SetContent(x, y, middle, nil, te.Style)
+		}
+	}
+}
+
+func (te *TableEntity) drawRow(screen mauview.Screen, y int, row []TableCell) {
+	x := 0
+	screen.SetContent(x, y, '│', nil, te.Style)
+	for i, columnWidth := range te.columnWidths {
+		x += 1 + tableCellPadding
+		if i < len(row) {
+			cell := row[i]
+			text := runewidth.Truncate(cell.Text, columnWidth, "…")
+			offset := 0
+			switch cell.Align {
+			case TableAlignCenter:
+				offset = (columnWidth - runewidth.StringWidth(text)) / 2
+			case TableAlignRight:
+				offset = columnWidth - runewidth.StringWidth(text)
+			}
+			style := te.Style
+			if cell.Header {
+				style = style.Bold(true)
+			}
+			widget.WriteLine(screen, mauview.AlignLeft, text, x+offset, y, columnWidth-offset, style)
+		}
+		x += columnWidth + tableCellPadding
+		screen.SetContent(x, y, '│', nil, te.Style)
+	}
+}
+
+func (te *TableEntity) Draw(screen mauview.Screen, ctx DrawContext) {
+	if len(te.columnWidths) == 0 {
+		return
+	}
+	y := 0
+	te.drawSeparator(screen, y, '┌', '┬', '┐')
+	for i, row := range te.Rows {
+		y++
+		te.drawRow(screen, y, row)
+		if i == 0 && te.hasHeaderSeparator() {
+			y++
+			te.drawSeparator(screen, y, '├', '┼', '┤')
+		}
+	}
+	y++
+	te.drawSeparator(screen, y, '└', '┴', '┘')
+}
+
+func (te *TableEntity) PlainText() string {
+	var buf strings.Builder
+	for i, row := range te.Rows {
+		buf.WriteRune('|')
+		for _, cell := range row {
+			buf.WriteRune(' ')
+			buf.WriteString(cell.Text)
+			buf.WriteString(" |")
+		}
+		buf.WriteRune('\n')
+		if i == 0 && te.hasHeaderSeparator() {
+			buf.WriteRune('|')
+			for range row {
+				buf.WriteString(" --- |")
+			}
+			buf.WriteRune('\n')
+		}
+	}
+	return buf.String()
+}
+
+func (te *TableEntity) String() string {
+	return fmt.Sprintf("&html.TableEntity{Rows=%v, Base=%s},\n", te.Rows, te.BaseEntity)
+}
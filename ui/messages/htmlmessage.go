@@ -54,7 +54,7 @@ func (hw *HTMLMessage) Draw(screen mauview.Screen, msg *UIMessage) {
 		}, html.AdjustStyleReasonNormal)
 	}
 	screen.Clear()
-	hw.Root.Draw(screen, html.DrawContext{IsSelected: msg.IsSelected})
+	hw.Root.Draw(screen, html.DrawContext{IsSelected: msg.IsSelected, RevealSpoilers: msg.SpoilersRevealed})
 }
 
 func (hw *HTMLMessage) OnKeyEvent(event mauview.KeyEvent) bool {
@@ -77,8 +77,9 @@ func (hw *HTMLMessage) CalculateBuffer(preferences config.UserPreferences, width
 	startX := 0
 	hw.TextColor = msg.TextColor()
 	hw.Root.CalculateBuffer(width, startX, html.DrawContext{
-		IsSelected:   msg.IsSelected,
-		BareMessages: preferences.BareMessageView,
+		IsSelected:     msg.IsSelected,
+		RevealSpoilers: msg.SpoilersRevealed,
+		BareMessages:   preferences.BareMessageView,
 	})
 }
 
@@ -0,0 +1,71 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package messages
+
+import (
+	"fmt"
+
+	"go.mau.fi/tcell"
+
+	"maunium.net/go/gomuks/ui/messages/tstring"
+)
+
+// IgnoredMessage is a single line that stands in for a message from an ignored user. When expanded, the message is
+// shown below it.
+type IgnoredMessage struct {
+	*ExpandedTextMessage
+	Message  *UIMessage
+	Expanded bool
+}
+
+// NewIgnoredMessage creates the placeholder line for the given message from an ignored user.
+func NewIgnoredMessage(message *UIMessage, expanded bool) *UIMessage {
+	ignored := &IgnoredMessage{
+		Message:  message,
+		Expanded: expanded,
+	}
+	ignored.ExpandedTextMessage = &ExpandedTextMessage{Text: ignored.makeText()}
+	return &UIMessage{
+		SenderID:   "*",
+		SenderName: "---",
+		Timestamp:  message.Timestamp,
+		IsService:  true,
+		Renderer:   ignored,
+	}
+}
+
+func (im *IgnoredMessage) makeText() tstring.TString {
+	arrow, hint := "▸ ", " (click to show)"
+	if im.Expanded {
+		arrow, hint = "▾ ", " (click to hide)"
+	}
+	return tstring.NewBlankTString().
+		AppendColor(arrow+"Message from ignored user", tcell.ColorGray).
+		AppendColor(hint, tcell.ColorGray)
+}
+
+func (im *IgnoredMessage) Clone() MessageRenderer {
+	return &IgnoredMessage{
+		ExpandedTextMessage: im.ExpandedTextMessage.Clone().(*ExpandedTextMessage),
+		Message:             im.Message,
+		Expanded:            im.Expanded,
+	}
+}
+
+func (im *IgnoredMessage) String() string {
+	return fmt.Sprintf(`&messages.IgnoredMessage{Message=%s, Expanded=%t}`, im.Message.ID(), im.Expanded)
+}
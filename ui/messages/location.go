@@ -0,0 +1,97 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package messages
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"go.mau.fi/tcell"
+
+	"maunium.net/go/mautrix/event"
+
+	"maunium.net/go/gomuks/config"
+	"maunium.net/go/gomuks/matrix/muksevt"
+	"maunium.net/go/gomuks/ui/messages/html"
+)
+
+// ParseGeoURI parses the latitude and longitude from a RFC 5870 geo URI, e.g. geo:51.5008,0.1247;u=35.
+func ParseGeoURI(uri string) (lat, lon float64, ok bool) {
+	if !strings.HasPrefix(strings.ToLower(uri), "geo:") {
+		return
+	}
+	coordinates := strings.SplitN(uri[len("geo:"):], ";", 2)[0]
+	parts := strings.Split(coordinates, ",")
+	if len(parts) < 2 || len(parts) > 3 {
+		return
+	}
+	var err error
+	if lat, err = strconv.ParseFloat(parts[0], 64); err != nil {
+		return
+	} else if lon, err = strconv.ParseFloat(parts[1], 64); err != nil {
+		return
+	}
+	ok = ValidCoordinates(lat, lon)
+	return
+}
+
+// ValidCoordinates checks that the latitude and longitude are within the ranges of the WGS 84 coordinate system.
+func ValidCoordinates(lat, lon float64) bool {
+	return !math.IsNaN(lat) && !math.IsNaN(lon) && lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180
+}
+
+// FormatGeoURI makes a geo URI out of the given coordinates.
+func FormatGeoURI(lat, lon float64) string {
+	return fmt.Sprintf("geo:%s,%s", strconv.FormatFloat(lat, 'f', -1, 64), strconv.FormatFloat(lon, 'f', -1, 64))
+}
+
+// GetGeoURI returns the geo URI of a location message. The MSC3488 location block is used if the geo_uri field is
+// missing.
+func GetGeoURI(evt *muksevt.Event, content *event.MessageEventContent) string {
+	if len(content.GeoURI) > 0 {
+		return content.GeoURI
+	}
+	location, _ := evt.Content.Raw["org.matrix.msc3488.location"].(map[string]interface{})
+	uri, _ := location["uri"].(string)
+	return uri
+}
+
+func parseLocation(prefs *config.UserPreferences, evt *muksevt.Event, content *event.MessageEventContent) html.Entity {
+	uri := GetGeoURI(evt, content)
+	lat, lon, ok := ParseGeoURI(uri)
+	if !ok {
+		entity := html.NewTextEntity(fmt.Sprintf("📍 %s (invalid location %q)", content.Body, uri))
+		return entity.AdjustStyle(html.AdjustStyleTextColor(tcell.ColorRed), html.AdjustStyleReasonNormal)
+	}
+	coordinates := fmt.Sprintf("(%s, %s)", strconv.FormatFloat(lat, 'f', -1, 64), strconv.FormatFloat(lon, 'f', -1, 64))
+	text := "📍 " + coordinates
+	if description := strings.TrimSpace(content.Body); len(description) > 0 && description != uri {
+		text = fmt.Sprintf("📍 %s %s", description, coordinates)
+	}
+	link := html.NewTextEntity(uri)
+	if prefs.EnableInlineURLs() {
+		link.AdjustStyle(html.AdjustStyleLink(uri, string(evt.ID)), html.AdjustStyleReasonNormal)
+	} else {
+		link.AdjustStyle(html.AdjustStyleUnderline, html.AdjustStyleReasonNormal)
+	}
+	return &html.ContainerEntity{
+		BaseEntity: &html.BaseEntity{Tag: "span"},
+		Children:   []html.Entity{html.NewTextEntity(text), html.NewBreakEntity(), link},
+	}
+}
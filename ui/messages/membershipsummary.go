@@ -0,0 +1,144 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package messages
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mau.fi/tcell"
+
+	"maunium.net/go/gomuks/ui/messages/tstring"
+)
+
+// MembershipChange is the kind of change a member event makes. It's used to decide which events can be collapsed.
+type MembershipChange string
+
+const (
+	MembershipChangeJoin        MembershipChange = "join"
+	MembershipChangeLeave       MembershipChange = "leave"
+	MembershipChangeInvite      MembershipChange = "invite"
+	MembershipChangeKick        MembershipChange = "kick"
+	MembershipChangeBan         MembershipChange = "ban"
+	MembershipChangeUnban       MembershipChange = "unban"
+	MembershipChangeDisplayname MembershipChange = "displayname"
+	MembershipChangeAvatar      MembershipChange = "avatar"
+)
+
+// membershipSummaryVerbs are the singular and plural verbs for each kind of change, in the order they're listed in
+// the summary.
+var membershipSummaryVerbs = []struct {
+	kind             MembershipChange
+	singular, plural string
+}{
+	{MembershipChangeJoin, "joined", "joined"},
+	{MembershipChangeLeave, "left", "left"},
+	{MembershipChangeInvite, "was invited", "were invited"},
+	{MembershipChangeKick, "was kicked", "were kicked"},
+	{MembershipChangeBan, "was banned", "were banned"},
+	{MembershipChangeUnban, "was unbanned", "were unbanned"},
+	{MembershipChangeDisplayname, "changed their name", "changed their names"},
+	{MembershipChangeAvatar, "changed their avatar", "changed their avatars"},
+}
+
+// MembershipSummary is a single line that stands in for a run of consecutive membership events. When expanded, the
+// events are shown below the summary line.
+type MembershipSummary struct {
+	*ExpandedTextMessage
+	Messages []*UIMessage
+	Expanded bool
+}
+
+// NewMembershipSummaryMessage creates the summary line for the given membership events.
+func NewMembershipSummaryMessage(group []*UIMessage, expanded bool) *UIMessage {
+	summary := &MembershipSummary{
+		Messages: group,
+		Expanded: expanded,
+	}
+	summary.ExpandedTextMessage = &ExpandedTextMessage{Text: summary.makeText()}
+	return &UIMessage{
+		SenderID:   "*",
+		SenderName: "---",
+		Timestamp:  group[0].Timestamp,
+		IsService:  true,
+		Renderer:   summary,
+	}
+}
+
+// countUsers counts the distinct users affected by each kind of change.
+func (ms *MembershipSummary) countUsers() map[MembershipChange]int {
+	users := make(map[MembershipChange]map[string]struct{})
+	for _, msg := range ms.Messages {
+		user := string(msg.SenderID)
+		if msg.Event != nil && msg.Event.StateKey != nil {
+			user = *msg.Event.StateKey
+		}
+		if users[msg.MembershipChange] == nil {
+			users[msg.MembershipChange] = make(map[string]struct{})
+		}
+		users[msg.MembershipChange][user] = struct{}{}
+	}
+	counts := make(map[MembershipChange]int, len(users))
+	for kind, set := range users {
+		counts[kind] = len(set)
+	}
+	return counts
+}
+
+func (ms *MembershipSummary) makeText() tstring.TString {
+	counts := ms.countUsers()
+	parts := make([]string, 0, len(counts))
+	for _, verb := range membershipSummaryVerbs {
+		count, ok := counts[verb.kind]
+		if !ok {
+			continue
+		}
+		text := verb.plural
+		if count == 1 {
+			text = verb.singular
+		}
+		if len(parts) == 0 {
+			users := "users"
+			if count == 1 {
+				users = "user"
+			}
+			parts = append(parts, fmt.Sprintf("%d %s %s", count, users, text))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d %s", count, text))
+		}
+	}
+	arrow, hint := "▸ ", " (click to expand)"
+	if ms.Expanded {
+		arrow, hint = "▾ ", " (click to collapse)"
+	}
+	return tstring.NewBlankTString().
+		AppendColor(arrow+strings.Join(parts, ", "), tcell.ColorGreen).
+		AppendColor(hint, tcell.ColorGray)
+}
+
+func (ms *MembershipSummary) Clone() MessageRenderer {
+	return &MembershipSummary{
+		ExpandedTextMessage: ms.ExpandedTextMessage.Clone().(*ExpandedTextMessage),
+		Messages:            ms.Messages,
+		Expanded:            ms.Expanded,
+	}
+}
+
+func (ms *MembershipSummary) String() string {
+	return fmt.Sprintf(`&messages.MembershipSummary{Messages=%d, Expanded=%t, Text="%s"}`,
+		len(ms.Messages), ms.Expanded, ms.Text.String())
+}
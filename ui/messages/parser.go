@@ -50,6 +50,7 @@ func ParseEvent(matrix ifc.MatrixContainer, mainView ifc.MainView, room *rooms.R
 	if msg == nil {
 		return nil
 	}
+	msg.SetReactions(evt, matrix.Client().UserID)
 	if content, ok := evt.Content.Parsed.(*event.MessageEventContent); ok && len(content.GetReplyTo()) > 0 {
 		if replyToMsg := getCachedEvent(mainView, room.ID, content.GetReplyTo()); replyToMsg != nil {
 			msg.ReplyTo = replyToMsg.Clone()
@@ -63,6 +64,15 @@ func ParseEvent(matrix ifc.MatrixContainer, mainView ifc.MainView, room *rooms.R
 		} else {
 			// TODO add unknown reply header
 		}
+	} else if msg.Relation.Type == muksevt.RelThread {
+		if rootMsg := getCachedEvent(mainView, room.ID, msg.Relation.EventID); rootMsg != nil {
+			msg.ReplyTo = rootMsg.Clone()
+		} else if rootEvt, _ := matrix.GetEvent(room, msg.Relation.EventID); rootEvt != nil {
+			if rootMsg = directParseEvent(matrix, room, rootEvt); rootMsg != nil {
+				msg.ReplyTo = rootMsg
+				msg.ReplyTo.Reactions = nil
+			}
+		}
 	}
 	return msg
 }
@@ -86,7 +96,8 @@ func directParseEvent(matrix ifc.MatrixContainer, room *rooms.Room, evt *muksevt
 		return NewExpandedTextMessage(evt, displayname, tstring.NewStyleTString(content.Reason, tcell.StyleDefault.Italic(true)))
 	case *muksevt.EncryptionUnsupportedContent:
 		return NewExpandedTextMessage(evt, displayname, tstring.NewStyleTString("gomuks not built with encryption support", tcell.StyleDefault.Italic(true)))
-	case *event.TopicEventContent, *event.RoomNameEventContent, *event.CanonicalAliasEventContent:
+	case *event.TopicEventContent, *event.RoomNameEventContent, *event.CanonicalAliasEventContent, *event.TombstoneEventContent,
+		*event.PinnedEventsEventContent:
 		return ParseStateEvent(evt, displayname)
 	case *event.MemberEventContent:
 		return ParseMembershipEvent(room, evt)
@@ -137,6 +148,22 @@ NewLoop:
 	return
 }
 
+// countPinChanges counts how many event IDs were added to and removed from the pinned messages.
+func countPinChanges(newList, oldList []id.EventID) (added, removed int) {
+	oldSet := make(map[id.EventID]struct{}, len(oldList))
+	for _, eventID := range oldList {
+		oldSet[eventID] = struct{}{}
+	}
+	for _, eventID := range newList {
+		if _, ok := oldSet[eventID]; ok {
+			delete(oldSet, eventID)
+		} else {
+			added++
+		}
+	}
+	return added, len(oldSet)
+}
+
 func ParseStateEvent(evt *muksevt.Event, displayname string) *UIMessage {
 	text := tstring.NewColorTString(displayname, widget.GetHashColor(evt.Sender)).Append(" ")
 	switch content := evt.Content.Parsed.(type) {
@@ -156,6 +183,34 @@ func ParseStateEvent(evt *muksevt.Event, displayname string) *UIMessage {
 				AppendStyle(content.Name, tcell.StyleDefault.Underline(true)).
 				AppendColor(".", tcell.ColorGreen)
 		}
+	case *event.TombstoneEventContent:
+		text = text.AppendColor("upgraded this room. The conversation continues in ", tcell.ColorRed).
+			AppendStyle(string(content.ReplacementRoom), tcell.StyleDefault.Underline(true)).
+			AppendColor(".", tcell.ColorRed)
+		if len(content.Body) > 0 {
+			text = text.AppendColor(" "+content.Body, tcell.ColorRed)
+		}
+	case *event.PinnedEventsEventContent:
+		prevContent := &event.PinnedEventsEventContent{}
+		if evt.Unsigned.PrevContent != nil {
+			_ = evt.Unsigned.PrevContent.ParseRaw(evt.Type)
+			prevContent = evt.Unsigned.PrevContent.AsPinnedEvents()
+		}
+		added, removed := countPinChanges(content.Pinned, prevContent.Pinned)
+		switch {
+		case added == 0 && removed == 0:
+			text = text.AppendColor("updated the pinned messages.", tcell.ColorGreen)
+		case added == 1 && removed == 0:
+			text = text.AppendColor("pinned a message.", tcell.ColorGreen)
+		case added == 0 && removed == 1:
+			text = text.AppendColor("unpinned a message.", tcell.ColorGreen)
+		case removed == 0:
+			text = text.AppendColor(fmt.Sprintf("pinned %d messages.", added), tcell.ColorGreen)
+		case added == 0:
+			text = text.AppendColor(fmt.Sprintf("unpinned %d messages.", removed), tcell.ColorGreen)
+		default:
+			text = text.AppendColor(fmt.Sprintf("pinned %d and unpinned %d messages.", added, removed), tcell.ColorGreen)
+		}
 	case *event.CanonicalAliasEventContent:
 		prevContent := &event.CanonicalAliasEventContent{}
 		if evt.Unsigned.PrevContent != nil {
@@ -195,11 +250,18 @@ func ParseMessage(matrix ifc.MatrixContainer, room *rooms.Room, evt *muksevt.Eve
 	content := evt.Content.AsMessage()
 	if len(content.GetReplyTo()) > 0 {
 		content.RemoveReplyFallback()
+	} else if content.RelatesTo != nil && content.RelatesTo.Type == muksevt.RelThread &&
+		content.Format == event.FormatHTML && strings.HasPrefix(content.FormattedBody, "<mx-reply>") {
+		// Thread messages only have a reply fallback for clients that don't support threads
+		content.FormattedBody = event.TrimReplyFallbackHTML(content.FormattedBody)
+		content.Body = event.TrimReplyFallbackText(content.Body)
 	}
+	edited := false
 	if len(evt.Gomuks.Edits) > 0 {
 		newContent := evt.Gomuks.Edits[len(evt.Gomuks.Edits)-1].Content.AsMessage().NewContent
 		if newContent != nil {
 			content = newContent
+			edited = true
 		}
 	}
 	switch content.MsgType {
@@ -218,7 +280,18 @@ func ParseMessage(matrix ifc.MatrixContainer, room *rooms.Room, evt *muksevt.Eve
 			htmlEntity = html.NewTextEntity("Blank message")
 			htmlEntity.AdjustStyle(html.AdjustStyleTextColor(tcell.ColorRed), html.AdjustStyleReasonNormal)
 		}
+		if edited {
+			htmlEntity = &html.ContainerEntity{
+				BaseEntity: &html.BaseEntity{Tag: "span"},
+				Children: []html.Entity{
+					htmlEntity,
+					html.NewTextEntity(" (edited)").AdjustStyle(html.AdjustStyleTextColor(tcell.ColorGray), html.AdjustStyleReasonNormal),
+				},
+			}
+		}
 		return NewHTMLMessage(evt, displayname, htmlEntity)
+	case event.MsgLocation:
+		return NewHTMLMessage(evt, displayname, parseLocation(matrix.Preferences(), evt, content))
 	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile:
 		msg := NewFileMessage(matrix, evt, displayname)
 		if !matrix.Preferences().DisableDownloads {
@@ -230,15 +303,17 @@ func ParseMessage(matrix ifc.MatrixContainer, room *rooms.Room, evt *muksevt.Eve
 	return nil
 }
 
-func getMembershipChangeMessage(evt *muksevt.Event, content *event.MemberEventContent, prevMembership event.Membership, senderDisplayname, displayname, prevDisplayname string) (sender string, text tstring.TString) {
+func getMembershipChangeMessage(evt *muksevt.Event, content *event.MemberEventContent, prevMembership event.Membership, senderDisplayname, displayname, prevDisplayname string) (sender string, kind MembershipChange, text tstring.TString) {
 	switch content.Membership {
 	case "invite":
 		sender = "---"
+		kind = MembershipChangeInvite
 		text = tstring.NewColorTString(fmt.Sprintf("%s invited %s.", senderDisplayname, displayname), tcell.ColorGreen)
 		text.Colorize(0, len(senderDisplayname), widget.GetHashColor(evt.Sender))
 		text.Colorize(len(senderDisplayname)+len(" invited "), len(displayname), widget.GetHashColor(evt.StateKey))
 	case "join":
 		sender = "-->"
+		kind = MembershipChangeJoin
 		if prevMembership == event.MembershipInvite {
 			text = tstring.NewColorTString(fmt.Sprintf("%s accepted the invite.", displayname), tcell.ColorGreen)
 		} else {
@@ -247,11 +322,14 @@ func getMembershipChangeMessage(evt *muksevt.Event, content *event.MemberEventCo
 		text.Colorize(0, len(displayname), widget.GetHashColor(evt.StateKey))
 	case "leave":
 		sender = "<--"
+		kind = MembershipChangeLeave
 		if evt.Sender != id.UserID(*evt.StateKey) {
 			if prevMembership == event.MembershipBan {
+				kind = MembershipChangeUnban
 				text = tstring.NewColorTString(fmt.Sprintf("%s unbanned %s", senderDisplayname, displayname), tcell.ColorGreen)
 				text.Colorize(len(senderDisplayname)+len(" unbanned "), len(displayname), widget.GetHashColor(evt.StateKey))
 			} else {
+				kind = MembershipChangeKick
 				text = tstring.NewColorTString(fmt.Sprintf("%s kicked %s: %s", senderDisplayname, displayname, content.Reason), tcell.ColorRed)
 				text.Colorize(len(senderDisplayname)+len(" kicked "), len(displayname), widget.GetHashColor(evt.StateKey))
 			}
@@ -268,6 +346,7 @@ func getMembershipChangeMessage(evt *muksevt.Event, content *event.MemberEventCo
 			text.Colorize(0, len(displayname), widget.GetHashColor(evt.StateKey))
 		}
 	case "ban":
+		kind = MembershipChangeBan
 		text = tstring.NewColorTString(fmt.Sprintf("%s banned %s: %s", senderDisplayname, displayname, content.Reason), tcell.ColorRed)
 		text.Colorize(len(senderDisplayname)+len(" banned "), len(displayname), widget.GetHashColor(evt.StateKey))
 		text.Colorize(0, len(senderDisplayname), widget.GetHashColor(evt.Sender))
@@ -275,7 +354,7 @@ func getMembershipChangeMessage(evt *muksevt.Event, content *event.MemberEventCo
 	return
 }
 
-func getMembershipEventContent(room *rooms.Room, evt *muksevt.Event) (sender string, text tstring.TString) {
+func getMembershipEventContent(room *rooms.Room, evt *muksevt.Event) (sender string, kind MembershipChange, text tstring.TString) {
 	member := room.GetMember(evt.Sender)
 	senderDisplayname := string(evt.Sender)
 	if member != nil {
@@ -290,35 +369,50 @@ func getMembershipEventContent(room *rooms.Room, evt *muksevt.Event) (sender str
 
 	prevMembership := event.MembershipLeave
 	prevDisplayname := *evt.StateKey
+	var prevAvatarURL id.ContentURIString
 	if evt.Unsigned.PrevContent != nil {
 		_ = evt.Unsigned.PrevContent.ParseRaw(evt.Type)
 		prevContent := evt.Unsigned.PrevContent.AsMember()
 		prevMembership = prevContent.Membership
 		prevDisplayname = prevContent.Displayname
+		prevAvatarURL = prevContent.AvatarURL
 		if len(prevDisplayname) == 0 {
 			prevDisplayname = *evt.StateKey
 		}
 	}
 
 	if content.Membership != prevMembership {
-		sender, text = getMembershipChangeMessage(evt, content, prevMembership, senderDisplayname, displayname, prevDisplayname)
+		sender, kind, text = getMembershipChangeMessage(evt, content, prevMembership, senderDisplayname, displayname, prevDisplayname)
 	} else if displayname != prevDisplayname {
 		sender = "---"
+		kind = MembershipChangeDisplayname
 		color := widget.GetHashColor(evt.StateKey)
 		text = tstring.NewBlankTString().
 			AppendColor(prevDisplayname, color).
 			AppendColor(" changed their display name to ", tcell.ColorGreen).
 			AppendColor(displayname, color).
 			AppendColor(".", tcell.ColorGreen)
+	} else if content.AvatarURL != prevAvatarURL {
+		sender = "---"
+		kind = MembershipChangeAvatar
+		action := " changed their avatar."
+		if len(content.AvatarURL) == 0 {
+			action = " removed their avatar."
+		}
+		text = tstring.NewBlankTString().
+			AppendColor(displayname, widget.GetHashColor(evt.StateKey)).
+			AppendColor(action, tcell.ColorGreen)
 	}
 	return
 }
 
 func ParseMembershipEvent(room *rooms.Room, evt *muksevt.Event) *UIMessage {
-	displayname, text := getMembershipEventContent(room, evt)
+	displayname, kind, text := getMembershipEventContent(room, evt)
 	if len(text) == 0 {
 		return nil
 	}
 
-	return NewExpandedTextMessage(evt, displayname, text)
+	msg := NewExpandedTextMessage(evt, displayname, text)
+	msg.MembershipChange = kind
+	return msg
 }
@@ -0,0 +1,69 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package messages
+
+import (
+	"strings"
+	"time"
+
+	"github.com/mattn/go-runewidth"
+
+	"go.mau.fi/tcell"
+
+	"maunium.net/go/gomuks/config"
+	"maunium.net/go/gomuks/ui/messages/tstring"
+)
+
+const readMarkerLabel = "── New messages "
+
+// ReadMarker is the divider line shown after the message that the user has fully read.
+type ReadMarker struct {
+	*ExpandedTextMessage
+}
+
+// NewReadMarkerMessage creates the divider line for the fully read marker.
+func NewReadMarkerMessage(timestamp time.Time) *UIMessage {
+	return &UIMessage{
+		SenderID:   "*",
+		SenderName: "---",
+		Timestamp:  timestamp,
+		IsService:  true,
+		Renderer: &ReadMarker{
+			ExpandedTextMessage: &ExpandedTextMessage{Text: tstring.NewColorTString(readMarkerLabel, tcell.ColorRed)},
+		},
+	}
+}
+
+// CalculateBuffer fills the line to the full width of the message area.
+func (rm *ReadMarker) CalculateBuffer(prefs config.UserPreferences, width int, uiMsg *UIMessage) {
+	line := readMarkerLabel
+	if rest := width - runewidth.StringWidth(line); rest > 0 {
+		line += strings.Repeat("─", rest)
+	}
+	rm.Text = tstring.NewColorTString(line, tcell.ColorRed)
+	rm.ExpandedTextMessage.CalculateBuffer(prefs, width, uiMsg)
+}
+
+func (rm *ReadMarker) Clone() MessageRenderer {
+	return &ReadMarker{
+		ExpandedTextMessage: rm.ExpandedTextMessage.Clone().(*ExpandedTextMessage),
+	}
+}
+
+func (rm *ReadMarker) String() string {
+	return "&messages.ReadMarker{}"
+}
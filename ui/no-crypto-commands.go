@@ -26,21 +26,52 @@ func autocompleteUser(cmd *CommandAutocomplete) ([]string, string) {
 	return []string{}, ""
 }
 
+func autocompleteOwnDevice(cmd *CommandAutocomplete) ([]string, string) {
+	return []string{}, ""
+}
+
+func autocompleteSSSS(cmd *CommandAutocomplete) ([]string, string) {
+	return []string{}, ""
+}
+
+func pendingVerificationCount() int {
+	return 0
+}
+
+func (view *MainView) setupVerificationInbox() {}
+
+func (view *MainView) loadSavedCrossSigningKeys() {}
+
 func cmdNoCrypto(cmd *Command) {
 	cmd.Reply("This gomuks was built without encryption support")
 }
 
 var (
+	cmdFingerprint    = cmdNoCrypto
+	cmdDeleteDevice   = cmdNoCrypto
+	cmdWhoami         = cmdNoCrypto
 	cmdDevices        = cmdNoCrypto
 	cmdDevice         = cmdNoCrypto
 	cmdVerifyDevice   = cmdNoCrypto
 	cmdVerify         = cmdNoCrypto
+	cmdOlmSessions    = cmdNoCrypto
+	cmdVerifyPhrase   = cmdNoCrypto
 	cmdUnverify       = cmdNoCrypto
 	cmdBlacklist      = cmdNoCrypto
 	cmdResetSession   = cmdNoCrypto
 	cmdImportKeys     = cmdNoCrypto
+	cmdVerifyExport   = cmdNoCrypto
 	cmdExportKeys     = cmdNoCrypto
 	cmdExportRoomKeys = cmdNoCrypto
+	cmdImportTrust    = cmdNoCrypto
+	cmdExportTrust    = cmdNoCrypto
 	cmdSSSS           = cmdNoCrypto
 	cmdCrossSigning   = cmdNoCrypto
+	cmdCrypto         = cmdNoCrypto
+	cmdKeyBackup      = cmdNoCrypto
+	cmdKeyRequests    = cmdNoCrypto
+	cmdKeyRequest     = cmdNoCrypto
+	cmdDecrypt        = cmdNoCrypto
+	cmdUndecryptable  = cmdNoCrypto
+	cmdImportBackup   = cmdNoCrypto
 )
@@ -24,6 +24,16 @@ import (
 	"go.mau.fi/tcell"
 )
 
+const (
+	defaultPassphrasePlaceholder = "correct horse battery staple"
+	recoveryKeyPlaceholder       = "tDAK LMRH PiYE bdzi maCe xLX5 wV6P Nmfd c5mC wLef 15Fs VVSc"
+)
+
+// modalParent is a view that password modals can be shown on.
+type modalParent interface {
+	HideModal()
+}
+
 type PasswordModal struct {
 	mauview.Component
 
@@ -41,7 +51,12 @@ type PasswordModal struct {
 	cancel *mauview.Button
 	submit *mauview.Button
 
-	parent *MainView
+	// The status and toggle are only used by AskPassphraseOrRecoveryKey
+	status          *mauview.TextField
+	toggle          *mauview.Button
+	recoveryKeyMode bool
+
+	parent modalParent
 }
 
 func (view *MainView) AskPassword(title, thing, placeholder string, isNew bool) (string, bool) {
@@ -51,9 +66,26 @@ func (view *MainView) AskPassword(title, thing, placeholder string, isNew bool)
 	return pwm.Wait()
 }
 
-func NewPasswordModal(parent *MainView, title, thing, placeholder string, isNew bool) *PasswordModal {
+// AskPassphraseOrRecoveryKey asks for a passphrase, with a button to switch to entering the recovery key instead.
+// The status is shown under the input field, e.g. to explain why the modal was opened again. The second return value
+// tells whether the input is a recovery key.
+func (view *MainView) AskPassphraseOrRecoveryKey(title, status string, recoveryKey bool) (string, bool, bool) {
+	pwm := newPasswordModal(view, title, "passphrase", "", false, true)
+	pwm.status.SetText(status)
+	pwm.setRecoveryKeyMode(recoveryKey)
+	view.ShowModal(pwm)
+	view.parent.Render()
+	text, ok := pwm.Wait()
+	return text, pwm.recoveryKeyMode, ok
+}
+
+func NewPasswordModal(parent modalParent, title, thing, placeholder string, isNew bool) *PasswordModal {
+	return newPasswordModal(parent, title, thing, placeholder, isNew, false)
+}
+
+func newPasswordModal(parent modalParent, title, thing, placeholder string, isNew, recoveryKeyToggle bool) *PasswordModal {
 	if placeholder == "" {
-		placeholder = "correct horse battery staple"
+		placeholder = defaultPassphrasePlaceholder
 	}
 	if thing == "" {
 		thing = strings.ToLower(title)
@@ -96,6 +128,14 @@ func NewPasswordModal(parent *MainView, title, thing, placeholder string, isNew
 		pwm.form.SetRow(3, 1).SetRow(4, 1).SetRow(5, 1)
 		pwm.form.AddComponent(pwm.confirmText, 1, 4, 3, 1)
 		pwm.form.AddFormItem(pwm.confirmInput, 1, 5, 3, 1)
+	} else if recoveryKeyToggle {
+		height += 2
+		pwm.status = mauview.NewTextField()
+		pwm.toggle = mauview.NewButton("Use recovery key instead").SetOnClick(pwm.ClickToggle)
+
+		pwm.form.SetRow(3, 1).SetRow(4, 1)
+		pwm.form.AddComponent(pwm.status, 1, 3, 3, 1)
+		pwm.form.AddFormItem(pwm.toggle, 1, 4, 3, 1)
 	}
 
 	pwm.cancel = mauview.NewButton("Cancel").SetOnClick(pwm.ClickCancel)
@@ -121,6 +161,25 @@ func (pwm *PasswordModal) HandleChange(_ string) {
 	}
 }
 
+func (pwm *PasswordModal) setRecoveryKeyMode(recoveryKey bool) {
+	pwm.recoveryKeyMode = recoveryKey
+	pwm.input.SetText("")
+	if recoveryKey {
+		pwm.text.SetText("Enter the recovery key")
+		pwm.input.SetPlaceholder(recoveryKeyPlaceholder)
+		pwm.toggle.SetText("Use passphrase instead")
+	} else {
+		pwm.text.SetText("Enter the passphrase")
+		pwm.input.SetPlaceholder(defaultPassphrasePlaceholder)
+		pwm.toggle.SetText("Use recovery key instead")
+	}
+}
+
+func (pwm *PasswordModal) ClickToggle() {
+	pwm.status.SetText("")
+	pwm.setRecoveryKeyMode(!pwm.recoveryKeyMode)
+}
+
 func (pwm *PasswordModal) ClickCancel() {
 	pwm.parent.HideModal()
 	pwm.cancelChan <- struct{}{}
@@ -0,0 +1,194 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/mauview"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/config"
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+// PinnedMessagesModal lists the pinned messages of a room. Confirming a message jumps to it in the timeline.
+type PinnedMessagesModal struct {
+	mauview.Component
+
+	container *mauview.Box
+
+	list   *mauview.TextView
+	status *mauview.TextField
+
+	room     *rooms.Room
+	eventIDs []id.EventID
+	selected int
+
+	parent *MainView
+}
+
+// NewPinnedMessagesModal creates a modal for the given pinned event IDs. The messages themselves are fetched by Load.
+func NewPinnedMessagesModal(parent *MainView, room *rooms.Room, eventIDs []id.EventID, width, height int) *PinnedMessagesModal {
+	pmm := &PinnedMessagesModal{
+		parent:   parent,
+		room:     room,
+		eventIDs: eventIDs,
+	}
+
+	pmm.list = mauview.NewTextView().SetRegions(true)
+	pmm.status = mauview.NewTextField()
+	pmm.status.SetText(fmt.Sprintf("Loading %d pinned messages...", len(eventIDs)))
+
+	flex := mauview.NewFlex().
+		SetDirection(mauview.FlexRow).
+		AddProportionalComponent(pmm.list, 1).
+		AddFixedComponent(pmm.status, 1)
+
+	pmm.container = mauview.NewBox(flex).
+		SetBorder(true).
+		SetTitle(fmt.Sprintf("Pinned messages in %s", room.GetTitle())).
+		SetBlurCaptureFunc(func() bool {
+			pmm.parent.HideModal()
+			return true
+		})
+
+	pmm.Component = mauview.Center(pmm.container, width, height).SetAlwaysFocusChild(true)
+
+	return pmm
+}
+
+func (pmm *PinnedMessagesModal) Focus() {
+	pmm.container.Focus()
+}
+
+func (pmm *PinnedMessagesModal) Blur() {
+	pmm.container.Blur()
+}
+
+// getEvent fetches a pinned message, decrypting it if necessary.
+func (pmm *PinnedMessagesModal) getEvent(eventID id.EventID) (*event.Event, error) {
+	evt, err := pmm.parent.matrix.GetEvent(pmm.room, eventID)
+	if err != nil {
+		return nil, err
+	}
+	if evt.Type == event.EventEncrypted {
+		if crypto := pmm.parent.matrix.Crypto(); crypto != nil {
+			decrypted, err := crypto.DecryptMegolmEvent(evt.Event)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decrypt: %w", err)
+			}
+			return decrypted, nil
+		}
+	}
+	return evt.Event, nil
+}
+
+func (pmm *PinnedMessagesModal) formatEvent(evt *event.Event) string {
+	body, _ := evt.Content.Raw["body"].(string)
+	if evt.Unsigned.RedactedBecause != nil {
+		body = "[redacted]"
+	} else if len(body) == 0 {
+		body = evt.Type.Type
+	}
+	body = escapeTextViewTags(strings.ReplaceAll(body, "\n", " "))
+	timestamp := time.Unix(evt.Timestamp/1000, evt.Timestamp%1000*int64(time.Millisecond))
+	sender := string(evt.Sender)
+	if member := pmm.room.GetMember(evt.Sender); member != nil {
+		sender = member.Displayname
+	}
+	return fmt.Sprintf("%s <%s> %s", timestamp.Format("2006-01-02 15:04"), escapeTextViewTags(sender), body)
+}
+
+// Load fetches the pinned messages and adds them to the list. The most recently pinned message is shown first.
+func (pmm *PinnedMessagesModal) Load() {
+	defer debug.Recover()
+	for i := len(pmm.eventIDs) - 1; i >= 0; i-- {
+		eventID := pmm.eventIDs[i]
+		line := fmt.Sprintf("%s (failed to load)", eventID)
+		evt, err := pmm.getEvent(eventID)
+		if err != nil {
+			debug.Printf("Failed to load pinned message %s: %v", eventID, err)
+		} else {
+			line = pmm.formatEvent(evt)
+		}
+		fmt.Fprintf(pmm.list, `["%d"]%s[""]%s`, i, line, "\n")
+		if i == len(pmm.eventIDs)-1 {
+			pmm.selectMessage(i)
+		}
+		pmm.parent.parent.Render()
+	}
+	pmm.status.SetText(fmt.Sprintf("%d pinned messages, press enter to jump to one", len(pmm.eventIDs)))
+	pmm.parent.parent.Render()
+}
+
+func (pmm *PinnedMessagesModal) selectMessage(index int) {
+	if len(pmm.eventIDs) == 0 {
+		return
+	}
+	pmm.selected = (index + len(pmm.eventIDs)) % len(pmm.eventIDs)
+	pmm.list.Highlight(strconv.Itoa(pmm.selected))
+	pmm.list.ScrollToHighlight()
+}
+
+func (pmm *PinnedMessagesModal) jumpToSelected() {
+	if len(pmm.eventIDs) == 0 {
+		return
+	}
+	eventID := pmm.eventIDs[pmm.selected]
+	go func() {
+		defer debug.Recover()
+		err := pmm.parent.JumpToEvent(pmm.room.ID, eventID, "")
+		if err != nil {
+			if roomView := pmm.parent.currentRoom; roomView != nil {
+				roomView.AddServiceMessage(fmt.Sprintf("Failed to jump to pinned message %s: %v", eventID, err))
+			}
+			pmm.parent.parent.Render()
+		}
+	}()
+}
+
+func (pmm *PinnedMessagesModal) OnKeyEvent(event mauview.KeyEvent) bool {
+	kb := config.Keybind{
+		Key: event.Key(),
+		Ch:  event.Rune(),
+		Mod: event.Modifiers(),
+	}
+	// The list is shown newest first, so moving down goes to older pins.
+	switch pmm.parent.config.Keybindings.Modal[kb] {
+	case "cancel":
+		pmm.parent.HideModal()
+		return true
+	case "select_next":
+		pmm.selectMessage(pmm.selected - 1)
+		return true
+	case "select_prev":
+		pmm.selectMessage(pmm.selected + 1)
+		return true
+	case "confirm":
+		pmm.parent.HideModal()
+		pmm.jumpToSelected()
+		return true
+	}
+	return pmm.list.OnKeyEvent(event)
+}
@@ -0,0 +1,185 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.mau.fi/mauview"
+
+	"maunium.net/go/mautrix/event"
+
+	"maunium.net/go/gomuks/config"
+	"maunium.net/go/gomuks/matrix/muksevt"
+)
+
+// quotableLines returns the lines of the message that can be quoted in a reply. Edits are taken into account and the
+// reply fallback of the message itself is left out.
+func quotableLines(evt *muksevt.Event) []string {
+	content := evt.Content.AsMessage()
+	if len(evt.Gomuks.Edits) > 0 {
+		if newContent := evt.Gomuks.Edits[len(evt.Gomuks.Edits)-1].Content.AsMessage().NewContent; newContent != nil {
+			content = newContent
+		}
+	}
+	body := content.Body
+	if len(content.GetReplyTo()) > 0 {
+		body = event.TrimReplyFallbackText(body)
+	}
+	body = strings.TrimSpace(body)
+	if len(body) == 0 {
+		return nil
+	}
+	return strings.Split(body, "\n")
+}
+
+// QuoteSelectModal lets the user pick a range of lines from a message to quote in a reply. The first confirm sets
+// the first line of the quote and the second one the last line.
+type QuoteSelectModal struct {
+	mauview.Component
+
+	container *mauview.Box
+
+	list   *mauview.TextView
+	status *mauview.TextField
+
+	room  *RoomView
+	evt   *muksevt.Event
+	lines []string
+	// text is sent as the reply right away after the quote is selected, if it's not empty.
+	text string
+
+	cursor int
+	start  int
+
+	parent *MainView
+}
+
+func NewQuoteSelectModal(room *RoomView, evt *muksevt.Event, text string, width, height int) *QuoteSelectModal {
+	qsm := &QuoteSelectModal{
+		parent: room.parent,
+		room:   room,
+		evt:    evt,
+		lines:  quotableLines(evt),
+		text:   text,
+		start:  -1,
+	}
+
+	qsm.list = mauview.NewTextView().SetRegions(true)
+	for i, line := range qsm.lines {
+		fmt.Fprintf(qsm.list, `["%d"]%s[""]%s`, i, escapeTextViewTags(line), "\n")
+	}
+	qsm.status = mauview.NewTextField()
+
+	flex := mauview.NewFlex().
+		SetDirection(mauview.FlexRow).
+		AddProportionalComponent(qsm.list, 1).
+		AddFixedComponent(qsm.status, 1)
+
+	qsm.container = mauview.NewBox(flex).
+		SetBorder(true).
+		SetTitle(fmt.Sprintf("Quote a part of the message from %s", evt.Sender)).
+		SetBlurCaptureFunc(func() bool {
+			qsm.parent.HideModal()
+			return true
+		})
+
+	qsm.Component = mauview.Center(qsm.container, width, height).SetAlwaysFocusChild(true)
+
+	qsm.update()
+	return qsm
+}
+
+func (qsm *QuoteSelectModal) Focus() {
+	qsm.container.Focus()
+}
+
+func (qsm *QuoteSelectModal) Blur() {
+	qsm.container.Blur()
+}
+
+// selection returns the first and last line of the current selection.
+func (qsm *QuoteSelectModal) selection() (first, last int) {
+	if qsm.start < 0 {
+		return qsm.cursor, qsm.cursor
+	} else if qsm.start > qsm.cursor {
+		return qsm.cursor, qsm.start
+	}
+	return qsm.start, qsm.cursor
+}
+
+func (qsm *QuoteSelectModal) update() {
+	first, last := qsm.selection()
+	regions := make([]string, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		regions = append(regions, strconv.Itoa(i))
+	}
+	qsm.list.Highlight(regions...)
+	qsm.list.ScrollToHighlight()
+	if qsm.start < 0 {
+		qsm.status.SetText("Select the first line to quote and press enter")
+	} else {
+		qsm.status.SetText(fmt.Sprintf("Quoting %d lines, press enter on the last line", last-first+1))
+	}
+}
+
+func (qsm *QuoteSelectModal) moveCursor(diff int) {
+	if len(qsm.lines) == 0 {
+		return
+	}
+	qsm.cursor = (qsm.cursor + diff + len(qsm.lines)) % len(qsm.lines)
+	qsm.update()
+}
+
+func (qsm *QuoteSelectModal) confirm() {
+	if qsm.start < 0 {
+		qsm.start = qsm.cursor
+		qsm.update()
+		return
+	}
+	first, last := qsm.selection()
+	qsm.parent.HideModal()
+	qsm.room.SetQuotedReply(qsm.evt, strings.Join(qsm.lines[first:last+1], "\n"))
+	if len(qsm.text) > 0 {
+		go qsm.room.SendMessage(event.MsgText, qsm.text)
+	}
+}
+
+func (qsm *QuoteSelectModal) OnKeyEvent(event mauview.KeyEvent) bool {
+	kb := config.Keybind{
+		Key: event.Key(),
+		Ch:  event.Rune(),
+		Mod: event.Modifiers(),
+	}
+	switch qsm.parent.config.Keybindings.Modal[kb] {
+	case "cancel":
+		qsm.parent.HideModal()
+		return true
+	case "select_next":
+		qsm.moveCursor(1)
+		return true
+	case "select_prev":
+		qsm.moveCursor(-1)
+		return true
+	case "confirm":
+		qsm.confirm()
+		return true
+	}
+	return qsm.list.OnKeyEvent(event)
+}
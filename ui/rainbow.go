@@ -19,6 +19,7 @@ package ui
 import (
 	"fmt"
 	"math/rand"
+	"strings"
 	"unicode"
 
 	"github.com/rivo/uniseg"
@@ -59,22 +60,54 @@ type rainbowBufWriter struct {
 	ColorID string
 }
 
+// isEntityChar checks if the grapheme can be a part of the name of an HTML entity like &amp; or &#39;.
+func isEntityChar(str string) bool {
+	return len(str) == 1 && (str[0] == '#' || ('a' <= str[0] && str[0] <= 'z') || ('A' <= str[0] && str[0] <= 'Z') ||
+		('0' <= str[0] && str[0] <= '9'))
+}
+
 func (rbw rainbowBufWriter) WriteString(s string) (int, error) {
 	i := 0
+	write := func(str string) error {
+		var i2 int
+		var err error
+		if runes := []rune(str); len(runes) == 1 && unicode.IsSpace(runes[0]) {
+			i2, err = rbw.BufWriter.WriteRune(runes[0])
+		} else {
+			i2, err = fmt.Fprintf(rbw.BufWriter, "<font color=\"%s\">%s</font>", rbw.ColorID, str)
+		}
+		i += i2
+		return err
+	}
+	// HTML entities like &amp; are colored as a single character, splitting them would produce invalid HTML
+	var entity []string
 	graphemes := uniseg.NewGraphemes(s)
 	for graphemes.Next() {
-		runes := graphemes.Runes()
-		if len(runes) == 1 && unicode.IsSpace(runes[0]) {
-			i2, err := rbw.BufWriter.WriteRune(runes[0])
-			i += i2
-			if err != nil {
-				return i, err
+		str := graphemes.Str()
+		if len(entity) > 0 && str == ";" {
+			str = strings.Join(entity, "") + str
+			entity = nil
+		} else if len(entity) > 0 && isEntityChar(str) {
+			entity = append(entity, str)
+			continue
+		} else if len(entity) > 0 {
+			for _, part := range entity {
+				if err := write(part); err != nil {
+					return i, err
+				}
 			}
+			entity = nil
+		}
+		if str == "&" {
+			entity = []string{str}
 			continue
 		}
-		i2, err := fmt.Fprintf(rbw.BufWriter, "<font color=\"%s\">%s</font>", rbw.ColorID, graphemes.Str())
-		i += i2
-		if err != nil {
+		if err := write(str); err != nil {
+			return i, err
+		}
+	}
+	for _, part := range entity {
+		if err := write(part); err != nil {
 			return i, err
 		}
 	}
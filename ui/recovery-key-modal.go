@@ -0,0 +1,238 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build cgo
+
+package ui
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/zyedidia/clipboard"
+	"go.mau.fi/mauview"
+	"go.mau.fi/tcell"
+
+	"maunium.net/go/mautrix/crypto/utils"
+)
+
+const (
+	// recoveryKeyGroups is the number of 4-character groups in a recovery key (35 bytes encoded as 48 base58 characters).
+	recoveryKeyGroups       = 12
+	recoveryKeyGroupLength  = 4
+	recoveryKeyGroupsPerRow = 4
+	base58Alphabet          = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+)
+
+// RecoveryKeyModal is an alternative to the password modal for entering recovery keys by hand. Each group of the key
+// has its own field, which makes it easier to keep track of the position when typing the key from paper.
+type RecoveryKeyModal struct {
+	mauview.Component
+
+	outputChan chan string
+	cancelChan chan struct{}
+
+	form   *mauview.Form
+	groups []*mauview.InputField
+	status *mauview.TextField
+
+	cancel *mauview.Button
+	submit *mauview.Button
+
+	parent *MainView
+}
+
+func (view *MainView) AskRecoveryKey(title string) (string, bool) {
+	rkm := NewRecoveryKeyModal(view, title)
+	view.ShowModal(rkm)
+	view.parent.Render()
+	return rkm.Wait()
+}
+
+func NewRecoveryKeyModal(parent *MainView, title string) *RecoveryKeyModal {
+	rkm := &RecoveryKeyModal{
+		parent:     parent,
+		form:       mauview.NewForm(),
+		groups:     make([]*mauview.InputField, recoveryKeyGroups),
+		outputChan: make(chan string, 1),
+		cancelChan: make(chan struct{}, 1),
+	}
+
+	rows := recoveryKeyGroups / recoveryKeyGroupsPerRow
+	rkm.form.
+		SetColumns([]int{1, 6, 1, 6, 1, 6, 1, 6, 1}).
+		SetRows([]int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1})
+
+	text := mauview.NewTextField().SetText("Type the recovery key")
+	rkm.form.AddComponent(text, 1, 1, 7, 1)
+	for i := range rkm.groups {
+		index := i
+		rkm.groups[i] = mauview.NewInputField().
+			SetPlaceholder(strings.Repeat("_", recoveryKeyGroupLength)).
+			SetChangedFunc(func(text string) {
+				rkm.HandleChange(index, text)
+			})
+		rkm.form.AddFormItem(rkm.groups[i], 1+(i%recoveryKeyGroupsPerRow)*2, 3+i/recoveryKeyGroupsPerRow, 1, 1)
+	}
+	rkm.status = mauview.NewTextField()
+	rkm.form.AddComponent(rkm.status, 1, 4+rows, 7, 1)
+
+	rkm.cancel = mauview.NewButton("Cancel").SetOnClick(rkm.ClickCancel)
+	rkm.submit = mauview.NewButton("Submit").SetOnClick(rkm.ClickSubmit)
+	rkm.form.AddFormItem(rkm.submit, 5, 6+rows, 3, 1)
+	rkm.form.AddFormItem(rkm.cancel, 1, 6+rows, 3, 1)
+
+	box := mauview.NewBox(rkm.form).SetTitle(title)
+	center := mauview.Center(box, 31, 13).SetAlwaysFocusChild(true)
+	center.Focus()
+	rkm.form.FocusNextItem()
+	rkm.Component = center
+
+	return rkm
+}
+
+// validateRecoveryKeyGroup checks a single group of a recovery key. Incomplete groups are only an error if complete
+// is set.
+func validateRecoveryKeyGroup(group string, complete bool) error {
+	for _, char := range group {
+		if !strings.ContainsRune(base58Alphabet, char) {
+			return fmt.Errorf("invalid character '%c'", char)
+		}
+	}
+	if len(group) > recoveryKeyGroupLength {
+		return fmt.Errorf("too many characters")
+	} else if complete && len(group) < recoveryKeyGroupLength {
+		return fmt.Errorf("too few characters")
+	}
+	return nil
+}
+
+func (rkm *RecoveryKeyModal) highlightGroup(index int, err error) {
+	if err != nil {
+		rkm.groups[index].SetBackgroundColor(tcell.ColorDarkRed)
+		rkm.status.SetText(fmt.Sprintf("Group %d: %v", index+1, err))
+	} else {
+		rkm.groups[index].SetBackgroundColor(mauview.Styles.ContrastBackgroundColor)
+	}
+}
+
+func (rkm *RecoveryKeyModal) HandleChange(index int, text string) {
+	rkm.status.SetText("")
+	err := validateRecoveryKeyGroup(text, false)
+	rkm.highlightGroup(index, err)
+	if err == nil && len(text) == recoveryKeyGroupLength && index < len(rkm.groups)-1 {
+		rkm.form.FocusNextItem()
+	}
+}
+
+func (rkm *RecoveryKeyModal) ClickCancel() {
+	rkm.parent.HideModal()
+	rkm.cancelChan <- struct{}{}
+}
+
+func (rkm *RecoveryKeyModal) ClickSubmit() {
+	groups := make([]string, len(rkm.groups))
+	for i, field := range rkm.groups {
+		groups[i] = field.GetText()
+		if err := validateRecoveryKeyGroup(groups[i], true); err != nil {
+			rkm.highlightGroup(i, err)
+			return
+		}
+	}
+	recoveryKey := strings.Join(groups, " ")
+	if utils.DecodeBase58RecoveryKey(recoveryKey) == nil {
+		// The checksum is a single parity byte over the whole key, so it can't tell which group has the typo
+		for i := range rkm.groups {
+			rkm.groups[i].SetBackgroundColor(tcell.ColorDarkRed)
+		}
+		rkm.status.SetText("Checksum mismatch, check all groups")
+		return
+	}
+	rkm.parent.HideModal()
+	rkm.outputChan <- recoveryKey
+}
+
+func (rkm *RecoveryKeyModal) Wait() (string, bool) {
+	select {
+	case result := <-rkm.outputChan:
+		return result, true
+	case <-rkm.cancelChan:
+		return "", false
+	}
+}
+
+// RecoveryKeyPopup shows a newly generated recovery key. It's used instead of a command reply so that the key never
+// ends up in the scrollback, and it has to be dismissed explicitly so the key isn't missed.
+type RecoveryKeyPopup struct {
+	mauview.Component
+
+	recoveryKey string
+	doneChan    chan struct{}
+
+	status *mauview.TextField
+
+	parent *MainView
+}
+
+func (view *MainView) ShowRecoveryKey(keyID, recoveryKey string) {
+	rkp := NewRecoveryKeyPopup(view, keyID, recoveryKey)
+	view.ShowModal(rkp)
+	view.parent.Render()
+	<-rkp.doneChan
+}
+
+func NewRecoveryKeyPopup(parent *MainView, keyID, recoveryKey string) *RecoveryKeyPopup {
+	rkp := &RecoveryKeyPopup{
+		parent:      parent,
+		recoveryKey: recoveryKey,
+		doneChan:    make(chan struct{}, 1),
+	}
+
+	form := mauview.NewForm()
+	form.
+		SetColumns([]int{1, 30, 1, 30, 1}).
+		SetRows([]int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1})
+	form.AddComponent(mauview.NewTextField().SetText("Store this recovery key somewhere safe, like a"), 1, 1, 3, 1)
+	form.AddComponent(mauview.NewTextField().SetText("password manager. It won't be shown again."), 1, 2, 3, 1)
+	form.AddComponent(mauview.NewTextField().SetText(recoveryKey), 1, 4, 3, 1)
+	rkp.status = mauview.NewTextField()
+	form.AddComponent(rkp.status, 1, 6, 3, 1)
+
+	form.AddFormItem(mauview.NewButton("Copy to clipboard").SetOnClick(rkp.ClickCopy), 1, 8, 1, 1)
+	form.AddFormItem(mauview.NewButton("I've saved it").SetOnClick(rkp.ClickDone), 3, 8, 1, 1)
+
+	box := mauview.NewBox(form).SetTitle(fmt.Sprintf("Recovery key for %s", keyID))
+	center := mauview.Center(box, 65, 12).SetAlwaysFocusChild(true)
+	center.Focus()
+	form.FocusNextItem()
+	rkp.Component = center
+
+	return rkp
+}
+
+func (rkp *RecoveryKeyPopup) ClickCopy() {
+	err := clipboard.WriteAll(rkp.recoveryKey, "clipboard")
+	if err != nil {
+		rkp.status.SetText(fmt.Sprintf("Failed to copy to clipboard: %v", err))
+	} else {
+		rkp.status.SetText("Copied to clipboard")
+	}
+}
+
+func (rkp *RecoveryKeyPopup) ClickDone() {
+	rkp.parent.HideModal()
+	rkp.doneChan <- struct{}{}
+}
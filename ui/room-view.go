@@ -17,9 +17,13 @@
 package ui
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 
@@ -76,12 +80,34 @@ type RoomView struct {
 	selecting     bool
 	selectReason  SelectReason
 	selectContent string
+	// marked contains the messages that were marked in visual mode to be redacted together.
+	marked []*messages.UIMessage
 
 	replying *muksevt.Event
+	// replyQuote is the part of the replied-to message that's quoted in the reply fallback.
+	replyQuote string
+	// threadReplying is the message that new messages are sent as thread replies to.
+	threadReplying *muksevt.Event
 
 	editing      *muksevt.Event
 	editMoveText string
 
+	searchQuery   string
+	searchMatches []*messages.UIMessage
+	searchIndex   int
+
+	// currentMention is the mention that was last jumped to with the mention keybindings.
+	currentMention id.EventID
+
+	// outgoing contains the messages waiting to be sent, oldest first. Only the first one is sent at a time, so that
+	// messages don't get reordered when one of them has to be retried.
+	outgoing []*outgoingMessage
+	// failed contains the messages that failed to send permanently, oldest first, so that they can be retried manually.
+	failed []*outgoingMessage
+	// sendingOutgoing is true while the outgoing queue is being sent or waiting for a retry.
+	sendingOutgoing bool
+	outgoingLock    sync.Mutex
+
 	completions struct {
 		list      []string
 		textCache string
@@ -93,7 +119,7 @@ func NewRoomView(parent *MainView, room *rooms.Room) *RoomView {
 	view := &RoomView{
 		topic:    mauview.NewTextView(),
 		status:   mauview.NewTextField(),
-		userList: NewMemberList(),
+		userList: NewMemberList(parent.matrix),
 		ulBorder: widget.NewBorder(),
 		input:    mauview.NewInputArea(),
 		Room:     room,
@@ -181,9 +207,35 @@ func (view *RoomView) StartSelecting(reason SelectReason, content string) {
 func (view *RoomView) StopSelecting() {
 	view.selecting = false
 	view.selectContent = ""
+	view.clearMarked()
 	view.MessageView().SetSelected(nil)
 }
 
+// ToggleMarked marks or unmarks the given message for bulk redaction.
+func (view *RoomView) ToggleMarked(message *messages.UIMessage) {
+	if message == nil {
+		return
+	}
+	message.IsMarked = !message.IsMarked
+	if message.IsMarked {
+		view.marked = append(view.marked, message)
+		return
+	}
+	for i, marked := range view.marked {
+		if marked == message {
+			view.marked = append(view.marked[:i], view.marked[i+1:]...)
+			break
+		}
+	}
+}
+
+func (view *RoomView) clearMarked() {
+	for _, message := range view.marked {
+		message.IsMarked = false
+	}
+	view.marked = nil
+}
+
 func (view *RoomView) OnSelect(message *messages.UIMessage) {
 	if !view.selecting || message == nil {
 		return
@@ -191,31 +243,65 @@ func (view *RoomView) OnSelect(message *messages.UIMessage) {
 	switch view.selectReason {
 	case SelectReply:
 		view.replying = message.Event
+		view.replyQuote = ""
 		if len(view.selectContent) > 0 {
 			go view.SendMessage(event.MsgText, view.selectContent)
 		}
 	case SelectEdit:
-		view.SetEditing(message.Event)
+		if view.filterEditable(message.Event) {
+			view.SetEditing(message.Event)
+		} else {
+			view.AddServiceMessage("You can only edit your own text messages.")
+		}
 	case SelectReact:
-		go view.SendReaction(message.EventID, view.selectContent)
+		go view.ToggleReaction(message, view.selectContent)
 	case SelectRedact:
-		go view.Redact(message.EventID, view.selectContent)
+		targets := append([]*messages.UIMessage(nil), view.marked...)
+		if len(targets) == 0 {
+			targets = []*messages.UIMessage{message}
+		}
+		go view.RedactMessages(targets, view.selectContent)
 	case SelectDownload, SelectOpen:
 		msg, ok := message.Renderer.(*messages.FileMessage)
 		if ok {
-			path := ""
-			if len(view.selectContent) > 0 {
-				path = view.selectContent
-			} else if view.selectReason == SelectDownload {
-				path = msg.Body
+			path := view.selectContent
+			if view.selectReason == SelectDownload {
+				var err error
+				path, err = view.downloadPath(path, msg.Body)
+				if err != nil {
+					view.AddServiceMessage(fmt.Sprintf("Failed to download media: %v", err))
+					break
+				}
 			}
 			go view.Download(msg.URL, msg.File, path, view.selectReason == SelectOpen)
 		}
 	case SelectCopy:
-		go view.CopyToClipboard(message.Renderer.PlainText(), view.selectContent)
+		text := message.Renderer.PlainText()
+		if message.Event != nil {
+			content, ok := message.Event.Content.Parsed.(*event.MessageEventContent)
+			if ok && content.MsgType == event.MsgLocation {
+				// Copying the geo URI is more useful than the human-readable text
+				text = messages.GetGeoURI(message.Event, content)
+			}
+		}
+		go view.CopyToClipboard(text, view.selectContent)
+	case SelectKeyRequest:
+		go view.RequestSession(message.EventID, view.selectContent == "--resend")
+	case SelectDecrypt:
+		go view.Redecrypt(message.EventID)
+	case SelectThread:
+		view.StartThread(message.Event)
+	case SelectPin, SelectUnpin:
+		go view.SetPinned(message, view.selectReason == SelectPin)
+	case SelectQuote:
+		// The modal is opened after the input is focused below, so that it keeps the focus
+		defer view.ShowQuoteSelection(message, view.selectContent)
+	case SelectReport:
+		go view.Report(message, view.selectContent)
 	}
 	view.selecting = false
 	view.selectContent = ""
+	view.clearMarked()
 	view.MessageView().SetSelected(nil)
 	view.input.Focus()
 }
@@ -223,16 +309,29 @@ func (view *RoomView) OnSelect(message *messages.UIMessage) {
 func (view *RoomView) GetStatus() string {
 	var buf strings.Builder
 
+	if view.selecting && len(view.marked) > 0 {
+		buf.WriteString(fmt.Sprintf("%d messages marked for redaction - ", len(view.marked)))
+	}
+
 	if view.editing != nil {
 		buf.WriteString("Editing message - ")
 	} else if view.replying != nil {
 		buf.WriteString("Replying to ")
 		buf.WriteString(string(view.replying.Sender))
+		if len(view.replyQuote) > 0 {
+			_, _ = fmt.Fprintf(&buf, " (quoting %d lines)", strings.Count(view.replyQuote, "\n")+1)
+		}
+		buf.WriteString(" - ")
+	} else if view.threadReplying != nil {
+		buf.WriteString("Replying in thread to ")
+		buf.WriteString(string(view.threadReplying.Sender))
 		buf.WriteString(" - ")
 	} else if view.selecting {
 		buf.WriteString("Selecting message to ")
 		buf.WriteString(string(view.selectReason))
 		buf.WriteString(" - ")
+	} else if len(view.searchMatches) > 0 && len(view.searchQuery) > 0 {
+		buf.WriteString(fmt.Sprintf("Match %d/%d for \"%s\" - ", view.searchIndex+1, len(view.searchMatches), view.searchQuery))
 	}
 
 	if len(view.completions.list) > 0 {
@@ -244,25 +343,40 @@ func (view *RoomView) GetStatus() string {
 		}
 	}
 
-	if len(view.typing) == 1 {
-		buf.WriteString("Typing: " + string(view.typing[0]))
-		buf.WriteString(" - ")
-	} else if len(view.typing) > 1 {
-		buf.WriteString("Typing: ")
-		for i, userID := range view.typing {
-			if i == len(view.typing)-1 {
-				buf.WriteString(" and ")
-			} else if i > 0 {
-				buf.WriteString(", ")
-			}
-			buf.WriteString(string(userID))
+	if view.config.PendingVerificationIndicator {
+		if count := pendingVerificationCount(); count > 0 {
+			buf.WriteString(fmt.Sprintf("🔐%d - ", count))
 		}
+	}
+
+	if status := view.outgoingStatus(); len(status) > 0 {
+		buf.WriteString(status)
+		buf.WriteString(" - ")
+	}
+
+	if len(view.typing) > 0 {
+		buf.WriteString(formatTyping(view.typing))
 		buf.WriteString(" - ")
 	}
 
 	return strings.TrimSuffix(buf.String(), " - ")
 }
 
+// maxTypingNames is the number of typing users that are listed by name before the rest are collapsed into a count.
+const maxTypingNames = 3
+
+func formatTyping(typing []string) string {
+	switch {
+	case len(typing) == 1:
+		return fmt.Sprintf("%s is typing…", typing[0])
+	case len(typing) <= maxTypingNames:
+		return fmt.Sprintf("%s and %s are typing…", strings.Join(typing[:len(typing)-1], ", "), typing[len(typing)-1])
+	default:
+		others := len(typing) - maxTypingNames + 1
+		return fmt.Sprintf("%s and %d others are typing…", strings.Join(typing[:maxTypingNames-1], ", "), others)
+	}
+}
+
 // Constants defining the size of the room view grid.
 const (
 	UserListBorderWidth   = 1
@@ -332,10 +446,32 @@ func (view *RoomView) Draw(screen mauview.Screen) {
 func (view *RoomView) ClearAllContext() {
 	view.SetEditing(nil)
 	view.StopSelecting()
+	view.ClearSearch()
 	view.replying = nil
+	view.replyQuote = ""
+	view.threadReplying = nil
 	view.input.Focus()
 }
 
+// getThreadRoot returns the root of the thread the given event is in, or the event itself if it's not in a thread.
+func getThreadRoot(evt *muksevt.Event) id.EventID {
+	if content, ok := evt.Content.Parsed.(*event.MessageEventContent); ok && content.RelatesTo != nil &&
+		content.RelatesTo.Type == muksevt.RelThread {
+		return content.RelatesTo.EventID
+	}
+	return evt.ID
+}
+
+// StartThread puts the composer into thread reply mode, so that new messages are sent in the thread of the given
+// message. If the message isn't in a thread yet, it becomes the root of a new one.
+func (view *RoomView) StartThread(evt *muksevt.Event) {
+	view.SetEditing(nil)
+	view.replying = nil
+	view.replyQuote = ""
+	view.threadReplying = evt
+	view.status.SetText(view.GetStatus())
+}
+
 func (view *RoomView) OnKeyEvent(event mauview.KeyEvent) bool {
 	msgView := view.MessageView()
 	kb := config.Keybind{
@@ -354,6 +490,38 @@ func (view *RoomView) OnKeyEvent(event mauview.KeyEvent) bool {
 			view.SelectNext()
 		case "confirm":
 			view.OnSelect(msgView.selected)
+		case "react":
+			if msgView.selected != nil {
+				go view.ToggleReaction(msgView.selected, defaultReaction)
+			}
+			view.ClearAllContext()
+		case "edit":
+			view.selectReason = SelectEdit
+			view.OnSelect(msgView.selected)
+		case "mark":
+			if view.selectReason == SelectRedact {
+				view.ToggleMarked(msgView.selected)
+			}
+		case "reveal_spoiler":
+			if msgView.selected != nil {
+				msgView.selected.SpoilersRevealed = !msgView.selected.SpoilersRevealed
+			}
+		case "pin":
+			if msgView.selected != nil {
+				go view.TogglePinned(msgView.selected)
+			}
+			view.ClearAllContext()
+		case "quote_reply":
+			selected := msgView.selected
+			view.ClearAllContext()
+			if selected != nil {
+				view.ShowQuoteSelection(selected, "")
+			}
+		case "set_fully_read":
+			if msgView.selected != nil {
+				go view.SetFullyRead(msgView.selected)
+			}
+			view.ClearAllContext()
 		default:
 			return false
 		}
@@ -376,6 +544,36 @@ func (view *RoomView) OnKeyEvent(event mauview.KeyEvent) bool {
 	case "send":
 		view.InputSubmit(view.input.GetText())
 		return true
+	case "search_next":
+		view.SearchNext()
+		return true
+	case "search_prev":
+		view.SearchPrevious()
+		return true
+	case "react":
+		view.StartSelecting(SelectReact, defaultReaction)
+		return true
+	case "follow_upgrade":
+		go view.FollowUpgrade()
+		return true
+	case "pinned_messages":
+		view.ShowPinnedMessages()
+		return true
+	case "toggle_membership_events":
+		msgView.ToggleAllMembership()
+		return true
+	case "jump_to_unread":
+		go view.JumpToUnread()
+		return true
+	case "prev_mention":
+		go view.JumpToMention(false)
+		return true
+	case "next_mention":
+		go view.JumpToMention(true)
+		return true
+	case "retry_send":
+		go view.RetrySend()
+		return true
 	}
 	return view.input.OnKeyEvent(event)
 }
@@ -412,9 +610,11 @@ func (view *RoomView) loadTyping() {
 }
 
 func (view *RoomView) SetTyping(users []id.UserID) {
-	view.typing = make([]string, len(users))
-	for i, user := range users {
-		view.typing[i] = string(user)
+	view.typing = make([]string, 0, len(users))
+	for _, user := range users {
+		if user != view.config.UserID {
+			view.typing = append(view.typing, string(user))
+		}
 	}
 	if view.Room.Loaded() {
 		view.loadTyping()
@@ -445,6 +645,7 @@ func (view *RoomView) SetEditing(evt *muksevt.Event) {
 		view.editing = evt
 		// replying should never be non-nil when SetEditing, but do this just to be safe
 		view.replying = nil
+		view.replyQuote = ""
 		msgContent := view.editing.Content.AsMessage()
 		if len(view.editing.Gomuks.Edits) > 0 {
 			// This feels kind of dangerous, but I think it works
@@ -469,8 +670,15 @@ func (view *RoomView) SetEditing(evt *muksevt.Event) {
 
 type findFilter func(evt *muksevt.Event) bool
 
-func (view *RoomView) filterOwnOnly(evt *muksevt.Event) bool {
-	return evt.Sender == view.parent.matrix.Client().UserID && evt.Type == event.EventMessage
+// filterEditable allows the user's own text, notice and emote messages that haven't been redacted.
+func (view *RoomView) filterEditable(evt *muksevt.Event) bool {
+	if evt.Sender != view.parent.matrix.Client().UserID || evt.Type != event.EventMessage || evt.Unsigned.RedactedBecause != nil {
+		return false
+	}
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	return ok && (content.MsgType == event.MsgText ||
+		content.MsgType == event.MsgNotice ||
+		content.MsgType == event.MsgEmote)
 }
 
 func (view *RoomView) filterMediaOnly(evt *muksevt.Event) bool {
@@ -507,7 +715,7 @@ func (view *RoomView) EditNext() {
 	if view.editing == nil {
 		return
 	}
-	foundMsg := view.findMessage(view.editing, true, view.filterOwnOnly)
+	foundMsg := view.findMessage(view.editing, true, view.filterEditable)
 	view.SetEditing(foundMsg.GetEvent())
 }
 
@@ -515,21 +723,28 @@ func (view *RoomView) EditPrevious() {
 	if view.replying != nil {
 		return
 	}
-	foundMsg := view.findMessage(view.editing, false, view.filterOwnOnly)
+	foundMsg := view.findMessage(view.editing, false, view.filterEditable)
 	if foundMsg != nil {
 		view.SetEditing(foundMsg.GetEvent())
 	}
 }
 
+func (view *RoomView) selectFilter() findFilter {
+	switch view.selectReason {
+	case SelectDownload, SelectOpen:
+		return view.filterMediaOnly
+	case SelectEdit:
+		return view.filterEditable
+	}
+	return nil
+}
+
 func (view *RoomView) SelectNext() {
 	msgView := view.MessageView()
 	if msgView.selected == nil {
 		return
 	}
-	var filter findFilter
-	if view.selectReason == SelectDownload || view.selectReason == SelectOpen {
-		filter = view.filterMediaOnly
-	}
+	filter := view.selectFilter()
 	foundMsg := view.findMessage(msgView.selected.GetEvent(), true, filter)
 	if foundMsg != nil {
 		msgView.SetSelected(foundMsg)
@@ -539,10 +754,7 @@ func (view *RoomView) SelectNext() {
 
 func (view *RoomView) SelectPrevious() {
 	msgView := view.MessageView()
-	var filter findFilter
-	if view.selectReason == SelectDownload || view.selectReason == SelectOpen {
-		filter = view.filterMediaOnly
-	}
+	filter := view.selectFilter()
 	foundMsg := view.findMessage(msgView.selected.GetEvent(), false, filter)
 	if foundMsg != nil {
 		msgView.SetSelected(foundMsg)
@@ -550,6 +762,163 @@ func (view *RoomView) SelectPrevious() {
 	}
 }
 
+// Search highlights the loaded messages whose body contains the query (case-insensitively) and jumps to the newest
+// match. Messages that couldn't be decrypted have no body, so they're never matched. Returns the number of matches.
+func (view *RoomView) Search(query string) int {
+	view.ClearSearch()
+	view.searchQuery = query
+	query = strings.ToLower(query)
+	msgView := view.MessageView()
+	msgView.messagesLock.RLock()
+	for _, msg := range msgView.messages {
+		if msg.Event == nil || msg.IsService {
+			continue
+		}
+		content, ok := msg.Event.Content.Parsed.(*event.MessageEventContent)
+		if ok && strings.Contains(strings.ToLower(content.Body), query) {
+			msg.IsSearchMatch = true
+			view.searchMatches = append(view.searchMatches, msg)
+		}
+	}
+	msgView.messagesLock.RUnlock()
+	if len(view.searchMatches) > 0 {
+		view.jumpToSearchMatch(len(view.searchMatches) - 1)
+	}
+	return len(view.searchMatches)
+}
+
+func (view *RoomView) jumpToSearchMatch(index int) {
+	view.searchMatches[view.searchIndex].IsCurrentMatch = false
+	view.searchIndex = index
+	view.searchMatches[index].IsCurrentMatch = true
+	view.MessageView().ScrollToMessage(view.searchMatches[index])
+}
+
+// SearchNext jumps to the next newer search match, wrapping around to the oldest one.
+func (view *RoomView) SearchNext() {
+	if len(view.searchMatches) > 0 {
+		view.jumpToSearchMatch((view.searchIndex + 1) % len(view.searchMatches))
+	}
+}
+
+// SearchPrevious jumps to the next older search match, wrapping around to the newest one.
+func (view *RoomView) SearchPrevious() {
+	if len(view.searchMatches) > 0 {
+		view.jumpToSearchMatch((view.searchIndex - 1 + len(view.searchMatches)) % len(view.searchMatches))
+	}
+}
+
+// ShowSearchResult highlights a single message found by the server-side search as the current search match.
+func (view *RoomView) ShowSearchResult(query string, message *messages.UIMessage) {
+	view.ClearSearch()
+	view.searchQuery = query
+	message.IsSearchMatch = true
+	view.searchMatches = []*messages.UIMessage{message}
+	view.jumpToSearchMatch(0)
+}
+
+// JumpToUnread scrolls to the first message after the fully read marker. If the marker isn't loaded, more history is
+// loaded until it's found.
+func (view *RoomView) JumpToUnread() {
+	defer debug.Recover()
+	defer view.parent.parent.Render()
+	fullyRead := view.Room.GetFullyRead()
+	if len(fullyRead) == 0 {
+		view.AddServiceMessage("This room doesn't have a read marker yet")
+		return
+	}
+	msgView := view.MessageView()
+	err := view.parent.loadHistoryUntil(view, func() bool {
+		return msgView.getMessageByID(fullyRead) != nil
+	})
+	if err != nil {
+		view.AddServiceMessage(fmt.Sprintf("Read marker %v", err))
+		return
+	}
+	next := msgView.messageAfter(fullyRead)
+	if next == nil {
+		view.AddServiceMessage("No unread messages")
+		return
+	}
+	msgView.recalculateBuffers()
+	msgView.ScrollToMessage(next)
+}
+
+// loadedMentions returns the loaded messages that mention the user, from oldest to newest.
+func (view *RoomView) loadedMentions() []*messages.UIMessage {
+	msgView := view.MessageView()
+	msgView.messagesLock.RLock()
+	defer msgView.messagesLock.RUnlock()
+	var mentions []*messages.UIMessage
+	for _, msg := range msgView.messages {
+		if msg.Event != nil && !msg.IsService && msg.IsHighlight {
+			mentions = append(mentions, msg)
+		}
+	}
+	return mentions
+}
+
+// mentionIndex returns the index of the mention that was last jumped to, or -1 if it isn't in the list.
+func (view *RoomView) mentionIndex(mentions []*messages.UIMessage) int {
+	for i, msg := range mentions {
+		if msg.ID() == view.currentMention {
+			return i
+		}
+	}
+	return -1
+}
+
+// JumpToMention jumps to the next older (or newer if newer is true) message that mentions the user. When going
+// backwards past the oldest loaded mention, more history is loaded to look for older ones before wrapping around to
+// the newest mention.
+func (view *RoomView) JumpToMention(newer bool) {
+	defer debug.Recover()
+	defer view.parent.parent.Render()
+	mentions := view.loadedMentions()
+	index := view.mentionIndex(mentions)
+	var target *messages.UIMessage
+	if newer {
+		if index >= 0 && index+1 < len(mentions) {
+			target = mentions[index+1]
+		} else if len(mentions) > 0 {
+			target = mentions[0]
+		}
+	} else if index > 0 {
+		target = mentions[index-1]
+	} else if index < 0 && len(mentions) > 0 {
+		target = mentions[len(mentions)-1]
+	} else {
+		// The oldest loaded mention (or no mention) is current, so look for older ones in the history.
+		prevCount := len(mentions)
+		_ = view.parent.loadHistoryUntil(view, func() bool {
+			mentions = view.loadedMentions()
+			return len(mentions) > prevCount
+		})
+		if len(mentions) > prevCount {
+			target = mentions[len(mentions)-prevCount-1]
+		} else if len(mentions) > 0 {
+			target = mentions[len(mentions)-1]
+		}
+	}
+	if target == nil {
+		view.AddServiceMessage("No messages mentioning you were found")
+		return
+	}
+	view.currentMention = target.ID()
+	view.MessageView().recalculateBuffers()
+	view.ShowSearchResult("", target)
+}
+
+func (view *RoomView) ClearSearch() {
+	for _, msg := range view.searchMatches {
+		msg.IsSearchMatch = false
+		msg.IsCurrentMatch = false
+	}
+	view.searchQuery = ""
+	view.searchMatches = nil
+	view.searchIndex = 0
+}
+
 type completion struct {
 	displayName string
 	id          string
@@ -585,30 +954,6 @@ func (view *RoomView) AutocompleteRoom(existingText string) (completions []compl
 	return
 }
 
-func (view *RoomView) AutocompleteEmoji(word string) (completions []string) {
-	if word[0] != ':' {
-		return
-	}
-	var valueCompletion1 string
-	var manyValues bool
-	for name, value := range emoji.CodeMap() {
-		if name == word {
-			return []string{value}
-		} else if strings.HasPrefix(name, word) {
-			completions = append(completions, name)
-			if valueCompletion1 == "" {
-				valueCompletion1 = value
-			} else if valueCompletion1 != value {
-				manyValues = true
-			}
-		}
-	}
-	if !manyValues && len(completions) > 0 {
-		return []string{emoji.CodeMap()[completions[0]]}
-	}
-	return
-}
-
 func findWordToTabComplete(text string) string {
 	output := ""
 	runes := []rune(text)
@@ -656,7 +1001,6 @@ func (view *RoomView) defaultAutocomplete(word string, startIndex int) (strCompl
 	}
 
 	strCompletions = append(strCompletions, view.parent.cmdProcessor.AutocompleteCommand(word)...)
-	strCompletions = append(strCompletions, view.AutocompleteEmoji(word)...)
 
 	return
 }
@@ -674,6 +1018,10 @@ func (view *RoomView) InputTabComplete(text string, cursorOffset int) {
 
 	strCompletions, newText, ok := view.parent.cmdProcessor.Autocomplete(view, text, cursorOffset)
 	if !ok {
+		if query, offset, isEmoji := view.emojiQuery(word); isEmoji {
+			view.tabCompleteEmoji(text, str, startIndex+offset, query)
+			return
+		}
 		strCompletions, strCompletion = view.defaultAutocomplete(word, startIndex)
 	}
 
@@ -719,6 +1067,37 @@ func (view *RoomView) CopyToClipboard(text string, register string) {
 	}
 }
 
+// downloadPath returns the path to download a file with the given name to. If the target is empty or a directory,
+// the file name from the message is used.
+func (view *RoomView) downloadPath(target, filename string) (string, error) {
+	// The file name comes from the message, so it must not be able to point outside the target directory.
+	filename = filepath.Base(filepath.Clean(filename))
+	if filename == "." || filename == ".." || filename == string(filepath.Separator) || len(filename) == 0 {
+		filename = fmt.Sprintf("download-%s", time.Now().Format("20060102-150405"))
+	}
+	path := target
+	if len(target) == 0 {
+		path = filename
+	} else {
+		dir := target
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(view.config.DownloadDir, dir)
+		}
+		if strings.HasSuffix(target, string(filepath.Separator)) {
+			path = filepath.Join(target, filename)
+		} else if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			path = filepath.Join(target, filename)
+		}
+	}
+	if !filepath.IsAbs(path) {
+		rel, err := filepath.Rel(view.config.DownloadDir, filepath.Join(view.config.DownloadDir, path))
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("%s is outside the download directory, use an absolute path instead", path)
+		}
+	}
+	return path, nil
+}
+
 func (view *RoomView) Download(url id.ContentURI, file *attachment.EncryptedFile, filename string, openFile bool) {
 	path, err := view.parent.matrix.DownloadToDisk(url, file, filename)
 	if err != nil {
@@ -734,27 +1113,158 @@ func (view *RoomView) Download(url id.ContentURI, file *attachment.EncryptedFile
 	}
 }
 
-func (view *RoomView) Redact(eventID id.EventID, reason string) {
+func (view *RoomView) RequestSession(eventID id.EventID, resend bool) {
 	defer debug.Recover()
-	err := view.parent.matrix.Redact(view.Room.ID, eventID, reason)
+	req, sent, err := view.parent.matrix.RequestSession(view.Room.ID, eventID, resend)
 	if err != nil {
-		if httpErr, ok := err.(mautrix.HTTPError); ok {
-			err = httpErr
-			if respErr := httpErr.RespError; respErr != nil {
-				err = respErr
+		view.AddServiceMessage(fmt.Sprintf("Failed to request session: %v", err))
+	} else if !sent {
+		view.AddServiceMessage(fmt.Sprintf("Session %s was already requested %s ago. Use /keyrequest --resend to request it again.",
+			req.SessionID, time.Since(req.Sent).Truncate(time.Second)))
+	} else {
+		targets := make([]string, 0, len(req.Targets))
+		for userID, devices := range req.Targets {
+			for _, deviceID := range devices {
+				targets = append(targets, fmt.Sprintf("%s/%s", userID, deviceID))
 			}
 		}
+		sort.Strings(targets)
+		view.AddServiceMessage(fmt.Sprintf("Requested session %s from %s. Messages in the local history will be decrypted when the key arrives.",
+			req.SessionID, strings.Join(targets, ", ")))
+	}
+	view.parent.parent.Render()
+}
+
+func (view *RoomView) Redecrypt(eventID id.EventID) {
+	defer debug.Recover()
+	err := view.parent.matrix.RedecryptEvent(view.Room.ID, eventID)
+	if err != nil {
+		view.AddServiceMessage(fmt.Sprintf("Failed to decrypt message: %v", err))
+		view.parent.parent.Render()
+	}
+}
+
+func (view *RoomView) Redact(eventID id.EventID, reason string) {
+	defer debug.Recover()
+	if err := view.redact(eventID, reason); err != nil {
 		view.AddServiceMessage(fmt.Sprintf("Failed to redact message: %v", err))
 		view.parent.parent.Render()
 	}
 }
 
-func (view *RoomView) SendReaction(eventID id.EventID, reaction string) {
+const (
+	// redactionInterval is the delay between redactions when redacting multiple messages.
+	redactionInterval = 500 * time.Millisecond
+	// maxRedactionRetries is the number of times a rate limited redaction is retried.
+	maxRedactionRetries = 3
+)
+
+// redact redacts the given event, waiting and retrying if the server rate limits the request. If the event is shown
+// in the timeline, it's replaced with the redacted placeholder right away instead of waiting for the redaction to
+// come down sync.
+func (view *RoomView) redact(eventID id.EventID, reason string) error {
+	var err error
+	for i := 0; i <= maxRedactionRetries; i++ {
+		err = view.parent.matrix.Redact(view.Room.ID, eventID, reason)
+		httpErr, ok := err.(mautrix.HTTPError)
+		if !ok || httpErr.RespError == nil || !errors.Is(err, mautrix.MLimitExceeded) || i == maxRedactionRetries {
+			break
+		}
+		retryAfter := 1000.0
+		if retryAfterMS, ok := httpErr.RespError.ExtraData["retry_after_ms"].(float64); ok {
+			retryAfter = retryAfterMS
+		}
+		debug.Printf("Redaction of %s was rate limited, retrying in %.0f ms", eventID, retryAfter)
+		time.Sleep(time.Duration(retryAfter) * time.Millisecond)
+	}
+	if err != nil {
+		if httpErr, ok := err.(mautrix.HTTPError); ok && httpErr.RespError != nil {
+			return httpErr.RespError
+		}
+		return err
+	}
+	if msg := view.MessageView().getMessageByID(eventID); msg != nil && msg.Event != nil {
+		redacted := *msg.Event.Event
+		redacted.Unsigned.RedactedBecause = &event.Event{
+			Type:      event.EventRedaction,
+			Sender:    view.config.UserID,
+			RoomID:    view.Room.ID,
+			Redacts:   eventID,
+			Timestamp: time.Now().UnixNano() / 1e6,
+			Content:   event.Content{Parsed: &event.RedactionEventContent{Reason: reason}},
+		}
+		view.AddRedaction(&muksevt.Event{Event: &redacted, Gomuks: msg.Event.Gomuks})
+		view.parent.parent.Render()
+	}
+	return nil
+}
+
+// canRedact checks if the user's power level is high enough to redact the given event. Redacting other users'
+// events requires the redact level in addition to the level for sending redactions.
+func (view *RoomView) canRedact(evt *muksevt.Event) bool {
+	plEvent := view.Room.GetStateEvent(event.StatePowerLevels, "")
+	if plEvent == nil || evt == nil {
+		return true
+	}
+	pls := plEvent.Content.AsPowerLevels()
+	ownLevel := pls.GetUserLevel(view.config.UserID)
+	if ownLevel < pls.GetEventLevel(event.EventRedaction) {
+		return false
+	}
+	return evt.Sender == view.config.UserID || ownLevel >= pls.Redact()
+}
+
+// RedactMessages redacts the given messages one by one with a delay in between to avoid hitting rate limits.
+func (view *RoomView) RedactMessages(msgs []*messages.UIMessage, reason string) {
 	defer debug.Recover()
+	var redacted, failed, forbidden int
+	for _, msg := range msgs {
+		if !view.canRedact(msg.Event) {
+			forbidden++
+			continue
+		}
+		if redacted+failed > 0 {
+			time.Sleep(redactionInterval)
+		}
+		if err := view.redact(msg.EventID, reason); err != nil {
+			failed++
+			view.AddServiceMessage(fmt.Sprintf("Failed to redact message: %v", err))
+		} else {
+			redacted++
+		}
+	}
+	if forbidden > 0 {
+		view.AddServiceMessage(fmt.Sprintf("Your power level isn't high enough to redact %d of the messages.", forbidden))
+	}
+	if len(msgs) > 1 {
+		view.AddServiceMessage(fmt.Sprintf("Redacted %d of %d messages.", redacted, len(msgs)))
+	}
+	view.parent.parent.Render()
+}
+
+func (view *RoomView) normalizeReaction(reaction string) string {
 	if !view.config.Preferences.DisableEmojis {
 		reaction = emoji.Sprint(reaction)
 	}
-	reaction = variationselector.Add(strings.TrimSpace(reaction))
+	return variationselector.Add(strings.TrimSpace(reaction))
+}
+
+// ToggleReaction reacts to the given message, or removes the reaction if the user has already reacted with the same
+// key.
+func (view *RoomView) ToggleReaction(message *messages.UIMessage, reaction string) {
+	defer debug.Recover()
+	reaction = view.normalizeReaction(reaction)
+	if reactionID := message.GetOwnReaction(view.config.UserID, reaction); len(reactionID) > 0 {
+		debug.Print("Removing reaction", reaction, "to", message.EventID, "in", view.Room.ID)
+		view.Redact(reactionID, "")
+		return
+	}
+	view.SendReaction(message.EventID, reaction)
+}
+
+func (view *RoomView) SendReaction(eventID id.EventID, reaction string) {
+	defer debug.Recover()
+	reaction = view.normalizeReaction(reaction)
 	debug.Print("Reacting to", eventID, "in", view.Room.ID, "with", reaction)
 	eventID, err := view.parent.matrix.SendEvent(&muksevt.Event{
 		Event: &event.Event{
@@ -793,6 +1303,13 @@ func (view *RoomView) getRelationForNewEvent() *ifc.Relation {
 		return &ifc.Relation{
 			Type:  event.RelReply,
 			Event: view.replying,
+			Quote: view.replyQuote,
+		}
+	} else if view.threadReplying != nil {
+		return &ifc.Relation{
+			Type:       muksevt.RelThread,
+			Event:      view.threadReplying,
+			ThreadRoot: getThreadRoot(view.threadReplying),
 		}
 	}
 	return nil
@@ -802,18 +1319,211 @@ func (view *RoomView) SendMessageHTML(msgtype event.MessageType, text, html stri
 	defer debug.Recover()
 	debug.Print("Sending message", msgtype, text, "to", view.Room.ID)
 	if !view.config.Preferences.DisableEmojis {
+		view.countEmojiShortcodes(text)
 		text = emoji.Sprint(text)
 	}
 	rel := view.getRelationForNewEvent()
-	evt := view.parent.matrix.PrepareMarkdownMessage(view.Room.ID, msgtype, text, html, rel)
+	evt, err := view.parent.matrix.PrepareMarkdownMessage(view.Room.ID, msgtype, text, html, rel)
+	if err != nil {
+		view.AddServiceMessage(fmt.Sprintf("Failed to send message: %v", err))
+		view.parent.parent.Render()
+		return
+	}
+	view.addLocalEcho(evt)
+}
+
+// canChangePins checks if the user has a high enough power level to pin and unpin messages.
+func (view *RoomView) canChangePins() bool {
+	plEvent := view.Room.GetStateEvent(event.StatePowerLevels, "")
+	if plEvent == nil {
+		return true
+	}
+	pls := plEvent.Content.AsPowerLevels()
+	return pls.GetUserLevel(view.config.UserID) >= pls.GetEventLevel(event.StatePinnedEvents)
+}
+
+// SetPinned pins or unpins the given message. The room shows a notice when the pinned messages change, so only
+// failures are reported here.
+func (view *RoomView) SetPinned(message *messages.UIMessage, pinned bool) {
+	defer debug.Recover()
+	action := "unpin"
+	if pinned {
+		action = "pin"
+	}
+	if message.Event == nil || message.IsService || len(message.EventID) == 0 {
+		view.AddServiceMessage(fmt.Sprintf("Can't %s that message", action))
+	} else if !view.canChangePins() {
+		view.AddServiceMessage(fmt.Sprintf("You don't have a high enough power level to %s messages", action))
+	} else if changed, err := view.parent.matrix.SetPinned(view.Room.ID, message.EventID, pinned); err != nil {
+		view.AddServiceMessage(fmt.Sprintf("Failed to %s message: %v", action, err))
+	} else if !changed && pinned {
+		view.AddServiceMessage("That message is already pinned")
+	} else if !changed {
+		view.AddServiceMessage("That message isn't pinned")
+	} else {
+		return
+	}
+	view.parent.parent.Render()
+}
+
+// Report asks for confirmation and reports the given message to the homeserver admins.
+func (view *RoomView) Report(message *messages.UIMessage, reason string) {
+	defer debug.Recover()
+	if message.Event == nil || message.IsService || len(message.EventID) == 0 {
+		view.AddServiceMessage("Can't report that message")
+		view.parent.parent.Render()
+		return
+	}
+	text := fmt.Sprintf("Report the message from %s to the homeserver admins?", message.SenderName)
+	if len(reason) > 0 {
+		text = fmt.Sprintf("%s\nReason: %s", text, reason)
+	}
+	if !view.parent.AskConfirmation("Report message", text, "Report") {
+		return
+	}
+	err := view.parent.matrix.ReportEvent(view.Room.ID, message.EventID, reason)
+	if errors.Is(err, ifc.ErrReportUnsupported) {
+		view.AddServiceMessage("Your homeserver doesn't support reporting messages")
+	} else if err != nil {
+		view.AddServiceMessage(fmt.Sprintf("Failed to report message: %v", err))
+	} else {
+		view.AddServiceMessage("Reported the message to the homeserver admins")
+	}
+	view.parent.parent.Render()
+}
+
+// TogglePinned pins the given message, or unpins it if it's already pinned.
+func (view *RoomView) TogglePinned(message *messages.UIMessage) {
+	defer debug.Recover()
+	pinned, err := view.parent.matrix.PinnedEvents(view.Room.ID)
+	if err != nil {
+		view.AddServiceMessage(fmt.Sprintf("Failed to get pinned messages: %v", err))
+		view.parent.parent.Render()
+		return
+	}
+	for _, eventID := range pinned {
+		if eventID == message.EventID {
+			view.SetPinned(message, false)
+			return
+		}
+	}
+	view.SetPinned(message, true)
+}
+
+// ShowPinnedMessages opens a modal that lists the pinned messages of the room.
+func (view *RoomView) ShowPinnedMessages() {
+	go func() {
+		defer debug.Recover()
+		pinned, err := view.parent.matrix.PinnedEvents(view.Room.ID)
+		if err != nil {
+			view.AddServiceMessage(fmt.Sprintf("Failed to get pinned messages: %v", err))
+		} else if len(pinned) == 0 {
+			view.AddServiceMessage("There are no pinned messages in this room")
+		} else {
+			modal := NewPinnedMessagesModal(view.parent, view.Room, pinned, 100, 25)
+			view.parent.ShowModal(modal)
+			go modal.Load()
+		}
+		view.parent.parent.Render()
+	}()
+}
+
+// ShowQuoteSelection opens a modal for choosing the lines of the given message to quote in a reply. If text isn't
+// empty, it's sent as the reply after the lines are chosen.
+func (view *RoomView) ShowQuoteSelection(message *messages.UIMessage, text string) {
+	if message.Event == nil || len(quotableLines(message.Event)) == 0 {
+		view.AddServiceMessage("That message doesn't have any text to quote.")
+		return
+	}
+	view.parent.ShowModal(NewQuoteSelectModal(view, message.Event, text, 80, 20))
+}
+
+// SetQuotedReply makes new messages replies to the given event that only quote the given part of it.
+func (view *RoomView) SetQuotedReply(evt *muksevt.Event, quote string) {
+	if view.editing != nil {
+		view.SetEditing(nil)
+	}
+	view.threadReplying = nil
+	view.replying = evt
+	view.replyQuote = quote
+	view.status.SetText(view.GetStatus())
+}
+
+// FollowUpgrade joins the room that replaced this room and switches to it.
+func (view *RoomView) FollowUpgrade() {
+	defer debug.Recover()
+	if err := view.parent.FollowRoomUpgrade(view.Room); err != nil {
+		view.AddServiceMessage(fmt.Sprintf("Failed to follow room upgrade: %v", err))
+		view.parent.parent.Render()
+	}
+}
+
+// SendPlainMessage sends the text as-is, without emoji shortcodes, markdown or HTML being processed.
+func (view *RoomView) SendPlainMessage(msgtype event.MessageType, text string) {
+	defer debug.Recover()
+	debug.Print("Sending plain message", msgtype, text, "to", view.Room.ID)
+	rel := view.getRelationForNewEvent()
+	evt, err := view.parent.matrix.PreparePlainMessage(view.Room.ID, msgtype, text, rel)
+	if err != nil {
+		view.AddServiceMessage(fmt.Sprintf("Failed to send message: %v", err))
+		view.parent.parent.Render()
+		return
+	}
+	view.addLocalEcho(evt)
+}
+
+func (view *RoomView) SendLocation(geoURI, description string) {
+	defer debug.Recover()
+	debug.Print("Sending location", geoURI, "to", view.Room.ID)
+	rel := view.getRelationForNewEvent()
+	evt, err := view.parent.matrix.PrepareLocationMessage(view.Room.ID, geoURI, description, rel)
+	if err != nil {
+		view.AddServiceMessage(fmt.Sprintf("Failed to send message: %v", err))
+		view.parent.parent.Render()
+		return
+	}
 	view.addLocalEcho(evt)
 }
 
+// formatFileSize formats the given number of bytes in a human-readable form.
+func formatFileSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
 func (view *RoomView) SendMessageMedia(path string) {
 	defer debug.Recover()
 	debug.Print("Sending media at", path, "to", view.Room.ID)
 	rel := view.getRelationForNewEvent()
-	evt, err := view.parent.matrix.PrepareMediaMessage(view.Room, path, rel)
+	name := filepath.Base(path)
+	progress := view.parent.OpenProgressModal("Uploading")
+	progress.SetMessage(fmt.Sprintf("Uploading %s", name))
+	progress.SetSteps(100)
+	var percent int64
+	evt, err := view.parent.matrix.PrepareMediaMessage(view.Room, path, rel, func(uploaded, total int64) {
+		if total <= 0 {
+			return
+		}
+		// Only update the modal when the percentage changes to avoid rendering after every read
+		newPercent := uploaded * 100 / total
+		if newPercent == percent {
+			return
+		}
+		for ; percent < newPercent; percent++ {
+			progress.Step()
+		}
+		progress.SetMessage(fmt.Sprintf("%s / %s", formatFileSize(uploaded), formatFileSize(total)))
+		view.parent.parent.Render()
+	})
+	progress.Close()
 	if err != nil {
 		view.AddServiceMessage(fmt.Sprintf("Failed to upload media: %v", err))
 		view.parent.parent.Render()
@@ -825,27 +1535,13 @@ func (view *RoomView) SendMessageMedia(path string) {
 func (view *RoomView) addLocalEcho(evt *muksevt.Event) {
 	msg := view.parseEvent(evt.SomewhatDangerousCopy())
 	view.content.AddMessage(msg, AppendMessage)
+	// Thread reply mode stays on until it's cleared explicitly, so a conversation can be continued in the thread
+	thread := view.threadReplying
 	view.ClearAllContext()
+	view.threadReplying = thread
 	view.status.SetText(view.GetStatus())
-	eventID, err := view.parent.matrix.SendEvent(evt)
-	if err != nil {
-		msg.State = muksevt.StateSendFail
-		// Show shorter version if available
-		if httpErr, ok := err.(mautrix.HTTPError); ok {
-			err = httpErr
-			if respErr := httpErr.RespError; respErr != nil {
-				err = respErr
-			}
-		}
-		view.AddServiceMessage(fmt.Sprintf("Failed to send message: %v", err))
-		view.parent.parent.Render()
-	} else {
-		debug.Print("Event ID received:", eventID)
-		msg.EventID = eventID
-		msg.State = muksevt.StateDefault
-		view.MessageView().setMessageID(msg)
-		view.parent.parent.Render()
-	}
+	view.parent.matrix.QueueOutgoing(evt)
+	view.enqueue(&outgoingMessage{msg: msg, evt: evt})
 }
 
 func (view *RoomView) MessageView() *MessageView {
@@ -866,6 +1562,12 @@ func (view *RoomView) Update() {
 		}
 		topicStr = strings.TrimSpace(topicStr)
 	}
+	if view.Room.IsReplaced() {
+		topicStr = "This room has been upgraded. Use /follow-upgrade or press Alt+u to join the new room."
+		view.topic.SetBackgroundColor(tcell.ColorDarkRed)
+	} else {
+		view.topic.SetBackgroundColor(tcell.ColorDarkGreen)
+	}
 	view.topic.SetText(topicStr)
 	if !view.userListLoaded {
 		view.UpdateUserList()
@@ -886,7 +1588,85 @@ func (view *RoomView) AddServiceMessage(text string) {
 }
 
 func (view *RoomView) parseEvent(evt *muksevt.Event) *messages.UIMessage {
-	return messages.ParseEvent(view.parent.matrix, view.parent, view.Room, evt)
+	msg := messages.ParseEvent(view.parent.matrix, view.parent, view.Room, evt)
+	if msg == nil {
+		return nil
+	}
+	if !msg.IsService {
+		// Highlights are computed once here, so that finding mentions doesn't need to evaluate push rules again.
+		msg.IsHighlight = view.parent.matrix.IsMention(view.Room, evt.Event)
+	}
+	if view.showReadReceipts() {
+		msg.SetReadReceipts(view.getReadReceipts(evt.ID))
+	}
+	return msg
+}
+
+// showReadReceipts returns whether read receipts of other users should be shown in this room. They're hidden in
+// large rooms to avoid clutter.
+func (view *RoomView) showReadReceipts() bool {
+	limit := view.config.ReadReceiptMemberLimit
+	return limit > 0 && view.Room.GetMemberCount() <= limit
+}
+
+func (view *RoomView) getReadReceipts(eventID id.EventID) []messages.ReadReceipt {
+	userIDs := view.Room.GetReadReceipts(eventID)
+	if len(userIDs) == 0 {
+		return nil
+	}
+	receipts := make([]messages.ReadReceipt, len(userIDs))
+	for i, userID := range userIDs {
+		receipts[i] = messages.ReadReceipt{UserID: userID, Name: string(userID)}
+		if member := view.Room.GetMember(userID); member != nil && len(member.Displayname) > 0 {
+			receipts[i].Name = member.Displayname
+		}
+	}
+	return receipts
+}
+
+// UpdateReadReceipts moves the read receipts of other users to the messages they've last read.
+func (view *RoomView) UpdateReadReceipts() {
+	show := view.showReadReceipts()
+	msgView := view.MessageView()
+	heightChanged := false
+	msgView.messagesLock.RLock()
+	for _, msg := range msgView.messages {
+		if len(msg.ReadReceipts) == 0 && (!show || msg.EventID == "") {
+			continue
+		}
+		height := msg.ReactionHeight()
+		if show {
+			msg.SetReadReceipts(view.getReadReceipts(msg.EventID))
+		} else {
+			msg.SetReadReceipts(nil)
+		}
+		heightChanged = heightChanged || height != msg.ReactionHeight()
+	}
+	msgView.messagesLock.RUnlock()
+	if heightChanged {
+		// Rebuild the buffer on the next draw, as messages may have been added or removed from the reaction row
+		msgView.msgBufferLock.Lock()
+		msgView.prevMsgCount = -1
+		msgView.msgBufferLock.Unlock()
+	}
+}
+
+// UpdateFullyRead moves the read marker divider to the message the user has fully read up to.
+func (view *RoomView) UpdateFullyRead() {
+	view.content.invalidateBuffer()
+}
+
+// SetFullyRead moves the fully read marker to the given message.
+func (view *RoomView) SetFullyRead(message *messages.UIMessage) {
+	defer debug.Recover()
+	if message.Event == nil || message.IsService || len(message.EventID) == 0 {
+		view.AddServiceMessage("Can't mark that message as read")
+	} else if err := view.parent.matrix.SetFullyRead(view.Room.ID, message.EventID); err != nil {
+		view.AddServiceMessage(fmt.Sprintf("Failed to move read marker: %v", err))
+	} else {
+		view.UpdateFullyRead()
+	}
+	view.parent.parent.Render()
 }
 
 func (view *RoomView) AddHistoryEvent(evt *muksevt.Event) {
@@ -913,16 +1693,16 @@ func (view *RoomView) AddEdit(evt *muksevt.Event) {
 	}
 }
 
-func (view *RoomView) AddReaction(evt *muksevt.Event, key string) {
+func (view *RoomView) UpdateReactions(evt *muksevt.Event) {
 	msgView := view.MessageView()
 	msg := msgView.getMessageByID(evt.ID)
 	if msg == nil {
 		// Message not in view, nothing to do
 		return
 	}
-	recalculate := len(msg.Reactions) == 0
-	msg.AddReaction(key)
-	if recalculate {
+	height := msg.ReactionHeight()
+	msg.SetReactions(evt, view.config.UserID)
+	if height != msg.ReactionHeight() {
 		// Recalculate height for message
 		msg.CalculateBuffer(msgView.prevPrefs, msgView.prevWidth())
 		msgView.replaceBuffer(msg, msg)
@@ -0,0 +1,236 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/mauview"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/config"
+	"maunium.net/go/gomuks/debug"
+	ifc "maunium.net/go/gomuks/interface"
+)
+
+var textViewTagRegex = regexp.MustCompile(`(\[[a-zA-Z0-9_,;: \-\."#]+\[*)\]`)
+
+// escapeTextViewTags escapes anything in message bodies that would be interpreted as a color tag or region.
+func escapeTextViewTags(text string) string {
+	return textViewTagRegex.ReplaceAllString(text, "$1[]")
+}
+
+// SearchResultsModal is a temporary buffer for the results of the server-side search API. Each result is shown with
+// the messages around it, and confirming a result jumps to it in its room. More results are loaded when moving past
+// the last one.
+type SearchResultsModal struct {
+	mauview.Component
+
+	container *mauview.Box
+
+	results *mauview.TextView
+	status  *mauview.TextField
+
+	roomID    id.RoomID
+	query     string
+	count     int
+	events    []*event.Event
+	nextBatch string
+	selected  int
+	loading   bool
+
+	parent *MainView
+}
+
+// NewSearchResultsModal creates a modal for the results of the given query. If roomID is empty, the results are from
+// all rooms and the room of each result is shown.
+func NewSearchResultsModal(parent *MainView, roomID id.RoomID, query string, width, height int) *SearchResultsModal {
+	srm := &SearchResultsModal{
+		parent: parent,
+		roomID: roomID,
+		query:  query,
+	}
+
+	srm.results = mauview.NewTextView().SetRegions(true)
+	srm.status = mauview.NewTextField()
+
+	flex := mauview.NewFlex().
+		SetDirection(mauview.FlexRow).
+		AddProportionalComponent(srm.results, 1).
+		AddFixedComponent(srm.status, 1)
+
+	title := fmt.Sprintf("Search results for \"%s\"", query)
+	if len(roomID) == 0 {
+		title += " in all rooms"
+	}
+	srm.container = mauview.NewBox(flex).
+		SetBorder(true).
+		SetTitle(title).
+		SetBlurCaptureFunc(func() bool {
+			srm.parent.HideModal()
+			return true
+		})
+
+	srm.Component = mauview.Center(srm.container, width, height).SetAlwaysFocusChild(true)
+
+	return srm
+}
+
+func (srm *SearchResultsModal) Focus() {
+	srm.container.Focus()
+}
+
+func (srm *SearchResultsModal) Blur() {
+	srm.container.Blur()
+}
+
+func (srm *SearchResultsModal) formatEvent(evt *event.Event) string {
+	body, _ := evt.Content.Raw["body"].(string)
+	body = escapeTextViewTags(strings.ReplaceAll(body, "\n", " "))
+	timestamp := time.Unix(evt.Timestamp/1000, evt.Timestamp%1000*int64(time.Millisecond))
+	if len(srm.roomID) == 0 {
+		roomName := string(evt.RoomID)
+		if room := srm.parent.matrix.GetRoom(evt.RoomID); room != nil {
+			roomName = room.GetTitle()
+		}
+		return fmt.Sprintf("%s %s <%s> %s", timestamp.Format("2006-01-02 15:04"), escapeTextViewTags(roomName), evt.Sender, body)
+	}
+	return fmt.Sprintf("%s <%s> %s", timestamp.Format("2006-01-02 15:04"), evt.Sender, body)
+}
+
+func (srm *SearchResultsModal) formatContext(evt *event.Event) string {
+	body, _ := evt.Content.Raw["body"].(string)
+	if len(body) == 0 {
+		body = evt.Type.Type
+	}
+	return fmt.Sprintf("    <%s> %s", evt.Sender, escapeTextViewTags(strings.ReplaceAll(body, "\n", " ")))
+}
+
+// AddResults appends a page of results to the buffer.
+func (srm *SearchResultsModal) AddResults(results *ifc.SearchResults) {
+	if results.Count > 0 {
+		srm.count = results.Count
+	}
+	srm.nextBatch = results.NextBatch
+	for _, result := range results.Results {
+		for _, evt := range result.ContextBefore {
+			fmt.Fprintln(srm.results, srm.formatContext(evt))
+		}
+		fmt.Fprintf(srm.results, `["%d"]%s[""]%s`, len(srm.events), srm.formatEvent(result.Event), "\n")
+		for _, evt := range result.ContextAfter {
+			fmt.Fprintln(srm.results, srm.formatContext(evt))
+		}
+		fmt.Fprintln(srm.results)
+		srm.events = append(srm.events, result.Event)
+	}
+	if len(srm.events) > 0 && len(srm.results.GetHighlights()) == 0 {
+		srm.results.Highlight(strconv.Itoa(srm.selected))
+	}
+	srm.updateStatus()
+}
+
+func (srm *SearchResultsModal) updateStatus() {
+	total := srm.count
+	if total < len(srm.events) {
+		total = len(srm.events)
+	}
+	if srm.loading {
+		srm.status.SetText(fmt.Sprintf("Showing %d of %d results, loading more...", len(srm.events), total))
+	} else if len(srm.nextBatch) > 0 {
+		srm.status.SetText(fmt.Sprintf("Showing %d of %d results, move past the last one to load more", len(srm.events), total))
+	} else {
+		srm.status.SetText(fmt.Sprintf("Showing all %d results, press enter to jump to one", len(srm.events)))
+	}
+}
+
+func (srm *SearchResultsModal) loadMore() {
+	srm.loading = true
+	srm.updateStatus()
+	go func() {
+		defer debug.Recover()
+		results, err := srm.parent.matrix.Search(srm.query, srm.roomID, srm.nextBatch)
+		srm.loading = false
+		if err != nil {
+			srm.status.SetText(fmt.Sprintf("Failed to load more results: %v", err))
+		} else {
+			srm.AddResults(results)
+			srm.selectResult(srm.selected + 1)
+		}
+		srm.parent.parent.Render()
+	}()
+}
+
+func (srm *SearchResultsModal) selectResult(index int) {
+	if len(srm.events) == 0 {
+		return
+	} else if index >= len(srm.events) && len(srm.nextBatch) > 0 {
+		if !srm.loading {
+			srm.loadMore()
+		}
+		return
+	}
+	srm.selected = (index + len(srm.events)) % len(srm.events)
+	srm.results.Highlight(strconv.Itoa(srm.selected))
+	srm.results.ScrollToHighlight()
+}
+
+func (srm *SearchResultsModal) jumpToSelected() {
+	if len(srm.events) == 0 {
+		return
+	}
+	evt := srm.events[srm.selected]
+	go func() {
+		defer debug.Recover()
+		err := srm.parent.JumpToEvent(evt.RoomID, evt.ID, srm.query)
+		if err != nil {
+			if roomView := srm.parent.currentRoom; roomView != nil {
+				roomView.AddServiceMessage(fmt.Sprintf("Failed to jump to search result %s: %v", evt.ID, err))
+			}
+			srm.parent.parent.Render()
+		}
+	}()
+}
+
+func (srm *SearchResultsModal) OnKeyEvent(event mauview.KeyEvent) bool {
+	kb := config.Keybind{
+		Key: event.Key(),
+		Ch:  event.Rune(),
+		Mod: event.Modifiers(),
+	}
+	switch srm.parent.config.Keybindings.Modal[kb] {
+	case "cancel":
+		srm.parent.HideModal()
+		return true
+	case "select_next":
+		srm.selectResult(srm.selected + 1)
+		return true
+	case "select_prev":
+		srm.selectResult(srm.selected - 1)
+		return true
+	case "confirm":
+		srm.parent.HideModal()
+		srm.jumpToSelected()
+		return true
+	}
+	return srm.results.OnKeyEvent(event)
+}
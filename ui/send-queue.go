@@ -0,0 +1,291 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/matrix/muksevt"
+	"maunium.net/go/gomuks/ui/messages"
+)
+
+const (
+	// sendRetryInitialDelay is the delay before the first automatic retry of a message that failed to send. The delay
+	// is doubled after every failed attempt.
+	sendRetryInitialDelay = 2 * time.Second
+	// sendRetryMaxDelay is the maximum delay between automatic retries.
+	sendRetryMaxDelay = 5 * time.Minute
+	// maxSendRetries is the number of automatic retries after which a message has to be retried manually.
+	maxSendRetries = 10
+)
+
+// outgoingMessage is a message in the outgoing queue along with the event that's sent. The event is copied before
+// every attempt, so that it's encrypted again when retrying, and the transaction ID stays the same so that the
+// server can deduplicate attempts that did go through.
+type outgoingMessage struct {
+	msg *messages.UIMessage
+	evt *muksevt.Event
+	// attempts is the number of times sending has failed.
+	attempts int
+	// retry is the timer of the pending automatic retry, or nil if there isn't one.
+	retry   *time.Timer
+	retryAt time.Time
+}
+
+// sendRetryDelay checks if sending failed because of a temporary error, like a network error, a rate limit or an
+// internal server error, and returns how long to wait before trying again. Rate limits use the delay given by the
+// server, other errors use exponential backoff based on the number of previous attempts.
+func sendRetryDelay(err error, attempts int) (time.Duration, bool) {
+	var httpErr mautrix.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Request == nil {
+		return 0, false
+	}
+	backoff := sendRetryInitialDelay << attempts
+	if backoff <= 0 || backoff > sendRetryMaxDelay {
+		backoff = sendRetryMaxDelay
+	}
+	switch {
+	case httpErr.Response == nil:
+		// The request didn't reach the server.
+		return backoff, true
+	case httpErr.IsStatus(http.StatusTooManyRequests) || errors.Is(err, mautrix.MLimitExceeded):
+		if httpErr.RespError != nil {
+			if retryAfterMS, ok := httpErr.RespError.ExtraData["retry_after_ms"].(float64); ok && retryAfterMS > 0 {
+				return time.Duration(retryAfterMS) * time.Millisecond, true
+			}
+		}
+		if retryAfter, err := strconv.Atoi(httpErr.Response.Header.Get("Retry-After")); err == nil && retryAfter > 0 {
+			return time.Duration(retryAfter) * time.Second, true
+		}
+		return backoff, true
+	case httpErr.Response.StatusCode >= 500:
+		return backoff, true
+	default:
+		return 0, false
+	}
+}
+
+// enqueue adds a message to the end of the outgoing queue and sends the queue, unless it's already being sent.
+func (view *RoomView) enqueue(out *outgoingMessage) {
+	view.outgoingLock.Lock()
+	view.outgoing = append(view.outgoing, out)
+	if view.sendingOutgoing {
+		out.msg.State = muksevt.StateQueued
+		view.outgoingLock.Unlock()
+		view.parent.parent.Render()
+		return
+	}
+	view.sendingOutgoing = true
+	view.outgoingLock.Unlock()
+	view.sendOutgoing()
+}
+
+// ResumeSending adds messages that were left in the outgoing queue when gomuks was closed to the timeline and sends
+// them again.
+func (view *RoomView) ResumeSending(evts []*muksevt.Event) {
+	defer debug.Recover()
+	for _, evt := range evts {
+		if _, ok := evt.Content.Parsed.(*event.MessageEventContent); !ok {
+			view.parent.matrix.DequeueOutgoing(evt)
+			continue
+		}
+		msg := view.parseEvent(evt.SomewhatDangerousCopy())
+		if msg == nil {
+			view.parent.matrix.DequeueOutgoing(evt)
+			continue
+		}
+		view.content.AddMessage(msg, AppendMessage)
+		view.outgoingLock.Lock()
+		view.outgoing = append(view.outgoing, &outgoingMessage{msg: msg, evt: evt})
+		view.outgoingLock.Unlock()
+	}
+	view.outgoingLock.Lock()
+	if view.sendingOutgoing || len(view.outgoing) == 0 {
+		view.outgoingLock.Unlock()
+		return
+	}
+	view.sendingOutgoing = true
+	view.outgoingLock.Unlock()
+	view.sendOutgoing()
+}
+
+// sendOutgoing sends the messages in the outgoing queue in order until the queue is empty or the first message has
+// to wait for an automatic retry, in which case the retry timer continues sending the queue.
+func (view *RoomView) sendOutgoing() {
+	defer debug.Recover()
+	for {
+		view.outgoingLock.Lock()
+		if len(view.outgoing) == 0 {
+			view.sendingOutgoing = false
+			view.outgoingLock.Unlock()
+			return
+		}
+		out := view.outgoing[0]
+		out.retry = nil
+		view.outgoingLock.Unlock()
+		if !view.sendOutgoingMessage(out) {
+			return
+		}
+	}
+}
+
+// removeOutgoing removes a message from the outgoing queue, both in memory and on disk.
+func (view *RoomView) removeOutgoing(out *outgoingMessage) {
+	view.outgoingLock.Lock()
+	for i, item := range view.outgoing {
+		if item == out {
+			view.outgoing = append(view.outgoing[:i], view.outgoing[i+1:]...)
+			break
+		}
+	}
+	view.outgoingLock.Unlock()
+	view.parent.matrix.DequeueOutgoing(out.evt)
+}
+
+// sendOutgoingMessage sends the first message of the outgoing queue and updates the state of the message based on
+// the result. Returns false if sending failed temporarily and an automatic retry was scheduled.
+func (view *RoomView) sendOutgoingMessage(out *outgoingMessage) bool {
+	if out.evt.Sender != view.config.UserID {
+		// The account was switched, so the event can't be sent anymore.
+		view.removeOutgoing(out)
+		return true
+	}
+	out.msg.State = muksevt.StateLocalEcho
+	view.parent.parent.Render()
+	eventID, err := view.parent.matrix.SendEvent(out.evt)
+	if err == nil {
+		view.removeOutgoing(out)
+		debug.Print("Event ID received:", eventID)
+		out.msg.EventID = eventID
+		out.msg.State = muksevt.StateDefault
+		out.msg.SendError = ""
+		view.MessageView().setMessageID(out.msg)
+		view.parent.parent.Render()
+		return true
+	}
+	delay, temporary := sendRetryDelay(err, out.attempts)
+	// Show shorter version if available
+	if httpErr, ok := err.(mautrix.HTTPError); ok {
+		err = httpErr
+		if respErr := httpErr.RespError; respErr != nil {
+			err = respErr
+		}
+	}
+	out.attempts++
+	view.outgoingLock.Lock()
+	out.msg.SendError = err.Error()
+	if temporary && out.attempts <= maxSendRetries {
+		debug.Printf("Sending %s failed: %v, retrying in %s", out.evt.Unsigned.TransactionID, err, delay)
+		out.msg.State = muksevt.StateSendRetry
+		out.retryAt = time.Now().Add(delay)
+		out.retry = time.AfterFunc(delay, view.sendOutgoing)
+		view.outgoingLock.Unlock()
+		view.parent.parent.Render()
+		return false
+	}
+	out.msg.State = muksevt.StateSendFail
+	view.failed = append(view.failed, out)
+	view.outgoingLock.Unlock()
+	view.removeOutgoing(out)
+	view.AddServiceMessage(fmt.Sprintf("Failed to send message: %v", err))
+	view.parent.parent.Render()
+	return true
+}
+
+// outgoingStatus returns the text shown in the status bar about messages that are waiting for a retry or have failed
+// to send.
+func (view *RoomView) outgoingStatus() string {
+	view.outgoingLock.Lock()
+	defer view.outgoingLock.Unlock()
+	if len(view.outgoing) > 0 && view.outgoing[0].retry != nil {
+		head := view.outgoing[0]
+		status := fmt.Sprintf("Failed to send message: %s, retrying in %s (use /retry cancel to stop)",
+			head.msg.SendError, time.Until(head.retryAt).Round(time.Second))
+		if len(view.outgoing) > 1 {
+			status = fmt.Sprintf("%s, %d more queued", status, len(view.outgoing)-1)
+		}
+		return status
+	} else if len(view.failed) > 0 {
+		last := view.failed[len(view.failed)-1]
+		return fmt.Sprintf("Failed to send message: %s (use /retry to send it again)", last.msg.SendError)
+	}
+	return ""
+}
+
+// RetrySend retries sending right away. If the outgoing queue is waiting for an automatic retry, it's retried
+// immediately, otherwise the most recent message that failed to send permanently is added back to the queue.
+func (view *RoomView) RetrySend() {
+	defer debug.Recover()
+	view.outgoingLock.Lock()
+	if len(view.outgoing) > 0 && view.outgoing[0].retry != nil {
+		stopped := view.outgoing[0].retry.Stop()
+		view.outgoingLock.Unlock()
+		// If the timer couldn't be stopped, it has already started retrying.
+		if stopped {
+			view.sendOutgoing()
+		}
+		return
+	} else if len(view.failed) == 0 {
+		view.outgoingLock.Unlock()
+		view.AddServiceMessage("There are no failed messages to retry")
+		view.parent.parent.Render()
+		return
+	}
+	out := view.failed[len(view.failed)-1]
+	view.failed = view.failed[:len(view.failed)-1]
+	view.outgoingLock.Unlock()
+	out.attempts = 0
+	out.msg.SendError = ""
+	view.parent.matrix.QueueOutgoing(out.evt)
+	view.enqueue(out)
+}
+
+// CancelRetry stops the automatic retry of the first message in the outgoing queue. The message is marked as failed,
+// so it can still be retried manually, and the rest of the queue is sent.
+func (view *RoomView) CancelRetry() {
+	defer debug.Recover()
+	view.outgoingLock.Lock()
+	if len(view.outgoing) == 0 || view.outgoing[0].retry == nil {
+		view.outgoingLock.Unlock()
+		view.AddServiceMessage("There are no pending retries")
+		view.parent.parent.Render()
+		return
+	}
+	out := view.outgoing[0]
+	if !out.retry.Stop() {
+		view.outgoingLock.Unlock()
+		view.AddServiceMessage("The message is already being retried")
+		view.parent.parent.Render()
+		return
+	}
+	out.retry = nil
+	out.msg.State = muksevt.StateSendFail
+	view.failed = append(view.failed, out)
+	view.outgoingLock.Unlock()
+	view.removeOutgoing(out)
+	view.AddServiceMessage("Cancelled the automatic retry, use /retry to send the message manually")
+	view.parent.parent.Render()
+	view.sendOutgoing()
+}
@@ -28,7 +28,9 @@ type SyncingModal struct {
 	progress *mauview.ProgressBar
 }
 
-func NewSyncingModal(parent *MainView) (mauview.Component, *SyncingModal) {
+// NewSyncingModal creates a progress modal with the given title. Despite the name, it's also used for other long
+// operations like media uploads.
+func NewSyncingModal(parent *MainView, title string) (mauview.Component, *SyncingModal) {
 	sm := &SyncingModal{
 		parent:   parent,
 		progress: mauview.NewProgressBar(),
@@ -40,7 +42,7 @@ func NewSyncingModal(parent *MainView) (mauview.Component, *SyncingModal) {
 				SetDirection(mauview.FlexRow).
 				AddFixedComponent(sm.progress, 1).
 				AddFixedComponent(mauview.Center(sm.text, 40, 1), 1)).
-			SetTitle("Synchronizing"),
+			SetTitle(title),
 		42, 4).
 		SetAlwaysFocusChild(true), sm
 }
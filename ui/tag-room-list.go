@@ -63,6 +63,19 @@ func (or *OrderedRoom) Draw(roomList *RoomList, screen mauview.Screen, x, y, lin
 
 	unreadCount := or.UnreadCount()
 
+	mx := roomList.parent.matrix
+	if or.IsDirect && len(or.OtherUser) > 0 && mx.PresenceEnabled() {
+		symbol, color := presenceIndicator(mx.GetPresence(or.OtherUser))
+		symbolStyle := style
+		if color != tcell.ColorDefault {
+			symbolStyle = style.Foreground(color)
+		}
+		screen.SetCell(x, y, symbolStyle, symbol)
+		screen.SetCell(x+1, y, style, ' ')
+		x += 2
+		lineWidth -= 2
+	}
+
 	widget.WriteLinePadded(screen, mauview.AlignLeft, or.GetTitle(), x, y, lineWidth, style)
 
 	if unreadCount > 0 {
@@ -93,6 +93,8 @@ func (ui *GomuksUI) Render() {
 }
 
 func (ui *GomuksUI) OnLogin() {
+	ui.mainView.setupVerificationInbox()
+	ui.mainView.loadSavedCrossSigningKeys()
 	ui.SetView(ViewMain)
 }
 
@@ -0,0 +1,159 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build cgo
+
+package ui
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/debug"
+)
+
+type pendingVerification struct {
+	TransactionID string
+	Device        *crypto.DeviceIdentity
+	Received      time.Time
+}
+
+// verificationInbox contains incoming to-device verification requests that haven't been accepted or rejected yet.
+type verificationInbox struct {
+	sync.Mutex
+	pending  map[string]*pendingVerification
+	accepted map[string]crypto.VerificationHooks
+	timeout  time.Duration
+}
+
+var verifications = &verificationInbox{
+	pending:  make(map[string]*pendingVerification),
+	accepted: make(map[string]crypto.VerificationHooks),
+}
+
+func pendingVerificationKey(userID id.UserID, deviceID id.DeviceID) string {
+	return userID.String() + "|" + deviceID.String()
+}
+
+// pruneLocked removes requests that have expired. The lock must be held when calling this.
+func (inbox *verificationInbox) pruneLocked() {
+	for key, req := range inbox.pending {
+		if inbox.timeout > 0 && time.Since(req.Received) > inbox.timeout {
+			delete(inbox.pending, key)
+		}
+	}
+}
+
+// List returns the pending verification requests, oldest first.
+func (inbox *verificationInbox) List() []*pendingVerification {
+	inbox.Lock()
+	defer inbox.Unlock()
+	inbox.pruneLocked()
+	list := make([]*pendingVerification, 0, len(inbox.pending))
+	for _, req := range inbox.pending {
+		list = append(list, req)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Received.Before(list[j].Received)
+	})
+	return list
+}
+
+// Pop removes and returns the pending request from the given device, or nil if there isn't one.
+func (inbox *verificationInbox) Pop(userID id.UserID, deviceID id.DeviceID) *pendingVerification {
+	inbox.Lock()
+	defer inbox.Unlock()
+	inbox.pruneLocked()
+	key := pendingVerificationKey(userID, deviceID)
+	req, ok := inbox.pending[key]
+	if ok {
+		delete(inbox.pending, key)
+	}
+	return req
+}
+
+func pendingVerificationCount() int {
+	verifications.Lock()
+	defer verifications.Unlock()
+	verifications.pruneLocked()
+	return len(verifications.pending)
+}
+
+// Accept marks the given transaction as accepted, so that the AcceptVerificationFrom hook accepts it with the
+// given hooks when the request is passed to the crypto machine again.
+func (inbox *verificationInbox) Accept(userID id.UserID, transactionID string, hooks crypto.VerificationHooks) {
+	inbox.Lock()
+	defer inbox.Unlock()
+	inbox.accepted[userID.String()+"|"+transactionID] = hooks
+}
+
+// popAccepted removes and returns the hooks of an accepted transaction, or nil if the transaction wasn't accepted.
+func (inbox *verificationInbox) popAccepted(userID id.UserID, transactionID string) crypto.VerificationHooks {
+	inbox.Lock()
+	defer inbox.Unlock()
+	key := userID.String() + "|" + transactionID
+	hooks, ok := inbox.accepted[key]
+	if ok {
+		delete(inbox.accepted, key)
+	}
+	return hooks
+}
+
+// setupVerificationInbox makes the crypto machine put incoming verification requests into the inbox instead of
+// rejecting them. When the user accepts a request, the received request is passed to the machine again, which then
+// continues the existing transaction with the hooks given to Accept.
+//
+// In-room verification requests aren't supported: gomuks only handles in-room verification that it started itself,
+// so incoming in-room requests are cancelled with a reason that tells the other side to use to-device verification.
+func (view *MainView) setupVerificationInbox() {
+	mach, ok := view.matrix.Crypto().(*crypto.OlmMachine)
+	if !ok {
+		return
+	}
+	verifications.timeout = mach.DefaultSASTimeout
+	mach.AcceptVerificationFrom = func(transactionID string, device *crypto.DeviceIdentity, roomID id.RoomID) (crypto.VerificationRequestResponse, crypto.VerificationHooks) {
+		if len(roomID) > 0 {
+			view.matrix.LogVerification("Cancelled unsupported in-room verification request %s from %s/%s in %s", transactionID, device.UserID, device.DeviceID, roomID)
+			err := mach.SendInRoomSASVerificationCancel(roomID, device.UserID, transactionID,
+				"gomuks doesn't support incoming in-room verification, verify the device directly instead",
+				event.VerificationCancelUnknownMethod)
+			if err != nil {
+				debug.Printf("Failed to cancel in-room verification request %s from %s: %v", transactionID, device.UserID, err)
+			}
+			return crypto.IgnoreRequest, nil
+		}
+		if hooks := verifications.popAccepted(device.UserID, transactionID); hooks != nil {
+			view.matrix.LogVerification("Accepted verification request %s from %s/%s", transactionID, device.UserID, device.DeviceID)
+			return crypto.AcceptRequest, hooks
+		}
+		debug.Printf("Received verification request %s from %s/%s", transactionID, device.UserID, device.DeviceID)
+		view.matrix.LogVerification("Queued verification request %s from %s/%s", transactionID, device.UserID, device.DeviceID)
+		verifications.Lock()
+		verifications.pending[pendingVerificationKey(device.UserID, device.DeviceID)] = &pendingVerification{
+			TransactionID: transactionID,
+			Device:        device,
+			Received:      time.Now(),
+		}
+		verifications.Unlock()
+		view.parent.Render()
+		return crypto.IgnoreRequest, nil
+	}
+}
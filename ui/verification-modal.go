@@ -19,9 +19,11 @@
 package ui
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"go.mau.fi/mauview"
@@ -29,6 +31,7 @@ import (
 
 	"maunium.net/go/mautrix/crypto"
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 
 	"maunium.net/go/gomuks/config"
 	"maunium.net/go/gomuks/debug"
@@ -71,27 +74,45 @@ type VerificationModal struct {
 
 	container *mauview.Box
 
-	waitingBar *mauview.ProgressBar
-	infoText   *mauview.TextView
-	emojiText  *EmojiView
-	inputBar   *mauview.InputField
+	waitingBar  *mauview.ProgressBar
+	profileText *mauview.TextView
+	infoText    *mauview.TextView
+	emojiText   *EmojiView
+	inputBar    *mauview.InputField
 
-	progress    int
+	title       string
 	progressMax int
 	stopWaiting chan struct{}
+	stopOnce    sync.Once
 	confirmChan chan bool
+
+	// lock protects progress, done and displayName, which are changed by the countdown, crypto and profile
+	// goroutines.
+	lock        sync.Mutex
+	progress    int
 	done        bool
+	displayName string
+
+	// observeOnly makes the modal only display and compare the SAS. The
+	// verification is cancelled after the comparison, so no trust is established.
+	observeOnly   bool
+	observed      bool
+	observedMatch bool
+	transactionID string
+	// decimalSAS makes the modal only offer the decimal SAS, for terminals that can't display the emojis.
+	decimalSAS bool
 
 	parent *MainView
 }
 
-func NewVerificationModal(mainView *MainView, device *crypto.DeviceIdentity, timeout time.Duration) *VerificationModal {
+func NewVerificationModal(mainView *MainView, device *crypto.DeviceIdentity, roomID id.RoomID, timeout time.Duration) *VerificationModal {
 	vm := &VerificationModal{
 		parent:      mainView,
 		device:      device,
+		title:       "Interactive verification",
 		stopWaiting: make(chan struct{}),
 		confirmChan: make(chan bool),
-		done:        false,
+		decimalSAS:  mainView.config.Preferences.UseDecimalSAS(mainView.canDisplaySASEmojis()),
 	}
 
 	vm.progressMax = int(timeout.Seconds())
@@ -101,6 +122,9 @@ func NewVerificationModal(mainView *MainView, device *crypto.DeviceIdentity, tim
 		SetProgress(vm.progress).
 		SetIndeterminate(false)
 
+	vm.profileText = mauview.NewTextView()
+	vm.profileText.SetText(fmt.Sprintf("User: %s\nResolving profile...", device.UserID))
+
 	vm.infoText = mauview.NewTextView()
 	vm.infoText.SetText(fmt.Sprintf("Waiting for %s\nto accept", device.UserID))
 
@@ -113,32 +137,126 @@ func NewVerificationModal(mainView *MainView, device *crypto.DeviceIdentity, tim
 	flex := mauview.NewFlex().
 		SetDirection(mauview.FlexRow).
 		AddFixedComponent(vm.waitingBar, 1).
+		AddFixedComponent(vm.profileText, 2).
 		AddFixedComponent(vm.infoText, 4).
 		AddFixedComponent(vm.emojiText, 4).
 		AddFixedComponent(vm.inputBar, 1)
 
 	vm.container = mauview.NewBox(flex).
-		SetBorder(true).
-		SetTitle("Interactive verification")
+		SetBorder(true)
+	vm.updateCountdown()
 
-	vm.Component = mauview.Center(vm.container, 45, 12).SetAlwaysFocusChild(true)
+	vm.Component = mauview.Center(vm.container, 45, 14).SetAlwaysFocusChild(true)
 
 	go vm.decrementWaitingBar()
+	go vm.resolveProfile(roomID)
+	mainView.matrix.LogVerification("Opened verification with %s/%s (room: %s)", device.UserID, device.DeviceID, roomID)
 
 	return vm
 }
 
+// SetObserveOnly switches the modal into observer mode, in which the SAS is only compared and the
+// transaction is cancelled afterwards instead of marking the device as verified.
+func (vm *VerificationModal) SetObserveOnly(transactionID string) {
+	vm.observeOnly = true
+	vm.title = "Observer verification (no trust)"
+	vm.SetTransactionID(transactionID)
+	vm.updateCountdown()
+}
+
+// SetTransactionID sets the ID of the to-device verification transaction, so that it can be cancelled when the
+// countdown runs out. In-room verifications are left to time out on their own.
+func (vm *VerificationModal) SetTransactionID(transactionID string) {
+	vm.transactionID = transactionID
+}
+
+// resolveProfile shows the display name and avatar URL of the other user, so that users with similar-looking
+// user IDs are easier to tell apart.
+func (vm *VerificationModal) resolveProfile(roomID id.RoomID) {
+	userID := vm.device.UserID
+	displayName, avatarURL := vm.parent.matrix.GetProfile(roomID, userID)
+	vm.lock.Lock()
+	vm.displayName = displayName
+	vm.lock.Unlock()
+	if len(displayName) == 0 {
+		displayName = "(no display name)"
+	}
+	if len(avatarURL) == 0 {
+		avatarURL = "(no avatar)"
+	}
+	vm.profileText.SetText(fmt.Sprintf("%s (%s)\nAvatar: %s", displayName, userID, avatarURL))
+	vm.parent.parent.Render()
+}
+
+// otherParty returns the display name and user ID of the other user, or just the user ID if the display name
+// isn't known.
+func (vm *VerificationModal) otherParty() string {
+	vm.lock.Lock()
+	displayName := vm.displayName
+	vm.lock.Unlock()
+	if len(displayName) > 0 {
+		return fmt.Sprintf("%s (%s)", displayName, vm.device.UserID)
+	}
+	return vm.device.UserID.String()
+}
+
+func (vm *VerificationModal) updateCountdown() {
+	vm.lock.Lock()
+	progress := vm.progress
+	vm.lock.Unlock()
+	vm.waitingBar.SetProgress(progress)
+	vm.container.SetTitle(fmt.Sprintf("%s (%d:%02d)", vm.title, progress/60, progress%60))
+}
+
+// resetCountdown restarts the countdown, which is done whenever the verification moves forward.
+func (vm *VerificationModal) resetCountdown() {
+	vm.lock.Lock()
+	vm.progress = vm.progressMax
+	vm.lock.Unlock()
+	vm.updateCountdown()
+}
+
+// isDone returns whether the verification has ended and the modal is only waiting to be closed.
+func (vm *VerificationModal) isDone() bool {
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+	return vm.done
+}
+
+// markDone marks the verification as ended. It returns false if it had already ended.
+func (vm *VerificationModal) markDone() bool {
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+	if vm.done {
+		return false
+	}
+	vm.done = true
+	return true
+}
+
+func (vm *VerificationModal) stopCountdown() {
+	vm.stopOnce.Do(func() {
+		close(vm.stopWaiting)
+	})
+	vm.waitingBar.SetIndeterminate(false).SetMax(100).SetProgress(100)
+	vm.container.SetTitle(vm.title)
+}
+
 func (vm *VerificationModal) decrementWaitingBar() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
 		select {
-		case <-time.Tick(time.Second):
-			if vm.progress <= 0 {
-				vm.waitingBar.SetIndeterminate(true)
-				vm.parent.parent.app.SetRedrawTicker(100 * time.Millisecond)
+		case <-ticker.C:
+			vm.lock.Lock()
+			vm.progress--
+			progress := vm.progress
+			vm.lock.Unlock()
+			if progress <= 0 {
+				vm.onTimeout()
 				return
 			}
-			vm.progress--
-			vm.waitingBar.SetProgress(vm.progress)
+			vm.updateCountdown()
 			vm.parent.parent.Render()
 		case <-vm.stopWaiting:
 			return
@@ -146,7 +264,59 @@ func (vm *VerificationModal) decrementWaitingBar() {
 	}
 }
 
+func (vm *VerificationModal) onTimeout() {
+	vm.parent.matrix.LogVerification("Verification with %s/%s timed out", vm.device.UserID, vm.device.DeviceID)
+	// Close first, so that the OnCancel call caused by cancelling the transaction is ignored
+	vm.closeWithMessage(fmt.Sprintf("Verification with %s timed out", vm.otherParty()))
+	if len(vm.transactionID) > 0 {
+		mach := vm.parent.matrix.Crypto().(*crypto.OlmMachine)
+		err := mach.CancelSASVerification(vm.device.UserID, vm.transactionID, "Timed out")
+		if err != nil && !errors.Is(err, crypto.ErrUnknownTransaction) {
+			debug.Printf("Failed to cancel timed out verification %s: %v", vm.transactionID, err)
+		}
+	}
+}
+
+// closeWithMessage hides the modal and shows the message in the current room instead. It's used when the
+// verification ends without anything left to do in the modal.
+func (vm *VerificationModal) closeWithMessage(message string) {
+	if !vm.markDone() {
+		return
+	}
+	vm.stopCountdown()
+	// Unblock VerifySASMatch if the SAS was still being compared
+	select {
+	case vm.confirmChan <- false:
+	default:
+	}
+	vm.parent.HideModal()
+	if vm.parent.currentRoom != nil {
+		vm.parent.currentRoom.AddServiceMessage(message)
+	}
+	vm.parent.parent.Render()
+}
+
+// sasEmojiSample is a subset of the SAS emojis used to check whether the terminal can display them.
+var sasEmojiSample = []rune{'🐶', '🦄', '🌵', '🎅', '🔒', '📌'}
+
+func (view *MainView) canDisplaySASEmojis() bool {
+	screen := view.parent.app.Screen()
+	if screen == nil {
+		return true
+	}
+	for _, emoji := range sasEmojiSample {
+		if !screen.CanDisplay(emoji, false) {
+			return false
+		}
+	}
+	return true
+}
+
 func (vm *VerificationModal) VerificationMethods() []crypto.VerificationMethod {
+	if vm.decimalSAS {
+		// Decimal is mandatory in the spec, so offering only it doesn't prevent verifying with any client
+		return []crypto.VerificationMethod{crypto.VerificationMethodDecimal{}}
+	}
 	return []crypto.VerificationMethod{crypto.VerificationMethodEmoji{}, crypto.VerificationMethodDecimal{}}
 }
 
@@ -158,53 +328,97 @@ func (vm *VerificationModal) VerifySASMatch(device *crypto.DeviceIdentity, data
 	} else if data.Type() == event.SASEmoji {
 		typeName = "emojis"
 	} else {
+		vm.parent.matrix.LogVerification("Unsupported SAS type %s from %s/%s", data.Type(), device.UserID, device.DeviceID)
 		return false
 	}
-	vm.infoText.SetText(fmt.Sprintf(
-		"Check if the other device is showing the\n"+
-			"same %s as below, then type \"yes\" to\n"+
-			"accept, or \"no\" to reject", typeName))
+	vm.parent.matrix.LogVerification("Showing SAS (%s) for %s/%s", typeName, device.UserID, device.DeviceID)
+	if vm.observeOnly {
+		vm.infoText.SetText(fmt.Sprintf(
+			"Observer mode, this will NOT verify the\n"+
+				"device. Type \"yes\" if the other device\n"+
+				"shows the same %s, otherwise \"no\"", typeName))
+	} else {
+		vm.infoText.SetText(fmt.Sprintf(
+			"Check if the other device is showing the\n"+
+				"same %s as below, then type \"yes\" to\n"+
+				"accept, or \"no\" to reject", typeName))
+	}
 	vm.inputBar.
 		SetTextColor(tcell.ColorDefault).
 		SetBackgroundColor(tcell.ColorDarkCyan).
 		SetPlaceholder("Type \"yes\" or \"no\"").
 		Focus()
 	vm.emojiText.Data = data
+	vm.resetCountdown()
 	vm.parent.parent.Render()
-	vm.progress = vm.progressMax
 	confirm := <-vm.confirmChan
-	vm.progress = vm.progressMax
+	if vm.isDone() {
+		return false
+	}
+	vm.parent.matrix.LogVerification("User answered SAS match with %s/%s: %t", device.UserID, device.DeviceID, confirm)
+	vm.resetCountdown()
 	vm.emojiText.Data = nil
-	vm.infoText.SetText(fmt.Sprintf("Waiting for %s\nto confirm", vm.device.UserID))
+	if vm.observeOnly {
+		vm.observed = true
+		vm.observedMatch = confirm
+		mach := vm.parent.matrix.Crypto().(*crypto.OlmMachine)
+		err := mach.CancelSASVerification(vm.device.UserID, vm.transactionID, "Observer-only verification finished")
+		if err != nil {
+			debug.Printf("Failed to cancel observer verification %s: %v", vm.transactionID, err)
+		}
+		return false
+	}
+	vm.infoText.SetText(fmt.Sprintf("Waiting for %s\nto confirm", vm.otherParty()))
 	vm.parent.parent.Render()
 	return confirm
 }
 
-func (vm *VerificationModal) OnCancel(cancelledByUs bool, reason string, _ event.VerificationCancelCode) {
-	vm.waitingBar.SetIndeterminate(false).SetMax(100).SetProgress(100)
-	vm.parent.parent.app.SetRedrawTicker(1 * time.Minute)
-	if cancelledByUs {
-		vm.infoText.SetText(fmt.Sprintf("Verification failed: %s", reason))
+func (vm *VerificationModal) OnCancel(cancelledByUs bool, reason string, code event.VerificationCancelCode) {
+	vm.parent.matrix.LogVerification("Verification with %s/%s cancelled (by us: %t, code: %s): %s",
+		vm.device.UserID, vm.device.DeviceID, cancelledByUs, code, reason)
+	if vm.isDone() {
+		// Already closed, e.g. when the countdown ran out
+		return
+	} else if !cancelledByUs {
+		vm.closeWithMessage(fmt.Sprintf("Verification cancelled by %s: %s", vm.otherParty(), reason))
+		return
+	}
+	vm.stopCountdown()
+	if vm.observeOnly && vm.observed {
+		result := "did NOT match"
+		if vm.observedMatch {
+			result = "matched"
+		}
+		vm.infoText.SetText(fmt.Sprintf("SAS %s for %s of %s.\nObserver mode: no trust was established.", result, vm.device.DeviceID, vm.device.UserID))
 	} else {
-		vm.infoText.SetText(fmt.Sprintf("Verification cancelled by %s: %s", vm.device.UserID, reason))
+		vm.infoText.SetText(fmt.Sprintf("Verification failed: %s", reason))
 	}
 	vm.inputBar.SetPlaceholder("Press enter to close the dialog")
-	vm.stopWaiting <- struct{}{}
-	vm.done = true
+	vm.markDone()
 	vm.parent.parent.Render()
 }
 
 func (vm *VerificationModal) OnSuccess() {
-	vm.waitingBar.SetIndeterminate(false).SetMax(100).SetProgress(100)
-	vm.parent.parent.app.SetRedrawTicker(1 * time.Minute)
-	vm.infoText.SetText(fmt.Sprintf("Successfully verified %s (%s) of %s", vm.device.Name, vm.device.DeviceID, vm.device.UserID))
+	vm.parent.matrix.LogVerification("Verification with %s/%s succeeded", vm.device.UserID, vm.device.DeviceID)
+	vm.stopCountdown()
+	infoText := fmt.Sprintf("Successfully verified %s (%s) of %s", vm.device.Name, vm.device.DeviceID, vm.otherParty())
+	mach := vm.parent.matrix.Crypto().(*crypto.OlmMachine)
+	if vm.device.UserID != mach.Client.UserID && mach.CrossSigningKeys != nil {
+		// mautrix signs the other user's master key after a successful verification, so their cross-signed devices are trusted too
+		marked, err := markCrossSignedDevicesTrusted(mach, vm.device.UserID)
+		if err != nil {
+			debug.Printf("Failed to mark cross-signed devices of %s as trusted: %v", vm.device.UserID, err)
+		} else {
+			infoText += fmt.Sprintf("\nMarked %d cross-signed devices as trusted", marked)
+		}
+	}
+	vm.infoText.SetText(infoText)
 	vm.inputBar.SetPlaceholder("Press enter to close the dialog")
-	vm.stopWaiting <- struct{}{}
-	vm.done = true
+	vm.markDone()
 	vm.parent.parent.Render()
 	if vm.parent.config.SendToVerifiedOnly {
 		// Hacky way to make new group sessions after verified
-		vm.parent.matrix.Crypto().(*crypto.OlmMachine).OnDevicesChanged(vm.device.UserID)
+		mach.OnDevicesChanged(vm.device.UserID)
 	}
 }
 
@@ -214,7 +428,7 @@ func (vm *VerificationModal) OnKeyEvent(event mauview.KeyEvent) bool {
 		Ch:  event.Rune(),
 		Mod: event.Modifiers(),
 	}
-	if vm.done {
+	if vm.isDone() {
 		if vm.parent.config.Keybindings.Modal[kb] == "cancel" || vm.parent.config.Keybindings.Modal[kb] == "confirm" {
 			vm.parent.HideModal()
 			return true
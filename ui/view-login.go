@@ -46,8 +46,9 @@ type LoginView struct {
 	password   *mauview.InputField
 	error      *mauview.TextView
 
-	loginButton *mauview.Button
-	quitButton  *mauview.Button
+	loginButton    *mauview.Button
+	registerButton *mauview.Button
+	quitButton     *mauview.Button
 
 	loading bool
 
@@ -68,8 +69,9 @@ func (ui *GomuksUI) NewLoginView() mauview.Component {
 		password:   mauview.NewInputField(),
 		homeserver: mauview.NewInputField(),
 
-		loginButton: mauview.NewButton("Login"),
-		quitButton:  mauview.NewButton("Quit"),
+		loginButton:    mauview.NewButton("Login"),
+		registerButton: mauview.NewButton("Register"),
+		quitButton:     mauview.NewButton("Quit"),
 
 		matrix: ui.gmx.Matrix(),
 		config: ui.gmx.Config(),
@@ -83,16 +85,18 @@ func (ui *GomuksUI) NewLoginView() mauview.Component {
 
 	view.quitButton.SetOnClick(func() { ui.gmx.Stop(true) }).SetBackgroundColor(tcell.ColorDarkCyan)
 	view.loginButton.SetOnClick(view.Login).SetBackgroundColor(tcell.ColorDarkCyan)
+	view.registerButton.SetOnClick(view.Register).SetBackgroundColor(tcell.ColorDarkCyan)
 
 	view.
 		SetColumns([]int{1, 10, 1, 30, 1}).
-		SetRows([]int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1})
+		SetRows([]int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1})
 	view.
 		AddFormItem(view.username, 3, 1, 1, 1).
 		AddFormItem(view.password, 3, 3, 1, 1).
 		AddFormItem(view.homeserver, 3, 5, 1, 1).
 		AddFormItem(view.loginButton, 1, 7, 3, 1).
-		AddFormItem(view.quitButton, 1, 9, 3, 1).
+		AddFormItem(view.registerButton, 1, 9, 3, 1).
+		AddFormItem(view.quitButton, 1, 11, 3, 1).
 		AddComponent(view.usernameLabel, 1, 1, 1, 1).
 		AddComponent(view.passwordLabel, 1, 3, 1, 1).
 		AddComponent(view.homeserverLabel, 1, 5, 1, 1)
@@ -100,7 +104,7 @@ func (ui *GomuksUI) NewLoginView() mauview.Component {
 	view.FocusNextItem()
 	ui.loginView = view
 
-	view.container = mauview.Center(mauview.NewBox(view).SetTitle("Log in to Matrix"), 45, 13)
+	view.container = mauview.Center(mauview.NewBox(view).SetTitle("Log in to Matrix"), 45, 15)
 	view.container.SetAlwaysFocusChild(true)
 	return view.container
 }
@@ -131,19 +135,19 @@ func (view *LoginView) Error(err string) {
 	if len(err) == 0 && view.error != nil {
 		debug.Print("Hiding error")
 		view.RemoveComponent(view.error)
-		view.container.SetHeight(13)
-		view.SetRows([]int{1, 1, 1, 1, 1, 1, 1, 1, 1})
+		view.container.SetHeight(15)
+		view.SetRows([]int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1})
 		view.error = nil
 	} else if len(err) > 0 {
 		debug.Print("Showing error", err)
 		if view.error == nil {
 			view.error = mauview.NewTextView().SetTextColor(tcell.ColorRed)
-			view.AddComponent(view.error, 1, 11, 3, 1)
+			view.AddComponent(view.error, 1, 13, 3, 1)
 		}
 		view.error.SetText(err)
 		errorHeight := int(math.Ceil(float64(runewidth.StringWidth(err)) / 45))
-		view.container.SetHeight(14 + errorHeight)
-		view.SetRow(11, errorHeight)
+		view.container.SetHeight(16 + errorHeight)
+		view.SetRow(13, errorHeight)
 	}
 
 	view.parent.Render()
@@ -157,21 +161,26 @@ func (view *LoginView) actuallyLogin(hs, mxid, password string) {
 		debug.Print("Init error:", err)
 		view.Error(err.Error())
 	} else if err = view.matrix.Login(mxid, password); err != nil {
-		if httpErr, ok := err.(mautrix.HTTPError); ok {
-			if httpErr.RespError != nil {
-				view.Error(httpErr.RespError.Err)
-			} else {
-				view.Error(httpErr.Message)
-			}
-		} else {
-			view.Error(err.Error())
-		}
+		view.showHTTPError(err)
 		debug.Print("Login error:", err)
 	}
 	view.loading = false
 	view.loginButton.SetText("Login")
 }
 
+// showHTTPError shows the error message of a failed request.
+func (view *LoginView) showHTTPError(err error) {
+	if httpErr, ok := err.(mautrix.HTTPError); ok {
+		if httpErr.RespError != nil {
+			view.Error(httpErr.RespError.Err)
+		} else {
+			view.Error(httpErr.Message)
+		}
+	} else {
+		view.Error(err.Error())
+	}
+}
+
 func (view *LoginView) Login() {
 	if view.loading {
 		return
@@ -181,6 +190,66 @@ func (view *LoginView) Login() {
 	password := view.password.GetText()
 
 	view.loading = true
-	view.loginButton.SetText("Logging in...")
+	if len(password) == 0 {
+		// An empty password means single sign-on, which is completed in the browser
+		view.loginButton.SetText("Waiting for browser login...")
+	} else {
+		view.loginButton.SetText("Logging in...")
+	}
 	go view.actuallyLogin(hs, mxid, password)
 }
+
+// ShowModal shows a modal in place of the login form.
+func (view *LoginView) ShowModal(modal mauview.Component) {
+	view.parent.app.SetRoot(modal)
+}
+
+// HideModal brings back the login form after a modal.
+func (view *LoginView) HideModal() {
+	view.parent.SetView(ViewLogin)
+}
+
+// askRegistrationToken asks for the registration token required by the homeserver.
+func (view *LoginView) askRegistrationToken() (string, bool) {
+	pwm := NewPasswordModal(view, "Registration token", "", "", false)
+	view.ShowModal(pwm)
+	view.parent.Render()
+	return pwm.Wait()
+}
+
+func (view *LoginView) actuallyRegister(hs, username, password string) {
+	debug.Printf("Registering %s on %s...", username, hs)
+	view.config.HS = hs
+
+	if err := view.matrix.InitClient(); err != nil {
+		debug.Print("Init error:", err)
+		view.Error(err.Error())
+	} else if err = view.matrix.Register(username, password, view.askRegistrationToken); err != nil {
+		view.showHTTPError(err)
+		debug.Print("Registration error:", err)
+	}
+	view.loading = false
+	view.registerButton.SetText("Register")
+}
+
+// Register creates a new account with the username and password in the form. Registration steps like captchas and
+// terms of service are completed in the browser.
+func (view *LoginView) Register() {
+	if view.loading {
+		return
+	}
+	hs := view.homeserver.GetText()
+	username := view.username.GetText()
+	password := view.password.GetText()
+	if localpart, _, err := id.UserID(username).Parse(); err == nil {
+		username = localpart
+	}
+	if len(username) == 0 || len(password) == 0 || len(hs) == 0 {
+		view.Error("Enter a username, password and homeserver to register")
+		return
+	}
+
+	view.loading = true
+	view.registerButton.SetText("Registering...")
+	go view.actuallyRegister(hs, username, password)
+}
@@ -18,6 +18,7 @@ package ui
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
 	"sync/atomic"
@@ -28,6 +29,7 @@ import (
 	"go.mau.fi/mauview"
 	"go.mau.fi/tcell"
 
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/pushrules"
 
@@ -53,6 +55,8 @@ type MainView struct {
 
 	modal mauview.Component
 
+	graphics graphicsLayer
+
 	lastFocusTime time.Time
 
 	matrix ifc.MatrixContainer
@@ -112,6 +116,7 @@ func (view *MainView) Draw(screen mauview.Screen) {
 	if view.modal != nil {
 		view.modal.Draw(screen)
 	}
+	view.graphics.flush(screen, view.modal != nil)
 }
 
 func (view *MainView) BumpFocus(roomView *RoomView) {
@@ -158,7 +163,12 @@ func (view *MainView) ShowBare(roomView *RoomView) {
 }
 
 func (view *MainView) OpenSyncingModal() ifc.SyncingModal {
-	component, modal := NewSyncingModal(view)
+	return view.OpenProgressModal("Synchronizing")
+}
+
+// OpenProgressModal opens a progress modal with the given title.
+func (view *MainView) OpenProgressModal(title string) *SyncingModal {
+	component, modal := NewSyncingModal(view, title)
 	view.ShowModal(component)
 	return modal
 }
@@ -181,7 +191,7 @@ func (view *MainView) OnKeyEvent(event mauview.KeyEvent) bool {
 	case "prev_room":
 		view.SwitchRoom(view.roomList.Previous())
 	case "search_rooms":
-		view.ShowModal(NewFuzzySearchModal(view, 42, 12))
+		view.ShowModal(NewFuzzySearchModal(view, 60, 16))
 	case "scroll_up":
 		msgView := view.currentRoom.MessageView()
 		msgView.AddScrollOffset(msgView.TotalHeight())
@@ -194,6 +204,14 @@ func (view *MainView) OnKeyEvent(event mauview.KeyEvent) bool {
 		view.SwitchRoom(view.roomList.NextWithActivity())
 	case "show_bare":
 		view.ShowBare(view.currentRoom)
+	case "next_account":
+		if len(view.config.Accounts) > 0 {
+			view.SwitchAccount(view.config.Accounts[0].UserID)
+		}
+	case "show_verifications":
+		if view.currentRoom != nil {
+			go view.cmdProcessor.HandleCommand(view.cmdProcessor.ParseCommand(view.currentRoom, "/crypto pending-verifications"))
+		}
 	default:
 		goto defaultHandler
 	}
@@ -238,6 +256,21 @@ func (view *MainView) Blur() {
 	}
 }
 
+// SwitchAccount stops syncing the active account and switches to the given saved account in the background. If the
+// new account can't be started, the login view is shown.
+func (view *MainView) SwitchAccount(userID id.UserID) {
+	go func() {
+		defer debug.Recover()
+		err := view.matrix.SwitchAccount(userID)
+		if err != nil {
+			debug.Printf("Failed to switch to %s: %v", userID, err)
+			view.parent.OnLogout()
+			view.parent.loginView.Error(fmt.Sprintf("Failed to switch to %s: %v", userID, err))
+		}
+		view.parent.Render()
+	}()
+}
+
 func (view *MainView) SwitchRoom(tag string, room *rooms.Room) {
 	view.switchRoom(tag, room, true)
 }
@@ -333,6 +366,35 @@ func (view *MainView) RemoveRoom(room *rooms.Room) {
 	view.parent.Render()
 }
 
+// FollowRoomUpgrade joins the room that replaced the given upgraded room if necessary, switches to it and removes
+// the old room from the room list.
+func (view *MainView) FollowRoomUpgrade(oldRoom *rooms.Room) error {
+	if !oldRoom.IsReplaced() || len(oldRoom.ReplacedBy()) == 0 {
+		return errors.New("this room hasn't been upgraded")
+	}
+	var server string
+	if tombstone := oldRoom.GetStateEvent(event.StateTombstone, ""); tombstone != nil {
+		_, server, _ = tombstone.Sender.Parse()
+	}
+	return view.switchToUpgradedRoom(oldRoom, oldRoom.ReplacedBy(), server)
+}
+
+func (view *MainView) switchToUpgradedRoom(oldRoom *rooms.Room, newRoomID id.RoomID, server string) error {
+	newRoom := view.matrix.GetRoom(newRoomID)
+	if newRoom == nil || newRoom.HasLeft || newRoom.SessionMember == nil || newRoom.SessionMember.Membership != event.MembershipJoin {
+		var err error
+		newRoom, err = view.matrix.JoinRoom(newRoomID, server)
+		if err != nil {
+			return fmt.Errorf("failed to join the new room: %w", err)
+		}
+	}
+	view.AddRoom(newRoom)
+	view.SwitchRoom("", newRoom)
+	view.roomList.Remove(oldRoom)
+	view.parent.Render()
+	return nil
+}
+
 func (view *MainView) addRoom(room *rooms.Room) *RoomView {
 	if view.roomList.Contains(room.ID) {
 		debug.Print("Add aborted (room exists)", room.ID, room.GetTitle())
@@ -379,6 +441,17 @@ func (view *MainView) UpdateTags(room *rooms.Room) {
 	view.parent.Render()
 }
 
+// UpdateIgnoredUsers rebuilds the timelines of all rooms after the ignore list has changed, so that messages from
+// newly ignored users are hidden and messages from unignored users are shown again.
+func (view *MainView) UpdateIgnoredUsers() {
+	view.roomsLock.RLock()
+	for _, roomView := range view.rooms {
+		roomView.content.invalidateBuffer()
+	}
+	view.roomsLock.RUnlock()
+	view.parent.Render()
+}
+
 func (view *MainView) SetTyping(roomID id.RoomID, users []id.UserID) {
 	roomView, ok := view.getRoomView(roomID, true)
 	if ok {
@@ -464,3 +537,59 @@ func (view *MainView) LoadHistory(roomID id.RoomID) {
 	}
 	view.parent.Render()
 }
+
+// maxJumpHistoryPages is the maximum number of history pages that are loaded when jumping to a message that isn't
+// loaded yet.
+const maxJumpHistoryPages = 20
+
+// JumpToEvent switches to the given room and scrolls to the given message, loading more history until the message
+// is found. The message is highlighted like a search match for the given query.
+func (view *MainView) JumpToEvent(roomID id.RoomID, eventID id.EventID, query string) error {
+	roomView, ok := view.getRoomView(roomID, true)
+	if !ok {
+		return fmt.Errorf("room %s is not joined", roomID)
+	}
+	tag := ""
+	if tags := roomView.Room.Tags(); len(tags) > 0 {
+		tag = tags[0].Tag
+	}
+	view.SwitchRoom(tag, roomView.Room)
+	msgView := roomView.MessageView()
+	err := view.loadHistoryUntil(roomView, func() bool {
+		return msgView.getMessageByID(eventID) != nil
+	})
+	if err != nil {
+		return fmt.Errorf("message %w", err)
+	}
+	msgView.recalculateBuffers()
+	roomView.ShowSearchResult(query, msgView.getMessageByID(eventID))
+	view.parent.Render()
+	return nil
+}
+
+// loadHistoryUntil loads more history into the given room until found returns true. An error is returned if the
+// start of the room or the maxJumpHistoryPages limit is reached first.
+func (view *MainView) loadHistoryUntil(roomView *RoomView, found func() bool) error {
+	msgView := roomView.MessageView()
+	for page := 0; ; page++ {
+		if found() {
+			return nil
+		} else if page >= maxJumpHistoryPages {
+			return fmt.Errorf("not found in the last %d pages of history", maxJumpHistoryPages)
+		}
+		// Wait for the initial history load started by switching rooms
+		for atomic.LoadInt32(&msgView.loadingMessages) != 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		msgView.messagesLock.RLock()
+		prevCount := len(msgView.messages)
+		msgView.messagesLock.RUnlock()
+		view.LoadHistory(roomView.Room.ID)
+		msgView.messagesLock.RLock()
+		newCount := len(msgView.messages)
+		msgView.messagesLock.RUnlock()
+		if newCount == prevCount && !found() {
+			return fmt.Errorf("not found in room history")
+		}
+	}
+}